@@ -0,0 +1,189 @@
+package photon
+
+import (
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Photon/channel"
+	"github.com/SmartMeshFoundation/Photon/channel/channeltype"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/notify"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//autoSettleRetries settle的tx失败以后最多重试的次数
+const autoSettleRetries = 3
+
+//autoSettleState 自动结算过程中通道的进度,只保存在内存中,重启以后从头再来也没有问题
+type autoSettleState struct {
+	unlocked  bool               //所有知道密码并且在链上注册了的锁都已经unlock了
+	unlocking *utils.AsyncResult //正在进行的unlock
+	gaveUp    bool               //settle失败次数太多,需要人工处理
+}
+
+/*
+autoSettle 每个新块检查关闭了的通道:
+1. unlock的最后期限之前RevealTimeout块,链上unlock所有知道密码还没有unlock的锁,之后合约不再允许unlock,
+2. settle的时间到了以后,等unlock的tx都打包了,提交settle,
+3. settle的tx失败以后重试,最多autoSettleRetries次.
+全局或者这个通道关闭了自动结算时什么都不做,需要用户调用settle接口.
+*/
+func (rs *Service) autoSettle(blockNumber int64) {
+	if rs.Config.DisableAutoSettle {
+		return
+	}
+	closed := make(map[common.Hash]bool)
+	for _, g := range rs.Token2ChannelGraph {
+		for id, c := range g.ChannelIdentifier2Channel {
+			if c.State != channeltype.StateClosed && c.State != channeltype.StateSettling {
+				continue
+			}
+			closed[id] = true
+			if rs.ChannelFlags.Get(id).NoAutoSettle {
+				continue
+			}
+			rs.autoSettleChannel(c, blockNumber)
+		}
+	}
+	for id := range rs.AutoSettleStates {
+		if !closed[id] {
+			delete(rs.AutoSettleStates, id)
+		}
+	}
+}
+
+func (rs *Service) autoSettleChannel(c *channel.Channel, blockNumber int64) {
+	id := c.ChannelIdentifier.ChannelIdentifier
+	closedBlock := c.ExternState.ClosedBlock
+	if closedBlock == 0 {
+		return
+	}
+	state := rs.AutoSettleStates[id]
+	if state == nil {
+		state = new(autoSettleState)
+		rs.AutoSettleStates[id] = state
+	}
+	unlockDeadline := closedBlock + int64(c.SettleTimeout)
+	if blockNumber <= unlockDeadline {
+		if blockNumber >= unlockDeadline-int64(c.RevealTimeout) && !state.unlocked {
+			rs.autoUnlockChannel(c, state)
+		}
+		return
+	}
+	if blockNumber < c.ExternState.SettledBlock || state.gaveUp {
+		return
+	}
+	txs, err := rs.dao.GetTXInfoList(id, 0, utils.EmptyAddress, "", "")
+	if err != nil {
+		log.Error(fmt.Sprintf("auto settle channel %s get tx err %s", utils.HPex(id), err))
+		return
+	}
+	wait, failed := settleTXState(txs, closedBlock)
+	if wait {
+		return
+	}
+	if failed >= autoSettleRetries {
+		state.gaveUp = true
+		info := fmt.Sprintf("settle channel %s failed %d times,please settle it manually", utils.HPex(id), failed)
+		log.Error(info)
+		rs.NotifyHandler.NotifyString(notify.LevelError, info)
+		return
+	}
+	//上次的settle失败了
+	c.State = channeltype.StateClosed
+	err = c.Settle(blockNumber)
+	if err != nil {
+		log.Error(fmt.Sprintf("auto settle channel %s err %s", utils.HPex(id), err))
+		return
+	}
+	log.Info(fmt.Sprintf("auto settle channel %s,failed %d times before", utils.HPex(id), failed))
+	err = rs.UpdateChannelState(channel.NewChannelSerialization(c))
+	if err != nil {
+		log.Error(fmt.Sprintf("auto settle channel %s update state err %s", utils.HPex(id), err))
+	}
+}
+
+/*
+autoUnlockChannel 等上次的unlock结束以后,还有没unlock的锁就再unlock一次,失败了下一个块重试,
+所有的锁都unlock了才算完成.
+*/
+func (rs *Service) autoUnlockChannel(c *channel.Channel, state *autoSettleState) {
+	id := c.ChannelIdentifier.ChannelIdentifier
+	if state.unlocking != nil {
+		select {
+		case err := <-state.unlocking.Result:
+			state.unlocking = nil
+			if err != nil {
+				log.Error(fmt.Sprintf("unlock channel %s before settle err %s", utils.HPex(id), err))
+			}
+		default:
+			return
+		}
+	}
+	if rs.locksToUnlock(c) == 0 {
+		state.unlocked = true
+		return
+	}
+	state.unlocking = c.UnlockOnChain()
+	if state.unlocking != nil {
+		log.Info(fmt.Sprintf("unlock locks of channel %s before settle", utils.HPex(id)))
+	}
+}
+
+//locksToUnlock 对方的锁中知道密码并且在链上注册了,但是还没有unlock也没有放弃的锁的个数
+func (rs *Service) locksToUnlock(c *channel.Channel) (n int) {
+	id := c.ChannelIdentifier.ChannelIdentifier
+	for _, p := range c.PartnerState.Lock2UnclaimedLocks {
+		if !p.IsRegisteredOnChain {
+			continue
+		}
+		if rs.dao.IsThisLockHasUnlocked(id, p.Lock.LockSecretHash) || rs.dao.IsLockSecretHashChannelIdentifierDisposed(p.Lock.LockSecretHash, id) {
+			continue
+		}
+		n++
+	}
+	return
+}
+
+/*
+settleTXState 根据通道关闭以后的tx决定能不能提交settle,
+还有unlock或者settle的tx没有打包,或者settle已经成功时需要等待,failed是失败了的settle的次数
+*/
+func settleTXState(txs []*models.TXInfo, closedBlock int64) (wait bool, failed int) {
+	//通道id会重复使用,关闭之前打包的tx和在它们之前发起的tx都属于通道以前的生命周期,失败的tx没有块号,只能按时间比较
+	var lifecycleStart int64
+	for _, tx := range txs {
+		if tx.PackBlockNumber > 0 && tx.PackBlockNumber < closedBlock && tx.CallTime > lifecycleStart {
+			lifecycleStart = tx.CallTime
+		}
+	}
+	for _, tx := range txs {
+		if tx.Type != models.TXInfoTypeUnlock && tx.Type != models.TXInfoTypeSettle {
+			continue
+		}
+		switch {
+		case tx.Status == models.TXInfoStatusPending:
+			wait = true
+		case tx.Type == models.TXInfoTypeSettle && tx.Status == models.TXInfoStatusSuccess && tx.PackBlockNumber >= closedBlock:
+			wait = true
+		case tx.Type == models.TXInfoTypeSettle && tx.Status == models.TXInfoStatusFailed && tx.CallTime > lifecycleStart:
+			failed++
+		}
+	}
+	return
+}
+
+//SetAutoSettleOptOut stops or resumes settling the channel automatically
+func (rs *Service) SetAutoSettleOptOut(channelIdentifier common.Hash, optOut bool) error {
+	return rs.ChannelFlags.Update(channelIdentifier, func(f *models.ChannelFlags) {
+		f.NoAutoSettle = optOut
+	})
+}
+
+//GetAutoSettleOptOutChannels returns channels which are never settled automatically
+func (rs *Service) GetAutoSettleOptOutChannels() []common.Hash {
+	return rs.ChannelFlags.Channels(func(f *models.ChannelFlags) bool {
+		return f.NoAutoSettle
+	})
+}
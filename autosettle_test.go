@@ -0,0 +1,103 @@
+package photon
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon/channel/channeltype"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/transfer/mtree"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettleTXState(t *testing.T) {
+	closedBlock := int64(100)
+	deposit := &models.TXInfo{Type: models.TXInfoTypeDeposit, Status: models.TXInfoStatusSuccess, PackBlockNumber: 10, CallTime: 1000}
+	wait, failed := settleTXState([]*models.TXInfo{deposit}, closedBlock)
+	assert.False(t, wait)
+	assert.EqualValues(t, 0, failed)
+	//unlock not packed yet
+	unlock := &models.TXInfo{Type: models.TXInfoTypeUnlock, Status: models.TXInfoStatusPending, CallTime: 2000}
+	wait, _ = settleTXState([]*models.TXInfo{deposit, unlock}, closedBlock)
+	assert.True(t, wait)
+	unlock.Status = models.TXInfoStatusSuccess
+	unlock.PackBlockNumber = 110
+	//failed tx has no block number
+	failedSettle := &models.TXInfo{Type: models.TXInfoTypeSettle, Status: models.TXInfoStatusFailed, CallTime: 3000}
+	wait, failed = settleTXState([]*models.TXInfo{deposit, unlock, failedSettle}, closedBlock)
+	assert.False(t, wait)
+	assert.EqualValues(t, 1, failed)
+	//settle of the last lifecycle of the channel doesn't count
+	oldSettle := &models.TXInfo{Type: models.TXInfoTypeSettle, Status: models.TXInfoStatusFailed, CallTime: 500}
+	oldSuccess := &models.TXInfo{Type: models.TXInfoTypeSettle, Status: models.TXInfoStatusSuccess, PackBlockNumber: 5, CallTime: 600}
+	wait, failed = settleTXState([]*models.TXInfo{oldSettle, oldSuccess, deposit, unlock, failedSettle}, closedBlock)
+	assert.False(t, wait)
+	assert.EqualValues(t, 1, failed)
+	settle := &models.TXInfo{Type: models.TXInfoTypeSettle, Status: models.TXInfoStatusSuccess, PackBlockNumber: 400, CallTime: 4000}
+	wait, _ = settleTXState([]*models.TXInfo{deposit, unlock, failedSettle, settle}, closedBlock)
+	assert.True(t, wait)
+}
+
+func TestChannelFlagsCache(t *testing.T) {
+	store := &memoryChannelFlagsStore{flags: make(map[string]*models.ChannelFlags)}
+	c := NewChannelFlagsCache(store)
+	id := utils.NewRandomHash()
+	assert.False(t, c.Get(id).NoAutoSettle)
+	assert.NoError(t, c.Update(id, func(f *models.ChannelFlags) {
+		f.NoPfsSubmit = true
+	}))
+	assert.NoError(t, c.Update(id, func(f *models.ChannelFlags) {
+		f.NoAutoSettle = true
+	}))
+	//settings of others are kept
+	c = NewChannelFlagsCache(store)
+	f := c.Get(id)
+	assert.True(t, f.NoPfsSubmit)
+	assert.True(t, f.NoAutoSettle)
+	assert.EqualValues(t, 1, len(c.Channels(func(f *models.ChannelFlags) bool {
+		return f.NoAutoSettle
+	})))
+	//PfsSubmitter only changes NoPfsSubmit
+	s := NewPfsSubmitter(c.PfsSubmitterStore(), 0, 4, nil)
+	assert.True(t, s.IsOptedOut(id))
+	assert.NoError(t, s.SetOptOut(id, false))
+	f = NewChannelFlagsCache(store).Get(id)
+	assert.False(t, f.NoPfsSubmit)
+	assert.True(t, f.NoAutoSettle)
+}
+
+func TestAutoUnlockChannel(t *testing.T) {
+	rs, channels := newTestWorkerService(t, 1, 1)
+	c := channels[0]
+	id := c.ChannelIdentifier.ChannelIdentifier
+	//nothing to unlock
+	state := new(autoSettleState)
+	rs.autoUnlockChannel(c, state)
+	assert.True(t, state.unlocked)
+	lock := &mtree.Lock{Expiration: 90, Amount: big.NewInt(10), LockSecretHash: utils.NewRandomHash()}
+	c.PartnerState.Lock2UnclaimedLocks[lock.LockSecretHash] = channeltype.UnlockPartialProof{
+		Lock:     lock,
+		LockHash: lock.Hash(),
+	}
+	//secret not registered on chain, it can't be unlocked
+	assert.EqualValues(t, 0, rs.locksToUnlock(c))
+	c.PartnerState.Lock2UnclaimedLocks[lock.LockSecretHash] = channeltype.UnlockPartialProof{
+		Lock:                lock,
+		LockHash:            lock.Hash(),
+		IsRegisteredOnChain: true,
+	}
+	assert.EqualValues(t, 1, rs.locksToUnlock(c))
+	//wait for the last unlock
+	state = &autoSettleState{unlocking: utils.NewAsyncResult()}
+	rs.autoUnlockChannel(c, state)
+	assert.False(t, state.unlocked)
+	assert.NotNil(t, state.unlocking)
+	//the last unlock failed but the lock was unlocked by another tx
+	rs.dao.UnlockThisLock(id, lock.LockSecretHash)
+	state.unlocking.Result <- errors.New("unlock failed")
+	rs.autoUnlockChannel(c, state)
+	assert.Nil(t, state.unlocking)
+	assert.True(t, state.unlocked)
+}
@@ -10,6 +10,7 @@ import (
 	"math/big"
 
 	"strings"
+	"sync"
 
 	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/models"
@@ -20,6 +21,7 @@ import (
 	"github.com/SmartMeshFoundation/Photon/transfer"
 	"github.com/SmartMeshFoundation/Photon/transfer/mediatedtransfer"
 	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -76,6 +78,14 @@ type Events struct {
 	txDone              map[eventID]uint64         // 该map记录最近30块内处理的events流水,用于事件去重
 	firstStart          bool                       //保证ContractHistoryEventCompleteStateChange 只会发送一次
 	chainEventRecordDao models.ChainEventRecordDao // 事件处理记录保存
+	sub                 *chainSubscription         // 订阅新块和事件,nil表示轮询	// nil if polling
+	chunker             *historyChunker            // 长时间离线后分段查询历史事件
+	syncTarget          int64                      // 分段同步历史事件时,事件以目标块确认,否则为0	// events are confirmed against it while syncing history
+	queryLogs           logQuerier                 // 查询合约事件,测试时替换
+	syncLock            sync.RWMutex
+	syncProgress        *models.HistorySyncProgress
+	syncNotify          func(progress *models.HistorySyncProgress)
+	syncNotifyTime      time.Time
 }
 
 //NewBlockChainEvents create BlockChainEvents
@@ -87,7 +97,9 @@ func NewBlockChainEvents(client *helper.SafeEthClient, rpcModuleDependency RPCMo
 		txDone:              make(map[eventID]uint64),
 		firstStart:          true,
 		chainEventRecordDao: chainEventRecordDao,
+		chunker:             newHistoryChunker(),
 	}
+	be.queryLogs = be.queryLogsFromChain
 	return be
 }
 
@@ -145,6 +157,14 @@ func (be *Events) startAlarmTask() {
 	retryTime := 0
 	be.stopChan = make(chan int)
 	be.StateChangeChannel <- &transfer.BlockStateChange{BlockNumber: currentBlock}
+	var lastSubscribeTime time.Time
+	var pushedBlock int64 // 订阅推送的最新块	// the latest block pushed by subscription
+	defer func() {
+		if be.sub != nil {
+			be.sub.unsubscribe()
+			be.sub = nil
+		}
+	}()
 	/*
 		正常处理流程:
 		1. 抓取历史事件,排序,发送给photon
@@ -167,21 +187,38 @@ func (be *Events) startAlarmTask() {
 				be.pollPeriod = params.DefaultEthRPCPollPeriod
 			}
 		}
-		ctx, cancelFunc := context.WithTimeout(context.Background(), params.EthRPCTimeout)
-		h, err := be.client.HeaderByNumber(ctx, nil)
-		if err != nil {
-			//无论公链发生什么错误,都应该让photon启动起来,而不是卡主
-			be.notifyPhotonStartupCompleteIfNeeded(currentBlock)
-			log.Error(fmt.Sprintf("HeaderByNumber err=%s", err))
+		// websocket/ipc可以订阅新块和事件,订阅失败或者断开时使用轮询
+		if be.sub == nil && be.client.SupportSubscription() && time.Since(lastSubscribeTime) > subscribeRetryInterval {
+			lastSubscribeTime = time.Now()
+			sub, err := be.subscribe()
+			if err != nil {
+				log.Warn(fmt.Sprintf("subscribe chain events err=%s, use polling", err))
+			} else {
+				be.sub = sub
+			}
+		}
+		lastedBlock := pushedBlock
+		if lastedBlock <= currentBlock {
+			ctx, cancelFunc := context.WithTimeout(context.Background(), params.EthRPCTimeout)
+			h, err := be.client.HeaderByNumber(ctx, nil)
+			if err != nil {
+				//无论公链发生什么错误,都应该让photon启动起来,而不是卡主
+				be.notifyPhotonStartupCompleteIfNeeded(currentBlock)
+				log.Error(fmt.Sprintf("HeaderByNumber err=%s", err))
+				cancelFunc()
+				if be.stopChan != nil {
+					be.pollPeriod = 0
+					go be.client.RecoverDisconnect()
+				}
+				return
+			}
 			cancelFunc()
-			if be.stopChan != nil {
-				be.pollPeriod = 0
-				go be.client.RecoverDisconnect()
+			lastedBlock = h.Number.Int64()
+			if be.sub != nil && be.sub.from == 0 {
+				// 订阅以后出的块都会推送过来	// blocks after this are all pushed
+				be.sub.from = lastedBlock + 1
 			}
-			return
 		}
-		cancelFunc()
-		lastedBlock := h.Number.Int64()
 		// 这里如果出现切换公链导致获取到的新块比当前块更小的话,只需要等待即可
 		if currentBlock >= lastedBlock {
 			if startUpBlockNumber >= lastedBlock {
@@ -196,7 +233,13 @@ func (be *Events) startAlarmTask() {
 			//在启动的时候连接到了一条无效的公链(不出块)的情况下,photon也应该可以继续启动.
 			// 连接到另外一个节点,该节点落后很多,也应该让photon尽快启动
 			be.notifyPhotonStartupCompleteIfNeeded(currentBlock)
-			time.Sleep(be.pollPeriod / 2)
+			var stopped bool
+			pushedBlock, stopped = be.waitNextBlock(be.pollPeriod / 2)
+			if stopped {
+				be.stopChan = nil
+				log.Info(fmt.Sprintf("AlarmTask quit complete"))
+				return
+			}
 			retryTime++
 			if retryTime > 10 {
 				log.Warn(fmt.Sprintf("get same block number %d from chain %d times,maybe something wrong with smc ...", lastedBlock, retryTime))
@@ -216,7 +259,23 @@ func (be *Events) startAlarmTask() {
 			fromBlockNumber = 0
 		}
 		// get all state change between currentBlock and lastedBlock
-		stateChanges, err := be.queryAllStateChange(fromBlockNumber, lastedBlock)
+		var stateChanges []mediatedtransfer.ContractStateChange
+		var err error
+		if lastedBlock-fromBlockNumber > historySyncThreshold {
+			// 离线太久,分段同步,已经处理的部分不需要重新查询	// chunks already delivered needn't be queried again
+			var synced int64
+			stateChanges, synced, err = be.syncHistory(fromBlockNumber, lastedBlock)
+			if err != nil && synced > currentBlock {
+				currentBlock = synced
+			}
+		} else {
+			stateChanges, err = be.queryAllStateChange(fromBlockNumber, lastedBlock)
+		}
+		if err == errEventsStopped {
+			be.stopChan = nil
+			log.Info(fmt.Sprintf("AlarmTask quit complete"))
+			return
+		}
 		if err != nil {
 			log.Error(fmt.Sprintf("queryAllStateChange err=%s", err))
 			//无论公链发生什么错误,都应该让photon启动起来,而不是卡主
@@ -232,7 +291,6 @@ func (be *Events) startAlarmTask() {
 		// refresh block number and notify PhotonService
 		currentBlock = lastedBlock
 		be.lastBlockNumber = currentBlock
-		var lastSendBlockNumber int64
 		// notify Photon service
 		//我们需要photon service在处理相关事件的时候知道了对应的块已经发生了,否则可能因为错误的当前块数而出现逻辑错误.
 		//同时也需要以下问题得到有效解决
@@ -240,13 +298,7 @@ func (be *Events) startAlarmTask() {
 		//如果直接告诉Photon最新块数,那么photon将直接判断该锁过期而发送RemoveExpiredHashLock
 		//但是很有可能B已经在链上注册了密码,这个时候A如果发送RemoveExpiredHashLock,将会导致该通道无法使用.
 		//因为B会拒绝RemoveExpiredHashLock.为了避免这种情况,一定要在处理最新块之前,处理SerecretRevealOnChain
-		for _, sc := range stateChanges {
-			if sc.GetBlockNumber() != lastSendBlockNumber {
-				be.StateChangeChannel <- &transfer.BlockStateChange{BlockNumber: sc.GetBlockNumber()}
-				lastSendBlockNumber = sc.GetBlockNumber()
-			}
-			be.StateChangeChannel <- sc
-		}
+		lastSendBlockNumber := be.sendStateChanges(stateChanges)
 		//正常启动流程是,所有历史事件处理完毕,然后再通知photon继续启动
 		be.notifyPhotonStartupCompleteIfNeeded(currentBlock)
 		if lastSendBlockNumber != currentBlock {
@@ -264,9 +316,9 @@ func (be *Events) startAlarmTask() {
 		}
 		// wait to next time
 		//time.Sleep(be.pollPeriod)
-		select {
-		case <-time.After(be.pollPeriod):
-		case <-be.stopChan:
+		var stopped bool
+		pushedBlock, stopped = be.waitNextBlock(be.pollPeriod)
+		if stopped {
 			be.stopChan = nil
 			log.Info(fmt.Sprintf("AlarmTask quit complete"))
 			return
@@ -274,6 +326,18 @@ func (be *Events) startAlarmTask() {
 	}
 }
 
+//sendStateChanges sends sorted state changes to photon, each preceded by its block, returns the last block sent
+func (be *Events) sendStateChanges(stateChanges []mediatedtransfer.ContractStateChange) (lastSendBlockNumber int64) {
+	for _, sc := range stateChanges {
+		if sc.GetBlockNumber() != lastSendBlockNumber {
+			be.StateChangeChannel <- &transfer.BlockStateChange{BlockNumber: sc.GetBlockNumber()}
+			lastSendBlockNumber = sc.GetBlockNumber()
+		}
+		be.StateChangeChannel <- sc
+	}
+	return
+}
+
 func (be *Events) queryAllStateChange(fromBlock int64, toBlock int64) (stateChanges []mediatedtransfer.ContractStateChange, err error) {
 	/*
 		get all event of contract TokenNetworkRegistry, SecretRegistry , TokenNetwork
@@ -291,23 +355,51 @@ func (be *Events) queryAllStateChange(fromBlock int64, toBlock int64) (stateChan
 	return
 }
 
-func (be *Events) getLogsFromChain(fromBlock int64, toBlock int64) (logs []types.Log, err error) {
+//logQuerier returns logs of photon contracts of blocks from `fromBlock` to `toBlock`, only logs of `topics` if not empty
+type logQuerier func(fromBlock, toBlock int64, topics []common.Hash) ([]types.Log, error)
+
+func (be *Events) queryLogsFromChain(fromBlock, toBlock int64, topics []common.Hash) ([]types.Log, error) {
 	/*
 		get all event of contract TokenNetworkRegistry, SecretRegistry , TokenNetwork
 	*/
-	contractAddresses := []common.Address{
-		be.rpcModuleDependency.GetRegistryAddress(),
-		be.rpcModuleDependency.GetSecretRegistryAddress(),
+	q := ethereum.FilterQuery{
+		FromBlock: big.NewInt(fromBlock),
+		ToBlock:   big.NewInt(toBlock),
+		Addresses: []common.Address{
+			be.rpcModuleDependency.GetRegistryAddress(),
+			be.rpcModuleDependency.GetSecretRegistryAddress(),
+		},
 	}
-	logs, err = rpc.EventsGetInternal(
-		rpc.GetQueryConext(), contractAddresses, fromBlock, toBlock, be.client)
-	if err != nil {
-		return
+	if len(topics) > 0 {
+		q.Topics = [][]common.Hash{topics}
+	}
+	return be.client.FilterLogs(rpc.GetQueryConext(), q)
+}
+
+func (be *Events) getLogsFromChain(fromBlock int64, toBlock int64) (logs []types.Log, err error) {
+	/*
+		订阅期间的事件已经推送过来了,只需要查询订阅之前的部分
+		logs pushed since subscription, only query blocks before it
+	*/
+	sub := be.sub
+	queryTo, pushedFrom := sub.splitRange(fromBlock, toBlock)
+	if fromBlock <= queryTo {
+		logs, err = be.queryLogs(fromBlock, queryTo, nil)
+		if err != nil {
+			return
+		}
+	}
+	if pushedFrom <= toBlock {
+		logs = append(logs, sub.logsBetween(pushedFrom, toBlock)...)
 	}
 	return
 }
 
 func (be *Events) parseLogsToEvents(logs []types.Log) (stateChanges []mediatedtransfer.ContractStateChange, err error) {
+	confirmBlockNumber := be.lastBlockNumber
+	if be.syncTarget > confirmBlockNumber {
+		confirmBlockNumber = be.syncTarget
+	}
 	for _, l := range logs {
 		eventName := topicToEventName[l.Topics[0]]
 		// 根据已处理流水去重
@@ -330,17 +422,17 @@ func (be *Events) parseLogsToEvents(logs []types.Log) (stateChanges []mediatedtr
 
 		// open,deposit,withdraw事件延迟确认,开关默认关闭,方便测试
 		if params.EnableForkConfirm && needConfirm(eventName) {
-			if be.lastBlockNumber-int64(l.BlockNumber) < params.ForkConfirmNumber {
+			if confirmBlockNumber-int64(l.BlockNumber) < params.ForkConfirmNumber {
 				continue
 			}
-			log.Info(fmt.Sprintf("event %s tx=%s happened at %d, confirmed at %d", eventName, l.TxHash.String(), l.BlockNumber, be.lastBlockNumber))
+			log.Info(fmt.Sprintf("event %s tx=%s happened at %d, confirmed at %d", eventName, l.TxHash.String(), l.BlockNumber, confirmBlockNumber))
 		}
 		// registry secret事件延迟确认,否则在出现恶意分叉的情况下,中间节点有损失资金的风险
 		if eventName == params.NameSecretRevealed && params.EnableForkConfirm {
-			if be.lastBlockNumber-int64(l.BlockNumber) < params.ForkConfirmNumber {
+			if confirmBlockNumber-int64(l.BlockNumber) < params.ForkConfirmNumber {
 				continue
 			}
-			log.Info(fmt.Sprintf("event %s tx=%s happened at %d, confirmed at %d", eventName, l.TxHash.String(), l.BlockNumber, be.lastBlockNumber))
+			log.Info(fmt.Sprintf("event %s tx=%s happened at %d, confirmed at %d", eventName, l.TxHash.String(), l.BlockNumber, confirmBlockNumber))
 		}
 
 		switch eventName {
@@ -0,0 +1,227 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/params"
+	"github.com/SmartMeshFoundation/Photon/transfer"
+	"github.com/SmartMeshFoundation/Photon/transfer/mediatedtransfer"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+/*
+After being offline for a long time, querying all logs since the last handled block at once
+is often rejected by the endpoint (too many results) or times out.
+So events are caught up chunk by chunk, the chunk is halved when a query fails because of its size
+and doubled after a success.
+Before that, ChannelClosed of the whole range is queried and delivered first,
+since the settle window of a channel closed while offline may be running out.
+They are delivered again in chain order later, photon ignores a duplicate close.
+Then each chunk is delivered to photon as soon as it's got, in chain order, followed by its last block,
+photon saves that block, so a restart resumes from there.
+*/
+const (
+	//historySyncThreshold catch up chunk by chunk if more blocks than this are behind
+	historySyncThreshold int64 = 1000
+	//historySyncInitialChunk blocks of the first query
+	historySyncInitialChunk int64 = 1000
+	historySyncMinChunk     int64 = 10
+	historySyncMaxChunk     int64 = 100000
+	//historySyncNotifyInterval don't notify progress too often
+	historySyncNotifyInterval = 5 * time.Second
+)
+
+var errEventsStopped = errors.New("events stopped")
+
+//historyChunker decides how many blocks to query each time
+type historyChunker struct {
+	size int64
+}
+
+func newHistoryChunker() *historyChunker {
+	return &historyChunker{size: historySyncInitialChunk}
+}
+
+//end returns the last block of the chunk starting at `from`, no more than `to`
+func (c *historyChunker) end(from, to int64) int64 {
+	end := from + c.size - 1
+	if end > to {
+		end = to
+	}
+	return end
+}
+
+func (c *historyChunker) grow() {
+	c.size *= 2
+	if c.size > historySyncMaxChunk {
+		c.size = historySyncMaxChunk
+	}
+}
+
+//shrink returns false if the chunk cannot be smaller
+func (c *historyChunker) shrink() bool {
+	if c.size <= historySyncMinChunk {
+		return false
+	}
+	c.size /= 2
+	if c.size < historySyncMinChunk {
+		c.size = historySyncMinChunk
+	}
+	return true
+}
+
+//isRangeTooLarge returns true if a log query fails because of too many results or a timeout
+func isRangeTooLarge(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"more than", "too many", "limit exceeded", "too large", "timeout", "timed out", "deadline exceeded"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+//SetHistorySyncNotifier `notify` is called when history sync starts, makes progress and completes
+func (be *Events) SetHistorySyncNotifier(notify func(progress *models.HistorySyncProgress)) {
+	be.syncLock.Lock()
+	be.syncNotify = notify
+	be.syncLock.Unlock()
+}
+
+//HistorySyncProgress returns progress of the latest history sync, nil if never needed
+func (be *Events) HistorySyncProgress() *models.HistorySyncProgress {
+	be.syncLock.RLock()
+	defer be.syncLock.RUnlock()
+	if be.syncProgress == nil {
+		return nil
+	}
+	p := *be.syncProgress
+	return &p
+}
+
+func (be *Events) updateHistorySyncProgress(from, synced, to int64, force bool) {
+	be.syncLock.Lock()
+	be.syncProgress = &models.HistorySyncProgress{
+		Syncing:     synced < to,
+		FromBlock:   from,
+		SyncedBlock: synced,
+		TargetBlock: to,
+		ChunkSize:   be.chunker.size,
+	}
+	p := *be.syncProgress
+	notify := be.syncNotify
+	if !force && time.Since(be.syncNotifyTime) < historySyncNotifyInterval {
+		notify = nil
+	}
+	if notify != nil {
+		be.syncNotifyTime = time.Now()
+	}
+	be.syncLock.Unlock()
+	if notify != nil {
+		notify(&p)
+	}
+}
+
+/*
+syncHistory delivers state changes of blocks from `from` to `to` chunk by chunk,
+except those of the last chunk, which are returned to be handled as a normal poll.
+synced is the last block delivered, it's from-1 if none.
+*/
+func (be *Events) syncHistory(from, to int64) (stateChanges []mediatedtransfer.ContractStateChange, synced int64, err error) {
+	log.Info(fmt.Sprintf("sync history events from %d to %d", from, to))
+	// 确认事件是否足够老要以最新块为准	// events are confirmed against the latest block
+	be.syncTarget = to
+	defer func() {
+		be.syncTarget = 0
+	}()
+	synced = from - 1
+	be.updateHistorySyncProgress(from, synced, to, true)
+	err = be.deliverClosedStateChanges(from, to)
+	if err != nil {
+		return
+	}
+	for {
+		select {
+		case <-be.stopChan:
+			err = errEventsStopped
+			return
+		default:
+		}
+		end := be.chunker.end(synced+1, to)
+		stateChanges, err = be.queryAllStateChange(synced+1, end)
+		if err != nil {
+			if isRangeTooLarge(err) && be.chunker.shrink() {
+				log.Info(fmt.Sprintf("query events %d-%d err=%s, query %d blocks at a time", synced+1, end, err, be.chunker.size))
+				continue
+			}
+			return
+		}
+		be.chunker.grow()
+		if end == to {
+			be.updateHistorySyncProgress(from, to, to, true)
+			log.Info(fmt.Sprintf("sync history events from %d to %d complete", from, to))
+			return
+		}
+		lastSendBlockNumber := be.sendStateChanges(stateChanges)
+		if lastSendBlockNumber != end {
+			be.StateChangeChannel <- &transfer.BlockStateChange{BlockNumber: end}
+		}
+		synced = end
+		be.lastBlockNumber = synced
+		be.updateHistorySyncProgress(from, synced, to, false)
+	}
+}
+
+/*
+deliverClosedStateChanges delivers ChannelClosed of blocks from `from` to `to` without their blocks,
+photon is still at an earlier block, so they are not marked as done and are delivered again in chain order.
+*/
+func (be *Events) deliverClosedStateChanges(from, to int64) error {
+	topic := tokenNetworkAbi.Events[params.NameChannelClosed].Id()
+	queryTo, pushedFrom := be.sub.splitRange(from, to)
+	//only a few logs match, the chunk size of the full query doesn't fit
+	chunker := &historyChunker{size: be.chunker.size}
+	var logs []types.Log
+	for start := from; start <= queryTo; {
+		select {
+		case <-be.stopChan:
+			return errEventsStopped
+		default:
+		}
+		end := chunker.end(start, queryTo)
+		l, err := be.queryLogs(start, end, []common.Hash{topic})
+		if err != nil {
+			if isRangeTooLarge(err) && chunker.shrink() {
+				continue
+			}
+			return err
+		}
+		chunker.grow()
+		logs = append(logs, l...)
+		start = end + 1
+	}
+	if pushedFrom <= to {
+		for _, l := range be.sub.logsBetween(pushedFrom, to) {
+			if len(l.Topics) > 0 && l.Topics[0] == topic {
+				logs = append(logs, l)
+			}
+		}
+	}
+	for i := range logs {
+		e, err := newEventChannelClosed(&logs[i])
+		if err != nil {
+			return err
+		}
+		be.StateChangeChannel <- eventChannelClosed2StateChange(e)
+	}
+	if len(logs) > 0 {
+		log.Info(fmt.Sprintf("%d channels closed between block %d and %d, handle them first", len(logs), from, to))
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon/params"
+	"github.com/SmartMeshFoundation/Photon/transfer"
+	"github.com/SmartMeshFoundation/Photon/transfer/mediatedtransfer"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryChunker(t *testing.T) {
+	c := newHistoryChunker()
+	assert.EqualValues(t, historySyncInitialChunk, c.size)
+	assert.EqualValues(t, 100+historySyncInitialChunk-1, c.end(100, 100000))
+	assert.EqualValues(t, 200, c.end(100, 200))
+	for c.shrink() {
+	}
+	assert.EqualValues(t, historySyncMinChunk, c.size)
+	assert.False(t, c.shrink())
+	for i := 0; i < 100; i++ {
+		c.grow()
+	}
+	assert.EqualValues(t, historySyncMaxChunk, c.size)
+}
+
+func TestIsRangeTooLarge(t *testing.T) {
+	assert.True(t, isRangeTooLarge(errors.New("query returned more than 10000 results")))
+	assert.True(t, isRangeTooLarge(context.DeadlineExceeded))
+	assert.True(t, isRangeTooLarge(errors.New("i/o timeout")))
+	assert.False(t, isRangeTooLarge(errors.New("connection refused")))
+}
+
+func makeTestLog(t *testing.T, eventName string, blockNumber uint64, channelIdentifier common.Hash, args ...interface{}) types.Log {
+	e := tokenNetworkAbi.Events[eventName]
+	data, err := e.Inputs.NonIndexed().Pack(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return types.Log{
+		Topics:      []common.Hash{e.Id(), channelIdentifier},
+		Data:        data,
+		BlockNumber: blockNumber,
+		TxHash:      utils.NewRandomHash(),
+	}
+}
+
+func TestSyncHistoryPriorityAndResume(t *testing.T) {
+	channelIdentifier := utils.NewRandomHash()
+	depositLog := makeTestLog(t, params.NameChannelNewDeposit, 150, channelIdentifier, utils.NewRandomAddress(), big.NewInt(10))
+	closedLog := makeTestLog(t, params.NameChannelClosed, 250, channelIdentifier, utils.NewRandomAddress(), utils.EmptyHash, big.NewInt(0))
+	fail := true
+	be := &Events{
+		StateChangeChannel:  make(chan transfer.StateChange, 100),
+		rpcModuleDependency: &fakeRPCModule{},
+		txDone:              make(map[eventID]uint64),
+		stopChan:            make(chan int),
+		chunker:             &historyChunker{size: 100},
+	}
+	be.queryLogs = func(fromBlock, toBlock int64, topics []common.Hash) (logs []types.Log, err error) {
+		if fail && len(topics) == 0 && fromBlock >= 200 {
+			return nil, errors.New("connection refused")
+		}
+		for _, l := range []types.Log{depositLog, closedLog} {
+			if int64(l.BlockNumber) < fromBlock || int64(l.BlockNumber) > toBlock {
+				continue
+			}
+			if len(topics) > 0 && topics[0] != l.Topics[0] {
+				continue
+			}
+			logs = append(logs, l)
+		}
+		return
+	}
+	receive := func() (scs []transfer.StateChange) {
+		for {
+			select {
+			case sc := <-be.StateChangeChannel:
+				scs = append(scs, sc)
+			default:
+				return
+			}
+		}
+	}
+	_, synced, err := be.syncHistory(100, 400)
+	assert.NotNil(t, err)
+	scs := receive()
+	//the close is handled before anything else
+	_, ok := scs[0].(*mediatedtransfer.ContractClosedStateChange)
+	assert.True(t, ok)
+	_, ok = scs[2].(*mediatedtransfer.ContractBalanceStateChange)
+	assert.True(t, ok)
+	//only the first chunk is done
+	assert.EqualValues(t, 199, synced)
+	assert.EqualValues(t, 199, be.lastBlockNumber)
+	assert.EqualValues(t, 199, scs[len(scs)-1].(*transfer.BlockStateChange).BlockNumber)
+
+	//resume from the next block
+	fail = false
+	stateChanges, synced, err := be.syncHistory(synced+1, 400)
+	assert.Nil(t, err)
+	//the last chunk is returned to be handled as a normal poll
+	assert.EqualValues(t, 399, synced)
+	scs = receive()
+	_, ok = scs[0].(*mediatedtransfer.ContractClosedStateChange)
+	assert.True(t, ok)
+	//the close is delivered again in chain order
+	var closed int
+	for _, sc := range stateChanges {
+		if _, ok = sc.(*mediatedtransfer.ContractClosedStateChange); ok {
+			closed++
+		}
+	}
+	for _, sc := range scs[1:] {
+		if _, ok = sc.(*mediatedtransfer.ContractClosedStateChange); ok {
+			closed++
+		}
+	}
+	assert.EqualValues(t, 1, closed)
+}
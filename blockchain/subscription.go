@@ -0,0 +1,190 @@
+package blockchain
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+/*
+With a websocket or ipc endpoint, new blocks and contract logs are pushed to photon,
+so it doesn't have to wait a poll period to react to a close or a secret reveal.
+If the subscription drops, events falls back to polling and subscribes again later,
+logs of blocks before the subscription starts are queried by block range.
+*/
+const (
+	//subscribeRetryInterval don't subscribe again too often after a failure
+	subscribeRetryInterval = 30 * time.Second
+	//subscriptionPollFactor while subscribed, still poll every such many poll periods in case a head is lost
+	subscriptionPollFactor = 5
+	//logSettleTime logs of a block may arrive a little later than its head
+	logSettleTime = 100 * time.Millisecond
+)
+
+//chainSubscription receives new heads and contract logs pushed by the endpoint
+type chainSubscription struct {
+	heads   chan *types.Header
+	logs    chan types.Log
+	headSub ethereum.Subscription
+	logSub  ethereum.Subscription
+	//logs of all blocks since `from` are pushed, 0 if unknown yet
+	from int64
+	//pushed logs by block number
+	pushedLogs map[uint64][]types.Log
+}
+
+func newChainSubscription() *chainSubscription {
+	return &chainSubscription{
+		heads:      make(chan *types.Header, 10),
+		logs:       make(chan types.Log, 100),
+		pushedLogs: make(map[uint64][]types.Log),
+	}
+}
+
+/*
+subscribe new heads and logs of photon contracts.
+`from` is set by the caller to the next block of the latest one after subscription,
+since a block mined before may be not pushed.
+*/
+func (be *Events) subscribe() (sub *chainSubscription, err error) {
+	sub = newChainSubscription()
+	ctx := context.Background()
+	sub.headSub, err = be.client.SubscribeNewHead(ctx, sub.heads)
+	if err != nil {
+		return nil, err
+	}
+	q := ethereum.FilterQuery{
+		Addresses: []common.Address{
+			be.rpcModuleDependency.GetRegistryAddress(),
+			be.rpcModuleDependency.GetSecretRegistryAddress(),
+		},
+	}
+	sub.logSub, err = be.client.SubscribeFilterLogs(ctx, q, sub.logs)
+	if err != nil {
+		sub.headSub.Unsubscribe()
+		return nil, err
+	}
+	log.Info("subscribe new heads and logs of contracts")
+	return sub, nil
+}
+
+func (s *chainSubscription) unsubscribe() {
+	s.headSub.Unsubscribe()
+	s.logSub.Unsubscribe()
+}
+
+//addLog saves a pushed log, or forgets it if it's removed because of a chain reorganisation
+func (s *chainSubscription) addLog(l types.Log) {
+	logs := s.pushedLogs[l.BlockNumber]
+	for i, l2 := range logs {
+		if l2.TxHash == l.TxHash && l2.Index == l.Index {
+			logs = append(logs[:i], logs[i+1:]...)
+			break
+		}
+	}
+	if !l.Removed {
+		logs = append(logs, l)
+	}
+	s.pushedLogs[l.BlockNumber] = logs
+}
+
+/*
+splitRange splits blocks from `fromBlock` to `toBlock`,
+logs of blocks from `fromBlock` to `queryTo` must be queried, logs of blocks from `pushedFrom` to `toBlock` are pushed.
+Without a subscription, all of them are queried.
+*/
+func (s *chainSubscription) splitRange(fromBlock, toBlock int64) (queryTo, pushedFrom int64) {
+	if s == nil || s.from <= 0 || toBlock < s.from {
+		return toBlock, toBlock + 1
+	}
+	queryTo = s.from - 1
+	pushedFrom = s.from
+	if fromBlock > pushedFrom {
+		pushedFrom = fromBlock
+	}
+	return
+}
+
+//logsBetween returns pushed logs of blocks from `from` to `to` in chain order, and forgets logs before `from`
+func (s *chainSubscription) logsBetween(from, to int64) (logs []types.Log) {
+	for blockNumber, l := range s.pushedLogs {
+		if int64(blockNumber) < from {
+			delete(s.pushedLogs, blockNumber)
+			continue
+		}
+		if int64(blockNumber) <= to {
+			logs = append(logs, l...)
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		if logs[i].BlockNumber != logs[j].BlockNumber {
+			return logs[i].BlockNumber < logs[j].BlockNumber
+		}
+		return logs[i].Index < logs[j].Index
+	})
+	return
+}
+
+/*
+waitNextBlock waits a new block until timeout, returns the pushed block number, 0 if polling is needed.
+stopped is true if events is stopped.
+*/
+func (be *Events) waitNextBlock(timeout time.Duration) (blockNumber int64, stopped bool) {
+	sub := be.sub
+	if sub == nil {
+		select {
+		case <-time.After(timeout):
+			return 0, false
+		case <-be.stopChan:
+			return 0, true
+		}
+	}
+	timeoutChan := time.After(timeout * subscriptionPollFactor)
+	for {
+		select {
+		case h := <-sub.heads:
+			if h.Number.Int64() <= be.lastBlockNumber {
+				continue
+			}
+			be.drainLogs(sub)
+			return h.Number.Int64(), false
+		case l := <-sub.logs:
+			sub.addLog(l)
+		case err := <-sub.headSub.Err():
+			be.dropSubscription(err)
+			return 0, false
+		case err := <-sub.logSub.Err():
+			be.dropSubscription(err)
+			return 0, false
+		case <-timeoutChan:
+			return 0, false
+		case <-be.stopChan:
+			return 0, true
+		}
+	}
+}
+
+//drainLogs receives logs which are pushed at about the same time as the head
+func (be *Events) drainLogs(sub *chainSubscription) {
+	for {
+		select {
+		case l := <-sub.logs:
+			sub.addLog(l)
+		case <-time.After(logSettleTime):
+			return
+		}
+	}
+}
+
+//dropSubscription falls back to polling
+func (be *Events) dropSubscription(err error) {
+	log.Warn(fmt.Sprintf("chain subscription dropped, fall back to polling, err=%v", err))
+	be.sub.unsubscribe()
+	be.sub = nil
+}
@@ -0,0 +1,75 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainSubscriptionLogs(t *testing.T) {
+	s := newChainSubscription()
+	l1 := types.Log{BlockNumber: 10, Index: 2, TxHash: utils.NewRandomHash()}
+	l2 := types.Log{BlockNumber: 10, Index: 1, TxHash: utils.NewRandomHash()}
+	l3 := types.Log{BlockNumber: 12, Index: 0, TxHash: utils.NewRandomHash()}
+	l4 := types.Log{BlockNumber: 8, Index: 0, TxHash: utils.NewRandomHash()}
+	s.addLog(l3)
+	s.addLog(l1)
+	s.addLog(l2)
+	s.addLog(l4)
+	//duplicate
+	s.addLog(l1)
+	logs := s.logsBetween(9, 12)
+	assert.EqualValues(t, []types.Log{l2, l1, l3}, logs)
+	//logs before 9 are forgotten
+	assert.EqualValues(t, 0, len(s.logsBetween(0, 8)))
+	//l1 is removed by a chain reorganisation
+	l1.Removed = true
+	s.addLog(l1)
+	assert.EqualValues(t, []types.Log{l2}, s.logsBetween(9, 11))
+}
+
+func TestChainSubscriptionSplitRange(t *testing.T) {
+	var s *chainSubscription
+	cases := []struct {
+		from       int64
+		fromBlock  int64
+		toBlock    int64
+		queryTo    int64
+		pushedFrom int64
+	}{
+		//not subscribed, query all
+		{0, 5, 20, 20, 21},
+		//subscribed after the range, query all
+		{30, 5, 20, 20, 21},
+		//backfill blocks before the subscription, the rest are pushed
+		{10, 5, 20, 9, 10},
+		//all pushed, logs pushed before `fromBlock` are delivered already
+		{10, 15, 20, 9, 15},
+	}
+	//fall back to polling
+	queryTo, pushedFrom := s.splitRange(5, 20)
+	assert.EqualValues(t, 20, queryTo)
+	assert.EqualValues(t, 21, pushedFrom)
+	for i, c := range cases {
+		s = newChainSubscription()
+		s.from = c.from
+		queryTo, pushedFrom = s.splitRange(c.fromBlock, c.toBlock)
+		assert.EqualValues(t, c.queryTo, queryTo, "case %d", i)
+		assert.EqualValues(t, c.pushedFrom, pushedFrom, "case %d", i)
+	}
+	//logs queried or delivered in the last round are not delivered again
+	s = newChainSubscription()
+	s.from = 10
+	l0 := types.Log{BlockNumber: 8, TxHash: utils.NewRandomHash()}
+	l1 := types.Log{BlockNumber: 12, TxHash: utils.NewRandomHash()}
+	l2 := types.Log{BlockNumber: 16, TxHash: utils.NewRandomHash()}
+	s.addLog(l0)
+	s.addLog(l1)
+	s.addLog(l2)
+	_, pushedFrom = s.splitRange(5, 14)
+	assert.EqualValues(t, []types.Log{l1}, s.logsBetween(pushedFrom, 14))
+	_, pushedFrom = s.splitRange(15, 20)
+	assert.EqualValues(t, []types.Log{l2}, s.logsBetween(pushedFrom, 20))
+}
@@ -261,9 +261,8 @@ func (c *Channel) HandleClosed(closingAddress common.Address, transferredAmount
 	}
 	//我是通道关闭方,需要进行相应的unlock,非通道关闭方,只能在updateBalanceProof以后进行unlock
 	if closingAddress == c.OurState.Address {
-		unlockProofs := c.PartnerState.GetCanUnlockOnChainLocks()
-		if len(unlockProofs) > 0 {
-			result := c.ExternState.Unlock(unlockProofs, c.PartnerState.contractTransferAmount())
+		result := c.UnlockOnChain()
+		if result != nil {
 			go func() {
 				err := <-result.Result
 				if err != nil {
@@ -275,6 +274,18 @@ func (c *Channel) HandleClosed(closingAddress common.Address, transferredAmount
 	}
 }
 
+/*
+UnlockOnChain unlocks locks partner sent me whose secret is registered on chain,
+locks already unlocked are skipped, returns nil if there is nothing to unlock.
+*/
+func (c *Channel) UnlockOnChain() *utils.AsyncResult {
+	unlockProofs := c.PartnerState.GetCanUnlockOnChainLocks()
+	if len(unlockProofs) == 0 {
+		return nil
+	}
+	return c.ExternState.Unlock(unlockProofs, c.PartnerState.contractTransferAmount())
+}
+
 /*
 HandleSettled handles this channel was settled on blockchain
 there is nothing tod rightnow
@@ -247,6 +247,9 @@ type ChannelDataDetail struct {
 	StateString         string   `json:"state_string"`
 	SettleTimeout       int      `json:"settle_timeout"`
 	RevealTimeout       int      `json:"reveal_timeout"`
+	NoOutboundMediation bool     `json:"no_outbound_mediation"` //操作员暂停了通过这个通道转发别人的交易
+	NoInboundMediation  bool     `json:"no_inbound_mediation"`  //操作员暂停了转发从这个通道收到的交易
+	NoReceive           bool     `json:"no_receive"`            //操作员暂停了从这个通道收款
 
 	/*
 		extended
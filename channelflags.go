@@ -0,0 +1,115 @@
+package photon
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+ChannelFlagsCache keeps settings of channels in memory, a change is saved to the store before it takes effect.
+All settings of a channel are in one record, so modules sharing the cache never overwrite each other's settings.
+*/
+type ChannelFlagsCache struct {
+	store ChannelFlagsStore
+	lock  sync.Mutex
+	flags map[common.Hash]*models.ChannelFlags
+}
+
+//NewChannelFlagsCache loads all settings from store, store can be nil for test
+func NewChannelFlagsCache(store ChannelFlagsStore) *ChannelFlagsCache {
+	c := &ChannelFlagsCache{
+		store: store,
+		flags: make(map[common.Hash]*models.ChannelFlags),
+	}
+	if store == nil {
+		return c
+	}
+	flags, err := store.GetAllChannelFlags()
+	if err != nil {
+		log.Error(fmt.Sprintf("load channel flags err %s", err))
+		return c
+	}
+	for _, f := range flags {
+		c.flags[f.ChannelIdentifier] = f
+	}
+	return c
+}
+
+//Get returns a copy of settings of the channel, all flags are off if it's never set
+func (c *ChannelFlagsCache) Get(channelIdentifier common.Hash) models.ChannelFlags {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if f, ok := c.flags[channelIdentifier]; ok {
+		return *f
+	}
+	return models.ChannelFlags{ChannelIdentifier: channelIdentifier}
+}
+
+//Update changes settings of the channel with fn and saves them
+func (c *ChannelFlagsCache) Update(channelIdentifier common.Hash, fn func(f *models.ChannelFlags)) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	f := &models.ChannelFlags{ChannelIdentifier: channelIdentifier}
+	if old, ok := c.flags[channelIdentifier]; ok {
+		cp := *old
+		f = &cp
+	}
+	fn(f)
+	if c.store != nil {
+		err := c.store.SaveChannelFlags(f)
+		if err != nil {
+			return err
+		}
+	}
+	c.flags[channelIdentifier] = f
+	return nil
+}
+
+//Channels returns channels whose settings match, sorted
+func (c *ChannelFlagsCache) Channels(match func(f *models.ChannelFlags) bool) (channels []common.Hash) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	channels = []common.Hash{}
+	for id, f := range c.flags {
+		if match(f) {
+			channels = append(channels, id)
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].String() < channels[j].String()
+	})
+	return
+}
+
+/*
+PfsSubmitterStore returns a ChannelFlagsStore for PfsSubmitter on top of the cache,
+only NoPfsSubmit of what PfsSubmitter saves is taken, so other settings of the channel are kept.
+*/
+func (c *ChannelFlagsCache) PfsSubmitterStore() ChannelFlagsStore {
+	return &pfsSubmitterStore{c}
+}
+
+type pfsSubmitterStore struct {
+	cache *ChannelFlagsCache
+}
+
+func (s *pfsSubmitterStore) SaveChannelFlags(f *models.ChannelFlags) error {
+	return s.cache.Update(f.ChannelIdentifier, func(cur *models.ChannelFlags) {
+		cur.NoPfsSubmit = f.NoPfsSubmit
+	})
+}
+
+func (s *pfsSubmitterStore) GetAllChannelFlags() (flags []*models.ChannelFlags, err error) {
+	s.cache.lock.Lock()
+	defer s.cache.lock.Unlock()
+	for _, f := range s.cache.flags {
+		cp := *f
+		flags = append(flags, &cp)
+	}
+	return
+}
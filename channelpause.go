@@ -0,0 +1,132 @@
+package photon
+
+import (
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Photon/channel"
+	"github.com/SmartMeshFoundation/Photon/channel/channeltype"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/rerr"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//directions of a channel the operator can pause
+const (
+	PauseOutboundMediation = "outbound" //不通过这个通道转发别人的交易
+	PauseInboundMediation  = "inbound"  //拒绝从这个通道收到的需要我转发的交易
+	PauseReceive           = "receive"  //拒绝从这个通道收到的给我的交易
+)
+
+//ChannelPause directions of a channel paused by the operator
+type ChannelPause struct {
+	ChannelIdentifier   common.Hash `json:"channel_identifier"`
+	NoOutboundMediation bool        `json:"no_outbound_mediation"`
+	NoInboundMediation  bool        `json:"no_inbound_mediation"`
+	NoReceive           bool        `json:"no_receive"`
+}
+
+/*
+pauseChannel 暂停或者恢复通道的一个方向,通道不关闭,正在进行的交易不受影响.
+pfs看到的容量和通知给app的通道信息马上更新.
+*/
+func (rs *Service) pauseChannel(r *pauseChannelReq) (result *utils.AsyncResult) {
+	result = utils.NewAsyncResult()
+	ch, err := rs.findChannelByIdentifier(r.ChannelIdentifier)
+	if err != nil {
+		result.Result <- rerr.ChannelNotFound(utils.HPex(r.ChannelIdentifier))
+		return
+	}
+	var set func(f *models.ChannelFlags)
+	switch r.Direction {
+	case PauseOutboundMediation:
+		set = func(f *models.ChannelFlags) { f.NoOutboundMediation = r.Pause }
+	case PauseInboundMediation:
+		set = func(f *models.ChannelFlags) { f.NoInboundMediation = r.Pause }
+	case PauseReceive:
+		set = func(f *models.ChannelFlags) { f.NoReceive = r.Pause }
+	default:
+		result.Result <- rerr.ErrArgumentError.Errorf("unknown direction %s", r.Direction)
+		return
+	}
+	err = rs.ChannelFlags.Update(r.ChannelIdentifier, set)
+	if err != nil {
+		result.Result <- err
+		return
+	}
+	log.Info(fmt.Sprintf("channel %s %s paused=%v", utils.HPex(r.ChannelIdentifier), r.Direction, r.Pause))
+	rs.PfsSubmitter.ForgetChannel(r.ChannelIdentifier)
+	rs.submitBalanceProofToPfs(ch)
+	rs.NotifyHandler.NotifyChannelStatus(rs.ChannelDataDetail(channel.NewChannelSerialization(ch)))
+	result.Result <- nil
+	return
+}
+
+//GetPausedChannels returns channels paused in any direction
+func (rs *Service) GetPausedChannels() (pauses []*ChannelPause) {
+	pauses = []*ChannelPause{}
+	ids := rs.ChannelFlags.Channels(func(f *models.ChannelFlags) bool {
+		return f.NoOutboundMediation || f.NoInboundMediation || f.NoReceive
+	})
+	for _, id := range ids {
+		f := rs.ChannelFlags.Get(id)
+		pauses = append(pauses, &ChannelPause{
+			ChannelIdentifier:   id,
+			NoOutboundMediation: f.NoOutboundMediation,
+			NoInboundMediation:  f.NoInboundMediation,
+			NoReceive:           f.NoReceive,
+		})
+	}
+	return
+}
+
+//IsOutboundMediationPaused implements graph.MediationPauser
+func (rs *Service) IsOutboundMediationPaused(channelIdentifier common.Hash) bool {
+	return rs.ChannelFlags.Get(channelIdentifier).NoOutboundMediation
+}
+
+//IsInboundPaused returns true if transfers from the partner through the channel are refused, to forward or to receive
+func (rs *Service) IsInboundPaused(channelIdentifier common.Hash) bool {
+	f := rs.ChannelFlags.Get(channelIdentifier)
+	return f.NoInboundMediation || f.NoReceive
+}
+
+//ChannelDataDetail channel detail for app, with directions paused by the operator
+func (rs *Service) ChannelDataDetail(c *channeltype.Serialization) *channeltype.ChannelDataDetail {
+	d := channeltype.ChannelSerialization2ChannelDataDetail(c)
+	f := rs.ChannelFlags.Get(c.ChannelIdentifier.ChannelIdentifier)
+	d.NoOutboundMediation = f.NoOutboundMediation
+	d.NoInboundMediation = f.NoInboundMediation
+	d.NoReceive = f.NoReceive
+	return d
+}
+
+/*
+mediationRejectReason 从from收到的交易需要转给next,任何一个通道暂停了转发时返回拒绝的原因,
+next为空表示下一跳还不确定,由路由算法跳过暂停的通道
+*/
+func (rs *Service) mediationRejectReason(tokenAddress, from, next common.Address) *rerr.StandardError {
+	var reason rerr.StandardError
+	if ch := rs.getChannel(tokenAddress, from); ch != nil && rs.ChannelFlags.Get(ch.ChannelIdentifier.ChannelIdentifier).NoInboundMediation {
+		reason = rerr.ErrInboundMediationPaused
+		return &reason
+	}
+	if next == utils.EmptyAddress {
+		return nil
+	}
+	if ch := rs.getChannel(tokenAddress, next); ch != nil && rs.IsOutboundMediationPaused(ch.ChannelIdentifier.ChannelIdentifier) {
+		reason = rerr.ErrOutboundMediationPaused
+		return &reason
+	}
+	return nil
+}
+
+//receiveRejectReason 从ch收到给我的交易,通道暂停了收款时返回拒绝的原因
+func (rs *Service) receiveRejectReason(ch *channel.Channel) *rerr.StandardError {
+	if !rs.ChannelFlags.Get(ch.ChannelIdentifier.ChannelIdentifier).NoReceive {
+		return nil
+	}
+	reason := rerr.ErrReceivePaused
+	return &reason
+}
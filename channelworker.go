@@ -0,0 +1,235 @@
+package photon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/SmartMeshFoundation/Photon/encoding"
+	"github.com/SmartMeshFoundation/Photon/internal/rpanic"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/network"
+	"github.com/SmartMeshFoundation/Photon/transfer"
+	"github.com/SmartMeshFoundation/Photon/transfer/mediatedtransfer"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+Service.loop receives all user requests, messages, contract events and blocks,
+but a slow dao write or contract call of one channel shouldn't stall all others.
+So work is routed by channelWorkers:
+
+1. Work which touches only one channel runs on the worker of that channel, workers run in parallel.
+While it runs, the worker owns the Channel, it can read but never change
+Token2ChannelGraph, Transfer2StateManager, Transfer2Result and Token2LockSecretHash2Channels.
+2. All other work, such as mediated transfers pairing two channels, blocks,
+channels opened, closed or settled, runs in Service.loop exclusively,
+that is after all workers are idle, so it owns all channels and maps above.
+3. Work of a channel is done in the order received, because a worker does its work one by one,
+and exclusive work waits for everything before it.
+*/
+
+//channelWorkQueueSize Service.loop blocks when a worker has so many works waiting
+const channelWorkQueueSize = 100
+
+type channelWorkers struct {
+	shards   []chan func()
+	pending  sync.WaitGroup
+	quitChan chan struct{}
+}
+
+//newChannelWorkers starts n workers, 0 means all work runs in Service.loop
+func newChannelWorkers(n int) *channelWorkers {
+	w := &channelWorkers{
+		quitChan: make(chan struct{}),
+	}
+	for i := 0; i < n; i++ {
+		shard := make(chan func(), channelWorkQueueSize)
+		w.shards = append(w.shards, shard)
+		go w.work(shard)
+	}
+	return w
+}
+
+func (w *channelWorkers) work(shard chan func()) {
+	defer rpanic.PanicRecover("channel worker")
+	for {
+		select {
+		case fn := <-shard:
+			fn()
+			w.pending.Done()
+		case <-w.quitChan:
+			return
+		}
+	}
+}
+
+//run runs `fn` on the worker of `channelIdentifier`, must be called by Service.loop
+func (w *channelWorkers) run(channelIdentifier common.Hash, fn func()) {
+	if len(w.shards) == 0 {
+		fn()
+		return
+	}
+	w.pending.Add(1)
+	w.shards[binary.BigEndian.Uint64(channelIdentifier[:8])%uint64(len(w.shards))] <- fn
+}
+
+//exclusive runs `fn` after all workers are idle, must be called by Service.loop
+func (w *channelWorkers) exclusive(fn func()) {
+	w.pending.Wait()
+	fn()
+}
+
+func (w *channelWorkers) stop() {
+	close(w.quitChan)
+}
+
+/*
+channelOfMessage returns the channel `msg` belongs to if handling it touches only this channel.
+The channel must be with the sender, otherwise the message is handled exclusively.
+*/
+func (rs *Service) channelOfMessage(msg encoding.SignedMessager) (channelIdentifier common.Hash, ok bool) {
+	switch m := msg.(type) {
+	case *encoding.DirectTransfer:
+		channelIdentifier = m.ChannelIdentifier
+	case *encoding.SettleRequest:
+		channelIdentifier = m.ChannelIdentifier
+	case *encoding.SettleResponse:
+		channelIdentifier = m.ChannelIdentifier
+	case *encoding.WithdrawRequest:
+		channelIdentifier = m.ChannelIdentifier
+	case *encoding.WithdrawResponse:
+		channelIdentifier = m.ChannelIdentifier
+	default:
+		return
+	}
+	ch, err := rs.findChannelByIdentifier(channelIdentifier)
+	if err != nil || ch.PartnerState.Address != msg.GetSender() {
+		return utils.EmptyHash, false
+	}
+	return channelIdentifier, true
+}
+
+/*
+channelOfStateChange returns the channel `st` belongs to if handling it touches only this channel.
+ContractBalanceProofUpdatedStateChange is dispatched to state managers, so it's not here.
+The channel must be mine, events of other channels change Token2ChannelGraph, so they are handled exclusively.
+*/
+func (rs *Service) channelOfStateChange(st transfer.StateChange) (channelIdentifier common.Hash, ok bool) {
+	switch st2 := st.(type) {
+	case *mediatedtransfer.ContractBalanceStateChange:
+		channelIdentifier = st2.ChannelIdentifier
+	case *mediatedtransfer.ContractPunishedStateChange:
+		channelIdentifier = st2.ChannelIdentifier
+	case *mediatedtransfer.ContractUnlockStateChange:
+		channelIdentifier = st2.ChannelIdentifier
+	default:
+		return
+	}
+	_, err := rs.findChannelByIdentifier(channelIdentifier)
+	if err != nil {
+		return utils.EmptyHash, false
+	}
+	return channelIdentifier, true
+}
+
+//channelOfReq returns the channel `req` operates on if it touches only this channel
+func channelOfReq(req *apiReq) (channelIdentifier common.Hash, ok bool) {
+	switch req.Name {
+	case closeChannelReqName, settleChannelReqName, cooperativeSettleChannelReqName,
+		prepareForCooperativeSettleReqName, cancelPrepareForCooperativeSettleReqName,
+		prepareWithdrawReqName, cancelPrepareWithdrawReqName:
+		return req.Req.(*closeSettleChannelReq).addr, true
+	case withdrawReqName:
+		return req.Req.(*withdrawReq).addr, true
+	}
+	return
+}
+
+//channelOfSentMessage returns the channel a sent balance proof message belongs to
+func channelOfSentMessage(msg encoding.Messager) (channelIdentifier common.Hash, ok bool) {
+	env, ok := msg.(encoding.EnvelopMessager)
+	if !ok {
+		return
+	}
+	return env.GetEnvelopMessage().ChannelIdentifier, true
+}
+
+//dispatchMessage handles a message from other nodes, and replies result to protocol
+func (rs *Service) dispatchMessage(m *network.MessageToPhoton) {
+	handle := func() {
+		err := rs.MessageHandler.onMessage(m.Msg, m.EchoHash)
+		if err != nil {
+			log.Error(fmt.Sprintf("MessageHandler.onMessage %v", err))
+		}
+		m.Result <- err
+	}
+	if channelIdentifier, ok := rs.channelOfMessage(m.Msg); ok {
+		rs.channelWorkers.run(channelIdentifier, handle)
+		return
+	}
+	rs.channelWorkers.exclusive(handle)
+}
+
+//dispatchStateChange handles a block or a contract event
+func (rs *Service) dispatchStateChange(st transfer.StateChange) {
+	if channelIdentifier, ok := rs.channelOfStateChange(st); ok {
+		rs.channelWorkers.run(channelIdentifier, func() {
+			rs.handleStateChange(st)
+		})
+		return
+	}
+	rs.channelWorkers.exclusive(func() {
+		rs.handleStateChange(st)
+	})
+}
+
+func (rs *Service) handleStateChange(st transfer.StateChange) {
+	blockStateChange, ok := st.(*transfer.BlockStateChange)
+	if ok {
+		rs.handleBlockNumber(blockStateChange)
+		return
+	}
+	log.Trace(fmt.Sprintf("statechange received :%s", utils.StringInterface(st, 2)))
+	_, isHistoryComplete := st.(*mediatedtransfer.ContractHistoryEventCompleteStateChange)
+	if isHistoryComplete {
+		if rs.ChanHistoryContractEventsDealComplete != nil {
+			close(rs.ChanHistoryContractEventsDealComplete)
+			rs.ChanHistoryContractEventsDealComplete = nil
+		} else {
+			panic("only can receive ContractHistoryEventCompleteStateChange once")
+		}
+		return
+	}
+	err := rs.StateMachineEventHandler.OnBlockchainStateChange(st)
+	if err != nil {
+		log.Error(fmt.Sprintf("stateMachineEventHandler.OnBlockchainStateChange %s", err))
+	}
+}
+
+//dispatchReq handles a user's request
+func (rs *Service) dispatchReq(req *apiReq) {
+	if channelIdentifier, ok := channelOfReq(req); ok {
+		rs.channelWorkers.run(channelIdentifier, func() {
+			rs.handleReq(req)
+		})
+		return
+	}
+	rs.channelWorkers.exclusive(func() {
+		rs.handleReq(req)
+	})
+}
+
+//dispatchSentMessage handles a message acked by its receiver
+func (rs *Service) dispatchSentMessage(sentMessage *protocolMessage) {
+	if channelIdentifier, ok := channelOfSentMessage(sentMessage.Message); ok {
+		rs.channelWorkers.run(channelIdentifier, func() {
+			rs.handleSentMessage(sentMessage)
+		})
+		return
+	}
+	rs.channelWorkers.exclusive(func() {
+		rs.handleSentMessage(sentMessage)
+	})
+}
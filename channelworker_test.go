@@ -0,0 +1,259 @@
+package photon
+
+import (
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/channel"
+	"github.com/SmartMeshFoundation/Photon/network/graph"
+	"github.com/SmartMeshFoundation/Photon/network/rpc/contracts"
+	"github.com/SmartMeshFoundation/Photon/notify"
+	"github.com/SmartMeshFoundation/Photon/params"
+	"github.com/SmartMeshFoundation/Photon/transfer"
+	"github.com/SmartMeshFoundation/Photon/transfer/mediatedtransfer"
+	"github.com/SmartMeshFoundation/Photon/transfer/mtree"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelWorkersOrder(t *testing.T) {
+	w := newChannelWorkers(4)
+	defer w.stop()
+	var channels []common.Hash
+	received := make(map[common.Hash][]int)
+	var lock sync.Mutex
+	for i := 0; i < 10; i++ {
+		channels = append(channels, utils.NewRandomHash())
+	}
+	for i := 0; i < 100; i++ {
+		for _, c := range channels {
+			c := c
+			i := i
+			w.run(c, func() {
+				lock.Lock()
+				received[c] = append(received[c], i)
+				lock.Unlock()
+			})
+		}
+	}
+	w.exclusive(func() {})
+	for _, c := range channels {
+		assert.EqualValues(t, 100, len(received[c]))
+		for i, n := range received[c] {
+			assert.EqualValues(t, i, n)
+		}
+	}
+}
+
+func TestChannelWorkersExclusive(t *testing.T) {
+	w := newChannelWorkers(4)
+	defer w.stop()
+	var running int32
+	var overlapped int32
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 8; j++ {
+			w.run(utils.NewRandomHash(), func() {
+				atomic.AddInt32(&running, 1)
+				time.Sleep(time.Microsecond * 100)
+				atomic.AddInt32(&running, -1)
+			})
+		}
+		w.exclusive(func() {
+			if atomic.LoadInt32(&running) != 0 {
+				atomic.AddInt32(&overlapped, 1)
+			}
+		})
+	}
+	assert.EqualValues(t, 0, overlapped)
+}
+
+func TestChannelWorkersInline(t *testing.T) {
+	w := newChannelWorkers(0)
+	defer w.stop()
+	var done bool
+	w.run(utils.NewRandomHash(), func() {
+		done = true
+	})
+	assert.True(t, done)
+}
+
+func TestChannelOfStateChange(t *testing.T) {
+	rs, channels := newTestWorkerService(t, 0, 1)
+	defer rs.dao.CloseDB()
+	c := channels[0].ChannelIdentifier.ChannelIdentifier
+	id, ok := rs.channelOfStateChange(&mediatedtransfer.ContractBalanceStateChange{ChannelIdentifier: c})
+	assert.True(t, ok)
+	assert.EqualValues(t, c, id)
+	//not my channel
+	_, ok = rs.channelOfStateChange(&mediatedtransfer.ContractBalanceStateChange{ChannelIdentifier: utils.NewRandomHash()})
+	assert.False(t, ok)
+	_, ok = rs.channelOfStateChange(&mediatedtransfer.ContractBalanceProofUpdatedStateChange{ChannelIdentifier: c})
+	assert.False(t, ok)
+	_, ok = rs.channelOfStateChange(&transfer.BlockStateChange{BlockNumber: 1})
+	assert.False(t, ok)
+	_, ok = channelOfReq(&apiReq{Name: closeChannelReqName, Req: &closeSettleChannelReq{addr: c}})
+	assert.True(t, ok)
+	_, ok = channelOfReq(&apiReq{Name: transferReqName, Req: &transferReq{}})
+	assert.False(t, ok)
+}
+
+//newTestWorkerService returns a Service with `n` channels and `workers` channel workers, without chain and network
+func newTestWorkerService(t *testing.T, workers, n int) (rs *Service, channels []*channel.Channel) {
+	dao, err := newTestStormDb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeAddress, tokenAddress := utils.NewRandomAddress(), utils.NewRandomAddress()
+	g := graph.NewChannelGraph(nodeAddress, tokenAddress, nil)
+	for i := 0; i < n; i++ {
+		key, partnerAddress := utils.MakePrivateKeyAddress()
+		channelIdentifier := &contracts.ChannelUniqueID{
+			ChannelIdentifier: utils.NewRandomHash(),
+			OpenBlockNumber:   3,
+		}
+		externState := channel.NewChannelExternalState(nil, nil, channelIdentifier, key, nil, nil, 0, nodeAddress, partnerAddress)
+		ourState := channel.NewChannelEndState(nodeAddress, big.NewInt(330), nil, mtree.EmptyTree)
+		partnerState := channel.NewChannelEndState(partnerAddress, big.NewInt(110), nil, mtree.EmptyTree)
+		ch, err := channel.NewChannel(ourState, partnerState, externState, tokenAddress, channelIdentifier, 7, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = g.AddChannel(ch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dao.NewChannel(channel.NewChannelSerialization(ch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		channels = append(channels, ch)
+	}
+	rs = &Service{
+		NodeAddress:        nodeAddress,
+		Config:             &params.Config{},
+		dao:                dao,
+		Token2ChannelGraph: map[common.Address]*graph.ChannelGraph{tokenAddress: g},
+		JitTransfers:       make(map[common.Hash]*jitTransfer),
+		NotifyHandler:      notify.NewNotifyHandler(),
+		channelWorkers:     newChannelWorkers(workers),
+		jitStateChangeChan: make(chan *jitStateChange, 10),
+	}
+	rs.BlockNumber = new(atomic.Value)
+	rs.BlockNumber.Store(int64(10))
+	rs.ChannelFlags = NewChannelFlagsCache(rs.dao)
+	rs.StateMachineEventHandler = newStateMachineEventHandler(rs)
+	return
+}
+
+//TestServiceChannelWorkers deposits of different channels are handled in parallel, run it with -race
+func TestServiceChannelWorkers(t *testing.T) {
+	rs, channels := newTestWorkerService(t, 4, 8)
+	defer rs.channelWorkers.stop()
+	defer rs.dao.CloseDB()
+	for i := 1; i <= 20; i++ {
+		for _, ch := range channels {
+			rs.dispatchStateChange(&mediatedtransfer.ContractBalanceStateChange{
+				ChannelIdentifier:  ch.ChannelIdentifier.ChannelIdentifier,
+				ParticipantAddress: rs.NodeAddress,
+				Balance:            big.NewInt(int64(1000 + i)),
+				BlockNumber:        int64(10 + i),
+			})
+		}
+		if i%5 == 0 {
+			//exclusive work sees all deposits before it
+			rs.channelWorkers.exclusive(func() {
+				for _, ch := range channels {
+					assert.EqualValues(t, big.NewInt(int64(1000+i)), ch.OurState.ContractBalance)
+				}
+			})
+		}
+	}
+	rs.channelWorkers.exclusive(func() {})
+	for _, ch := range channels {
+		c, err := rs.dao.GetChannelByAddress(ch.ChannelIdentifier.ChannelIdentifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.EqualValues(t, big.NewInt(1020), c.OurContractBalance)
+	}
+}
+
+//TestServiceNonParticipantDeposits deposits of other channels change the graph, run it with -race
+func TestServiceNonParticipantDeposits(t *testing.T) {
+	rs, channels := newTestWorkerService(t, 4, 2)
+	defer rs.channelWorkers.stop()
+	defer rs.dao.CloseDB()
+	token := channels[0].TokenAddress
+	var others []common.Hash
+	for i := 0; i < 2; i++ {
+		c := utils.NewRandomHash()
+		err := rs.dao.NewNonParticipantChannel(token, c, utils.NewRandomAddress(), utils.NewRandomAddress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		others = append(others, c)
+	}
+	for i := 1; i <= 20; i++ {
+		for j, c := range others {
+			_, p1, p2, err := rs.dao.GetNonParticipantChannelByID(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []common.Address{p1, p2} {
+				rs.dispatchStateChange(&mediatedtransfer.ContractBalanceStateChange{
+					ChannelIdentifier:  c,
+					ParticipantAddress: p,
+					Balance:            big.NewInt(int64(i)),
+					BlockNumber:        int64(10 + i),
+				})
+			}
+			rs.dispatchStateChange(&mediatedtransfer.ContractBalanceStateChange{
+				ChannelIdentifier:  channels[j].ChannelIdentifier.ChannelIdentifier,
+				ParticipantAddress: rs.NodeAddress,
+				Balance:            big.NewInt(int64(1000 + i)),
+				BlockNumber:        int64(10 + i),
+			})
+		}
+	}
+	rs.channelWorkers.exclusive(func() {
+		for _, ch := range channels {
+			assert.EqualValues(t, big.NewInt(1020), ch.OurState.ContractBalance)
+		}
+	})
+}
+
+//benchmarkChannelWorkers each work waits 1ms like a dao write, one of 20 works needs all channels
+func benchmarkChannelWorkers(b *testing.B, n int) {
+	w := newChannelWorkers(n)
+	defer w.stop()
+	var channels []common.Hash
+	for i := 0; i < 64; i++ {
+		channels = append(channels, utils.NewRandomHash())
+	}
+	work := func() {
+		time.Sleep(time.Millisecond)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%20 == 19 {
+			w.exclusive(work)
+			continue
+		}
+		w.run(channels[i%len(channels)], work)
+	}
+	w.exclusive(func() {})
+}
+
+//BenchmarkChannelWorkers0 all work in main loop, as before
+func BenchmarkChannelWorkers0(b *testing.B) {
+	benchmarkChannelWorkers(b, 0)
+}
+
+//BenchmarkChannelWorkers8 work of different channels in parallel
+func BenchmarkChannelWorkers8(b *testing.B) {
+	benchmarkChannelWorkers(b, 8)
+}
@@ -35,6 +35,7 @@ import (
 	"github.com/SmartMeshFoundation/Photon/internal/rpanic"
 	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/models/cachedb"
 	"github.com/SmartMeshFoundation/Photon/models/stormdb"
 	"github.com/SmartMeshFoundation/Photon/network"
 	"github.com/SmartMeshFoundation/Photon/network/helper"
@@ -92,7 +93,8 @@ func StartMain() (*photon.API, error) {
 		cli.StringFlag{
 			Name: "eth-rpc-endpoint",
 			Usage: `"host:port" address of ethereum JSON-RPC server.\n'
-	           'Also accepts a protocol prefix (ws:// or ipc channel) with optional port',`,
+	           'Also accepts a protocol prefix (ws:// or ipc channel) with optional port,\n'
+	           'new blocks and events are pushed by ws:// or ipc instead of polling',`,
 			Value: node.DefaultIPCEndpoint("geth"),
 		},
 		cli.StringFlag{
@@ -168,7 +170,11 @@ func StartMain() (*photon.API, error) {
 		},
 		cli.StringFlag{
 			Name:  "pfs",
-			Usage: "pathfinder service host,example http://transport01.smartmesh.cn:7000,default ",
+			Usage: "pathfinder service host,several hosts separated by comma fail over in order,example http://transport01.smartmesh.cn:7000,default ",
+		},
+		cli.BoolFlag{
+			Name:  "pfs-cross-check",
+			Usage: "ask two pathfinder services and prefer routes both agree on,need several pfs hosts",
 		},
 		cli.BoolFlag{
 			Name:  "enable-fork-confirm",
@@ -205,6 +211,89 @@ func StartMain() (*photon.API, error) {
 			Name:  "debug-udp-only",
 			Usage: "for test only",
 		},
+		cli.StringFlag{
+			Name:  "tcp-listen-address",
+			Usage: `"host:port" for encrypted direct tcp connections from other nodes,only work with --matrix,disabled if empty`,
+		},
+		cli.StringFlag{
+			Name:  "tcp-announce-address",
+			Usage: `public "host:port" announced to other nodes,default is tcp-listen-address`,
+		},
+		cli.BoolFlag{
+			Name:  "enable-encryption",
+			Usage: "encrypt messages to nodes which support it,so xmpp/matrix server cannot read them",
+		},
+		cli.IntFlag{
+			Name:  "send-window",
+			Usage: "max balance proof messages sent but not acked per channel,1 means wait ack of each message",
+			Value: params.DefaultConfig.SendWindow,
+		},
+		cli.IntFlag{
+			Name:  "channel-workers",
+			Usage: "workers handling messages and events of a single channel in parallel,0 means all in main loop",
+			Value: params.DefaultConfig.ChannelWorkers,
+		},
+		cli.IntFlag{
+			Name:  "db-cache",
+			Usage: "max cached channels,acks and locks of each kind,0 means no cache",
+			Value: params.DefaultConfig.DbCacheSize,
+		},
+		cli.IntFlag{
+			Name:  "local-routes",
+			Usage: "max full paths to try when routing locally without pfs,0 means only order neighbours",
+			Value: params.DefaultConfig.LocalRoutes,
+		},
+		cli.StringFlag{
+			Name:  "pfs-server",
+			Usage: "serve pathfinder service api on this host:port with channels this node knows,example 127.0.0.1:7000,default is disabled",
+		},
+		cli.BoolFlag{
+			Name:  "trampoline",
+			Usage: "find routes for transfers from partners which cannot see the network,such as mobile nodes",
+		},
+		cli.Int64Flag{
+			Name:  "trampoline-fee-rate",
+			Usage: "ppm of the amount paid as fee when sending through a trampoline without max fee",
+			Value: params.DefaultConfig.TrampolineFeeRate,
+		},
+		cli.BoolFlag{
+			Name:  "onion",
+			Usage: "hide route information from mediators with onion routing when every node of the route supports it",
+		},
+		cli.StringFlag{
+			Name:  "pfs-submit-window",
+			Usage: "channel changes within this duration are submitted to pfs once,example 30s,0 means submit at once",
+			Value: params.DefaultConfig.PfsSubmitWindow.String(),
+		},
+		cli.IntFlag{
+			Name:  "pfs-submit-buckets",
+			Usage: "submit a channel to pfs only when our share of it moves into another of these equal buckets,0 means every change",
+			Value: params.DefaultConfig.PfsSubmitBuckets,
+		},
+		cli.StringFlag{
+			Name:  "pfs-submit-thresholds",
+			Usage: "submit a channel to pfs only when our share of it crosses one of these percents,separated by comma,example 10,50,90",
+		},
+		cli.BoolFlag{
+			Name:  "jit-channel",
+			Usage: "as a mediator, open or deposit to a channel to the next hop when it has no enough capacity, and forward the transfer after it's confirmed",
+		},
+		cli.StringFlag{
+			Name:  "jit-max-deposit",
+			Usage: "max tokens deposited for one transfer with jit-channel",
+		},
+		cli.StringFlag{
+			Name:  "jit-max-pending-deposit",
+			Usage: "max tokens deposited for all transfers waiting for their channels with jit-channel,default is jit-max-deposit",
+		},
+		cli.StringFlag{
+			Name:  "jit-targets",
+			Usage: "next hops channels may be opened to with jit-channel,separated by comma,default is any node",
+		},
+		cli.BoolFlag{
+			Name:  "disable-auto-settle",
+			Usage: "don't settle closed channels automatically when the settle window expires",
+		},
 	}
 	app.Flags = append(app.Flags, debug.Flags...)
 	app.Action = mainCtx
@@ -254,6 +343,9 @@ func mainCtx(ctx *cli.Context) (err error) {
 		client.Close()
 		return
 	}
+	if cfg.DbCacheSize > 0 {
+		dao = cachedb.New(dao, cfg.DbCacheSize)
+	}
 	cfg.RegistryAddress, isFirstStartUp, hasConnectedChain, err = getRegistryAddress(cfg, dao, client)
 	if err != nil {
 		client.Close()
@@ -326,7 +418,7 @@ func mainCtx(ctx *cli.Context) (err error) {
 	}
 	params.PunishBlockNumber = cs.PunishBlockNumber
 	log.Info(fmt.Sprintf("punish block number=%d", params.PunishBlockNumber))
-	transport, err := buildTransport(cfg, bcs)
+	transport, err := buildTransport(cfg, bcs, dao)
 	if err != nil {
 		dao.CloseDB()
 		client.Close()
@@ -361,7 +453,7 @@ func mainCtx(ctx *cli.Context) (err error) {
 
 	return nil
 }
-func buildTransport(cfg *params.Config, bcs *rpc.BlockChainService) (transport network.Transporter, err error) {
+func buildTransport(cfg *params.Config, bcs *rpc.BlockChainService, dao models.Dao) (transport network.Transporter, err error) {
 	/*
 		use ice and doesn't work as route node,means this node runs  on a mobile phone.
 	*/
@@ -393,7 +485,14 @@ func buildTransport(cfg *params.Config, bcs *rpc.BlockChainService) (transport n
 		if params.MobileMode {
 			deviceType = network.DeviceTypeMobile
 		}
-		transport, err = network.NewMatrixMixTransporter(bcs.NodeAddress.String(), cfg.Host, cfg.Port, bcs.PrivKey, nil, policy, deviceType)
+		var tcp *network.TCPTransport
+		if cfg.TCPListenAddress != "" {
+			tcp, err = network.NewTCPTransport(bcs.NodeAddress.String(), cfg.TCPListenAddress, cfg.TCPAnnounceAddress, bcs.PrivKey, nil, dao)
+			if err != nil {
+				return
+			}
+		}
+		transport, err = network.NewMatrixMixTransporter(bcs.NodeAddress.String(), cfg.Host, cfg.Port, bcs.PrivKey, nil, policy, deviceType, tcp)
 	}
 	return
 }
@@ -508,6 +607,65 @@ func config(ctx *cli.Context) (config *params.Config, err error) {
 		}
 	}
 	config.PfsHost = ctx.String("pfs")
+	config.PfsCrossCheck = ctx.Bool("pfs-cross-check")
+	config.TCPListenAddress = ctx.String("tcp-listen-address")
+	config.TCPAnnounceAddress = ctx.String("tcp-announce-address")
+	config.EnableEncryption = ctx.Bool("enable-encryption")
+	config.SendWindow = ctx.Int("send-window")
+	config.ChannelWorkers = ctx.Int("channel-workers")
+	config.DbCacheSize = ctx.Int("db-cache")
+	config.LocalRoutes = ctx.Int("local-routes")
+	config.PfsServerAddress = ctx.String("pfs-server")
+	config.Trampoline = ctx.Bool("trampoline")
+	config.TrampolineFeeRate = ctx.Int64("trampoline-fee-rate")
+	config.Onion = ctx.Bool("onion")
+	config.PfsSubmitWindow, err = time.ParseDuration(ctx.String("pfs-submit-window"))
+	if err != nil {
+		err = fmt.Errorf("arg pfs-submit-window err %s", err)
+		return
+	}
+	config.PfsSubmitBuckets = ctx.Int("pfs-submit-buckets")
+	config.PfsSubmitThresholds = nil
+	if ts := ctx.String("pfs-submit-thresholds"); ts != "" {
+		for _, t := range strings.Split(ts, ",") {
+			var percent int
+			percent, err = strconv.Atoi(strings.TrimSpace(t))
+			if err != nil || percent <= 0 || percent >= 100 {
+				err = fmt.Errorf("arg pfs-submit-thresholds err, %s is not a percent between 0 and 100", t)
+				return
+			}
+			config.PfsSubmitThresholds = append(config.PfsSubmitThresholds, percent)
+		}
+	}
+	config.DisableAutoSettle = ctx.Bool("disable-auto-settle")
+	config.JitChannel = ctx.Bool("jit-channel")
+	if config.JitChannel {
+		var ok bool
+		config.JitMaxDeposit, ok = new(big.Int).SetString(ctx.String("jit-max-deposit"), 10)
+		if !ok || config.JitMaxDeposit.Sign() <= 0 {
+			err = fmt.Errorf("arg jit-max-deposit must be a positive integer when jit-channel is enabled")
+			return
+		}
+		config.JitMaxPendingDeposit = new(big.Int).Set(config.JitMaxDeposit)
+		if s := ctx.String("jit-max-pending-deposit"); s != "" {
+			config.JitMaxPendingDeposit, ok = new(big.Int).SetString(s, 10)
+			if !ok || config.JitMaxPendingDeposit.Cmp(config.JitMaxDeposit) < 0 {
+				err = fmt.Errorf("arg jit-max-pending-deposit must be an integer not less than jit-max-deposit")
+				return
+			}
+		}
+		config.JitTargets = nil
+		if ts := ctx.String("jit-targets"); ts != "" {
+			for _, t := range strings.Split(ts, ",") {
+				t = strings.TrimSpace(t)
+				if !common.IsHexAddress(t) {
+					err = fmt.Errorf("arg jit-targets err, %s is not an address", t)
+					return
+				}
+				config.JitTargets = append(config.JitTargets, common.HexToAddress(t))
+			}
+		}
+	}
 
 	if ctx.Bool("enable-fork-confirm") {
 		log.Info("fork-confirm enable...")
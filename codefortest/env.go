@@ -12,6 +12,7 @@ import (
 
 	accountModule "github.com/SmartMeshFoundation/Photon/accounts"
 	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/models/cachedb"
 	"github.com/SmartMeshFoundation/Photon/models/stormdb"
 	"github.com/SmartMeshFoundation/Photon/network/helper"
 	"github.com/SmartMeshFoundation/Photon/network/rpc/contracts"
@@ -142,5 +143,8 @@ func NewTestDB(dbPath string) (dao models.Dao) {
 		panic(err)
 	}
 	//}
+	if os.Getenv("PHOTON_DB") == "cache" {
+		dao = cachedb.New(dao, 1000)
+	}
 	return
 }
@@ -0,0 +1,164 @@
+package e2e
+
+import (
+	"math/big"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+Run with
+	go test -run XXX -bench . ./e2e
+and set PHOTON_E2E_RESULT to collect results as json lines.
+MemoryNetwork delivers each message on its own timer, so messages of a channel may arrive out of order like udp,
+a message the partner can't accept yet is resent after the protocol retry interval (6s), which dominates p99 latency.
+*/
+
+const (
+	//benchLatency of each message between nodes
+	benchLatency = time.Millisecond
+	//benchConcurrency transfers in flight at the same time
+	benchConcurrency = 16
+)
+
+var benchDeposit, _ = new(big.Int).SetString("1000000000000000000000", 10)
+
+func newBenchCluster(b *testing.B, nodes int) *Cluster {
+	c, err := NewCluster(nodes, benchLatency)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = c.OpenLine(benchDeposit)
+	if err != nil {
+		c.Stop()
+		b.Fatal(err)
+	}
+	err = c.Start()
+	if err != nil {
+		c.Stop()
+		b.Fatal(err)
+	}
+	return c
+}
+
+//benchmarkTransfers sends b.N transfers from the first node to the last one
+func benchmarkTransfers(b *testing.B, name string, nodes int, isDirect bool) {
+	c := newBenchCluster(b, nodes)
+	defer c.Stop()
+	latencies := make(Latencies, b.N)
+	jobs := make(chan int, b.N)
+	for i := 0; i < b.N; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var failed error
+	b.ResetTimer()
+	start := time.Now()
+	for k := 0; k < benchConcurrency; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				t := time.Now()
+				err := c.Transfer(0, nodes-1, big.NewInt(1), isDirect)
+				latencies[i] = time.Since(t)
+				if err != nil {
+					lock.Lock()
+					failed = err
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	b.StopTimer()
+	if failed != nil {
+		b.Fatal(failed)
+	}
+	r := &Result{
+		Name:               name,
+		Nodes:              nodes,
+		Transfers:          b.N,
+		TransfersPerSecond: float64(b.N) / elapsed.Seconds(),
+	}
+	r.SetLatencies(latencies)
+	b.ReportMetric(r.TransfersPerSecond, "transfers/s")
+	b.ReportMetric(r.P50LatencyMs, "p50-ms")
+	b.ReportMetric(r.P99LatencyMs, "p99-ms")
+	err := r.Save()
+	if err != nil {
+		b.Error(err)
+	}
+}
+
+//BenchmarkDirectTransfer direct transfers on one channel
+func BenchmarkDirectTransfer(b *testing.B) {
+	benchmarkTransfers(b, "DirectTransfer", 2, true)
+}
+
+//BenchmarkMediatedTransfer3Hops mediated transfers through two mediators
+func BenchmarkMediatedTransfer3Hops(b *testing.B) {
+	benchmarkTransfers(b, "MediatedTransfer3Hops", 4, false)
+}
+
+func heapAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+/*
+BenchmarkStateManagerMemory keeps b.N hashlocked transfers open,
+the initiator never reveals the secret, so both nodes keep a StateManager for each of them.
+There are no mediators, they reject new transfers when holding more than reveal timeout locks of a channel.
+*/
+func BenchmarkStateManagerMemory(b *testing.B) {
+	nodes := 2
+	c := newBenchCluster(b, nodes)
+	defer c.Stop()
+	initiator, target := c.Nodes[0], c.Nodes[nodes-1]
+	before := heapAlloc()
+	b.ResetTimer()
+	var lockSecretHashes []common.Hash
+	for i := 0; i < b.N; i++ {
+		secret := utils.NewRandomHash()
+		_, err := initiator.API.TransferInternal(c.Token, big.NewInt(1), target.Address, secret, false, "", nil, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		lockSecretHashes = append(lockSecretHashes, utils.ShaSecret(secret[:]))
+	}
+	//all transfers have arrived at the target
+	for _, lockSecretHash := range lockSecretHashes {
+		for i := 0; target.API.GetUnfinishedReceivedTransfer(lockSecretHash, c.Token) == nil; i++ {
+			if i > 1000 {
+				b.Fatalf("transfer %s not received", lockSecretHash.String())
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	b.StopTimer()
+	after := heapAlloc()
+	r := &Result{
+		Name:      "StateManagerMemory",
+		Nodes:     nodes,
+		Transfers: b.N,
+	}
+	if after > before {
+		r.BytesPerStateManager = float64(after-before) / float64(b.N*nodes)
+	}
+	b.ReportMetric(r.BytesPerStateManager, "bytes/statemanager")
+	err := r.Save()
+	if err != nil {
+		b.Error(err)
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Package e2e runs photon nodes in one process for benchmarks.
+There is no chain, tokens and opened channels are written to each node's db before it starts,
+just like their contract events have been handled, nodes send messages through a network.MemoryNetwork.
+*/
+package e2e
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"time"
+
+	photon "github.com/SmartMeshFoundation/Photon"
+	"github.com/SmartMeshFoundation/Photon/channel"
+	"github.com/SmartMeshFoundation/Photon/channel/channeltype"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/models/cachedb"
+	"github.com/SmartMeshFoundation/Photon/models/stormdb"
+	"github.com/SmartMeshFoundation/Photon/network"
+	"github.com/SmartMeshFoundation/Photon/network/helper"
+	"github.com/SmartMeshFoundation/Photon/network/rpc"
+	"github.com/SmartMeshFoundation/Photon/network/rpc/contracts"
+	"github.com/SmartMeshFoundation/Photon/notify"
+	"github.com/SmartMeshFoundation/Photon/params"
+	"github.com/SmartMeshFoundation/Photon/transfer"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	//offlineEthRPCEndpoint nothing listens here, so nodes are never connected to a chain
+	offlineEthRPCEndpoint = "http://127.0.0.1:1"
+	//openBlockNumber all channels are opened at this block
+	openBlockNumber = 1
+	//startBlockNumber nodes think it's the latest block
+	startBlockNumber = 10
+)
+
+//Node is a photon node of a Cluster
+type Node struct {
+	Key     *ecdsa.PrivateKey
+	Address common.Address
+	API     *photon.API
+	dataDir string
+	dao     models.Dao
+}
+
+//Cluster of nodes in one process
+type Cluster struct {
+	Nodes           []*Node
+	Token           common.Address
+	Network         *network.MemoryNetwork
+	registryAddress common.Address
+	//DbCacheSize of each node, see params.Config
+	DbCacheSize int
+	//ChannelWorkers of each node, see params.Config
+	ChannelWorkers int
+	//SendWindow of each node, see params.Config
+	SendWindow int
+	//EnableMediationFee nodes charge fees with the default fee policy
+	EnableMediationFee bool
+}
+
+//NewCluster creates `n` nodes, messages between them take `latency`
+func NewCluster(n int, latency time.Duration) (c *Cluster, err error) {
+	c = &Cluster{
+		Token:           utils.NewRandomAddress(),
+		Network:         network.NewMemoryNetwork(latency),
+		registryAddress: utils.NewRandomAddress(),
+		DbCacheSize:     params.DefaultConfig.DbCacheSize,
+		ChannelWorkers:  params.DefaultConfig.ChannelWorkers,
+		SendWindow:      params.DefaultConfig.SendWindow,
+	}
+	for i := 0; i < n; i++ {
+		node := &Node{}
+		node.Key, err = crypto.GenerateKey()
+		if err != nil {
+			return
+		}
+		node.Address = crypto.PubkeyToAddress(node.Key.PublicKey)
+		node.dataDir, err = ioutil.TempDir("", "photon-e2e")
+		if err != nil {
+			return
+		}
+		node.dao, err = stormdb.OpenDb(path.Join(node.dataDir, "log.db"))
+		if err != nil {
+			return
+		}
+		err = node.dao.AddToken(c.Token, utils.EmptyAddress)
+		if err != nil {
+			return
+		}
+		node.dao.SaveLatestBlockNumber(startBlockNumber)
+		c.Nodes = append(c.Nodes, node)
+	}
+	return
+}
+
+func newOpenedChannel(token, our, partner common.Address, channelIdentifier common.Hash, deposit *big.Int) *channeltype.Serialization {
+	return &channeltype.Serialization{
+		ChannelIdentifier: &contracts.ChannelUniqueID{
+			ChannelIdentifier: channelIdentifier,
+			OpenBlockNumber:   openBlockNumber,
+		},
+		Key:                    channelIdentifier[:],
+		TokenAddressBytes:      token[:],
+		PartnerAddressBytes:    partner[:],
+		OurAddress:             our,
+		RevealTimeout:          params.DefaultRevealTimeout,
+		OurBalanceProof:        transfer.NewEmptyBalanceProofState(),
+		PartnerBalanceProof:    transfer.NewEmptyBalanceProofState(),
+		State:                  channeltype.StateOpened,
+		OurContractBalance:     new(big.Int).Set(deposit),
+		PartnerContractBalance: new(big.Int).Set(deposit),
+		SettleTimeout:          params.DefaultSettleTimeout,
+	}
+}
+
+//OpenChannel between node `i` and `j`, both deposit `deposit`, must be called before Start
+func (c *Cluster) OpenChannel(i, j int, deposit *big.Int) error {
+	n1, n2 := c.Nodes[i], c.Nodes[j]
+	channelIdentifier := utils.NewRandomHash()
+	err := n1.dao.NewChannel(newOpenedChannel(c.Token, n1.Address, n2.Address, channelIdentifier, deposit))
+	if err != nil {
+		return err
+	}
+	err = n2.dao.NewChannel(newOpenedChannel(c.Token, n2.Address, n1.Address, channelIdentifier, deposit))
+	if err != nil {
+		return err
+	}
+	for k, n := range c.Nodes {
+		if k == i || k == j {
+			continue
+		}
+		err = n.dao.NewNonParticipantChannel(c.Token, channelIdentifier, n1.Address, n2.Address)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//OpenLine opens channels between node 0 and 1, 1 and 2, ... so node 0 can pay the last one through all others
+func (c *Cluster) OpenLine(deposit *big.Int) error {
+	for i := 0; i+1 < len(c.Nodes); i++ {
+		err := c.OpenChannel(i, i+1, deposit)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) newService(node *Node) (rs *photon.Service, err error) {
+	config := params.DefaultConfig
+	config.DataDir = node.dataDir
+	config.DataBasePath = path.Join(node.dataDir, "log.db")
+	config.MyAddress = node.Address
+	config.PrivateKey = node.Key
+	config.RegistryAddress = c.registryAddress
+	config.NetworkMode = params.NoNetwork
+	config.DbCacheSize = c.DbCacheSize
+	config.ChannelWorkers = c.ChannelWorkers
+	config.SendWindow = c.SendWindow
+	config.EnableMediationFee = c.EnableMediationFee
+	client, err := helper.NewSafeClient(offlineEthRPCEndpoint)
+	if err != nil {
+		return
+	}
+	bcs, err := rpc.NewBlockChainService(node.Key, c.registryAddress, client, notify.NewNotifyHandler(), &channel.FakeTXINfoDao{})
+	if err != nil {
+		return
+	}
+	dao := node.dao
+	if c.DbCacheSize > 0 {
+		dao = cachedb.New(dao, c.DbCacheSize)
+	}
+	return photon.NewPhotonService(bcs, node.Key, c.Network.NewTransport(node.Address), &config, notify.NewNotifyHandler(), dao)
+}
+
+//Start all nodes
+func (c *Cluster) Start() error {
+	for _, node := range c.Nodes {
+		rs, err := c.newService(node)
+		if err != nil {
+			return fmt.Errorf("create node %s err %s", utils.APex2(node.Address), err)
+		}
+		err = rs.Start()
+		if err != nil {
+			return fmt.Errorf("start node %s err %s", utils.APex2(node.Address), err)
+		}
+		node.API = photon.NewPhotonAPI(rs)
+	}
+	return nil
+}
+
+//Stop all nodes and remove their data
+func (c *Cluster) Stop() {
+	for _, node := range c.Nodes {
+		if node.API != nil {
+			node.API.Photon.Stop()
+		} else {
+			node.dao.CloseDB()
+		}
+		err := os.RemoveAll(node.dataDir)
+		if err != nil {
+			log.Error(fmt.Sprintf("remove %s err %s", node.dataDir, err))
+		}
+	}
+}
+
+//Transfer `amount` from node `from` to node `to` and wait it completes, mediated if they have no channel
+func (c *Cluster) Transfer(from, to int, amount *big.Int, isDirect bool) error {
+	result, err := c.Nodes[from].API.TransferInternal(c.Token, amount, c.Nodes[to].Address, utils.EmptyHash, isDirect, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	return <-result.Result
+}
@@ -0,0 +1,126 @@
+package e2e
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	photon "github.com/SmartMeshFoundation/Photon"
+	"github.com/SmartMeshFoundation/Photon/rerr"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterTransfer(t *testing.T) {
+	c, err := NewCluster(3, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	err = c.OpenLine(big.NewInt(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Transfer(0, 1, big.NewInt(1), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Transfer(0, 2, big.NewInt(1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := c.Nodes[0].API.GetChannelList(utils.EmptyAddress, c.Nodes[1].Address)
+	if err != nil || len(cs) != 1 {
+		t.Fatalf("channel not found, err=%v", err)
+	}
+	assert.EqualValues(t, big.NewInt(2), cs[0].OurBalanceProof.TransferAmount)
+}
+
+func TestClusterQuoteAndLimit(t *testing.T) {
+	c, err := NewCluster(3, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	c.EnableMediationFee = true
+	err = c.OpenLine(big.NewInt(1000000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := c.Nodes[0].API
+	amount := big.NewInt(100000)
+	//default fee is 0.01%
+	quotes, err := api.Quote(c.Nodes[2].Address, c.Token, amount, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, quotes, 1)
+	assert.EqualValues(t, []common.Address{c.Nodes[1].Address, c.Nodes[2].Address}, quotes[0].Path)
+	assert.EqualValues(t, []*big.Int{big.NewInt(10)}, quotes[0].Fees)
+	assert.EqualValues(t, big.NewInt(10), quotes[0].TotalFee)
+	assert.EqualValues(t, 2, quotes[0].Hops)
+	_, err = api.Quote(c.Nodes[2].Address, c.Token, amount, &photon.TransferLimit{MaxHops: 1})
+	assert.Equal(t, rerr.ErrNoRouteWithinLimit, err)
+
+	transfer := func(limit *photon.TransferLimit) error {
+		result, err := api.TransferInternal(c.Token, amount, c.Nodes[2].Address, utils.EmptyHash, false, "", nil, limit)
+		if err != nil {
+			return err
+		}
+		return <-result.Result
+	}
+	assert.Equal(t, rerr.ErrNoRouteWithinLimit, transfer(&photon.TransferLimit{MaxFee: big.NewInt(9)}))
+	assert.Equal(t, rerr.ErrNoRouteWithinLimit, transfer(&photon.TransferLimit{MaxHops: 1}))
+	assert.NoError(t, transfer(&photon.TransferLimit{MaxFee: big.NewInt(10), MaxHops: 2}))
+}
+
+func TestClusterLocalRoutesReroute(t *testing.T) {
+	c, err := NewCluster(4, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	//0-1-3 and 0-2-3, but 1 cannot pay 3 enough
+	deposit := big.NewInt(1000)
+	for _, e := range [][2]int{{0, 1}, {0, 2}, {2, 3}} {
+		err = c.OpenChannel(e[0], e[1], deposit)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.OpenChannel(1, 3, big.NewInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Transfer(0, 3, big.NewInt(100), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := c.Nodes[3].API.GetChannelList(utils.EmptyAddress, c.Nodes[2].Address)
+	if err != nil || len(cs) != 1 {
+		t.Fatalf("channel not found, err=%v", err)
+	}
+	assert.EqualValues(t, big.NewInt(100), cs[0].PartnerBalanceProof.TransferAmount)
+	//0 has learned 2-3 works
+	mc := c.Nodes[0].API.Photon.MissionControl
+	var learned bool
+	for _, e := range mc.GetEdgeStats() {
+		if e.From == c.Nodes[2].Address && e.To == c.Nodes[3].Address {
+			learned = e.Successes > 0.99
+		}
+	}
+	assert.True(t, learned)
+}
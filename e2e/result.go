@@ -0,0 +1,62 @@
+package e2e
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+)
+
+//ResultFileEnv if set, every benchmark appends its Result as a json line to this file
+const ResultFileEnv = "PHOTON_E2E_RESULT"
+
+//Result of a benchmark, compare them between commits to find regressions
+type Result struct {
+	Name                 string  `json:"name"`
+	Nodes                int     `json:"nodes"`
+	Transfers            int     `json:"transfers"`
+	TransfersPerSecond   float64 `json:"transfers_per_second,omitempty"`
+	P50LatencyMs         float64 `json:"p50_latency_ms,omitempty"`
+	P99LatencyMs         float64 `json:"p99_latency_ms,omitempty"`
+	BytesPerStateManager float64 `json:"bytes_per_state_manager,omitempty"`
+}
+
+//Latencies of transfers
+type Latencies []time.Duration
+
+//Percentile returns the latency `p` percent of transfers are faster than
+func (l Latencies) Percentile(p float64) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+	sorted := make(Latencies, len(l))
+	copy(sorted, l)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	i := int(float64(len(sorted)) * p / 100)
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+//SetLatencies fills percentiles of `l`
+func (r *Result) SetLatencies(l Latencies) {
+	r.P50LatencyMs = float64(l.Percentile(50)) / float64(time.Millisecond)
+	r.P99LatencyMs = float64(l.Percentile(99)) / float64(time.Millisecond)
+}
+
+//Save appends r to the file of ResultFileEnv if it's set
+func (r *Result) Save() error {
+	name := os.Getenv(ResultFileEnv)
+	if name == "" {
+		return nil
+	}
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(r)
+}
@@ -0,0 +1,218 @@
+package encoding
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/utils"
+)
+
+//optional features of a node, announced in Capabilities
+const (
+	//FeatureEncryption the node can decrypt `Encrypted` messages
+	FeatureEncryption uint32 = 1 << iota
+	//FeatureReorder the node delivers balance proof messages in nonce order, so they can be sent without waiting for acks
+	FeatureReorder
+	//FeatureTrampoline the node finds the rest of the route for MediatedTransfer whose Trampoline is itself
+	FeatureTrampoline
+	//FeatureOnion the node forwards onion routed MediatedTransfer
+	FeatureOnion
+)
+
+// MessageMaxVersionMap 保存每个消息支持的最高版本号,没有列出的与最低版本号相同
+var MessageMaxVersionMap = map[int16]int16{
+	MediatedTransferCmdID:         MediatedTransferOnionVersion,
+	AnnounceDisposedTransferCmdID: AnnounceDisposedOnionVersion,
+}
+
+//maxCapabilitiesVersions protects against a huge Capabilities
+const maxCapabilitiesVersions = 256
+
+//MessageVersionRange versions of a message which a node can encode and decode
+type MessageVersionRange struct {
+	CmdID      int16
+	MinVersion int16
+	MaxVersion int16
+}
+
+//LocalMessageVersionRange returns versions of message `cmdID` I support
+func LocalMessageVersionRange(cmdID int16) MessageVersionRange {
+	min := MessageVersionControlMap[cmdID]
+	max, ok := MessageMaxVersionMap[cmdID]
+	if !ok || max < min {
+		max = min
+	}
+	return MessageVersionRange{CmdID: cmdID, MinVersion: min, MaxVersion: max}
+}
+
+/*
+Capabilities tells another node which messages and versions I can decode,
+and which optional features I support.
+Nodes exchange it once before sending the first message, and it's not acked.
+An old node which doesn't know it simply drops it, and is treated as supporting what it did before.
+*/
+type Capabilities struct {
+	SignedMessage
+	//Query asks the receiver to reply with its own Capabilities
+	Query bool
+	//Timestamp a newer Capabilities replaces older ones, so an old one cannot be replayed
+	Timestamp int64
+	Features  uint32
+	Versions  []MessageVersionRange
+}
+
+//NewCapabilities create Capabilities with all messages I support
+func NewCapabilities(features uint32, timestamp int64, query bool) *Capabilities {
+	m := &Capabilities{
+		Query:     query,
+		Timestamp: timestamp,
+		Features:  features,
+	}
+	for cmdID := range MessageMap {
+		if cmdID == AckCmdID {
+			continue
+		}
+		m.Versions = append(m.Versions, LocalMessageVersionRange(int16(cmdID)))
+	}
+	m.CmdID = CapabilitiesCmdID
+	return m
+}
+
+//HasFeature returns true if all bits of `features` are set
+func (m *Capabilities) HasFeature(features uint32) bool {
+	return m.Features&features == features
+}
+
+//VersionRange returns versions of message `cmdID` the node supports, ok is false if it cannot decode this message at all
+func (m *Capabilities) VersionRange(cmdID int16) (r MessageVersionRange, ok bool) {
+	for _, r = range m.Versions {
+		if r.CmdID == cmdID {
+			return r, true
+		}
+	}
+	return
+}
+
+//CanDecode returns error if the node cannot decode the packed message `data`
+func (m *Capabilities) CanDecode(data []byte) error {
+	var cmd CmdStruct
+	err := cmd.ReadCmdStructFromBuf(bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	r, ok := m.VersionRange(cmd.CmdID)
+	if !ok {
+		return fmt.Errorf("%s cannot decode message %s", utils.APex2(m.Sender), MessageType(cmd.CmdID))
+	}
+	if cmd.Version < r.MinVersion || cmd.Version > r.MaxVersion {
+		return fmt.Errorf("%s cannot decode message %s version %d,supports [%d,%d]", utils.APex2(m.Sender),
+			MessageType(cmd.CmdID), cmd.Version, r.MinVersion, r.MaxVersion)
+	}
+	return nil
+}
+
+/*
+NegotiateVersion returns the highest version of message `cmdID` supported by both me and `peer`.
+If `peer` is nil, its capabilities are unknown, it may be an old node, so my lowest version is used.
+*/
+func NegotiateVersion(cmdID int16, peer *Capabilities) (version int16, err error) {
+	local := LocalMessageVersionRange(cmdID)
+	if peer == nil {
+		return local.MinVersion, nil
+	}
+	remote, ok := peer.VersionRange(cmdID)
+	if !ok {
+		return 0, fmt.Errorf("%s cannot decode message %s", utils.APex2(peer.Sender), MessageType(cmdID))
+	}
+	version = local.MaxVersion
+	if remote.MaxVersion < version {
+		version = remote.MaxVersion
+	}
+	if version < local.MinVersion || version < remote.MinVersion {
+		return 0, fmt.Errorf("no common version of message %s with %s, mine=[%d,%d],its=[%d,%d]", MessageType(cmdID),
+			utils.APex2(peer.Sender), local.MinVersion, local.MaxVersion, remote.MinVersion, remote.MaxVersion)
+	}
+	return
+}
+
+//Pack is MessagePacker
+func (m *Capabilities) Pack() []byte {
+	var err error
+	buf := new(bytes.Buffer)
+	err = m.WriteCmdStructToBuf(buf)
+	var query byte
+	if m.Query {
+		query = 1
+	}
+	err = buf.WriteByte(query)
+	err = binary.Write(buf, binary.BigEndian, m.Timestamp)
+	err = binary.Write(buf, binary.BigEndian, m.Features)
+	err = binary.Write(buf, binary.BigEndian, uint16(len(m.Versions)))
+	for _, r := range m.Versions {
+		err = binary.Write(buf, binary.BigEndian, r)
+	}
+	_, err = buf.Write(m.Signature)
+	if err != nil {
+		log.Crit(fmt.Sprintf("Capabilities Pack err %s", err))
+	}
+	return buf.Bytes()
+}
+
+//UnPack is MessageUnPacker
+func (m *Capabilities) UnPack(data []byte) error {
+	var err error
+	buf := bytes.NewBuffer(data)
+	err = m.ReadCmdStructFromBuf(buf)
+	if err != nil {
+		return err
+	}
+	if CapabilitiesCmdID != m.CmdID {
+		return fmt.Errorf("Capabilities Unpack cmdid should be %d,but get %d", CapabilitiesCmdID, m.CmdID)
+	}
+	query, err := buf.ReadByte()
+	if err != nil {
+		return err
+	}
+	m.Query = query != 0
+	err = binary.Read(buf, binary.BigEndian, &m.Timestamp)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(buf, binary.BigEndian, &m.Features)
+	if err != nil {
+		return err
+	}
+	var count uint16
+	err = binary.Read(buf, binary.BigEndian, &count)
+	if err != nil {
+		return err
+	}
+	if count > maxCapabilitiesVersions {
+		return errors.New("Capabilities unpack error, too many versions")
+	}
+	m.Versions = make([]MessageVersionRange, count)
+	for i := range m.Versions {
+		err = binary.Read(buf, binary.BigEndian, &m.Versions[i])
+		if err != nil {
+			return err
+		}
+	}
+	if buf.Len() != signatureLength {
+		return errPacketLength
+	}
+	m.Signature = make([]byte, signatureLength)
+	_, err = buf.Read(m.Signature)
+	if err != nil {
+		return err
+	}
+	return m.SignedMessage.verifySignature(data)
+}
+
+//String is fmt.Stringer
+func (m *Capabilities) String() string {
+	return fmt.Sprintf("Message{type=Capabilities query=%v,timestamp=%d,features=%d,versions=%v,sender=%s, has signature=%v}",
+		m.Query, m.Timestamp, m.Features, m.Versions, utils.APex2(m.Sender), len(m.Signature) != 0)
+}
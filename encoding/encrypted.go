@@ -0,0 +1,83 @@
+package encoding
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+)
+
+/*
+Encrypted wraps another packed message encrypted with ECIES to the public key of receiver,
+so a relay server(xmpp,matrix) cannot read amounts,locks or path.
+It's not signed, the wrapped message is.
+*/
+type Encrypted struct {
+	CmdStruct
+	Ciphertext []byte
+}
+
+//NewEncrypted encrypt `data` to `pub`
+func NewEncrypted(pub *ecdsa.PublicKey, data []byte) (m *Encrypted, err error) {
+	ciphertext, err := ecies.Encrypt(rand.Reader, ecies.ImportECDSAPublic(pub), data, nil, nil)
+	if err != nil {
+		return
+	}
+	m = &Encrypted{
+		Ciphertext: ciphertext,
+	}
+	m.CmdID = EncryptedCmdID
+	return
+}
+
+//Decrypt returns the wrapped message
+func (m *Encrypted) Decrypt(key *ecdsa.PrivateKey) (data []byte, err error) {
+	data, err = ecies.ImportECDSA(key).Decrypt(rand.Reader, m.Ciphertext, nil, nil)
+	if err != nil {
+		return
+	}
+	if len(data) == 0 || data[0] == EncryptedCmdID {
+		err = errors.New("Encrypted contains invalid message")
+	}
+	return
+}
+
+//Pack is MessagePacker
+func (m *Encrypted) Pack() []byte {
+	buf := new(bytes.Buffer)
+	err := m.WriteCmdStructToBuf(buf)
+	if err == nil {
+		_, err = buf.Write(m.Ciphertext)
+	}
+	if err != nil {
+		log.Crit(fmt.Sprintf("Encrypted Pack err %s", err))
+	}
+	return buf.Bytes()
+}
+
+//UnPack is MessageUnpacker
+func (m *Encrypted) UnPack(data []byte) error {
+	buf := bytes.NewBuffer(data)
+	err := m.ReadCmdStructFromBuf(buf)
+	if err != nil {
+		return err
+	}
+	if EncryptedCmdID != m.CmdID {
+		return fmt.Errorf("Encrypted Unpack cmdid should be %d,but get %d", EncryptedCmdID, m.CmdID)
+	}
+	if buf.Len() == 0 {
+		return errPacketLength
+	}
+	m.Ciphertext = buf.Bytes()
+	return nil
+}
+
+//String is fmt.Stringer
+func (m *Encrypted) String() string {
+	return fmt.Sprintf("Message{type=Encrypted len=%d,hash=%s}", len(m.Ciphertext), utils.HPex(utils.Sha3(m.Ciphertext)))
+}
@@ -10,6 +10,7 @@ import (
 
 	"errors"
 	"fmt"
+	"io"
 
 	"encoding/gob"
 
@@ -31,6 +32,18 @@ var MessageVersionControlMap = map[int16]int16{
 	MediatedTransferCmdID: int16(1), // 2019-03 MediatedTransfer消息升级,带上了Path,不兼容verison<1的版本
 }
 
+/*
+MediatedTransferTrampolineVersion MediatedTransfer 从这个版本开始带Trampoline,
+只有发给trampoline的交易使用这个版本,其他交易仍然使用版本1,这样没有声明过capabilities的老节点也能解析
+*/
+const MediatedTransferTrampolineVersion int16 = 2
+
+//MediatedTransferOnionVersion MediatedTransfer 从这个版本开始带Onion,同样只有onion交易使用
+const MediatedTransferOnionVersion int16 = 3
+
+//AnnounceDisposedOnionVersion AnnounceDisposed 从这个版本开始带加密给发起方的失败原因
+const AnnounceDisposedOnionVersion int16 = 1
+
 //MessageType is the type of message for receive and send
 type MessageType int
 
@@ -79,6 +92,21 @@ const (
 	*/
 	// Respond Refund
 	AnnounceDisposedTransferResponseCmdID
+	/*
+		加密后的消息,只有接收方可以解密
+	*/
+	// another message encrypted to the receiver
+	EncryptedCmdID
+	/*
+		节点支持的消息版本和可选功能
+	*/
+	// messages versions and optional features the sender supports
+	CapabilitiesCmdID
+	/*
+		接收方发现nonce不连续,请求发送方立即重发缺失的消息
+	*/
+	// the receiver found a nonce gap, asks the sender to resend the missing message now
+	ResendRequestCmdID
 )
 
 const signatureLength = 65
@@ -202,6 +230,12 @@ func (t MessageType) String() string {
 		return "AnnounceDisposed"
 	case AnnounceDisposedTransferResponseCmdID:
 		return "AnnounceDisposedResponse"
+	case EncryptedCmdID:
+		return "Encrypted"
+	case CapabilitiesCmdID:
+		return "Capabilities"
+	case ResendRequestCmdID:
+		return "ResendRequest"
 	case RevealSecretCmdID:
 		return "RevealSecret"
 	case RemoveExpiredLockCmdID:
@@ -331,6 +365,10 @@ func HashMessageWithoutSignature(pack MessagePacker) common.Hash {
 
 //VerifyMessage returns the sender of message if data is a valid SignedMessage
 func VerifyMessage(data []byte) (sender common.Address, err error) {
+	if len(data) <= signatureLength {
+		err = errPacketLength
+		return
+	}
 	messageData := data[:len(data)-signatureLength]
 	signature := make([]byte, signatureLength)
 	copy(signature, data[len(data)-signatureLength:])
@@ -344,6 +382,26 @@ func VerifyMessage(data []byte) (sender common.Address, err error) {
 	return
 }
 
+/*
+RecoverSenderPubkey returns the public key of msg's sender,
+only works for messages whose signature is over the whole packed data, returns nil for others,
+for example messages signed with balance proof.
+*/
+func RecoverSenderPubkey(msg SignedMessager, data []byte) *ecdsa.PublicKey {
+	if len(data) <= signatureLength {
+		return nil
+	}
+	signature := make([]byte, signatureLength)
+	copy(signature, data[len(data)-signatureLength:])
+	hash := utils.Sha3(data[:len(data)-signatureLength])
+	signature[len(signature)-1] -= 27
+	pubkey, err := crypto.SigToPub(hash[:], signature)
+	if err != nil || crypto.PubkeyToAddress(*pubkey) != msg.GetSender() {
+		return nil
+	}
+	return pubkey
+}
+
 //Ping message
 type Ping struct {
 	SignedMessage
@@ -954,6 +1012,8 @@ type MediatedTransfer struct {
 	Initiator      common.Address
 	Fee            *big.Int
 	Path           []common.Address // 2019-03 消息升级后,带全路径信息
+	Trampoline     common.Address   // 版本2,由这个节点自己计算到Target的剩余路由,Fee是给它和后续节点的全部手续费
+	Onion          []byte           // 版本3,不为空时Target,Initiator,Path都为空,每个节点从中解密自己的下一跳
 }
 
 //String is fmt.Stringer
@@ -1010,6 +1070,15 @@ func (m *MediatedTransfer) Pack() []byte {
 	for _, addr := range m.Path {
 		_, err = buf.Write(addr[:])
 	}
+	if m.Version >= MediatedTransferTrampolineVersion {
+		_, err = buf.Write(m.Trampoline[:])
+	}
+	if m.Version >= MediatedTransferOnionVersion {
+		err = binary.Write(buf, binary.BigEndian, int32(len(m.Onion)))
+		if err == nil {
+			_, err = buf.Write(m.Onion)
+		}
+	}
 	m.EnvelopMessage.pack(buf)
 	if err != nil {
 		log.Crit(fmt.Sprintf("MediatedTransfer Pack err %s", err))
@@ -1046,6 +1115,26 @@ func (m *MediatedTransfer) UnPack(data []byte) error {
 		_, err = buf.Read(addr[:])
 		m.Path = append(m.Path, addr)
 	}
+	if m.Version >= MediatedTransferTrampolineVersion {
+		_, err = buf.Read(m.Trampoline[:])
+	}
+	if m.Version >= MediatedTransferOnionVersion {
+		var onionLen int32
+		err = binary.Read(buf, binary.BigEndian, &onionLen)
+		if err != nil {
+			return fmt.Errorf("MediatedTransfer unpack error, read onion length err %s", err)
+		}
+		if onionLen != 0 && onionLen != OnionLength {
+			return fmt.Errorf("MediatedTransfer unpack error, invalid onion length %d", onionLen)
+		}
+		if onionLen > 0 {
+			m.Onion = make([]byte, onionLen)
+			_, err = io.ReadFull(buf, m.Onion)
+			if err != nil {
+				return fmt.Errorf("MediatedTransfer unpack error, read onion err %s", err)
+			}
+		}
+	}
 	err = m.EnvelopMessage.unpack(buf)
 	if err != nil {
 		return err
@@ -1098,6 +1187,8 @@ type AnnounceDisposed struct {
 	AnnounceDisposedProof
 	ErrorCode int    `json:"error_code"`
 	ErrorMsg  string `json:"error_message"`
+	//ErrorOnion 版本1,onion交易中加密给发起方的失败原因
+	ErrorOnion []byte `json:"error_onion,omitempty"`
 }
 
 //String is fmt.Stringer
@@ -1142,6 +1233,12 @@ func (m *AnnounceDisposed) Pack() []byte {
 	if errorMsgBytesLen > 0 {
 		_, err = buf.Write(errorMsgBytes)
 	}
+	if m.Version >= AnnounceDisposedOnionVersion {
+		err = binary.Write(buf, binary.BigEndian, int32(len(m.ErrorOnion)))
+		if err == nil {
+			_, err = buf.Write(m.ErrorOnion)
+		}
+	}
 	_, err = buf.Write(m.Signature)
 	if err != nil {
 		log.Crit(fmt.Sprintf("pack AnnounceDisposed err %s", err))
@@ -1173,6 +1270,23 @@ func (m *AnnounceDisposed) UnPack(data []byte) error {
 		_, err = buf.Read(errorMsgBuf)
 		m.ErrorMsg = utils.BytesToString(errorMsgBuf)
 	}
+	if m.Version >= AnnounceDisposedOnionVersion {
+		var errorOnionLen int32
+		err = binary.Read(buf, binary.BigEndian, &errorOnionLen)
+		if err != nil {
+			return fmt.Errorf("AnnounceDisposed UnPack err, read error onion length err %s", err)
+		}
+		if errorOnionLen < 0 || errorOnionLen > maxOnionErrorLength {
+			return fmt.Errorf("AnnounceDisposed UnPack err, invalid error onion length %d", errorOnionLen)
+		}
+		if errorOnionLen > 0 {
+			m.ErrorOnion = make([]byte, errorOnionLen)
+			_, err = io.ReadFull(buf, m.ErrorOnion)
+			if err != nil {
+				return fmt.Errorf("AnnounceDisposed UnPack err, read error onion err %s", err)
+			}
+		}
+	}
 	m.Signature = make([]byte, signatureLength)
 	n, err := buf.Read(m.Signature)
 	if err != nil || n != signatureLength {
@@ -1975,6 +2089,8 @@ var MessageMap = map[int]Messager{
 	WithdrawResponseCmdID:                 new(WithdrawResponse),
 	SettleRequestCmdID:                    new(SettleRequest),
 	SettleResponseCmdID:                   new(SettleResponse),
+	CapabilitiesCmdID:                     new(Capabilities),
+	ResendRequestCmdID:                    new(ResendRequest),
 }
 
 func init() {
@@ -189,6 +189,210 @@ func TestMediatedTransfer(t *testing.T) {
 	}
 }
 
+func TestMediatedTransferTrampoline(t *testing.T) {
+	bp := &BalanceProof{
+		Nonce:             11,
+		ChannelIdentifier: utils.Sha3([]byte("123")),
+		TransferAmount:    big.NewInt(12),
+		OpenBlockNumber:   3,
+		Locksroot:         utils.EmptyHash,
+	}
+	lock := &mtree.Lock{
+		Amount:         big.NewInt(34),
+		Expiration:     4589895,
+		LockSecretHash: utils.ShaSecret([]byte("hashlock")),
+	}
+	trampoline, target := utils.NewRandomAddress(), utils.NewRandomAddress()
+	m1 := NewMediatedTransfer(bp, lock, target, utils.NewRandomAddress(), big.NewInt(3), []common.Address{trampoline, target})
+	m1.Trampoline = trampoline
+	m1.Version = MediatedTransferTrampolineVersion
+	m1.Sign(GetTestPrivKey(), m1)
+	data := m1.Pack()
+	m2 := new(MediatedTransfer)
+	err := m2.UnPack(data)
+	assert.Nil(t, err)
+	assert.EqualValues(t, m1, m2)
+	//version 1 doesn't have trampoline
+	m1.Version = MessageVersionControlMap[MediatedTransferCmdID]
+	m1.Sign(GetTestPrivKey(), m1)
+	data1 := m1.Pack()
+	assert.EqualValues(t, len(data)-len(trampoline), len(data1))
+	m3 := new(MediatedTransfer)
+	err = m3.UnPack(data1)
+	assert.Nil(t, err)
+	assert.EqualValues(t, utils.EmptyAddress, m3.Trampoline)
+}
+
+func TestMediatedTransferOnion(t *testing.T) {
+	bp := &BalanceProof{
+		Nonce:             11,
+		ChannelIdentifier: utils.Sha3([]byte("123")),
+		TransferAmount:    big.NewInt(12),
+		OpenBlockNumber:   3,
+		Locksroot:         utils.EmptyHash,
+	}
+	lock := &mtree.Lock{
+		Amount:         big.NewInt(34),
+		Expiration:     4589895,
+		LockSecretHash: utils.ShaSecret([]byte("hashlock")),
+	}
+	key, _ := utils.MakePrivateKeyAddress()
+	onion, err := NewOnion([]*OnionHop{{Amount: big.NewInt(34), Expiration: 4589895, Initiator: utils.NewRandomAddress()}}, []*ecdsa.PublicKey{&key.PublicKey})
+	assert.Nil(t, err)
+	m1 := NewMediatedTransfer(bp, lock, utils.EmptyAddress, utils.EmptyAddress, big.NewInt(0), nil)
+	m1.Onion = onion
+	m1.Version = MediatedTransferOnionVersion
+	m1.Sign(GetTestPrivKey(), m1)
+	data := m1.Pack()
+	m2 := new(MediatedTransfer)
+	err = m2.UnPack(data)
+	assert.Nil(t, err)
+	assert.EqualValues(t, m1.Onion, m2.Onion)
+	assert.EqualValues(t, m1.Sender, m2.Sender)
+	//a broken onion is rejected
+	m1.Onion = onion[1:]
+	m1.Sign(GetTestPrivKey(), m1)
+	err = new(MediatedTransfer).UnPack(m1.Pack())
+	assert.NotNil(t, err)
+	//a truncated onion is rejected
+	m1.Onion = onion
+	m1.Sign(GetTestPrivKey(), m1)
+	data = m1.Pack()
+	err = new(MediatedTransfer).UnPack(data[:len(data)-signatureLength-10])
+	assert.NotNil(t, err)
+}
+
+func TestPeelOnion(t *testing.T) {
+	var hops []*OnionHop
+	var keys []*ecdsa.PrivateKey
+	var pubkeys []*ecdsa.PublicKey
+	initiator := utils.NewRandomAddress()
+	for i := 0; i < 3; i++ {
+		key, addr := utils.MakePrivateKeyAddress()
+		keys = append(keys, key)
+		pubkeys = append(pubkeys, &key.PublicKey)
+		if i > 0 {
+			hops[i-1].NextHop = addr
+		}
+		hops = append(hops, &OnionHop{
+			Amount:     big.NewInt(int64(100 - i)),
+			Expiration: int64(1000 - 50*i),
+			ErrorKey:   utils.NewRandomHash(),
+		})
+	}
+	hops[2].Initiator = initiator
+	onion, err := NewOnion(hops, pubkeys)
+	assert.Nil(t, err)
+	assert.EqualValues(t, OnionLength, len(onion))
+	_, _, err = PeelOnion(keys[1], onion)
+	assert.NotNil(t, err)
+	for i, key := range keys {
+		var hop *OnionHop
+		hop, onion, err = PeelOnion(key, onion)
+		assert.Nil(t, err)
+		assert.EqualValues(t, OnionLength, len(onion))
+		assert.EqualValues(t, hops[i], hop)
+		assert.EqualValues(t, i == 2, hop.IsTarget())
+	}
+	assert.EqualValues(t, initiator, hops[2].Initiator)
+	_, err = NewOnion(make([]*OnionHop, MaxOnionHops+1), make([]*ecdsa.PublicKey, MaxOnionHops+1))
+	assert.NotNil(t, err)
+}
+
+//looksLikeOnionFrame returns true if frame starts with an uncompressed public key, as an ECIES encrypted frame does
+func looksLikeOnionFrame(frame []byte) bool {
+	if frame[0] != 4 {
+		return false
+	}
+	x := new(big.Int).SetBytes(frame[1:33])
+	y := new(big.Int).SetBytes(frame[33:65])
+	return crypto.S256().IsOnCurve(x, y)
+}
+
+func TestOnionPadding(t *testing.T) {
+	mediator, mediatorAddress := utils.MakePrivateKeyAddress()
+	target, _ := utils.MakePrivateKeyAddress()
+	hops := []*OnionHop{
+		{NextHop: utils.NewRandomAddress(), Amount: big.NewInt(10), Expiration: 100},
+		{Amount: big.NewInt(9), Expiration: 90, Initiator: mediatorAddress},
+	}
+	pubkeys := []*ecdsa.PublicKey{&mediator.PublicKey, &target.PublicKey}
+	looksReal := 0
+	for i := 0; i < 20; i++ {
+		onion, err := NewOnion(hops, pubkeys)
+		assert.Nil(t, err)
+		//the mediator sees its own frame only, the target's frame is encrypted by the mediator's layer
+		_, _, err = PeelOnion(target, onion)
+		assert.NotNil(t, err)
+		for j := 1; j < MaxOnionHops; j++ {
+			if looksLikeOnionFrame(onion[j*onionFrameLength:]) {
+				looksReal++
+			}
+		}
+		_, next, err := PeelOnion(mediator, onion)
+		assert.Nil(t, err)
+		//it can tell the frame of the next hop, but not whether any hop follows
+		assert.True(t, looksLikeOnionFrame(next))
+		for j := 1; j < MaxOnionHops; j++ {
+			if looksLikeOnionFrame(next[j*onionFrameLength:]) {
+				looksReal++
+			}
+		}
+	}
+	//random bytes look like a frame with probability 1/512
+	assert.True(t, looksReal < 5, "%d frames look real", looksReal)
+}
+
+func TestOnionError(t *testing.T) {
+	keys := []common.Hash{utils.NewRandomHash(), utils.NewRandomHash(), utils.NewRandomHash()}
+	//the third node disposes the transfer, others wrap it
+	data, err := NewOnionError(keys[2], 3007, "no route", nil)
+	assert.Nil(t, err)
+	data, err = NewOnionError(keys[1], 0, "", data)
+	assert.Nil(t, err)
+	data, err = NewOnionError(keys[0], 0, "", data)
+	assert.Nil(t, err)
+	index, code, msg, err := OpenOnionError(keys, data)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 2, index)
+	assert.EqualValues(t, 3007, code)
+	assert.EqualValues(t, "no route", msg)
+	//nodes other than the initiator can't read it
+	_, _, _, err = OpenOnionError(keys[1:], data)
+	assert.NotNil(t, err)
+}
+
+func TestAnnounceDisposedErrorOnion(t *testing.T) {
+	bp := &AnnounceDisposedProof{
+		ChannelIDInMessage: ChannelIDInMessage{
+			ChannelIdentifier: utils.Sha3([]byte("123")),
+			OpenBlockNumber:   3,
+		},
+		Lock: &mtree.Lock{
+			Amount:         big.NewInt(34),
+			Expiration:     4589895,
+			LockSecretHash: utils.ShaSecret([]byte("hashlock")),
+		},
+	}
+	errorOnion, err := NewOnionError(utils.NewRandomHash(), 3007, "no route", nil)
+	assert.Nil(t, err)
+	m1 := NewAnnounceDisposed(bp, 3010, "onion")
+	m1.ErrorOnion = errorOnion
+	m1.Version = AnnounceDisposedOnionVersion
+	err = m1.Sign(GetTestPrivKey(), m1)
+	assert.Nil(t, err)
+	m2 := new(AnnounceDisposed)
+	err = m2.UnPack(m1.Pack())
+	assert.Nil(t, err)
+	assert.EqualValues(t, m1.ErrorOnion, m2.ErrorOnion)
+	assert.EqualValues(t, m1.ErrorCode, m2.ErrorCode)
+	assert.EqualValues(t, m1.Sender, m2.Sender)
+	//a truncated error onion is rejected
+	data := m1.Pack()
+	err = new(AnnounceDisposed).UnPack(data[:len(data)-signatureLength-10])
+	assert.NotNil(t, err)
+}
+
 func TestNewAnnounceDisposedTransfer(t *testing.T) {
 	bp := &AnnounceDisposedProof{
 		ChannelIDInMessage: ChannelIDInMessage{
@@ -259,6 +463,86 @@ func TestNewRevealSecret(t *testing.T) {
 	}
 }
 
+func TestEncrypted(t *testing.T) {
+	s1 := NewRevealSecret(utils.ShaSecret([]byte("xxx")))
+	s1.Sign(GetTestPrivKey(), s1)
+	data := s1.Pack()
+	pub := GetTestPubKey()
+	assert.Equal(t, pub, *RecoverSenderPubkey(s1, data))
+	e1, err := NewEncrypted(&pub, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2 := new(Encrypted)
+	err = e2.UnPack(e1.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, bytes.Contains(e2.Pack(), s1.LockSecret[:]))
+	plain, err := e2.Decrypt(GetTestPrivKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, data, plain)
+	otherKey, _ := crypto.GenerateKey()
+	_, err = e2.Decrypt(otherKey)
+	assert.NotNil(t, err)
+}
+
+func TestCapabilities(t *testing.T) {
+	c1 := NewCapabilities(FeatureEncryption, 10, true)
+	c1.Sign(GetTestPrivKey(), c1)
+	c2 := new(Capabilities)
+	err := c2.UnPack(c1.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, c1.Sender, c2.Sender)
+	assert.True(t, c2.Query)
+	assert.True(t, c2.HasFeature(FeatureEncryption))
+	assert.EqualValues(t, len(c1.Versions), len(c2.Versions))
+	v, err := NegotiateVersion(MediatedTransferCmdID, c2)
+	assert.Nil(t, err)
+	assert.Equal(t, LocalMessageVersionRange(MediatedTransferCmdID).MaxVersion, v)
+	s1 := NewRevealSecret(utils.ShaSecret([]byte("xxx")))
+	s1.Sign(GetTestPrivKey(), s1)
+	assert.Nil(t, c2.CanDecode(s1.Pack()))
+
+	//a peer which only supports a newer version
+	for i, r := range c2.Versions {
+		if r.CmdID == RevealSecretCmdID {
+			c2.Versions[i].MinVersion = r.MaxVersion + 1
+			c2.Versions[i].MaxVersion = r.MaxVersion + 1
+		}
+	}
+	_, err = NegotiateVersion(RevealSecretCmdID, c2)
+	assert.NotNil(t, err)
+	assert.NotNil(t, c2.CanDecode(s1.Pack()))
+	v, err = NegotiateVersion(MediatedTransferCmdID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, LocalMessageVersionRange(MediatedTransferCmdID).MinVersion, v)
+
+	data := c1.Pack()
+	data[len(data)-signatureLength-1] ^= 1
+	c3 := new(Capabilities)
+	err = c3.UnPack(data)
+	assert.True(t, err != nil || c3.Sender != c1.Sender)
+}
+
+func TestResendRequest(t *testing.T) {
+	r1 := NewResendRequest(utils.NewRandomHash(), 3, 7)
+	r1.Sign(GetTestPrivKey(), r1)
+	r2 := new(ResendRequest)
+	err := r2.UnPack(r1.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, r1.Sender, r2.Sender)
+	assert.Equal(t, r1.ChannelIdentifier, r2.ChannelIdentifier)
+	assert.EqualValues(t, 3, r2.OpenBlockNumber)
+	assert.EqualValues(t, 7, r2.Nonce)
+}
+
 func TestNewSecretRequest(t *testing.T) {
 	s1 := NewSecretRequest(utils.ShaSecret([]byte("xxx")), big.NewInt(506))
 	s1.Sign(GetTestPrivKey(), s1)
@@ -0,0 +1,246 @@
+package encoding
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+)
+
+//MaxOnionHops 一个onion最多包含的节点数,包括target
+const MaxOnionHops = 8
+
+const (
+	onionHopLength = 20 + 32 + 8 + 20 + 32
+	//每个frame除了OnionHop,还有加密后面所有frame的一层的密钥
+	onionLayerKeyLength = 32
+	//ECIES加密后的长度: 65字节临时公钥,16字节IV,32字节MAC
+	onionFrameLength = 65 + 16 + onionHopLength + onionLayerKeyLength + 32
+	//OnionLength onion总是这么长,节点无法通过长度判断自己在路径中的位置
+	OnionLength = MaxOnionHops * onionFrameLength
+	//maxOnionErrorLength 每层加密增加 1+12+16 字节
+	maxOnionErrorLength = 1024 + MaxOnionHops*(1+12+16)
+)
+
+/*
+OnionHop is the instruction for one node of an onion routed MediatedTransfer,
+it's encrypted to that node, so a mediator only learns who sent the transfer to it and whom to forward.
+*/
+type OnionHop struct {
+	NextHop    common.Address //为空表示我是target
+	Amount     *big.Int       //转给NextHop的金额,target应收的金额
+	Expiration int64          //转给NextHop的锁最晚的过期块,target收到的锁的过期块
+	Initiator  common.Address //只有target知道,用于请求密码
+	ErrorKey   common.Hash    //加密失败原因的密钥,只有initiator和这个节点知道
+}
+
+//IsTarget returns true if the transfer ends at this node
+func (h *OnionHop) IsTarget() bool {
+	return h.NextHop == utils.EmptyAddress
+}
+
+func (h *OnionHop) pack() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(h.NextHop[:])
+	buf.Write(utils.BigIntTo32Bytes(h.Amount))
+	binary.Write(buf, binary.BigEndian, h.Expiration)
+	buf.Write(h.Initiator[:])
+	buf.Write(h.ErrorKey[:])
+	return buf.Bytes()
+}
+
+func (h *OnionHop) unpack(data []byte) error {
+	if len(data) != onionHopLength {
+		return errPacketLength
+	}
+	buf := bytes.NewBuffer(data)
+	amount := make([]byte, 32)
+	_, err := io.ReadFull(buf, h.NextHop[:])
+	if err == nil {
+		_, err = io.ReadFull(buf, amount)
+	}
+	if err == nil {
+		err = binary.Read(buf, binary.BigEndian, &h.Expiration)
+	}
+	if err == nil {
+		_, err = io.ReadFull(buf, h.Initiator[:])
+	}
+	if err == nil {
+		_, err = io.ReadFull(buf, h.ErrorKey[:])
+	}
+	if err != nil {
+		return err
+	}
+	h.Amount = new(big.Int).SetBytes(amount)
+	return nil
+}
+
+//randomBytes 填充用,和用流密码加密后的数据无法区分
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+//xorOnionLayer 用这一层的密钥加密或者解密data,每个密钥只用一次,所以IV固定为0
+func xorOnionLayer(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	cipher.NewCTR(block, make([]byte, aes.BlockSize)).XORKeyStream(out, data)
+	return out, nil
+}
+
+/*
+NewOnion encrypts hops[i] to pubkeys[i], hops are in the order of the path.
+The onion is layered: the first frame is ECIES encrypted to the receiver and holds its hop and a layer key,
+everything after it is encrypted with that layer key. Every hop peels its layer and appends random bytes,
+so the onion has the same length at every hop, and a hop sees only its own frame and the next hop's,
+the rest can't be told from the random padding.
+*/
+func NewOnion(hops []*OnionHop, pubkeys []*ecdsa.PublicKey) (onion []byte, err error) {
+	if len(hops) == 0 || len(hops) > MaxOnionHops || len(hops) != len(pubkeys) {
+		return nil, fmt.Errorf("onion needs 1-%d hops and a public key for each,got %d hops,%d keys", MaxOnionHops, len(hops), len(pubkeys))
+	}
+	//从target往前一层层构造,target看到的onion中自己的frame后面都是随机数据
+	onion = randomBytes(OnionLength - onionFrameLength)
+	for i := len(hops) - 1; i >= 0; i-- {
+		layerKey := randomBytes(onionLayerKeyLength)
+		var frame []byte
+		frame, err = ecies.Encrypt(rand.Reader, ecies.ImportECDSAPublic(pubkeys[i]), append(hops[i].pack(), layerKey...), nil, nil)
+		if err != nil {
+			return
+		}
+		if len(frame) != onionFrameLength {
+			return nil, fmt.Errorf("onion frame length %d,expect %d", len(frame), onionFrameLength)
+		}
+		var body []byte
+		body, err = xorOnionLayer(layerKey, onion[:OnionLength-onionFrameLength])
+		if err != nil {
+			return
+		}
+		onion = append(frame, body...)
+	}
+	return onion, nil
+}
+
+//PeelOnion decrypts my instruction, and returns the onion to forward to the next hop
+func PeelOnion(key *ecdsa.PrivateKey, onion []byte) (hop *OnionHop, next []byte, err error) {
+	if len(onion) != OnionLength {
+		return nil, nil, fmt.Errorf("onion length %d,expect %d", len(onion), OnionLength)
+	}
+	data, err := ecies.ImportECDSA(key).Decrypt(rand.Reader, onion[:onionFrameLength], nil, nil)
+	if err != nil {
+		return
+	}
+	if len(data) != onionHopLength+onionLayerKeyLength {
+		return nil, nil, errPacketLength
+	}
+	hop = new(OnionHop)
+	err = hop.unpack(data[:onionHopLength])
+	if err != nil {
+		return nil, nil, err
+	}
+	next, err = xorOnionLayer(data[onionHopLength:], onion[onionFrameLength:])
+	if err != nil {
+		return nil, nil, err
+	}
+	next = append(next, randomBytes(onionFrameLength)...)
+	return
+}
+
+const (
+	onionErrorReport  = 0 //失败发生在这个节点
+	onionErrorWrapped = 1 //失败发生在下游,内容是下游加密的原因
+)
+
+func onionErrorAEAD(key common.Hash) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+NewOnionError encrypts why I disposed an onion routed transfer with my ErrorKey.
+If the transfer failed downstream, the encrypted reason from downstream is wrapped instead,
+so only the initiator, who knows all the keys, can read it.
+*/
+func NewOnionError(key common.Hash, errorCode int, errorMsg string, downstream []byte) ([]byte, error) {
+	aead, err := onionErrorAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if len(downstream) > 0 {
+		buf.WriteByte(onionErrorWrapped)
+		buf.Write(downstream)
+	} else {
+		buf.WriteByte(onionErrorReport)
+		binary.Write(buf, binary.BigEndian, int32(errorCode))
+		buf.WriteString(errorMsg)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	data := aead.Seal(nonce, nonce, buf.Bytes(), nil)
+	if len(data) > maxOnionErrorLength {
+		return nil, errors.New("onion error too long")
+	}
+	return data, nil
+}
+
+/*
+OpenOnionError decrypts the reason with keys of hops in the order of the path,
+index is the position in the path of the node which disposed the transfer.
+*/
+func OpenOnionError(keys []common.Hash, data []byte) (index int, errorCode int, errorMsg string, err error) {
+	for index = 0; index < len(keys); index++ {
+		var aead cipher.AEAD
+		aead, err = onionErrorAEAD(keys[index])
+		if err != nil {
+			return
+		}
+		if len(data) < aead.NonceSize() {
+			err = errPacketLength
+			return
+		}
+		var plain []byte
+		plain, err = aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+		if err != nil {
+			return
+		}
+		if len(plain) == 0 {
+			err = errPacketLength
+			return
+		}
+		if plain[0] == onionErrorWrapped {
+			data = plain[1:]
+			continue
+		}
+		if len(plain) < 5 {
+			err = errPacketLength
+			return
+		}
+		errorCode = int(int32(binary.BigEndian.Uint32(plain[1:5])))
+		errorMsg = string(plain[5:])
+		return
+	}
+	err = errors.New("onion error wrapped more times than hops")
+	return
+}
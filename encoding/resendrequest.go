@@ -0,0 +1,90 @@
+package encoding
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+ResendRequest is sent by a node which received balance proof messages out of nonce order.
+It asks the sender to resend the message with `Nonce` now instead of waiting for its retry timeout.
+It's not acked, a lost one is replaced by the next.
+*/
+type ResendRequest struct {
+	SignedMessage
+	ChannelIDInMessage
+	Nonce uint64
+}
+
+//NewResendRequest create ResendRequest
+func NewResendRequest(channelIdentifier common.Hash, openBlockNumber int64, nonce uint64) *ResendRequest {
+	m := &ResendRequest{
+		ChannelIDInMessage: ChannelIDInMessage{
+			ChannelIdentifier: channelIdentifier,
+			OpenBlockNumber:   openBlockNumber,
+		},
+		Nonce: nonce,
+	}
+	m.CmdID = ResendRequestCmdID
+	return m
+}
+
+//Pack is MessagePacker
+func (m *ResendRequest) Pack() []byte {
+	var err error
+	buf := new(bytes.Buffer)
+	err = m.WriteCmdStructToBuf(buf)
+	_, err = buf.Write(m.ChannelIdentifier[:])
+	err = binary.Write(buf, binary.BigEndian, m.OpenBlockNumber)
+	err = binary.Write(buf, binary.BigEndian, m.Nonce)
+	_, err = buf.Write(m.Signature)
+	if err != nil {
+		log.Crit(fmt.Sprintf("ResendRequest Pack err %s", err))
+	}
+	return buf.Bytes()
+}
+
+//UnPack is MessageUnPacker
+func (m *ResendRequest) UnPack(data []byte) error {
+	var err error
+	buf := bytes.NewBuffer(data)
+	err = m.ReadCmdStructFromBuf(buf)
+	if err != nil {
+		return err
+	}
+	if ResendRequestCmdID != m.CmdID {
+		return fmt.Errorf("ResendRequest Unpack cmdid should be %d,but get %d", ResendRequestCmdID, m.CmdID)
+	}
+	_, err = buf.Read(m.ChannelIdentifier[:])
+	if err != nil {
+		return err
+	}
+	err = binary.Read(buf, binary.BigEndian, &m.OpenBlockNumber)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(buf, binary.BigEndian, &m.Nonce)
+	if err != nil {
+		return err
+	}
+	if buf.Len() != signatureLength {
+		return errPacketLength
+	}
+	m.Signature = make([]byte, signatureLength)
+	_, err = buf.Read(m.Signature)
+	if err != nil {
+		return err
+	}
+	return m.SignedMessage.verifySignature(data)
+}
+
+//String is fmt.Stringer
+func (m *ResendRequest) String() string {
+	return fmt.Sprintf("Message{type=ResendRequest Channel=%s-%d,nonce=%d,sender=%s, has signature=%v}",
+		utils.HPex(m.ChannelIdentifier), m.OpenBlockNumber, m.Nonce, utils.APex2(m.Sender), len(m.Signature) != 0)
+}
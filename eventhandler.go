@@ -6,6 +6,7 @@ import (
 	"github.com/SmartMeshFoundation/Photon/params"
 
 	"errors"
+	"math/big"
 
 	"github.com/SmartMeshFoundation/Photon/channel"
 	"github.com/SmartMeshFoundation/Photon/channel/channeltype"
@@ -13,6 +14,7 @@ import (
 	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/models"
 	"github.com/SmartMeshFoundation/Photon/network/graph"
+	"github.com/SmartMeshFoundation/Photon/rerr"
 	"github.com/SmartMeshFoundation/Photon/transfer"
 	"github.com/SmartMeshFoundation/Photon/transfer/mediatedtransfer"
 	"github.com/SmartMeshFoundation/Photon/transfer/mediatedtransfer/initiator"
@@ -148,7 +150,33 @@ func (eh *stateMachineEventHandler) eventSendMediatedTransfer(event *mediatedtra
 	}
 	//log.Trace(fmt.Sprintf("eventSendMediatedTransfer g=%s", utils.StringInterface(g, 3)))
 	//log.Trace(fmt.Sprintf("eventSendMediatedTransfer ch=%s", utils.StringInterface(ch, 2)))
-	mtr, err := ch.CreateMediatedTransfer(event.Initiator, event.Target, event.Fee, event.Amount, event.Expiration, event.LockSecretHash, event.Path)
+	initiatorAddr, targetAddr, fee, path := event.Initiator, event.Target, event.Fee, event.Path
+	if len(event.Onion) > 0 {
+		//onion交易中下一跳只能知道给它的指令
+		initiatorAddr, targetAddr, fee, path = utils.EmptyAddress, utils.EmptyAddress, utils.BigInt0, nil
+	}
+	mtr, err := ch.CreateMediatedTransfer(initiatorAddr, targetAddr, fee, event.Amount, event.Expiration, event.LockSecretHash, path)
+	if err != nil {
+		return
+	}
+	//只有trampoline和onion交易使用新版本,其他交易仍然是最低版本,老节点也能解析
+	if len(event.Onion) > 0 {
+		if eh.photon.Protocol.OnionPubkey(receiver) == nil {
+			err = rerr.ErrPeerNotSupport.Errorf("%s doesn't support onion", utils.APex2(receiver))
+			return
+		}
+		mtr.Onion = event.Onion
+		mtr.Version = encoding.MediatedTransferOnionVersion
+	} else if event.Trampoline != utils.EmptyAddress {
+		if !eh.photon.Protocol.PeerSupportsTrampoline(event.Trampoline) {
+			err = rerr.ErrPeerNotSupport.Errorf("%s doesn't work as trampoline", utils.APex2(event.Trampoline))
+			return
+		}
+		mtr.Trampoline = event.Trampoline
+		mtr.Version = encoding.MediatedTransferTrampolineVersion
+	}
+	//the version is signed, so it must be checked before signing
+	err = eh.photon.Protocol.CheckPeerVersion(receiver, encoding.MediatedTransferCmdID, mtr.Version)
 	if err != nil {
 		return
 	}
@@ -247,6 +275,16 @@ func (eh *stateMachineEventHandler) eventSendAnnouncedDisposed(event *mediatedtr
 	if err != nil {
 		return
 	}
+	if event.ErrorKey != utils.EmptyHash {
+		//onion交易,只有发起方能看到真正的原因
+		mtr.ErrorOnion, err = encoding.NewOnionError(event.ErrorKey, event.Reason.ErrorCode, event.Reason.ErrorMsg, event.DownstreamOnionError)
+		if err != nil {
+			return
+		}
+		mtr.ErrorCode = rerr.ErrOnionRouteFailed.ErrorCode
+		mtr.ErrorMsg = rerr.ErrOnionRouteFailed.ErrorMsg
+		mtr.Version = encoding.AnnounceDisposedOnionVersion
+	}
 	err = mtr.Sign(eh.photon.PrivateKey, mtr)
 	err = ch.RegisterAnnouceDisposed(mtr)
 	if err != nil {
@@ -449,6 +487,10 @@ func (eh *stateMachineEventHandler) OnEvent(event transfer.Event, stateManager *
 		//st := eh.photon.dao.NewSentTransfer(eh.photon.GetBlockNumber(), e2.ChannelIdentifier, ch.ChannelIdentifier.OpenBlockNumber, ch.TokenAddress, e2.Target, ch.GetNextNonce(), e2.Amount, e2.LockSecretHash, e2.Data)
 		//eh.photon.NotifyHandler.NotifySentTransfer(st)
 		eh.finishOneTransfer(event)
+	case *mediatedtransfer.EventRouteSuccess:
+		eh.photon.MissionControl.ReportSuccess(e2.Token, eh.photon.NodeAddress, routePath(e2.HopNode, e2.Path))
+	case *mediatedtransfer.EventRouteFailed:
+		eh.photon.MissionControl.ReportFailure(e2.Token, eh.photon.NodeAddress, routePath(e2.HopNode, e2.Path), e2.Disposed, e2.Reason)
 	case *transfer.EventTransferSentFailed:
 		std := eh.photon.dao.UpdateSentTransferDetailStatus(e2.Token, e2.LockSecretHash, models.TransferStatusFailed, fmt.Sprintf("transfer fail err=%s", e2.Reason), nil)
 		//eh.photon.NotifyTransferStatusChange(e2.Token, e2.LockSecretHash, models.TransferStatusFailed, fmt.Sprintf("交易失败 err=%s", e2.Reason))
@@ -495,6 +537,14 @@ func (eh *stateMachineEventHandler) OnEvent(event transfer.Event, stateManager *
 	return
 }
 
+//routePath returns `path` of a route, or only the first hop if it's unknown
+func routePath(hopNode common.Address, path []common.Address) []common.Address {
+	if len(path) == 0 {
+		return []common.Address{hopNode}
+	}
+	return path
+}
+
 //remove the successful transfer's state manager
 func (eh *stateMachineEventHandler) finishOneTransfer(ev transfer.Event) {
 	var err error
@@ -510,6 +560,9 @@ func (eh *stateMachineEventHandler) finishOneTransfer(ev transfer.Event) {
 		log.Warn(fmt.Sprintf("EventTransferSentFailed for LockSecretHash %s,because of %s", e2.LockSecretHash.String(), e2.Reason))
 		lockSecretHash = e2.LockSecretHash
 		err = errors.New(e2.Reason)
+		if e2.Reason == initiator.ReasonNoRouteWithinLimit {
+			err = rerr.ErrNoRouteWithinLimit
+		}
 		tokenAddress = e2.Token
 	default:
 		panic("unknow event")
@@ -563,6 +616,9 @@ func (eh *stateMachineEventHandler) handleChannelNew(st *mediatedtransfer.Contra
 		log.Error(err.Error())
 		return err
 	}
+	if eh.photon.PfsServer != nil {
+		eh.photon.PfsServer.ResetChannel(st.ChannelIdentifier.ChannelIdentifier)
+	}
 	isParticipant := eh.photon.NodeAddress == participant2 || eh.photon.NodeAddress == participant1
 	partner := st.Participant1
 	if partner == eh.photon.NodeAddress {
@@ -590,9 +646,13 @@ func (eh *stateMachineEventHandler) handleChannelNew(st *mediatedtransfer.Contra
 
 //1. 重复的ContractBalanceStateChange没有什么大的影响
 func (eh *stateMachineEventHandler) handleBalance(st *mediatedtransfer.ContractBalanceStateChange) error {
+	if eh.photon.PfsServer != nil {
+		eh.photon.PfsServer.SetDeposit(st.ChannelIdentifier, st.ParticipantAddress, st.Balance)
+	}
 	ch, err := eh.photon.findChannelByIdentifier(st.ChannelIdentifier)
 	if err != nil {
 		//log.Trace(fmt.Sprintf("ContractBalanceStateChange i'm not a participant,channelIdentifier=%s", utils.HPex(st.ChannelIdentifier)))
+		eh.updateNonParticipantCapacity(st.ChannelIdentifier, st.ParticipantAddress, st.Balance)
 		return nil
 	}
 	if st.GetBlockNumber() < ch.ChannelIdentifier.OpenBlockNumber {
@@ -604,9 +664,29 @@ func (eh *stateMachineEventHandler) handleBalance(st *mediatedtransfer.ContractB
 		log.Error(fmt.Sprintf("handleBalance ChannelStateTransition err=%s", err))
 	}
 	err = eh.photon.UpdateChannelContractBalance(channel.NewChannelSerialization(ch))
+	//也许有交易在等这笔存款,可能在channel worker中,交给Service.loop处理
+	eh.photon.notifyJitDeposit()
 	return err
 }
 
+//updateNonParticipantCapacity 记录别人通道的押金,本地路由时跳过押金不够的通道
+func (eh *stateMachineEventHandler) updateNonParticipantCapacity(channelIdentifier common.Hash, participant common.Address, balance *big.Int) {
+	token, p1, p2, err := eh.photon.dao.GetNonParticipantChannelByID(channelIdentifier)
+	if err != nil || balance == nil {
+		return
+	}
+	g := eh.photon.getToken2ChannelGraph(token)
+	if g == nil {
+		return
+	}
+	switch participant {
+	case p1:
+		g.SetCapacity(p1, p2, balance)
+	case p2:
+		g.SetCapacity(p2, p1, balance)
+	}
+}
+
 //1. 必须能够正确处理重复的ContractClosedStateChange
 func (eh *stateMachineEventHandler) handleClosed(st *mediatedtransfer.ContractClosedStateChange) error {
 	channelIdentifier := st.ChannelIdentifier
@@ -675,7 +755,7 @@ func (eh *stateMachineEventHandler) removeSettledChannel(ch *channel.Channel) er
 	/*
 		通知上层
 	*/
-	eh.photon.NotifyHandler.NotifyChannelStatus(channeltype.ChannelSerialization2ChannelDataDetail(cs))
+	eh.photon.NotifyHandler.NotifyChannelStatus(eh.photon.ChannelDataDetail(cs))
 	return err
 }
 func (eh *stateMachineEventHandler) handleSettled(st *mediatedtransfer.ContractSettledStateChange) error {
@@ -748,8 +828,16 @@ func (eh *stateMachineEventHandler) handleCooperativeSettled(st *mediatedtransfe
 //1. 必须能够处理重复的ContractChannelWithdrawStateChange
 func (eh *stateMachineEventHandler) handleWithdraw(st *mediatedtransfer.ContractChannelWithdrawStateChange) error {
 	log.Trace(fmt.Sprintf("%s withdraw event handle", utils.HPex(st.ChannelIdentifier.ChannelIdentifier)))
+	if eh.photon.PfsServer != nil {
+		//withdraw以后通道重新开始,之前的balance proof都失效了
+		eh.photon.PfsServer.ResetChannel(st.ChannelIdentifier.ChannelIdentifier)
+		eh.photon.PfsServer.SetDeposit(st.ChannelIdentifier.ChannelIdentifier, st.Participant1, st.Participant1Balance)
+		eh.photon.PfsServer.SetDeposit(st.ChannelIdentifier.ChannelIdentifier, st.Participant2, st.Participant2Balance)
+	}
 	ch, err := eh.photon.findChannelByIdentifier(st.ChannelIdentifier.ChannelIdentifier)
 	if err != nil {
+		eh.updateNonParticipantCapacity(st.ChannelIdentifier.ChannelIdentifier, st.Participant1, st.Participant1Balance)
+		eh.updateNonParticipantCapacity(st.ChannelIdentifier.ChannelIdentifier, st.Participant2, st.Participant2Balance)
 		return nil
 	}
 	// 考虑到极小状况下会在崩溃重启后收到重复的上一个通道发生的事件,如果这里不验证块号,可能出现上一个channel的withdraw事件在新channel上被处理的BUG,导致新channel失败
@@ -9,6 +9,7 @@ import (
 
 	"fmt"
 
+	"github.com/SmartMeshFoundation/Photon/channel/channeltype"
 	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/models"
 	"github.com/SmartMeshFoundation/Photon/pfsproxy"
@@ -56,14 +57,11 @@ func (fm *FeeModule) SetFeePolicy(fp *models.FeePolicy) (err error) {
 	if fp == nil {
 		return errors.New("can not set nil fee policy")
 	}
-	if fp.AccountFee == nil {
-		return errors.New("AccountFee can not be nil")
-	}
-	if fp.TokenFeeMap == nil {
-		return errors.New("TokenFeeMap can not be nil")
-	}
-	if fp.ChannelFeeMap == nil {
-		return errors.New("ChannelFeeMap can not be nil")
+	// 兼容旧版本的FeePercent
+	fp.Upgrade()
+	err = fp.Validate()
+	if err != nil {
+		return
 	}
 	fm.lock.Lock()
 	defer fm.lock.Unlock()
@@ -95,34 +93,54 @@ func (fm *FeeModule) SubmitFeePolicyToPFS() (err error) {
 	return
 }
 
-//GetNodeChargeFee : impl of FeeCharge
+//GetNodeChargeFee : impl of FeeCharge, 只知道转出通道,转入通道按平衡计算
 func (fm *FeeModule) GetNodeChargeFee(nodeAddress, tokenAddress common.Address, amount *big.Int) *big.Int {
+	return fm.GetMediatorChargeFee(utils.EmptyAddress, nodeAddress, tokenAddress, amount)
+}
+
+/*
+GetMediatorChargeFee 中转从inNode转给outNode的交易时收取的手续费,
+启用ImbalanceFee时,根据转入和转出通道的余额比例调整
+*/
+func (fm *FeeModule) GetMediatorChargeFee(inNode, outNode, tokenAddress common.Address, amount *big.Int) *big.Int {
+	fp := fm.feePolicy
 	var feeSetting *models.FeeSetting
 	var ok bool
+	var fee *big.Int
 	// 优先channel
-	c, err := fm.dao.GetChannel(tokenAddress, nodeAddress)
-	if c != nil && err == nil {
-		feeSetting, ok = fm.feePolicy.ChannelFeeMap[c.ChannelIdentifier.ChannelIdentifier]
-		if ok {
-			return calculateFee(feeSetting, amount)
-		}
+	out, err := fm.dao.GetChannel(tokenAddress, outNode)
+	if err != nil {
+		out = nil
 	}
-	// 其次token
-	feeSetting, ok = fm.feePolicy.TokenFeeMap[tokenAddress]
-	if ok {
-		return calculateFee(feeSetting, amount)
+	if out != nil {
+		feeSetting, ok = fp.ChannelFeeMap[out.ChannelIdentifier.ChannelIdentifier]
 	}
-	// 最后account
-	return calculateFee(fm.feePolicy.AccountFee, amount)
-}
-
-func calculateFee(feeSetting *models.FeeSetting, amount *big.Int) *big.Int {
-	fee := big.NewInt(0)
-	if feeSetting.FeePercent > 0 {
-		fee = fee.Div(amount, big.NewInt(feeSetting.FeePercent))
+	if !ok {
+		// 其次token
+		feeSetting, ok = fp.TokenFeeMap[tokenAddress]
+	}
+	if !ok {
+		// 最后account
+		feeSetting = fp.AccountFee
+	}
+	fee = feeSetting.CalculateFee(amount)
+	if fp.ImbalanceFee == nil {
+		return fee
+	}
+	var in *channeltype.Serialization
+	if inNode != utils.EmptyAddress {
+		in, err = fm.dao.GetChannel(tokenAddress, inNode)
+		if err != nil {
+			in = nil
+		}
+	}
+	// 转出通道我方付款,转入通道对方付款
+	outRatio, inRatio := int64(models.BalancedRatio), int64(models.BalancedRatio)
+	if out != nil {
+		outRatio = models.BalanceRatio(out.OurBalance(), out.PartnerBalance())
 	}
-	if feeSetting.FeeConstant.Cmp(big.NewInt(0)) > 0 {
-		fee = fee.Add(fee, feeSetting.FeeConstant)
+	if in != nil {
+		inRatio = models.BalanceRatio(in.PartnerBalance(), in.OurBalance())
 	}
-	return fee
+	return fp.ImbalanceFee.AdjustFee(fee, amount, outRatio, inRatio)
 }
@@ -1,6 +1,8 @@
 package photon
 
 import (
+	"bytes"
+	"encoding/binary"
 	"os"
 	"path"
 	"testing"
@@ -8,6 +10,9 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/SmartMeshFoundation/Photon/channel"
+	"github.com/SmartMeshFoundation/Photon/channel/channeltype"
+	"github.com/SmartMeshFoundation/Photon/network/rpc/contracts"
+	"github.com/ethereum/go-ethereum/crypto"
 
 	"math/big"
 
@@ -115,6 +120,218 @@ func TestFeeModule_WithPFS(t *testing.T) {
 	}
 }
 
+func newTestFeeChannel(token, partner common.Address, ourBalance, partnerBalance int64) *channeltype.Serialization {
+	channelIdentifier := utils.NewRandomHash()
+	return &channeltype.Serialization{
+		ChannelIdentifier: &contracts.ChannelUniqueID{
+			ChannelIdentifier: channelIdentifier,
+		},
+		Key:                    channelIdentifier[:],
+		TokenAddressBytes:      token[:],
+		PartnerAddressBytes:    partner[:],
+		State:                  channeltype.StateOpened,
+		OurContractBalance:     big.NewInt(ourBalance),
+		PartnerContractBalance: big.NewInt(partnerBalance),
+	}
+}
+
+func TestFeeModule_Imbalance(t *testing.T) {
+	db, err := newTestStormDb()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer db.CloseDB()
+	fm, err := NewFeeModule(db, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	token := utils.NewRandomAddress()
+	a, b := utils.NewRandomAddress(), utils.NewRandomAddress()
+	// 和a的通道我方余额多,和b的通道对方余额多
+	err = db.NewChannel(newTestFeeChannel(token, a, 900, 100))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = db.NewChannel(newTestFeeChannel(token, b, 100, 900))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fp := models.NewDefaultFeePolicy()
+	fp.AccountFee = &models.FeeSetting{
+		FeeConstant: big.NewInt(10),
+	}
+	fp.ImbalanceFee = &models.ImbalanceFeeSetting{
+		Curve: []*models.ImbalanceFeePoint{
+			{Ratio: 0, FeeRate: 2000},
+			{Ratio: 50, FeeRate: 0},
+			{Ratio: 100, FeeRate: -2000},
+		},
+		MinFee: big.NewInt(-5),
+	}
+	err = fm.SetFeePolicy(fp)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	amount := big.NewInt(10000)
+	// a转给b,两个通道都更不平衡
+	assert.EqualValues(t, 42, fm.GetMediatorChargeFee(a, b, token, amount).Int64())
+	// b转给a,两个通道都更平衡,补贴到下限
+	assert.EqualValues(t, -5, fm.GetMediatorChargeFee(b, a, token, amount).Int64())
+	// 不知道转入通道
+	assert.EqualValues(t, 26, fm.GetNodeChargeFee(b, token, amount).Int64())
+	assert.EqualValues(t, -5, fm.GetNodeChargeFee(a, token, amount).Int64())
+	// 不认识的节点按平衡计算
+	assert.EqualValues(t, 10, fm.GetNodeChargeFee(utils.NewRandomAddress(), token, amount).Int64())
+	// channel的设置优先于account,动态部分仍然生效
+	c, err := db.GetChannel(token, b)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fp.ChannelFeeMap[c.ChannelIdentifier.ChannelIdentifier] = &models.FeeSetting{
+		FeeConstant: big.NewInt(100),
+	}
+	err = fm.SetFeePolicy(fp)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 132, fm.GetMediatorChargeFee(a, b, token, amount).Int64())
+
+	// 签名包括动态手续费
+	key, _ := crypto.GenerateKey()
+	fp.Sign(key)
+	assert.NotEmpty(t, fp.ImbalanceFee.Signature)
+
+	fp.ImbalanceFee.Curve = []*models.ImbalanceFeePoint{
+		{Ratio: 50, FeeRate: 0},
+		{Ratio: 50, FeeRate: 1},
+	}
+	assert.Error(t, fm.SetFeePolicy(fp))
+	fp.ImbalanceFee.Curve = []*models.ImbalanceFeePoint{
+		{Ratio: 101, FeeRate: 0},
+	}
+	assert.Error(t, fm.SetFeePolicy(fp))
+	fp.ImbalanceFee.Curve = nil
+	assert.Error(t, fm.SetFeePolicy(fp))
+}
+
+func TestFeeModule_Schedule(t *testing.T) {
+	db, err := newTestStormDb()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer db.CloseDB()
+	fm, err := NewFeeModule(db, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	token := utils.NewRandomAddress()
+	fp := models.NewDefaultFeePolicy()
+	// 0.15%,最少100,最多1000
+	fp.AccountFee = &models.FeeSetting{
+		FeeConstant: big.NewInt(0),
+		FeeRate:     1500,
+		MinFee:      big.NewInt(100),
+		MaxFee:      big.NewInt(1000),
+	}
+	// 分档
+	fp.TokenFeeMap[token] = &models.FeeSetting{
+		FeeConstant: big.NewInt(1),
+		FeeRate:     1000,
+		Tiers: []*models.FeeTier{
+			{MinAmount: big.NewInt(100000), FeeConstant: big.NewInt(2), FeeRate: 500},
+			{MinAmount: big.NewInt(1000000), FeeConstant: big.NewInt(0), FeeRate: 100},
+		},
+	}
+	err = fm.SetFeePolicy(fp)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	other := utils.NewRandomAddress()
+	node := utils.NewRandomAddress()
+	assert.EqualValues(t, 100, fm.GetNodeChargeFee(node, other, big.NewInt(50000)).Int64())
+	assert.EqualValues(t, 150, fm.GetNodeChargeFee(node, other, big.NewInt(100000)).Int64())
+	assert.EqualValues(t, 1000, fm.GetNodeChargeFee(node, other, big.NewInt(1000000)).Int64())
+	assert.EqualValues(t, 100, fm.GetNodeChargeFee(node, token, big.NewInt(99999)).Int64())
+	assert.EqualValues(t, 52, fm.GetNodeChargeFee(node, token, big.NewInt(100000)).Int64())
+	assert.EqualValues(t, 100, fm.GetNodeChargeFee(node, token, big.NewInt(1000000)).Int64())
+
+	// 旧版本的FeePercent
+	fp.AccountFee = &models.FeeSetting{
+		FeeConstant: big.NewInt(0),
+		FeePercent:  1000,
+	}
+	err = fm.SetFeePolicy(fp)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 1000, fp.AccountFee.FeeRate)
+	assert.EqualValues(t, 50, fm.GetNodeChargeFee(node, other, big.NewInt(50000)).Int64())
+
+	fp.AccountFee.MinFee = big.NewInt(10)
+	fp.AccountFee.MaxFee = big.NewInt(5)
+	assert.Error(t, fm.SetFeePolicy(fp))
+	fp.AccountFee.MaxFee = nil
+	fp.TokenFeeMap[token].Tiers[1].MinAmount = big.NewInt(100000)
+	assert.Error(t, fm.SetFeePolicy(fp))
+}
+
+//TestFeeSettingLegacySignature pfs of old versions verifies FeePercent+FeeConstant and reads FeePercent
+func TestFeeSettingLegacySignature(t *testing.T) {
+	key, addr := utils.MakePrivateKeyAddress()
+	token := utils.NewRandomAddress()
+	fp := models.NewDefaultFeePolicy()
+	fp.AccountFee.FeeConstant = big.NewInt(5)
+	fp.TokenFeeMap[token] = &models.FeeSetting{
+		FeeConstant: big.NewInt(0),
+		FeeRate:     1000,
+		MaxFee:      big.NewInt(100),
+	}
+	fp.Sign(key)
+	assert.Nil(t, fp.VerifySignature(addr))
+	//the same as pfs of old versions
+	fs := fp.AccountFee
+	assert.EqualValues(t, 10000, fs.FeePercent)
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, fs.FeePercent)
+	assert.Nil(t, err)
+	buf.Write(utils.BigIntTo32Bytes(fs.FeeConstant))
+	signer, err := utils.Ecrecover(utils.Sha3(buf.Bytes()), fs.Signature)
+	assert.Nil(t, err)
+	assert.EqualValues(t, addr, signer)
+	//a max fee can't be known by old versions
+	assert.EqualValues(t, 0, fp.TokenFeeMap[token].FeePercent)
+	//FeeRate is covered by the signature too
+	fs.FeeRate = 200
+	assert.NotNil(t, fp.VerifySignature(addr))
+}
+
+func TestImbalanceFeeRate(t *testing.T) {
+	is := &models.ImbalanceFeeSetting{
+		Curve: []*models.ImbalanceFeePoint{
+			{Ratio: 20, FeeRate: 1000},
+			{Ratio: 80, FeeRate: -500},
+		},
+	}
+	assert.EqualValues(t, 1000, is.FeeRate(0))
+	assert.EqualValues(t, 1000, is.FeeRate(2000))
+	assert.EqualValues(t, 250, is.FeeRate(5000))
+	assert.EqualValues(t, -500, is.FeeRate(8000))
+	assert.EqualValues(t, -500, is.FeeRate(10000))
+	assert.EqualValues(t, 5000, models.BalanceRatio(big.NewInt(0), big.NewInt(0)))
+	assert.EqualValues(t, 2500, models.BalanceRatio(big.NewInt(1), big.NewInt(3)))
+}
+
 // newTestStormDb :
 func newTestStormDb() (dao models.Dao, err error) {
 	dbPath := path.Join(os.TempDir(), "testxxxx.dao")
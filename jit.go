@@ -0,0 +1,284 @@
+package photon
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/SmartMeshFoundation/Photon/channel"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/rerr"
+	"github.com/SmartMeshFoundation/Photon/transfer"
+	"github.com/SmartMeshFoundation/Photon/transfer/mediatedtransfer"
+	"github.com/SmartMeshFoundation/Photon/transfer/mediatedtransfer/mediator"
+	"github.com/SmartMeshFoundation/Photon/transfer/route"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+JitPolicy decides whether a mediator opens a channel to the next hop, or deposits to it,
+when it has no channel or not enough capacity to forward a transfer.
+*/
+type JitPolicy struct {
+	MaxDeposit        *big.Int                //一次最多存入的金额
+	MaxPendingDeposit *big.Int                //所有等待通道的交易存入的金额合计最多是多少
+	Targets           map[common.Address]bool //允许的下一跳,为空表示任何节点
+}
+
+//NewJitPolicy targets are next hops allowed, empty means any node
+func NewJitPolicy(maxDeposit, maxPendingDeposit *big.Int, targets []common.Address) *JitPolicy {
+	p := &JitPolicy{
+		MaxDeposit:        new(big.Int).Set(maxDeposit),
+		MaxPendingDeposit: new(big.Int).Set(maxPendingDeposit),
+		Targets:           make(map[common.Address]bool),
+	}
+	for _, t := range targets {
+		p.Targets[t] = true
+	}
+	return p
+}
+
+/*
+Deposit returns how much to deposit so that the channel with next can forward amount,
+ch is nil if there is no channel with next, pending is deposited for transfers still waiting for their channels,
+ok is false if the channel can't or needn't be opened or deposited.
+*/
+func (p *JitPolicy) Deposit(next common.Address, ch *channel.Channel, amount, pending *big.Int) (deposit *big.Int, ok bool) {
+	if len(p.Targets) > 0 && !p.Targets[next] {
+		return nil, false
+	}
+	deposit = new(big.Int).Set(amount)
+	if ch != nil {
+		if !ch.CanTransfer() {
+			return nil, false
+		}
+		deposit.Sub(deposit, ch.Distributable())
+		if deposit.Cmp(utils.BigInt0) <= 0 {
+			return nil, false
+		}
+	}
+	if deposit.Cmp(p.MaxDeposit) > 0 {
+		return nil, false
+	}
+	if new(big.Int).Add(pending, deposit).Cmp(p.MaxPendingDeposit) > 0 {
+		return nil, false
+	}
+	return deposit, true
+}
+
+//jitTransfer 等待到下一跳的通道打开或者存款确认的交易,确认之前不会创建mediator
+type jitTransfer struct {
+	tokenAddress common.Address
+	next         common.Address
+	path         []common.Address //下一跳的路由,msg.Path或者只有下一跳
+	amount       *big.Int         //通道中需要的余额
+	feeAmount    *big.Int         //按这个金额计算我的手续费
+	deposit      *big.Int         //为这笔交易存入的金额
+	depositErr   error            //存款交易失败了,不必再等
+	init         *mediatedtransfer.ActionInitMediatorStateChange
+}
+
+/*
+jitStateChange 通知Service.loop检查等待通道的交易,
+存款交易失败了,或者某个通道的押金变了
+*/
+type jitStateChange struct {
+	smkey common.Hash //存款失败的交易,押金变了时为空
+	err   error
+}
+
+/*
+holdForJitChannel 我是mediator,到下一跳没有通道或者余额不够时,如果策略允许,
+先打开通道或者存款,暂不转发,等确认以后再转发,返回false表示按原来的流程处理.
+上家给的手续费不够时不存款,存款交易在Service.loop之外进行,结果由handleJitStateChange处理.
+*/
+func (rs *Service) holdForJitChannel(smkey common.Hash, jt *jitTransfer) bool {
+	from := jt.init.FromRoute.HopNode()
+	if rs.JitPolicy == nil || jt.next == from {
+		return false
+	}
+	ch := rs.getChannel(jt.tokenAddress, jt.next)
+	if ch != nil && rs.IsOutboundMediationPaused(ch.ChannelIdentifier.ChannelIdentifier) {
+		return false
+	}
+	//上家留下的手续费要够我收取的
+	fee := jt.init.FromTranfer.Fee
+	if jt.init.OnionHop != nil {
+		fee = new(big.Int).Sub(jt.init.FromTranfer.Amount, jt.init.OnionHop.Amount)
+	}
+	if fee.Cmp(rs.mediatorChargeFee(from, jt.tokenAddress, jt.next, jt.feeAmount)) < 0 {
+		return false
+	}
+	pending := big.NewInt(0)
+	for _, jt2 := range rs.JitTransfers {
+		//同一个通道只等一笔存款
+		if jt2.tokenAddress == jt.tokenAddress && jt2.next == jt.next {
+			return false
+		}
+		pending.Add(pending, jt2.deposit)
+	}
+	deposit, ok := rs.JitPolicy.Deposit(jt.next, ch, jt.amount, pending)
+	if !ok {
+		return false
+	}
+	if !mediator.IsSafeToWait(jt.init.FromTranfer, jt.init.FromRoute.RevealTimeout(), rs.GetBlockNumber()) {
+		return false
+	}
+	if _, isOnline := rs.Protocol.GetNetworkStatus(jt.next); !isOnline {
+		return false
+	}
+	//重启以后要退回给上家
+	record := &models.JitTransfer{
+		Key:            smkey,
+		LockSecretHash: jt.init.FromTranfer.LockSecretHash,
+		Token:          jt.tokenAddress,
+		Payer:          from,
+	}
+	if jt.init.OnionHop != nil {
+		record.ErrorKey = jt.init.OnionHop.ErrorKey
+	}
+	err := rs.dao.SaveJitTransfer(record)
+	if err != nil {
+		log.Error(fmt.Sprintf("save jit transfer %s err %s", utils.HPex(record.LockSecretHash), err))
+		return false
+	}
+	settleTimeout := 0
+	if ch == nil {
+		settleTimeout = rs.Config.SettleTimeout
+	}
+	jt.deposit = deposit
+	rs.JitTransfers[smkey] = jt
+	go rs.jitDeposit(smkey, jt.tokenAddress, jt.next, settleTimeout, deposit)
+	log.Info(fmt.Sprintf("hold transfer %s until %s deposited to channel with %s",
+		utils.HPex(record.LockSecretHash), deposit, utils.APex2(jt.next)))
+	return true
+}
+
+//jitDeposit 打开通道并存款,或者只存款,会等待链上交易,所以不能在Service.loop中
+func (rs *Service) jitDeposit(smkey common.Hash, tokenAddress, next common.Address, settleTimeout int, deposit *big.Int) {
+	tokenNetwork, err := rs.Chain.TokenNetwork(tokenAddress)
+	if err == nil {
+		err = tokenNetwork.NewChannelAndDepositAsync(rs.NodeAddress, next, settleTimeout, deposit)
+	}
+	if err == nil {
+		//等待存款事件
+		return
+	}
+	select {
+	case rs.jitStateChangeChan <- &jitStateChange{smkey: smkey, err: err}:
+	case <-rs.quitChan:
+	}
+}
+
+//notifyJitDeposit 押金变了,可能有交易在等,channel worker中也可以调用
+func (rs *Service) notifyJitDeposit() {
+	select {
+	case rs.jitStateChangeChan <- &jitStateChange{}:
+	default:
+		//已经有通知在等着处理了
+	}
+}
+
+//handleJitStateChange 必须在Service.loop中调用
+func (rs *Service) handleJitStateChange(st *jitStateChange) {
+	if jt, ok := rs.JitTransfers[st.smkey]; ok && st.err != nil {
+		log.Error(fmt.Sprintf("jit deposit %s to channel with %s for transfer %s err %s",
+			jt.deposit, utils.APex2(jt.next), utils.HPex(jt.init.FromTranfer.LockSecretHash), st.err))
+		jt.depositErr = st.err
+	}
+	rs.checkJitTransfers()
+}
+
+/*
+checkJitTransfers 通道确认以后转发,等不及的时候不再等待,mediator找不到路由会通过AnnounceDisposed退回给上家
+*/
+func (rs *Service) checkJitTransfers() {
+	blockNumber := rs.GetBlockNumber()
+	for smkey, jt := range rs.JitTransfers {
+		ch := rs.getChannel(jt.tokenAddress, jt.next)
+		ready := ch != nil && ch.CanTransfer() && ch.Distributable().Cmp(jt.amount) >= 0
+		if !ready && jt.depositErr == nil && mediator.IsSafeToWait(jt.init.FromTranfer, jt.init.FromRoute.RevealTimeout(), blockNumber) {
+			continue
+		}
+		delete(rs.JitTransfers, smkey)
+		err := rs.dao.RemoveJitTransfer(smkey)
+		if err != nil {
+			log.Error(fmt.Sprintf("remove jit transfer %s err %s", utils.HPex(jt.init.FromTranfer.LockSecretHash), err))
+		}
+		if !ready {
+			log.Warn(fmt.Sprintf("channel with %s isn't ready in time for transfer %s,refund it",
+				utils.APex2(jt.next), utils.HPex(jt.init.FromTranfer.LockSecretHash)))
+		}
+		var routes []*route.State
+		if r := rs.newMediatorRoute(jt.init.FromRoute.HopNode(), jt.tokenAddress, jt.next, jt.path, jt.feeAmount); r != nil {
+			routes = append(routes, r)
+		}
+		jt.init.Routes = route.NewRoutesState(routes)
+		jt.init.BlockNumber = blockNumber
+		//等待期间操作员可能暂停了通道
+		jt.init.RejectReason = rs.mediationRejectReason(jt.tokenAddress, jt.init.FromRoute.HopNode(), jt.next)
+		rs.startMediator(smkey, jt.init)
+	}
+}
+
+//startMediator 创建mediator开始转发
+func (rs *Service) startMediator(smkey common.Hash, init *mediatedtransfer.ActionInitMediatorStateChange) {
+	stateManager := transfer.NewStateManager(mediator.StateTransition, nil, mediator.NameMediatorTransition, init.FromTranfer.LockSecretHash, init.FromTranfer.Token)
+	rs.Transfer2StateManager[smkey] = stateManager //for path A-B-C-F-B-D-E ,node B will have two StateManagers for one identifier
+	rs.StateMachineEventHandler.dispatch(stateManager, init)
+}
+
+//newMediatorRoute 到下一跳的路由,手续费根据amount在下家通道中的费率计算,没有通道时返回nil
+func (rs *Service) newMediatorRoute(from, tokenAddress, next common.Address, path []common.Address, amount *big.Int) *route.State {
+	nextChan := rs.getChannel(tokenAddress, next)
+	if nextChan == nil {
+		return nil
+	}
+	r := route.NewState(nextChan, path)
+	r.Fee = rs.mediatorChargeFee(from, tokenAddress, next, amount)
+	return r
+}
+
+//mediatorChargeFee 转发from给next的amount时我收取的手续费,到next可以还没有通道
+func (rs *Service) mediatorChargeFee(from, tokenAddress, next common.Address, amount *big.Int) *big.Int {
+	if fm, ok := rs.FeePolicy.(*FeeModule); ok {
+		return fm.GetMediatorChargeFee(from, next, tokenAddress, amount)
+	}
+	return rs.FeePolicy.GetNodeChargeFee(next, tokenAddress, amount)
+}
+
+/*
+refundJitTransfers 重启前等待通道的交易只在内存中,没有mediator,
+restoreLocks为收到的锁创建了crash state manager,用它声明放弃这个锁,退回给上家.
+*/
+func (rs *Service) refundJitTransfers() {
+	records, err := rs.dao.GetAllJitTransfers()
+	if err != nil {
+		log.Error(fmt.Sprintf("GetAllJitTransfers err %s", err))
+		return
+	}
+	for _, r := range records {
+		err = rs.dao.RemoveJitTransfer(r.Key)
+		if err != nil {
+			log.Error(fmt.Sprintf("remove jit transfer %s err %s", utils.HPex(r.LockSecretHash), err))
+		}
+		stateManager := rs.Transfer2StateManager[r.Key]
+		ch := rs.getChannel(r.Token, r.Payer)
+		if stateManager == nil || ch == nil || !ch.PartnerState.IsKnown(r.LockSecretHash) {
+			//锁已经不在了
+			continue
+		}
+		log.Warn(fmt.Sprintf("transfer %s was waiting for a channel before restart,refund it", utils.HPex(r.LockSecretHash)))
+		err = rs.StateMachineEventHandler.eventSendAnnouncedDisposed(&mediatedtransfer.EventSendAnnounceDisposed{
+			LockSecretHash: r.LockSecretHash,
+			Token:          r.Token,
+			Receiver:       r.Payer,
+			Reason:         rerr.ErrNoAvailabeRoute,
+			ErrorKey:       r.ErrorKey,
+		}, stateManager)
+		if err != nil {
+			log.Error(fmt.Sprintf("refund jit transfer %s err %s", utils.HPex(r.LockSecretHash), err))
+		}
+	}
+}
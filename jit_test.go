@@ -0,0 +1,122 @@
+package photon
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon/channel/channeltype"
+	"github.com/SmartMeshFoundation/Photon/transfer/mediatedtransfer"
+	"github.com/SmartMeshFoundation/Photon/transfer/route"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/SmartMeshFoundation/Photon/utils/utest"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJitPolicy_Deposit(t *testing.T) {
+	allowed, other := utils.NewRandomAddress(), utils.NewRandomAddress()
+	p := NewJitPolicy(big.NewInt(100), big.NewInt(150), []common.Address{allowed})
+	//no channel, open one with the whole amount
+	deposit, ok := p.Deposit(allowed, nil, big.NewInt(60), utils.BigInt0)
+	assert.True(t, ok)
+	assert.EqualValues(t, big.NewInt(60), deposit)
+	_, ok = p.Deposit(allowed, nil, big.NewInt(101), utils.BigInt0)
+	assert.False(t, ok)
+	_, ok = p.Deposit(other, nil, big.NewInt(60), utils.BigInt0)
+	assert.False(t, ok)
+	//not more than MaxPendingDeposit for all transfers waiting
+	_, ok = p.Deposit(allowed, nil, big.NewInt(60), big.NewInt(90))
+	assert.True(t, ok)
+	_, ok = p.Deposit(allowed, nil, big.NewInt(60), big.NewInt(91))
+	assert.False(t, ok)
+
+	//deposit only what's missing
+	ch := utest.MakeRoute(allowed, big.NewInt(50), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()).Channel()
+	distributable := ch.Distributable()
+	deposit, ok = p.Deposit(allowed, ch, new(big.Int).Add(distributable, big.NewInt(30)), utils.BigInt0)
+	assert.True(t, ok)
+	assert.EqualValues(t, big.NewInt(30), deposit)
+	_, ok = p.Deposit(allowed, ch, distributable, utils.BigInt0)
+	assert.False(t, ok)
+	ch.State = channeltype.StateClosed
+	_, ok = p.Deposit(allowed, ch, new(big.Int).Add(distributable, big.NewInt(30)), utils.BigInt0)
+	assert.False(t, ok)
+
+	//any node without targets
+	p = NewJitPolicy(big.NewInt(100), big.NewInt(150), nil)
+	_, ok = p.Deposit(other, nil, big.NewInt(60), utils.BigInt0)
+	assert.True(t, ok)
+}
+
+type constantFeeCharger struct {
+	fee *big.Int
+}
+
+func (c *constantFeeCharger) GetNodeChargeFee(nodeAddress, tokenAddress common.Address, amount *big.Int) *big.Int {
+	return c.fee
+}
+
+//TestHoldForJitChannel no deposit for a transfer whose fee can't pay me, or when too much is deposited for others
+func TestHoldForJitChannel(t *testing.T) {
+	rs, channels := newTestWorkerService(t, 0, 1)
+	defer rs.dao.CloseDB()
+	rs.JitPolicy = NewJitPolicy(big.NewInt(100), big.NewInt(100), nil)
+	rs.FeePolicy = &constantFeeCharger{fee: big.NewInt(5)}
+	from := channels[0]
+	newJitTransfer := func(next common.Address, fee int64) *jitTransfer {
+		return &jitTransfer{
+			tokenAddress: from.TokenAddress,
+			next:         next,
+			path:         []common.Address{next},
+			amount:       big.NewInt(60),
+			feeAmount:    big.NewInt(60),
+			init: &mediatedtransfer.ActionInitMediatorStateChange{
+				FromTranfer: &mediatedtransfer.LockedTransferState{
+					Amount:         big.NewInt(60 + fee),
+					Fee:            big.NewInt(fee),
+					Expiration:     1000,
+					LockSecretHash: utils.NewRandomHash(),
+				},
+				FromRoute: route.NewState(from, nil),
+			},
+		}
+	}
+	assert.False(t, rs.holdForJitChannel(utils.NewRandomHash(), newJitTransfer(utils.NewRandomAddress(), 4)))
+	//50 deposited for another transfer
+	next := utils.NewRandomAddress()
+	rs.JitTransfers[utils.NewRandomHash()] = &jitTransfer{tokenAddress: from.TokenAddress, next: next, deposit: big.NewInt(50)}
+	assert.False(t, rs.holdForJitChannel(utils.NewRandomHash(), newJitTransfer(utils.NewRandomAddress(), 5)))
+	//only one deposit to a channel at a time
+	rs.JitPolicy.MaxPendingDeposit = big.NewInt(200)
+	assert.False(t, rs.holdForJitChannel(utils.NewRandomHash(), newJitTransfer(next, 5)))
+	assert.EqualValues(t, 1, len(rs.JitTransfers))
+	records, err := rs.dao.GetAllJitTransfers()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, len(records))
+}
+
+//TestServiceJitDepositNotify deposits handled by channel workers leave held transfers to Service.loop, run it with -race
+func TestServiceJitDepositNotify(t *testing.T) {
+	rs, channels := newTestWorkerService(t, 4, 8)
+	defer rs.channelWorkers.stop()
+	defer rs.dao.CloseDB()
+	//checking it on a worker panics
+	smkey := utils.NewRandomHash()
+	rs.JitTransfers[smkey] = &jitTransfer{tokenAddress: channels[0].TokenAddress, next: utils.NewRandomAddress(), deposit: big.NewInt(50)}
+	for i := 1; i <= 20; i++ {
+		for _, ch := range channels {
+			rs.dispatchStateChange(&mediatedtransfer.ContractBalanceStateChange{
+				ChannelIdentifier:  ch.ChannelIdentifier.ChannelIdentifier,
+				ParticipantAddress: rs.NodeAddress,
+				Balance:            big.NewInt(int64(1000 + i)),
+				BlockNumber:        int64(10 + i),
+			})
+		}
+	}
+	rs.channelWorkers.exclusive(func() {})
+	assert.EqualValues(t, cap(rs.jitStateChangeChan), len(rs.jitStateChangeChan))
+	st := <-rs.jitStateChangeChan
+	assert.EqualValues(t, utils.EmptyHash, st.smkey)
+	assert.Nil(t, st.err)
+	assert.EqualValues(t, 1, len(rs.JitTransfers))
+}
@@ -257,7 +257,7 @@ func (mh *photonMessageHandler) messageUnlock(msg *encoding.UnLock) error {
 	mh.balanceProof(msg, smkey)
 	mh.photon.UpdateChannelAndSaveAck(ch, msg.Tag())
 	// submit balance proof to pathfinder
-	go mh.photon.submitBalanceProofToPfs(ch)
+	mh.photon.submitBalanceProofToPfs(ch)
 	// 清空Token2LockSecretHash2Channels
 	mh.photon.removeToken2LockSecretHash2channel(msg.LockSecretHash(), ch)
 	return nil
@@ -278,7 +278,7 @@ func (mh *photonMessageHandler) messageUnlock(msg *encoding.UnLock) error {
 func (mh *photonMessageHandler) messageRemoveExpiredHashlockTransfer(msg *encoding.RemoveExpiredHashlockTransfer) error {
 	ch, err := mh.photon.findChannelByIdentifier(msg.ChannelIdentifier)
 	if err != nil {
-		return fmt.Errorf("received  RemoveExpiredHashlockTransfer ,but relate channel cannot found %s", utils.StringInterface(msg, 7))
+		return rerr.ChannelNotFound(fmt.Sprintf("received  RemoveExpiredHashlockTransfer ,but relate channel cannot found %s", utils.StringInterface(msg, 7)))
 	}
 	if !ch.CanContinueTransfer() {
 		log.Warn(fmt.Sprintf("receive msg %s, but channel cannot continue transfer", msg))
@@ -296,7 +296,7 @@ func (mh *photonMessageHandler) messageRemoveExpiredHashlockTransfer(msg *encodi
 	}
 	mh.photon.UpdateChannelAndSaveAck(ch, msg.Tag())
 	// submit balance proof to pathfinder
-	go mh.photon.submitBalanceProofToPfs(ch)
+	mh.photon.submitBalanceProofToPfs(ch)
 	// 清空Token2LockSecretHash2Channels
 	mh.photon.removeToken2LockSecretHash2channel(msg.LockSecretHash, ch)
 	return nil
@@ -404,7 +404,7 @@ func (mh *photonMessageHandler) messageAnnounceDisposed(msg *encoding.AnnounceDi
 func (mh *photonMessageHandler) messageAnnounceDisposedResponse(msg *encoding.AnnounceDisposedResponse) (err error) {
 	graph := mh.photon.getChannelGraph(msg.ChannelIdentifier)
 	if graph == nil {
-		return fmt.Errorf("unkonwn channel %s", msg.ChannelIdentifier.String())
+		return rerr.ChannelNotFound(fmt.Sprintf("unkonwn channel %s", msg.ChannelIdentifier.String()))
 	}
 	if !graph.HasChannel(mh.photon.NodeAddress, msg.Sender) {
 		err = fmt.Errorf("direct transfer from node without an existing channel: %s", msg.Sender)
@@ -420,7 +420,7 @@ func (mh *photonMessageHandler) messageAnnounceDisposedResponse(msg *encoding.An
 	// must check that I actually send this Dispose
 	b := mh.photon.dao.IsLockSecretHashChannelIdentifierDisposed(msg.LockSecretHash, msg.ChannelIdentifier)
 	if !b {
-		return fmt.Errorf("maybe a attack, receive a announce disposed response,but i never send announce disposed,msg=%s", msg)
+		return rerr.ErrUnsolicitedMessage.Errorf("maybe a attack, receive a announce disposed response,but i never send announce disposed,msg=%s", msg)
 	}
 	err = ch.RegisterTransfer(mh.photon.GetBlockNumber(), msg)
 	if err != nil {
@@ -430,7 +430,7 @@ func (mh *photonMessageHandler) messageAnnounceDisposedResponse(msg *encoding.An
 	// Just store channel state.
 	mh.photon.UpdateChannelAndSaveAck(ch, msg.Tag())
 	// submit balance proof to pathfinder
-	go mh.photon.submitBalanceProofToPfs(ch)
+	mh.photon.submitBalanceProofToPfs(ch)
 	// 清空Token2LockSecretHash2Channels
 	mh.photon.removeToken2LockSecretHash2channel(msg.LockSecretHash, ch)
 	return nil
@@ -456,7 +456,7 @@ func (mh *photonMessageHandler) messageDirectTransfer(msg *encoding.DirectTransf
 	graph := mh.photon.getChannelGraph(msg.ChannelIdentifier)
 	token := mh.photon.getTokenForChannelIdentifier(msg.ChannelIdentifier)
 	if graph == nil {
-		return fmt.Errorf("unknown channel %s", utils.HPex(msg.ChannelIdentifier))
+		return rerr.ChannelNotFound(fmt.Sprintf("unknown channel %s", utils.HPex(msg.ChannelIdentifier)))
 	}
 	if _, ok := mh.blockedTokens[token]; ok {
 		return rerr.ErrTransferUnwanted
@@ -484,7 +484,7 @@ func (mh *photonMessageHandler) messageDirectTransfer(msg *encoding.DirectTransf
 	mh.photon.UpdateChannelAndSaveAck(ch, msg.Tag())
 	err = mh.photon.StateMachineEventHandler.OnEvent(receiveSuccess, nil)
 	// submit balance proof to pathfinder
-	go mh.photon.submitBalanceProofToPfs(ch)
+	mh.photon.submitBalanceProofToPfs(ch)
 	return err
 }
 
@@ -529,7 +529,21 @@ func (mh *photonMessageHandler) messageMediatedTransfer(msg *encoding.MediatedTr
 		return fmt.Errorf("receive mediated transfer,it's secret is zero")
 	}
 	token := mh.photon.getTokenForChannelIdentifier(msg.ChannelIdentifier)
-	if mh.photon.Config.IgnoreMediatedNodeRequest && msg.Target != mh.photon.NodeAddress {
+	isTarget := msg.Target == mh.photon.NodeAddress
+	var hop *encoding.OnionHop
+	var onion []byte
+	if len(msg.Onion) > 0 {
+		if !mh.photon.Config.Onion {
+			return fmt.Errorf("receive onion routed transfer,but onion is disabled")
+		}
+		var err error
+		hop, onion, err = encoding.PeelOnion(mh.photon.PrivateKey, msg.Onion)
+		if err != nil {
+			return fmt.Errorf("receive mediated transfer %s,peel onion err %s", utils.HPex(msg.LockSecretHash), err)
+		}
+		isTarget = hop.IsTarget()
+	}
+	if mh.photon.Config.IgnoreMediatedNodeRequest && !isTarget {
 		//todo what about return a AnnounceDisposed Message ?
 		/*
 			需要考虑恶意攻击的情况,比如发送一个我已经知道密码,但是尚未 unlock 的锁
@@ -584,10 +598,10 @@ func (mh *photonMessageHandler) messageMediatedTransfer(msg *encoding.MediatedTr
 	buf, err := json.MarshalIndent(dataForDebug, "", "\t")
 	log.Trace(string(buf))
 	//mh.UpdateChannelAndSaveAck(ch, msg.Tag())
-	if msg.Target == mh.photon.NodeAddress {
-		mh.photon.targetMediatedTransfer(msg, ch)
+	if isTarget {
+		mh.photon.targetMediatedTransfer(msg, ch, hop)
 	} else {
-		mh.photon.mediateMediatedTransfer(msg, ch)
+		mh.photon.mediateMediatedTransfer(msg, ch, hop, onion)
 	}
 	/*
 		start  taker's tokenswap ,only if receive a valid mediated transfer
@@ -624,7 +638,7 @@ func (mh *photonMessageHandler) messageSettleRequest(msg *encoding.SettleRequest
 	graph := mh.photon.getChannelGraph(msg.ChannelIdentifier)
 	token := mh.photon.getTokenForChannelIdentifier(msg.ChannelIdentifier)
 	if graph == nil {
-		return fmt.Errorf("unknown channel %s", utils.HPex(msg.ChannelIdentifier))
+		return rerr.ChannelNotFound(fmt.Sprintf("unknown channel %s", utils.HPex(msg.ChannelIdentifier)))
 	}
 	ch := graph.GetPartenerAddress2Channel(msg.Sender)
 	if ch == nil {
@@ -675,7 +689,7 @@ func (mh *photonMessageHandler) messageSettleResponse(msg *encoding.SettleRespon
 	graph := mh.photon.getChannelGraph(msg.ChannelIdentifier)
 	token := mh.photon.getTokenForChannelIdentifier(msg.ChannelIdentifier)
 	if graph == nil {
-		return fmt.Errorf("unknown channel %s", utils.HPex(msg.ChannelIdentifier))
+		return rerr.ChannelNotFound(fmt.Sprintf("unknown channel %s", utils.HPex(msg.ChannelIdentifier)))
 	}
 	ch := graph.GetPartenerAddress2Channel(msg.Sender)
 	if ch == nil {
@@ -694,7 +708,7 @@ func (mh *photonMessageHandler) messageSettleResponse(msg *encoding.SettleRespon
 	 *	Also, we need to prevent the other participant proactively send settle response, but I do not send settle request.
 	 */
 	if ch.State != channeltype.StateCooprativeSettle {
-		return fmt.Errorf("receive settle response but channel state is %s", ch.State)
+		return rerr.ErrUnsolicitedMessage.Errorf("receive settle response but channel state is %s", ch.State)
 	}
 	// 错误的response处理放在通道状态校验之后,过滤掉不是自己发起的SettleRequest的response
 	if msg.ErrorCode != rerr.ErrSuccess.ErrorCode {
@@ -724,7 +738,7 @@ func (mh *photonMessageHandler) messageWithdrawRequest(msg *encoding.WithdrawReq
 	graph := mh.photon.getChannelGraph(msg.ChannelIdentifier)
 	token := mh.photon.getTokenForChannelIdentifier(msg.ChannelIdentifier)
 	if graph == nil {
-		return fmt.Errorf("unknown channel %s", utils.HPex(msg.ChannelIdentifier))
+		return rerr.ChannelNotFound(fmt.Sprintf("unknown channel %s", utils.HPex(msg.ChannelIdentifier)))
 	}
 	ch := graph.GetPartenerAddress2Channel(msg.Sender)
 	if ch == nil {
@@ -778,14 +792,14 @@ func (mh *photonMessageHandler) messageWithdrawResponse(msg *encoding.WithdrawRe
 	graph := mh.photon.getChannelGraph(msg.ChannelIdentifier)
 	token := mh.photon.getTokenForChannelIdentifier(msg.ChannelIdentifier)
 	if graph == nil {
-		return fmt.Errorf("unknown channel %s", utils.HPex(msg.ChannelIdentifier))
+		return rerr.ChannelNotFound(fmt.Sprintf("unknown channel %s", utils.HPex(msg.ChannelIdentifier)))
 	}
 	ch := graph.GetPartenerAddress2Channel(msg.Sender)
 	if ch == nil {
 		return rerr.ChannelNotFound(fmt.Sprintf("token:%s,partner:%s", utils.APex2(token), utils.APex2(msg.Sender)))
 	}
 	if ch.State != channeltype.StateWithdraw {
-		return fmt.Errorf("receive WithdrawResponse request but channel state is %s", ch.State)
+		return rerr.ErrUnsolicitedMessage.Errorf("receive WithdrawResponse request but channel state is %s", ch.State)
 	}
 	// 错误的response处理放在通道状态校验之后,过滤掉不是自己发起的WithdrawRequest的response
 	if msg.ErrorCode != rerr.ErrSuccess.ErrorCode {
@@ -156,7 +156,7 @@ func (a *API) GetOneChannel(channelIdentifier string) (result string) {
 		result = dto.NewErrorMobileResponse(err)
 		return
 	}
-	result = dto.NewSuccessMobileResponse(channeltype.ChannelSerialization2ChannelDataDetail(c))
+	result = dto.NewSuccessMobileResponse(a.api.Photon.ChannelDataDetail(c))
 	return
 }
 
@@ -220,7 +220,7 @@ func (a *API) deposit(partnerAddress, tokenAddress string, settleTimeout int, ba
 		return
 	}
 	if c != nil {
-		channel = channeltype.ChannelSerialization2ChannelDataDetail(c)
+		channel = a.api.Photon.ChannelDataDetail(c)
 	}
 	return
 }
@@ -280,7 +280,7 @@ func (a *API) closeChannel(channelIdentifier string, force bool) (channel *chann
 			return
 		}
 	}
-	channel = channeltype.ChannelSerialization2ChannelDataDetail(c)
+	channel = a.api.Photon.ChannelDataDetail(c)
 	return
 }
 
@@ -350,7 +350,7 @@ func (a *API) settleChannel(channelIdentifier string) (channel *channeltype.Chan
 		log.Error(err.Error())
 		return
 	}
-	channel = channeltype.ChannelSerialization2ChannelDataDetail(c)
+	channel = a.api.Photon.ChannelDataDetail(c)
 	return
 }
 
@@ -518,7 +518,7 @@ func (a *API) Transfers(tokenAddress, targetAddress string, amountstr string, se
 			return dto.NewErrorMobileResponse(err)
 		}
 	}
-	tr, err := a.api.TransferAsync(tokenAddr, amount, targetAddr, secret, isDirect, data, routeInfo)
+	tr, err := a.api.TransferAsync(tokenAddr, amount, targetAddr, secret, isDirect, data, routeInfo, nil)
 	if err != nil {
 		log.Error(err.Error())
 		return dto.NewErrorMobileResponse(err)
@@ -940,7 +940,7 @@ func (a *API) withdraw(channelIdentifierHashStr, amountStr, op string) (channel
 			return
 		}
 	}
-	channel = channeltype.ChannelSerialization2ChannelDataDetail(c)
+	channel = a.api.Photon.ChannelDataDetail(c)
 	return
 }
 
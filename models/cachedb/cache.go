@@ -0,0 +1,97 @@
+package cachedb
+
+import (
+	"sync"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+/*
+lruCache keeps at most `size` values, and never keeps a value older than the db.
+A key being written is not cached until the write finishes,
+and a value loaded from db is dropped if the key is written meanwhile.
+*/
+type lruCache struct {
+	lock sync.Mutex
+	lru  *simplelru.LRU
+	//writes in progress of each key
+	writing map[interface{}]int
+	//keys written concurrently, which one is the last in db is unknown
+	conflicts map[interface{}]bool
+	//key -> token of the latest loader, which may cache the loaded value
+	loading   map[interface{}]uint64
+	nextToken uint64
+}
+
+func newLRUCache(size int) *lruCache {
+	lru, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		panic(err)
+	}
+	return &lruCache{
+		lru:       lru,
+		writing:   make(map[interface{}]int),
+		conflicts: make(map[interface{}]bool),
+		loading:   make(map[interface{}]uint64),
+	}
+}
+
+/*
+get returns the cached value, if not found, the caller should load it from db,
+then call load with the returned token.
+*/
+func (c *lruCache) get(key interface{}) (value interface{}, ok bool, token uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	value, ok = c.lru.Get(key)
+	if ok {
+		return
+	}
+	if c.writing[key] > 0 {
+		return
+	}
+	c.nextToken++
+	token = c.nextToken
+	c.loading[key] = token
+	return
+}
+
+//load caches `value` loaded from db if `found` and no write happened since get
+func (c *lruCache) load(key interface{}, token uint64, value interface{}, found bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if token == 0 || c.loading[key] != token {
+		return
+	}
+	delete(c.loading, key)
+	if found {
+		c.lru.Add(key, value)
+	}
+}
+
+//beginWrite must be called before writing `key` to db
+func (c *lruCache) beginWrite(key interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lru.Remove(key)
+	delete(c.loading, key)
+	if c.writing[key] > 0 {
+		c.conflicts[key] = true
+	}
+	c.writing[key]++
+}
+
+//endWrite caches `value` if `ok` and no other write of `key` is in progress
+func (c *lruCache) endWrite(key interface{}, value interface{}, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writing[key]--
+	if c.writing[key] > 0 {
+		return
+	}
+	delete(c.writing, key)
+	if ok && !c.conflicts[key] {
+		c.lru.Add(key, value)
+	}
+	delete(c.conflicts, key)
+}
@@ -0,0 +1,333 @@
+package cachedb
+
+import (
+	"math/big"
+
+	"github.com/SmartMeshFoundation/Photon/channel/channeltype"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/transfer"
+	"github.com/SmartMeshFoundation/Photon/transfer/mtree"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+CachedDB decorates a models.Dao with caches of channels, acks and removed or unlocked locks,
+which are read again and again when handling every message.
+Writes go to the db first, then the cache, so the db is always the truth.
+Callbacks are registered to and called by the decorated db,
+a callback reading the written channel gets it from db.
+Other methods are passed to the decorated db directly.
+*/
+type CachedDB struct {
+	models.Dao
+	//channel identifier -> *channeltype.Serialization
+	channels *lruCache
+	//echo hash -> ack, nil if not acked
+	acks *lruCache
+	//lock key -> removed
+	removedLocks *lruCache
+	//lock key -> unlocked
+	unlockedLocks *lruCache
+}
+
+//New cache at most `size` items of each kind for `dao`
+func New(dao models.Dao, size int) *CachedDB {
+	return &CachedDB{
+		Dao:           dao,
+		channels:      newLRUCache(size),
+		acks:          newLRUCache(size),
+		removedLocks:  newLRUCache(size),
+		unlockedLocks: newLRUCache(size),
+	}
+}
+
+/*
+copyChannel a caller may change fields of the channel it gets or writes,
+even the big.Ints in place, which must not change the cached one.
+So everything reachable by a pointer is copied.
+*/
+func copyChannel(c *channeltype.Serialization) *channeltype.Serialization {
+	c2 := *c
+	if c.ChannelIdentifier != nil {
+		id := *c.ChannelIdentifier
+		c2.ChannelIdentifier = &id
+	}
+	c2.Key = copyBytes(c.Key)
+	c2.TokenAddressBytes = copyBytes(c.TokenAddressBytes)
+	c2.PartnerAddressBytes = copyBytes(c.PartnerAddressBytes)
+	c2.OurBalanceProof = copyBalanceProof(c.OurBalanceProof)
+	c2.PartnerBalanceProof = copyBalanceProof(c.PartnerBalanceProof)
+	c2.OurLeaves = copyLeaves(c.OurLeaves)
+	c2.PartnerLeaves = copyLeaves(c.PartnerLeaves)
+	c2.OurKnownSecrets = copyKnownSecrets(c.OurKnownSecrets)
+	c2.PartnerKnownSecrets = copyKnownSecrets(c.PartnerKnownSecrets)
+	c2.OurContractBalance = copyBigInt(c.OurContractBalance)
+	c2.PartnerContractBalance = copyBigInt(c.PartnerContractBalance)
+	return &c2
+}
+
+func copyBigInt(i *big.Int) *big.Int {
+	if i == nil {
+		return nil
+	}
+	return new(big.Int).Set(i)
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func copyBalanceProof(bp *transfer.BalanceProofState) *transfer.BalanceProofState {
+	if bp == nil {
+		return nil
+	}
+	bp2 := *bp
+	bp2.TransferAmount = copyBigInt(bp.TransferAmount)
+	bp2.ContractTransferAmount = copyBigInt(bp.ContractTransferAmount)
+	bp2.Signature = copyBytes(bp.Signature)
+	return &bp2
+}
+
+func copyLeaves(leaves []*mtree.Lock) []*mtree.Lock {
+	if leaves == nil {
+		return nil
+	}
+	leaves2 := make([]*mtree.Lock, len(leaves))
+	for i, l := range leaves {
+		if l == nil {
+			continue
+		}
+		l2 := *l
+		l2.Amount = copyBigInt(l.Amount)
+		leaves2[i] = &l2
+	}
+	return leaves2
+}
+
+func copyKnownSecrets(secrets []*channeltype.KnownSecret) []*channeltype.KnownSecret {
+	if secrets == nil {
+		return nil
+	}
+	secrets2 := make([]*channeltype.KnownSecret, len(secrets))
+	for i, s := range secrets {
+		if s == nil {
+			continue
+		}
+		s2 := *s
+		secrets2[i] = &s2
+	}
+	return secrets2
+}
+
+func channelKey(c *channeltype.Serialization) common.Hash {
+	return common.BytesToHash(c.Key)
+}
+
+//GetChannelByAddress return a channel queried by channel address
+func (db *CachedDB) GetChannelByAddress(channelIdentifier common.Hash) (c *channeltype.Serialization, err error) {
+	v, ok, token := db.channels.get(channelIdentifier)
+	if ok {
+		return copyChannel(v.(*channeltype.Serialization)), nil
+	}
+	c, err = db.Dao.GetChannelByAddress(channelIdentifier)
+	if err != nil {
+		db.channels.load(channelIdentifier, token, nil, false)
+		return
+	}
+	db.channels.load(channelIdentifier, token, copyChannel(c), true)
+	return
+}
+
+//updateChannel writes channel `c` with `write`
+func (db *CachedDB) updateChannel(c *channeltype.Serialization, write func() error) error {
+	key := channelKey(c)
+	db.channels.beginWrite(key)
+	err := write()
+	db.channels.endWrite(key, copyChannel(c), err == nil)
+	return err
+}
+
+// NewChannel save a just created channel to db
+func (db *CachedDB) NewChannel(c *channeltype.Serialization) error {
+	return db.updateChannel(c, func() error {
+		return db.Dao.NewChannel(c)
+	})
+}
+
+//UpdateChannelNoTx update channel status without a Tx
+func (db *CachedDB) UpdateChannelNoTx(c *channeltype.Serialization) error {
+	return db.updateChannel(c, func() error {
+		return db.Dao.UpdateChannelNoTx(c)
+	})
+}
+
+//UpdateChannelState update channel state ,close settle
+func (db *CachedDB) UpdateChannelState(c *channeltype.Serialization) error {
+	return db.updateChannel(c, func() error {
+		return db.Dao.UpdateChannelState(c)
+	})
+}
+
+//UpdateChannelContractBalance update channel balance
+func (db *CachedDB) UpdateChannelContractBalance(c *channeltype.Serialization) error {
+	return db.updateChannel(c, func() error {
+		return db.Dao.UpdateChannelContractBalance(c)
+	})
+}
+
+//UpdateChannelAndSaveAck update channel and save ack, must atomic
+func (db *CachedDB) UpdateChannelAndSaveAck(c *channeltype.Serialization, echoHash common.Hash, ack []byte) (err error) {
+	db.acks.beginWrite(echoHash)
+	err = db.updateChannel(c, func() error {
+		return db.Dao.UpdateChannelAndSaveAck(c, echoHash, ack)
+	})
+	db.acks.endWrite(echoHash, ack, err == nil)
+	return
+}
+
+//RemoveChannel a settled channel from db
+func (db *CachedDB) RemoveChannel(c *channeltype.Serialization) error {
+	key := channelKey(c)
+	db.channels.beginWrite(key)
+	err := db.Dao.RemoveChannel(c)
+	db.channels.endWrite(key, nil, false)
+	return err
+}
+
+//UpdateChannel update channel status in a Tx, it's cached when `tx` is committed
+func (db *CachedDB) UpdateChannel(c *channeltype.Serialization, tx models.TX) error {
+	ctx, ok := tx.(*cachedTx)
+	if !ok {
+		//not started by me, just forget it
+		key := channelKey(c)
+		db.channels.beginWrite(key)
+		err := db.Dao.UpdateChannel(c, tx)
+		db.channels.endWrite(key, nil, false)
+		return err
+	}
+	ctx.write(db.channels, channelKey(c), copyChannel(c))
+	return db.Dao.UpdateChannel(c, ctx.TX)
+}
+
+//GetAck get message related ack message
+func (db *CachedDB) GetAck(echoHash common.Hash) []byte {
+	v, ok, token := db.acks.get(echoHash)
+	if ok {
+		return v.([]byte)
+	}
+	ack := db.Dao.GetAck(echoHash)
+	db.acks.load(echoHash, token, ack, true)
+	return ack
+}
+
+//SaveAck save a new ack to db, it's cached when `tx` is committed
+func (db *CachedDB) SaveAck(echoHash common.Hash, ack []byte, tx models.TX) {
+	ctx, ok := tx.(*cachedTx)
+	if !ok {
+		db.acks.beginWrite(echoHash)
+		db.Dao.SaveAck(echoHash, ack, tx)
+		db.acks.endWrite(echoHash, nil, false)
+		return
+	}
+	ctx.write(db.acks, echoHash, ack)
+	db.Dao.SaveAck(echoHash, ack, ctx.TX)
+}
+
+//SaveAckNoTx save a ack to db
+func (db *CachedDB) SaveAckNoTx(echoHash common.Hash, ack []byte) {
+	db.acks.beginWrite(echoHash)
+	db.Dao.SaveAckNoTx(echoHash, ack)
+	//errors are only logged, so don't trust it
+	db.acks.endWrite(echoHash, nil, false)
+}
+
+func lockKey(channelIdentifier common.Hash, sender common.Address, lockHash common.Hash) common.Hash {
+	return utils.Sha3(channelIdentifier[:], lockHash[:], sender[:])
+}
+
+//IsThisLockHasUnlocked return ture when  lockhash has been unlocked on channel
+func (db *CachedDB) IsThisLockHasUnlocked(channelIdentifier common.Hash, lockHash common.Hash) bool {
+	key := lockKey(channelIdentifier, utils.EmptyAddress, lockHash)
+	v, ok, token := db.unlockedLocks.get(key)
+	if ok {
+		return v.(bool)
+	}
+	unlocked := db.Dao.IsThisLockHasUnlocked(channelIdentifier, lockHash)
+	db.unlockedLocks.load(key, token, unlocked, true)
+	return unlocked
+}
+
+//UnlockThisLock marks that I have withdrawed this secret on channel.
+func (db *CachedDB) UnlockThisLock(channelIdentifier common.Hash, lockHash common.Hash) {
+	key := lockKey(channelIdentifier, utils.EmptyAddress, lockHash)
+	db.unlockedLocks.beginWrite(key)
+	db.Dao.UnlockThisLock(channelIdentifier, lockHash)
+	db.unlockedLocks.endWrite(key, nil, false)
+}
+
+//IsThisLockRemoved return true when  a expired hashlock has been removed from channel status.
+func (db *CachedDB) IsThisLockRemoved(channelIdentifier common.Hash, sender common.Address, lockHash common.Hash) bool {
+	key := lockKey(channelIdentifier, sender, lockHash)
+	v, ok, token := db.removedLocks.get(key)
+	if ok {
+		return v.(bool)
+	}
+	removed := db.Dao.IsThisLockRemoved(channelIdentifier, sender, lockHash)
+	db.removedLocks.load(key, token, removed, true)
+	return removed
+}
+
+//RemoveLock remember this lock has been removed from channel status.
+func (db *CachedDB) RemoveLock(channelIdentifier common.Hash, sender common.Address, lockHash common.Hash) {
+	key := lockKey(channelIdentifier, sender, lockHash)
+	db.removedLocks.beginWrite(key)
+	db.Dao.RemoveLock(channelIdentifier, sender, lockHash)
+	db.removedLocks.endWrite(key, nil, false)
+}
+
+//StartTx start a new transaction, what's written in it is cached after commit
+func (db *CachedDB) StartTx() (tx models.TX) {
+	return &cachedTx{TX: db.Dao.StartTx()}
+}
+
+type cachedWrite struct {
+	cache *lruCache
+	key   interface{}
+	value interface{}
+}
+
+//cachedTx caches values written in it only after commit
+type cachedTx struct {
+	models.TX
+	writes []*cachedWrite
+}
+
+func (tx *cachedTx) write(cache *lruCache, key, value interface{}) {
+	cache.beginWrite(key)
+	tx.writes = append(tx.writes, &cachedWrite{cache, key, value})
+}
+
+func (tx *cachedTx) end(ok bool) {
+	for _, w := range tx.writes {
+		w.cache.endWrite(w.key, w.value, ok)
+	}
+	tx.writes = nil
+}
+
+//Commit is models.TX
+func (tx *cachedTx) Commit() error {
+	err := tx.TX.Commit()
+	tx.end(err == nil)
+	return err
+}
+
+//Rollback is models.TX
+func (tx *cachedTx) Rollback() error {
+	err := tx.TX.Rollback()
+	tx.end(false)
+	return err
+}
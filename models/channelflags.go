@@ -0,0 +1,16 @@
+package models
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ChannelFlags :
+// 操作员对单个通道的设置,没有记录时所有的开关都是关闭的
+type ChannelFlags struct {
+	ChannelIdentifier   common.Hash `json:"channel_identifier" storm:"id"`
+	NoPfsSubmit         bool        `json:"no_pfs_submit"`         // 不向pfs提交这个通道的balance proof
+	NoAutoSettle        bool        `json:"no_auto_settle"`        // settle时间到了以后不自动settle
+	NoOutboundMediation bool        `json:"no_outbound_mediation"` // 不通过这个通道转发别人的交易,自己发起的交易不受影响
+	NoInboundMediation  bool        `json:"no_inbound_mediation"`  // 拒绝从这个通道收到的需要我转发的交易
+	NoReceive           bool        `json:"no_receive"`            // 拒绝从这个通道收到的给我的交易
+}
@@ -52,6 +52,11 @@ const (
 	BucketTXInfo                   = "TXInfo"
 	BucketSentTransferDetail       = "SentTransferDetail"
 	BucketChainEventRecord         = "ChainEventRecord"
+	BucketPeerBan                  = "PeerBan"
+	BucketEdgeStat                 = "EdgeStat"
+	BucketChannelFlags             = "ChannelFlags"
+	BucketJitTransfer              = "JitTransfer"
+	BucketTCPAnnouncement          = "TCPAnnouncement"
 )
 
 /*
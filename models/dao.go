@@ -174,6 +174,40 @@ type XMPPSubDao interface {
 	XMPPUnMarkAddr(addr common.Address)
 }
 
+// ChannelFlagsDao :
+type ChannelFlagsDao interface {
+	SaveChannelFlags(f *ChannelFlags) error
+	RemoveChannelFlags(channelIdentifier common.Hash) error
+	GetAllChannelFlags() (flags []*ChannelFlags, err error)
+}
+
+// JitTransferDao :
+type JitTransferDao interface {
+	SaveJitTransfer(t *JitTransfer) error
+	RemoveJitTransfer(key common.Hash) error
+	GetAllJitTransfers() (transfers []*JitTransfer, err error)
+}
+
+// PeerBanDao :
+type PeerBanDao interface {
+	SavePeerBan(b *PeerBan) error
+	RemovePeerBan(addr common.Address) error
+	GetAllPeerBans() (bans []*PeerBan, err error)
+}
+
+// TCPAnnouncementDao :
+type TCPAnnouncementDao interface {
+	SaveTCPAnnouncement(a *TCPAnnouncement) error
+	GetAllTCPAnnouncements() (anns []*TCPAnnouncement, err error)
+}
+
+// EdgeStatDao :
+type EdgeStatDao interface {
+	SaveEdgeStat(e *EdgeStat) error
+	GetAllEdgeStats() (stats []*EdgeStat, err error)
+	RemoveAllEdgeStats() error
+}
+
 // TXInfoDao :
 type TXInfoDao interface {
 	NewPendingTXInfo(tx *types.Transaction, txType TXInfoType, channelIdentifier common.Hash, openBlockNumber int64, txParams TXParams) (txInfo *TXInfo, err error)
@@ -210,6 +244,11 @@ type Dao interface {
 	TokenDao
 	ReceivedTransferDao
 	XMPPSubDao
+	PeerBanDao
+	TCPAnnouncementDao
+	EdgeStatDao
+	ChannelFlagsDao
+	JitTransferDao
 	TXInfoDao
 	SentTransferDetailDao
 	ChainEventRecordDao
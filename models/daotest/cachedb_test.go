@@ -0,0 +1,220 @@
+package daotest
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon/channel/channeltype"
+	"github.com/SmartMeshFoundation/Photon/codefortest"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/models/cachedb"
+	"github.com/SmartMeshFoundation/Photon/network/rpc/contracts"
+	"github.com/SmartMeshFoundation/Photon/transfer"
+	"github.com/SmartMeshFoundation/Photon/transfer/mtree"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+TestMain runs all tests with stormdb, then again with cachedb over it.
+If PHOTON_DB is set, all tests run only once with it.
+*/
+func TestMain(m *testing.M) {
+	if os.Getenv("PHOTON_DB") != "" {
+		os.Exit(m.Run())
+	}
+	code := m.Run()
+	err := os.Setenv("PHOTON_DB", "cache")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("run all tests again with PHOTON_DB=cache")
+	if code2 := m.Run(); code == 0 {
+		code = code2
+	}
+	os.Exit(code)
+}
+
+func newTestChannel() *channeltype.Serialization {
+	h := utils.NewRandomHash()
+	token := utils.NewRandomAddress()
+	partner := utils.NewRandomAddress()
+	return &channeltype.Serialization{
+		ChannelIdentifier: &contracts.ChannelUniqueID{
+			ChannelIdentifier: h,
+			OpenBlockNumber:   3,
+		},
+		Key:                 h[:],
+		TokenAddressBytes:   token[:],
+		PartnerAddressBytes: partner[:],
+		State:               channeltype.StateOpened,
+		OurBalanceProof: &transfer.BalanceProofState{
+			TransferAmount:         big.NewInt(10),
+			ContractTransferAmount: big.NewInt(0),
+		},
+		PartnerBalanceProof:    transfer.NewEmptyBalanceProofState(),
+		OurLeaves:              []*mtree.Lock{{Expiration: 30, Amount: big.NewInt(10), LockSecretHash: h}},
+		OurContractBalance:     big.NewInt(10),
+		PartnerContractBalance: big.NewInt(0),
+	}
+}
+
+func newCachedTestDB() (db models.Dao, close func()) {
+	dao := codefortest.NewTestDB("")
+	if _, ok := dao.(*cachedb.CachedDB); ok {
+		return dao, dao.CloseDB
+	}
+	return cachedb.New(dao, 100), dao.CloseDB
+}
+
+func TestCachedDBChannel(t *testing.T) {
+	dao, closeDB := newCachedTestDB()
+	defer closeDB()
+	c := newTestChannel()
+	var states []int
+	dao.RegisterChannelStateCallback(func(c2 *channeltype.Serialization) bool {
+		//a callback reads what is just written
+		c3, err := dao.GetChannelByAddress(c.ChannelIdentifier.ChannelIdentifier)
+		assert.Nil(t, err)
+		states = append(states, int(c3.State))
+		return false
+	})
+	err := dao.NewChannel(c)
+	assert.Nil(t, err)
+	c2, err := dao.GetChannelByAddress(c.ChannelIdentifier.ChannelIdentifier)
+	assert.Nil(t, err)
+	assert.EqualValues(t, channeltype.StateOpened, c2.State)
+	//change what I get doesn't change the cache
+	c2.State = channeltype.StateClosed
+	c2.OurContractBalance.SetInt64(100)
+	c2.OurBalanceProof.TransferAmount.SetInt64(100)
+	c2.OurLeaves[0].Amount.SetInt64(100)
+	c2, err = dao.GetChannelByAddress(c.ChannelIdentifier.ChannelIdentifier)
+	assert.Nil(t, err)
+	assert.EqualValues(t, channeltype.StateOpened, c2.State)
+	assert.EqualValues(t, big.NewInt(10), c2.OurContractBalance)
+	assert.EqualValues(t, big.NewInt(10), c2.OurBalanceProof.TransferAmount)
+	assert.EqualValues(t, big.NewInt(10), c2.OurLeaves[0].Amount)
+	//change what I wrote doesn't change the cache either
+	c.OurContractBalance.SetInt64(100)
+	c2, err = dao.GetChannelByAddress(c.ChannelIdentifier.ChannelIdentifier)
+	assert.Nil(t, err)
+	assert.EqualValues(t, big.NewInt(10), c2.OurContractBalance)
+	c.OurContractBalance.SetInt64(10)
+	c.State = channeltype.StateClosed
+	err = dao.UpdateChannelState(c)
+	assert.Nil(t, err)
+	assert.EqualValues(t, []int{int(channeltype.StateClosed)}, states)
+	c2, err = dao.GetChannelByAddress(c.ChannelIdentifier.ChannelIdentifier)
+	assert.Nil(t, err)
+	assert.EqualValues(t, channeltype.StateClosed, c2.State)
+	c.State = channeltype.StateSettled
+	err = dao.RemoveChannel(c)
+	assert.Nil(t, err)
+	_, err = dao.GetChannelByAddress(c.ChannelIdentifier.ChannelIdentifier)
+	assert.NotNil(t, err)
+}
+
+func TestCachedDBTx(t *testing.T) {
+	dao, closeDB := newCachedTestDB()
+	defer closeDB()
+	c := newTestChannel()
+	err := dao.NewChannel(c)
+	assert.Nil(t, err)
+	echoHash := utils.NewRandomHash()
+	assert.Nil(t, dao.GetAck(echoHash))
+	//rolled back, nothing changed
+	tx := dao.StartTx()
+	c.State = channeltype.StateClosed
+	dao.SaveAck(echoHash, []byte{1}, tx)
+	err = dao.UpdateChannel(c, tx)
+	assert.Nil(t, err)
+	err = tx.Rollback()
+	assert.Nil(t, err)
+	assert.Nil(t, dao.GetAck(echoHash))
+	c2, err := dao.GetChannelByAddress(c.ChannelIdentifier.ChannelIdentifier)
+	assert.Nil(t, err)
+	assert.EqualValues(t, channeltype.StateOpened, c2.State)
+	//committed
+	tx = dao.StartTx()
+	dao.SaveAck(echoHash, []byte{1}, tx)
+	err = dao.UpdateChannel(c, tx)
+	assert.Nil(t, err)
+	err = tx.Commit()
+	assert.Nil(t, err)
+	assert.EqualValues(t, []byte{1}, dao.GetAck(echoHash))
+	c2, err = dao.GetChannelByAddress(c.ChannelIdentifier.ChannelIdentifier)
+	assert.Nil(t, err)
+	assert.EqualValues(t, channeltype.StateClosed, c2.State)
+	echoHash2 := utils.NewRandomHash()
+	assert.Nil(t, dao.GetAck(echoHash2))
+	err = dao.UpdateChannelAndSaveAck(c, echoHash2, []byte{2})
+	assert.Nil(t, err)
+	assert.EqualValues(t, []byte{2}, dao.GetAck(echoHash2))
+}
+
+func TestCachedDBLocks(t *testing.T) {
+	dao, closeDB := newCachedTestDB()
+	defer closeDB()
+	channelIdentifier := utils.NewRandomHash()
+	sender := utils.NewRandomAddress()
+	lockHash := utils.NewRandomHash()
+	assert.False(t, dao.IsThisLockRemoved(channelIdentifier, sender, lockHash))
+	dao.RemoveLock(channelIdentifier, sender, lockHash)
+	assert.True(t, dao.IsThisLockRemoved(channelIdentifier, sender, lockHash))
+	assert.False(t, dao.IsThisLockHasUnlocked(channelIdentifier, lockHash))
+	dao.UnlockThisLock(channelIdentifier, lockHash)
+	assert.True(t, dao.IsThisLockHasUnlocked(channelIdentifier, lockHash))
+}
+
+//benchmarkDao like handling a message, reads the channel, the ack and the lock, then saves the channel and the ack
+func benchmarkDao(b *testing.B, dao models.Dao) {
+	var channels []*channeltype.Serialization
+	for i := 0; i < 10; i++ {
+		c := newTestChannel()
+		err := dao.NewChannel(c)
+		if err != nil {
+			b.Fatal(err)
+		}
+		channels = append(channels, c)
+	}
+	sender := utils.NewRandomAddress()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := channels[i%len(channels)]
+		echoHash := utils.NewRandomHash()
+		_, err := dao.GetChannelByAddress(c.ChannelIdentifier.ChannelIdentifier)
+		if err != nil {
+			b.Fatal(err)
+		}
+		dao.GetAck(echoHash)
+		dao.IsThisLockRemoved(c.ChannelIdentifier.ChannelIdentifier, sender, echoHash)
+		for j := 0; j < 10; j++ {
+			_, err = dao.GetChannelByAddress(c.ChannelIdentifier.ChannelIdentifier)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		err = dao.UpdateChannelAndSaveAck(c, echoHash, echoHash[:])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStormDB(b *testing.B) {
+	dao := codefortest.NewTestDB("")
+	if _, ok := dao.(*cachedb.CachedDB); ok {
+		b.Skip("PHOTON_DB is cache")
+	}
+	defer dao.CloseDB()
+	benchmarkDao(b, dao)
+}
+
+func BenchmarkCachedDB(b *testing.B) {
+	dao, closeDB := newCachedTestDB()
+	defer closeDB()
+	benchmarkDao(b, dao)
+}
@@ -0,0 +1,52 @@
+package daotest
+
+import (
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon/codefortest"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_ChannelFlags(t *testing.T) {
+	dao := codefortest.NewTestDB("")
+	defer dao.CloseDB()
+	flags, err := dao.GetAllChannelFlags()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 0, len(flags))
+	f := &models.ChannelFlags{
+		ChannelIdentifier: utils.NewRandomHash(),
+		NoPfsSubmit:       true,
+		NoAutoSettle:      true,
+		NoReceive:         true,
+	}
+	err = dao.SaveChannelFlags(f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	flags, err = dao.GetAllChannelFlags()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 1, len(flags))
+	assert.EqualValues(t, f, flags[0])
+	err = dao.RemoveChannelFlags(f.ChannelIdentifier)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	flags, err = dao.GetAllChannelFlags()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 0, len(flags))
+	err = dao.RemoveChannelFlags(f.ChannelIdentifier)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,69 @@
+package daotest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/codefortest"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_EdgeStat(t *testing.T) {
+	dao := codefortest.NewTestDB("")
+	defer dao.CloseDB()
+	//remove when there is nothing
+	err := dao.RemoveAllEdgeStats()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	stats, err := dao.GetAllEdgeStats()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 0, len(stats))
+	token, from, to := utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress()
+	e := &models.EdgeStat{
+		Key:         models.EdgeStatKey(token, from, to),
+		Token:       token,
+		From:        from,
+		To:          to,
+		Failures:    1,
+		LastFailure: "insufficient balance",
+		UpdatedAt:   time.Now().Unix(),
+	}
+	err = dao.SaveEdgeStat(e)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	//save again when updated
+	e.Successes = 2
+	err = dao.SaveEdgeStat(e)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	stats, err = dao.GetAllEdgeStats()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 1, len(stats))
+	assert.EqualValues(t, e, stats[0])
+	assert.EqualValues(t, 0.75, stats[0].SuccessProbability())
+	err = dao.RemoveAllEdgeStats()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	stats, err = dao.GetAllEdgeStats()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 0, len(stats))
+}
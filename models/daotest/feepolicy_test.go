@@ -6,6 +6,9 @@ import (
 	"math/big"
 
 	"github.com/SmartMeshFoundation/Photon/codefortest"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestModelDB_FeePolicy(t *testing.T) {
@@ -17,13 +20,13 @@ func TestModelDB_FeePolicy(t *testing.T) {
 		t.Error("wrong fee constant")
 		return
 	}
-	if defaultFp.AccountFee.FeePercent != 10000 {
+	if defaultFp.AccountFee.FeeRate != 100 {
 		t.Error("wrong fee rate")
 		return
 	}
 
 	defaultFp.AccountFee.FeeConstant = big.NewInt(5)
-	defaultFp.AccountFee.FeePercent = 50000
+	defaultFp.AccountFee.FeeRate = 20
 
 	err := dao.SaveFeePolicy(defaultFp)
 	if err != nil {
@@ -35,8 +38,51 @@ func TestModelDB_FeePolicy(t *testing.T) {
 		t.Error("wrong fee constant")
 		return
 	}
-	if defaultFp.AccountFee.FeePercent != 50000 {
+	if defaultFp.AccountFee.FeeRate != 20 {
 		t.Error("wrong fee rate")
 		return
 	}
 }
+
+func TestModelDB_FeePolicyUpgrade(t *testing.T) {
+	dao := codefortest.NewTestDB("")
+	defer dao.CloseDB()
+
+	// 旧版本保存的FeePercent
+	fp := models.NewDefaultFeePolicy()
+	fp.AccountFee = &models.FeeSetting{
+		FeeConstant: big.NewInt(5),
+		FeePercent:  10000,
+	}
+	token := utils.NewRandomAddress()
+	fp.TokenFeeMap[token] = &models.FeeSetting{
+		FeeConstant: big.NewInt(0),
+		FeePercent:  400,
+	}
+	err := dao.SaveFeePolicy(fp)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fp = dao.GetFeePolicy()
+	assert.EqualValues(t, 0, fp.AccountFee.FeePercent)
+	assert.EqualValues(t, 100, fp.AccountFee.FeeRate)
+	assert.EqualValues(t, 5, fp.AccountFee.FeeConstant.Int64())
+	assert.EqualValues(t, 2500, fp.TokenFeeMap[token].FeeRate)
+	assert.False(t, fp.Upgrade())
+
+	// 不能精确转换的保留FeePercent
+	fp.AccountFee = &models.FeeSetting{
+		FeeConstant: big.NewInt(0),
+		FeePercent:  3000000,
+	}
+	err = dao.SaveFeePolicy(fp)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fp = dao.GetFeePolicy()
+	assert.EqualValues(t, 3000000, fp.AccountFee.FeePercent)
+	assert.EqualValues(t, 0, fp.AccountFee.FeeRate)
+	assert.EqualValues(t, 2, fp.AccountFee.CalculateFee(big.NewInt(6000000)).Int64())
+}
@@ -0,0 +1,53 @@
+package daotest
+
+import (
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon/codefortest"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_JitTransfer(t *testing.T) {
+	dao := codefortest.NewTestDB("")
+	defer dao.CloseDB()
+	transfers, err := dao.GetAllJitTransfers()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 0, len(transfers))
+	jt := &models.JitTransfer{
+		Key:            utils.NewRandomHash(),
+		LockSecretHash: utils.NewRandomHash(),
+		Token:          utils.NewRandomAddress(),
+		Payer:          utils.NewRandomAddress(),
+		ErrorKey:       utils.NewRandomHash(),
+	}
+	err = dao.SaveJitTransfer(jt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	transfers, err = dao.GetAllJitTransfers()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 1, len(transfers))
+	assert.EqualValues(t, jt, transfers[0])
+	err = dao.RemoveJitTransfer(jt.Key)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	transfers, err = dao.GetAllJitTransfers()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 0, len(transfers))
+	err = dao.RemoveJitTransfer(jt.Key)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,62 @@
+package daotest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/codefortest"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_PeerBan(t *testing.T) {
+	dao := codefortest.NewTestDB("")
+	defer dao.CloseDB()
+	bans, err := dao.GetAllPeerBans()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 0, len(bans))
+	b := &models.PeerBan{
+		Address:  utils.NewRandomAddress(),
+		Reason:   "invalid nonce",
+		Score:    101,
+		BannedAt: time.Now().Unix(),
+		Until:    time.Now().Add(time.Hour).Unix(),
+	}
+	err = dao.SavePeerBan(b)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	//save again when ban is renewed
+	b.Until++
+	err = dao.SavePeerBan(b)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	bans, err = dao.GetAllPeerBans()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 1, len(bans))
+	assert.EqualValues(t, b, bans[0])
+	err = dao.RemovePeerBan(b.Address)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	bans, err = dao.GetAllPeerBans()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 0, len(bans))
+	//remove a peer which isn't banned
+	err = dao.RemovePeerBan(b.Address)
+	assert.Nil(t, err)
+}
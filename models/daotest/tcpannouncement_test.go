@@ -0,0 +1,48 @@
+package daotest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/codefortest"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelDB_TCPAnnouncement(t *testing.T) {
+	dao := codefortest.NewTestDB("")
+	defer dao.CloseDB()
+	anns, err := dao.GetAllTCPAnnouncements()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 0, len(anns))
+	a := &models.TCPAnnouncement{
+		Address:   utils.NewRandomAddress(),
+		HostPort:  "1.2.3.4:5",
+		Timestamp: time.Now().Unix(),
+		Signature: []byte("signature"),
+	}
+	err = dao.SaveTCPAnnouncement(a)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	//a newer one replaces the old one
+	a.HostPort = "1.2.3.4:6"
+	a.Timestamp++
+	err = dao.SaveTCPAnnouncement(a)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	anns, err = dao.GetAllTCPAnnouncements()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.EqualValues(t, 1, len(anns))
+	assert.EqualValues(t, a, anns[0])
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// EdgeStat :
+// 我发起的交易在某个token上经过From到To这个方向的通道的结果,用来估计再次经过它的成功率
+type EdgeStat struct {
+	Key         string         `json:"-" storm:"id"`
+	Token       common.Address `json:"token"`
+	From        common.Address `json:"from"`
+	To          common.Address `json:"to"`
+	Successes   float64        `json:"successes"`
+	Failures    float64        `json:"failures"`
+	LastFailure string         `json:"last_failure,omitempty"`
+	UpdatedAt   int64          `json:"updated_at"` // 时间戳,time.Unix()
+}
+
+// EdgeStatKey :
+func EdgeStatKey(token, from, to common.Address) string {
+	return token.Hex() + from.Hex() + to.Hex()
+}
+
+// SuccessProbability 从没失败过的通道是1,每次失败都会降低,成功会让它恢复
+func (e *EdgeStat) SuccessProbability() float64 {
+	return (e.Successes + 1) / (e.Successes + e.Failures + 1)
+}
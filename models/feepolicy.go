@@ -1,6 +1,7 @@
 package models
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
 
@@ -15,17 +16,67 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 )
 
+//FeeRateDenominator 费率都是交易金额的百万分之几
+const FeeRateDenominator = 1000000
+
+// FeeTier :
+// 交易金额不小于MinAmount时,使用该档的FeeConstant和FeeRate代替FeeSetting中的
+type FeeTier struct {
+	MinAmount   *big.Int `json:"min_amount"`
+	FeeConstant *big.Int `json:"fee_constant"`
+	FeeRate     int64    `json:"fee_rate"`
+}
+
 // FeeSetting :
 // 其中FeeConstant为固定费率,比如5代表手续费固定部分为5个token,设置为0即不收费
-// FeePercent为比例费率,计算方式为 交易金额/FeePercent,比如交易金额50000,FeePercent=10000,那么手续费比例部分=50000/10000=5,设置为0即不收费
-// 最终为手续费为固定收费+比例收费
+// FeeRate为比例费率,单位为百万分之一,比如FeeRate=1500即0.15%,交易金额50000的手续费比例部分=50000*1500/1000000=75,设置为0即不收费
+// Tiers 按MinAmount从小到大排列的分档费率,交易金额落在哪一档就用哪一档的固定费率和比例费率
+// MinFee,MaxFee 手续费的下限和上限,nil表示不限制
+// 最终为手续费为固定收费+比例收费,再限制在MinFee和MaxFee之间
+// FeePercent 旧版本的比例费率,计算方式为 交易金额/FeePercent,只在FeeRate为0时使用,能精确转换时会转换为FeeRate.
+// 提交给pfs时,能用旧版本格式表示的设置会填上FeePercent并按旧版本格式签名,旧版本的pfs也能使用
 type FeeSetting struct {
-	FeeConstant *big.Int `json:"fee_constant"`
-	FeePercent  int64    `json:"fee_percent"`
-	Signature   []byte   `json:"signature"` // used when set fee policy to pfs
+	FeeConstant *big.Int   `json:"fee_constant"`
+	FeePercent  int64      `json:"fee_percent"`
+	FeeRate     int64      `json:"fee_rate"`
+	Tiers       []*FeeTier `json:"tiers,omitempty"`
+	MinFee      *big.Int   `json:"min_fee,omitempty"`
+	MaxFee      *big.Int   `json:"max_fee,omitempty"`
+	Signature   []byte     `json:"signature"` // used when set fee policy to pfs
 }
 
-func (fs *FeeSetting) sign(key *ecdsa.PrivateKey) []byte {
+//writeSignedBigInt nil is 0, a sign byte goes before the 32 bytes absolute value
+func writeSignedBigInt(buf *bytes.Buffer, i *big.Int) {
+	if i == nil {
+		i = utils.BigInt0
+	}
+	if i.Sign() < 0 {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	buf.Write(utils.BigIntTo32Bytes(new(big.Int).Abs(i)))
+}
+
+/*
+LegacyFeePercent 用旧版本的FeePercent表示的比例费率,
+有分档,上下限或者FeeRate不能精确转换为FeePercent时返回false
+*/
+func (fs *FeeSetting) LegacyFeePercent() (feePercent int64, ok bool) {
+	if len(fs.Tiers) > 0 || fs.MinFee != nil || fs.MaxFee != nil {
+		return 0, false
+	}
+	if fs.FeeRate == 0 {
+		return fs.FeePercent, true
+	}
+	if fs.FeeRate < 0 || FeeRateDenominator%fs.FeeRate != 0 {
+		return 0, false
+	}
+	return FeeRateDenominator / fs.FeeRate, true
+}
+
+//legacySignData 旧版本的签名格式, FeePercent + FeeConstant
+func (fs *FeeSetting) legacySignData() []byte {
 	var err error
 	buf := new(bytes.Buffer)
 	err = binary.Write(buf, binary.BigEndian, fs.FeePercent)
@@ -33,19 +84,241 @@ func (fs *FeeSetting) sign(key *ecdsa.PrivateKey) []byte {
 	if err != nil {
 		log.Error(fmt.Sprintf("signData err %s", err))
 	}
-	fs.Signature, err = utils.SignData(key, buf.Bytes())
+	return buf.Bytes()
+}
+
+//isLegacy 能用旧版本格式表示并且FeePercent和FeeRate一致
+func (fs *FeeSetting) isLegacy() bool {
+	feePercent, ok := fs.LegacyFeePercent()
+	return ok && feePercent == fs.FeePercent
+}
+
+func (fs *FeeSetting) signData() []byte {
+	if fs.isLegacy() {
+		return fs.legacySignData()
+	}
+	var err error
+	buf := new(bytes.Buffer)
+	err = binary.Write(buf, binary.BigEndian, fs.FeeRate)
+	writeSignedBigInt(buf, fs.FeeConstant)
+	writeSignedBigInt(buf, fs.MinFee)
+	writeSignedBigInt(buf, fs.MaxFee)
+	for _, t := range fs.Tiers {
+		writeSignedBigInt(buf, t.MinAmount)
+		writeSignedBigInt(buf, t.FeeConstant)
+		err = binary.Write(buf, binary.BigEndian, t.FeeRate)
+	}
+	if err != nil {
+		log.Error(fmt.Sprintf("signData err %s", err))
+	}
+	return buf.Bytes()
+}
+
+//sign 能用旧版本格式表示的设置填上FeePercent,按旧版本格式签名
+func (fs *FeeSetting) sign(key *ecdsa.PrivateKey) []byte {
+	var err error
+	if feePercent, ok := fs.LegacyFeePercent(); ok {
+		fs.FeePercent = feePercent
+	}
+	fs.Signature, err = utils.SignData(key, fs.signData())
 	if err != nil {
 		log.Crit(fmt.Sprintf("signDataFor FeeSetting err %s", err))
 	}
 	return fs.Signature
 }
 
+//verifySignature 签名必须来自signer
+func verifySignature(data, signature []byte, signer common.Address) error {
+	addr, err := utils.Ecrecover(utils.Sha3(data), signature)
+	if err != nil {
+		return err
+	}
+	if addr != signer {
+		return fmt.Errorf("signature signed by %s,expect %s", addr.String(), signer.String())
+	}
+	return nil
+}
+
+//Validate FeeConstant和FeeRate不能为负,分档必须按MinAmount递增
+func (fs *FeeSetting) Validate() error {
+	if fs == nil {
+		return errors.New("FeeSetting can not be nil")
+	}
+	if fs.FeeConstant == nil || fs.FeeConstant.Sign() < 0 || fs.FeeRate < 0 || fs.FeePercent < 0 {
+		return errors.New("FeeConstant, FeeRate and FeePercent can not be negative")
+	}
+	if fs.MinFee != nil && fs.MaxFee != nil && fs.MinFee.Cmp(fs.MaxFee) > 0 {
+		return errors.New("MinFee can not be greater than MaxFee")
+	}
+	for i, t := range fs.Tiers {
+		if t == nil || t.MinAmount == nil || t.FeeConstant == nil || t.FeeConstant.Sign() < 0 || t.FeeRate < 0 {
+			return errors.New("fee tier must have MinAmount, FeeConstant and FeeRate can not be negative")
+		}
+		if i > 0 && t.MinAmount.Cmp(fs.Tiers[i-1].MinAmount) <= 0 {
+			return errors.New("fee tiers MinAmount must be increasing")
+		}
+	}
+	return nil
+}
+
+//CalculateFee 交易金额为amount时的手续费
+func (fs *FeeSetting) CalculateFee(amount *big.Int) *big.Int {
+	feeConstant, feeRate, feePercent := fs.FeeConstant, fs.FeeRate, fs.FeePercent
+	// 使用金额所在档的费率
+	for _, t := range fs.Tiers {
+		if amount.Cmp(t.MinAmount) < 0 {
+			break
+		}
+		feeConstant, feeRate, feePercent = t.FeeConstant, t.FeeRate, 0
+	}
+	fee := big.NewInt(0)
+	if feeRate > 0 {
+		fee = fee.Mul(amount, big.NewInt(feeRate))
+		fee = fee.Div(fee, big.NewInt(FeeRateDenominator))
+	} else if feePercent > 0 {
+		// 旧版本的比例费率
+		fee = fee.Div(amount, big.NewInt(feePercent))
+	}
+	if feeConstant != nil && feeConstant.Cmp(big.NewInt(0)) > 0 {
+		fee = fee.Add(fee, feeConstant)
+	}
+	if fs.MinFee != nil && fee.Cmp(fs.MinFee) < 0 {
+		fee = fee.Set(fs.MinFee)
+	}
+	if fs.MaxFee != nil && fee.Cmp(fs.MaxFee) > 0 {
+		fee = fee.Set(fs.MaxFee)
+	}
+	return fee
+}
+
+/*
+upgrade converts FeePercent to FeeRate if it's exact, returns true if changed.
+Otherwise FeePercent is kept and still used, so the fee never changes.
+*/
+func (fs *FeeSetting) upgrade() bool {
+	if fs == nil || fs.FeePercent <= 0 || fs.FeeRate != 0 || FeeRateDenominator%fs.FeePercent != 0 {
+		return false
+	}
+	fs.FeeRate = FeeRateDenominator / fs.FeePercent
+	fs.FeePercent = 0
+	return true
+}
+
+// ImbalanceFeePoint :
+// Ratio 付款方在通道中的余额占双方余额之和的百分比,0-100
+// FeeRate 该比例下的手续费为交易金额的百万分之FeeRate,可以为负,即给平衡通道的交易补贴
+type ImbalanceFeePoint struct {
+	Ratio   int64 `json:"ratio"`
+	FeeRate int64 `json:"fee_rate"`
+}
+
+// ImbalanceFeeSetting :
+// 在FeeSetting之外,根据转入和转出通道的余额比例动态调整的手续费,两个通道分别按付款方的余额比例计算后相加
+// 比如转出通道中我方余额很多,或者转入通道中对方余额很多,这笔交易会让通道更平衡,就应该少收甚至补贴
+// Curve 按Ratio从小到大排列,两点之间线性插值,小于第一个点或大于最后一个点时取端点的值
+// MinFee 最终手续费(包括FeeSetting部分)的下限,可以为负
+type ImbalanceFeeSetting struct {
+	Curve     []*ImbalanceFeePoint `json:"curve"`
+	MinFee    *big.Int             `json:"min_fee"`
+	Signature []byte               `json:"signature"` // used when set fee policy to pfs
+}
+
+func (is *ImbalanceFeeSetting) signData() []byte {
+	var err error
+	buf := new(bytes.Buffer)
+	for _, p := range is.Curve {
+		err = binary.Write(buf, binary.BigEndian, p.Ratio)
+		err = binary.Write(buf, binary.BigEndian, p.FeeRate)
+	}
+	writeSignedBigInt(buf, is.MinFee)
+	if err != nil {
+		log.Error(fmt.Sprintf("signData err %s", err))
+	}
+	return buf.Bytes()
+}
+
+func (is *ImbalanceFeeSetting) sign(key *ecdsa.PrivateKey) []byte {
+	var err error
+	is.Signature, err = utils.SignData(key, is.signData())
+	if err != nil {
+		log.Crit(fmt.Sprintf("signDataFor ImbalanceFeeSetting err %s", err))
+	}
+	return is.Signature
+}
+
+//Validate 曲线不能为空,Ratio必须在0-100之间并且递增
+func (is *ImbalanceFeeSetting) Validate() error {
+	if len(is.Curve) == 0 {
+		return errors.New("ImbalanceFee curve can not be empty")
+	}
+	if is.MinFee == nil {
+		return errors.New("ImbalanceFee MinFee can not be nil")
+	}
+	for i, p := range is.Curve {
+		if p == nil || p.Ratio < 0 || p.Ratio > 100 {
+			return errors.New("ImbalanceFee curve ratio must between 0 and 100")
+		}
+		if i > 0 && p.Ratio <= is.Curve[i-1].Ratio {
+			return errors.New("ImbalanceFee curve ratio must be increasing")
+		}
+	}
+	return nil
+}
+
+// FeeRate 付款方余额比例为ratio(万分之)时的费率
+func (is *ImbalanceFeeSetting) FeeRate(ratio int64) int64 {
+	curve := is.Curve
+	if len(curve) == 0 {
+		return 0
+	}
+	if ratio <= curve[0].Ratio*100 {
+		return curve[0].FeeRate
+	}
+	for i := 1; i < len(curve); i++ {
+		p0, p1 := curve[i-1], curve[i]
+		if ratio <= p1.Ratio*100 {
+			return p0.FeeRate + (p1.FeeRate-p0.FeeRate)*(ratio-p0.Ratio*100)/((p1.Ratio-p0.Ratio)*100)
+		}
+	}
+	return curve[len(curve)-1].FeeRate
+}
+
+/*
+AdjustFee 在fee的基础上加上动态手续费,outRatio和inRatio分别是转出通道和转入通道中付款方的余额比例(万分之),
+结果不低于MinFee
+*/
+func (is *ImbalanceFeeSetting) AdjustFee(fee, amount *big.Int, outRatio, inRatio int64) *big.Int {
+	rate := is.FeeRate(outRatio) + is.FeeRate(inRatio)
+	imbalanceFee := new(big.Int).Mul(amount, big.NewInt(rate))
+	imbalanceFee.Quo(imbalanceFee, big.NewInt(FeeRateDenominator))
+	fee = new(big.Int).Add(fee, imbalanceFee)
+	if fee.Cmp(is.MinFee) < 0 {
+		fee.Set(is.MinFee)
+	}
+	return fee
+}
+
+//BalancedRatio 双方余额相等
+const BalancedRatio = 5000
+
+//BalanceRatio 付款方余额占双方余额之和的万分之几
+func BalanceRatio(payer, payee *big.Int) int64 {
+	total := new(big.Int).Add(payer, payee)
+	if total.Sign() <= 0 {
+		return BalancedRatio
+	}
+	r := new(big.Int).Mul(payer, big.NewInt(10000))
+	return r.Div(r, total).Int64()
+}
+
 // FeePolicy :
+// ImbalanceFee 为nil时不启用动态手续费
 type FeePolicy struct {
 	Key           string                         `storm:"id"`
 	AccountFee    *FeeSetting                    `json:"account_fee"`
 	TokenFeeMap   map[common.Address]*FeeSetting `json:"token_fee_map"`
 	ChannelFeeMap map[common.Hash]*FeeSetting    `json:"channel_fee_map"`
+	ImbalanceFee  *ImbalanceFeeSetting           `json:"imbalance_fee,omitempty"`
 }
 
 // Sign for pfs
@@ -57,6 +330,84 @@ func (fp *FeePolicy) Sign(key *ecdsa.PrivateKey) {
 	for _, fs := range fp.ChannelFeeMap {
 		fs.sign(key)
 	}
+	if fp.ImbalanceFee != nil {
+		fp.ImbalanceFee.sign(key)
+	}
+}
+
+// Validate 检查各项设置是否合法
+func (fp *FeePolicy) Validate() (err error) {
+	if fp.AccountFee == nil {
+		return errors.New("AccountFee can not be nil")
+	}
+	if fp.TokenFeeMap == nil {
+		return errors.New("TokenFeeMap can not be nil")
+	}
+	if fp.ChannelFeeMap == nil {
+		return errors.New("ChannelFeeMap can not be nil")
+	}
+	err = fp.AccountFee.Validate()
+	if err != nil {
+		return
+	}
+	for _, fs := range fp.TokenFeeMap {
+		err = fs.Validate()
+		if err != nil {
+			return
+		}
+	}
+	for _, fs := range fp.ChannelFeeMap {
+		err = fs.Validate()
+		if err != nil {
+			return
+		}
+	}
+	if fp.ImbalanceFee != nil {
+		err = fp.ImbalanceFee.Validate()
+	}
+	return
+}
+
+// VerifySignature pfs用来验证每一项设置都是signer签名的
+func (fp *FeePolicy) VerifySignature(signer common.Address) (err error) {
+	err = verifySignature(fp.AccountFee.signData(), fp.AccountFee.Signature, signer)
+	if err != nil {
+		return
+	}
+	for _, fs := range fp.TokenFeeMap {
+		err = verifySignature(fs.signData(), fs.Signature, signer)
+		if err != nil {
+			return
+		}
+	}
+	for _, fs := range fp.ChannelFeeMap {
+		err = verifySignature(fs.signData(), fs.Signature, signer)
+		if err != nil {
+			return
+		}
+	}
+	if fp.ImbalanceFee != nil {
+		err = verifySignature(fp.ImbalanceFee.signData(), fp.ImbalanceFee.Signature, signer)
+	}
+	return
+}
+
+// Upgrade 把旧版本的FeePercent精确地转换为FeeRate,返回true表示有改变,需要保存
+func (fp *FeePolicy) Upgrade() (changed bool) {
+	if fp.AccountFee.upgrade() {
+		changed = true
+	}
+	for _, fs := range fp.TokenFeeMap {
+		if fs.upgrade() {
+			changed = true
+		}
+	}
+	for _, fs := range fp.ChannelFeeMap {
+		if fs.upgrade() {
+			changed = true
+		}
+	}
+	return
 }
 
 const defaultKey string = "feePolicy"
@@ -66,7 +417,7 @@ func NewDefaultFeePolicy() *FeePolicy {
 	return &FeePolicy{
 		AccountFee: &FeeSetting{
 			FeeConstant: big.NewInt(0),
-			FeePercent:  10000,
+			FeeRate:     100,
 		},
 		TokenFeeMap:   make(map[common.Address]*FeeSetting),
 		ChannelFeeMap: make(map[common.Hash]*FeeSetting),
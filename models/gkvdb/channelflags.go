@@ -0,0 +1,38 @@
+package gkvdb
+
+import (
+	"gitee.com/johng/gkvdb/gkvdb"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SaveChannelFlags :
+func (dao *GkvDB) SaveChannelFlags(f *models.ChannelFlags) (err error) {
+	err = dao.saveKeyValueToBucket(models.BucketChannelFlags, f.ChannelIdentifier, f)
+	err = models.GeneratDBError(err)
+	return
+}
+
+// RemoveChannelFlags :
+func (dao *GkvDB) RemoveChannelFlags(channelIdentifier common.Hash) (err error) {
+	err = dao.removeKeyValueFromBucket(models.BucketChannelFlags, channelIdentifier)
+	err = models.GeneratDBError(err)
+	return
+}
+
+// GetAllChannelFlags :
+func (dao *GkvDB) GetAllChannelFlags() (flags []*models.ChannelFlags, err error) {
+	var tb *gkvdb.Table
+	tb, err = dao.db.Table(models.BucketChannelFlags)
+	if err != nil {
+		err = models.GeneratDBError(err)
+		return
+	}
+	buf := tb.Values(-1)
+	for _, v := range buf {
+		var f models.ChannelFlags
+		gobDecode(v, &f)
+		flags = append(flags, &f)
+	}
+	return
+}
@@ -0,0 +1,46 @@
+package gkvdb
+
+import (
+	"gitee.com/johng/gkvdb/gkvdb"
+	"github.com/SmartMeshFoundation/Photon/models"
+)
+
+// SaveEdgeStat :
+func (dao *GkvDB) SaveEdgeStat(e *models.EdgeStat) (err error) {
+	err = dao.saveKeyValueToBucket(models.BucketEdgeStat, e.Key, e)
+	err = models.GeneratDBError(err)
+	return
+}
+
+// GetAllEdgeStats :
+func (dao *GkvDB) GetAllEdgeStats() (stats []*models.EdgeStat, err error) {
+	var tb *gkvdb.Table
+	tb, err = dao.db.Table(models.BucketEdgeStat)
+	if err != nil {
+		err = models.GeneratDBError(err)
+		return
+	}
+	buf := tb.Values(-1)
+	for _, v := range buf {
+		var e models.EdgeStat
+		gobDecode(v, &e)
+		stats = append(stats, &e)
+	}
+	return
+}
+
+// RemoveAllEdgeStats :
+func (dao *GkvDB) RemoveAllEdgeStats() (err error) {
+	stats, err := dao.GetAllEdgeStats()
+	if err != nil {
+		return
+	}
+	for _, e := range stats {
+		err = dao.removeKeyValueFromBucket(models.BucketEdgeStat, e.Key)
+		if err != nil {
+			err = models.GeneratDBError(err)
+			return
+		}
+	}
+	return
+}
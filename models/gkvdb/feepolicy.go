@@ -28,5 +28,12 @@ func (dao *GkvDB) GetFeePolicy() (fp *models.FeePolicy) {
 		log.Error(fmt.Sprintf("GetFeePolicy err %s, use default fee policy", err))
 		return models.NewDefaultFeePolicy()
 	}
+	// 旧版本保存的FeePercent
+	if fp.Upgrade() {
+		err = dao.SaveFeePolicy(fp)
+		if err != nil {
+			log.Error(fmt.Sprintf("save upgraded fee policy err %s", err))
+		}
+	}
 	return
 }
@@ -0,0 +1,38 @@
+package gkvdb
+
+import (
+	"gitee.com/johng/gkvdb/gkvdb"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SaveJitTransfer :
+func (dao *GkvDB) SaveJitTransfer(t *models.JitTransfer) (err error) {
+	err = dao.saveKeyValueToBucket(models.BucketJitTransfer, t.Key, t)
+	err = models.GeneratDBError(err)
+	return
+}
+
+// RemoveJitTransfer :
+func (dao *GkvDB) RemoveJitTransfer(key common.Hash) (err error) {
+	err = dao.removeKeyValueFromBucket(models.BucketJitTransfer, key)
+	err = models.GeneratDBError(err)
+	return
+}
+
+// GetAllJitTransfers :
+func (dao *GkvDB) GetAllJitTransfers() (transfers []*models.JitTransfer, err error) {
+	var tb *gkvdb.Table
+	tb, err = dao.db.Table(models.BucketJitTransfer)
+	if err != nil {
+		err = models.GeneratDBError(err)
+		return
+	}
+	buf := tb.Values(-1)
+	for _, v := range buf {
+		var t models.JitTransfer
+		gobDecode(v, &t)
+		transfers = append(transfers, &t)
+	}
+	return
+}
@@ -0,0 +1,38 @@
+package gkvdb
+
+import (
+	"gitee.com/johng/gkvdb/gkvdb"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SavePeerBan :
+func (dao *GkvDB) SavePeerBan(b *models.PeerBan) (err error) {
+	err = dao.saveKeyValueToBucket(models.BucketPeerBan, b.Address, b)
+	err = models.GeneratDBError(err)
+	return
+}
+
+// RemovePeerBan :
+func (dao *GkvDB) RemovePeerBan(addr common.Address) (err error) {
+	err = dao.removeKeyValueFromBucket(models.BucketPeerBan, addr)
+	err = models.GeneratDBError(err)
+	return
+}
+
+// GetAllPeerBans :
+func (dao *GkvDB) GetAllPeerBans() (bans []*models.PeerBan, err error) {
+	var tb *gkvdb.Table
+	tb, err = dao.db.Table(models.BucketPeerBan)
+	if err != nil {
+		err = models.GeneratDBError(err)
+		return
+	}
+	buf := tb.Values(-1)
+	for _, v := range buf {
+		var b models.PeerBan
+		gobDecode(v, &b)
+		bans = append(bans, &b)
+	}
+	return
+}
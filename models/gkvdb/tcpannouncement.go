@@ -0,0 +1,30 @@
+package gkvdb
+
+import (
+	"gitee.com/johng/gkvdb/gkvdb"
+	"github.com/SmartMeshFoundation/Photon/models"
+)
+
+// SaveTCPAnnouncement :
+func (dao *GkvDB) SaveTCPAnnouncement(a *models.TCPAnnouncement) (err error) {
+	err = dao.saveKeyValueToBucket(models.BucketTCPAnnouncement, a.Address, a)
+	err = models.GeneratDBError(err)
+	return
+}
+
+// GetAllTCPAnnouncements :
+func (dao *GkvDB) GetAllTCPAnnouncements() (anns []*models.TCPAnnouncement, err error) {
+	var tb *gkvdb.Table
+	tb, err = dao.db.Table(models.BucketTCPAnnouncement)
+	if err != nil {
+		err = models.GeneratDBError(err)
+		return
+	}
+	buf := tb.Values(-1)
+	for _, v := range buf {
+		var a models.TCPAnnouncement
+		gobDecode(v, &a)
+		anns = append(anns, &a)
+	}
+	return
+}
@@ -0,0 +1,12 @@
+package models
+
+// HistorySyncProgress :
+// 长时间离线后,分段同步链上历史事件的进度
+// progress of catching up contract events after being offline for a long time
+type HistorySyncProgress struct {
+	Syncing     bool  `json:"syncing"`
+	FromBlock   int64 `json:"from_block"`
+	SyncedBlock int64 `json:"synced_block"` // 该块及之前的事件都已经处理	// events up to this block are handled
+	TargetBlock int64 `json:"target_block"`
+	ChunkSize   int64 `json:"chunk_size"` // 当前每次查询的块数	// blocks of each query now
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// JitTransfer :
+// mediator等待到下一跳的通道打开或者存款时持有的交易,重启以后没有mediator了,要退回给上家
+type JitTransfer struct {
+	Key            common.Hash    `json:"key" storm:"id"` // 交易的state manager的key
+	LockSecretHash common.Hash    `json:"lock_secret_hash"`
+	Token          common.Address `json:"token"`
+	Payer          common.Address `json:"payer"`
+	ErrorKey       common.Hash    `json:"error_key"` // onion交易用它把失败原因加密给发起方
+}
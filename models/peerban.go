@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// PeerBan :
+// 因为恶意行为被暂时屏蔽的节点,在Until之前收到它的消息直接丢弃
+type PeerBan struct {
+	Address  common.Address `json:"address" storm:"id"`
+	Reason   string         `json:"reason"`
+	Score    float64        `json:"score"`
+	BannedAt int64          `json:"banned_at"` // 时间戳,time.Unix()
+	Until    int64          `json:"until"`     // 时间戳,time.Unix()
+}
+
+// IsExpired returns true if the ban is over at `now`
+func (b *PeerBan) IsExpired(now time.Time) bool {
+	return now.Unix() >= b.Until
+}
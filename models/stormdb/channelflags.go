@@ -0,0 +1,34 @@
+package stormdb
+
+import (
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/asdine/storm"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SaveChannelFlags :
+func (model *StormDB) SaveChannelFlags(f *models.ChannelFlags) (err error) {
+	err = model.db.Save(f)
+	err = models.GeneratDBError(err)
+	return
+}
+
+// RemoveChannelFlags :
+func (model *StormDB) RemoveChannelFlags(channelIdentifier common.Hash) (err error) {
+	err = model.db.DeleteStruct(&models.ChannelFlags{ChannelIdentifier: channelIdentifier})
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	err = models.GeneratDBError(err)
+	return
+}
+
+// GetAllChannelFlags :
+func (model *StormDB) GetAllChannelFlags() (flags []*models.ChannelFlags, err error) {
+	err = model.db.All(&flags)
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	err = models.GeneratDBError(err)
+	return
+}
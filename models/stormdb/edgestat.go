@@ -0,0 +1,34 @@
+package stormdb
+
+import (
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/asdine/storm"
+	"github.com/coreos/bbolt"
+)
+
+// SaveEdgeStat :
+func (model *StormDB) SaveEdgeStat(e *models.EdgeStat) (err error) {
+	err = model.db.Save(e)
+	err = models.GeneratDBError(err)
+	return
+}
+
+// GetAllEdgeStats :
+func (model *StormDB) GetAllEdgeStats() (stats []*models.EdgeStat, err error) {
+	err = model.db.All(&stats)
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	err = models.GeneratDBError(err)
+	return
+}
+
+// RemoveAllEdgeStats :
+func (model *StormDB) RemoveAllEdgeStats() (err error) {
+	err = model.db.Drop(&models.EdgeStat{})
+	if err == bolt.ErrBucketNotFound {
+		err = nil
+	}
+	err = models.GeneratDBError(err)
+	return
+}
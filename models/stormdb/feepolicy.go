@@ -27,5 +27,12 @@ func (model *StormDB) GetFeePolicy() (fp *models.FeePolicy) {
 		log.Error(fmt.Sprintf("GetFeePolicy err %s, use default fee policy", err))
 		return models.NewDefaultFeePolicy()
 	}
+	// 旧版本保存的FeePercent
+	if fp.Upgrade() {
+		err = model.SaveFeePolicy(fp)
+		if err != nil {
+			log.Error(fmt.Sprintf("save upgraded fee policy err %s", err))
+		}
+	}
 	return
 }
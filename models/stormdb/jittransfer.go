@@ -0,0 +1,34 @@
+package stormdb
+
+import (
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/asdine/storm"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SaveJitTransfer :
+func (model *StormDB) SaveJitTransfer(t *models.JitTransfer) (err error) {
+	err = model.db.Save(t)
+	err = models.GeneratDBError(err)
+	return
+}
+
+// RemoveJitTransfer :
+func (model *StormDB) RemoveJitTransfer(key common.Hash) (err error) {
+	err = model.db.DeleteStruct(&models.JitTransfer{Key: key})
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	err = models.GeneratDBError(err)
+	return
+}
+
+// GetAllJitTransfers :
+func (model *StormDB) GetAllJitTransfers() (transfers []*models.JitTransfer, err error) {
+	err = model.db.All(&transfers)
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	err = models.GeneratDBError(err)
+	return
+}
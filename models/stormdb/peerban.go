@@ -0,0 +1,34 @@
+package stormdb
+
+import (
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/asdine/storm"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SavePeerBan :
+func (model *StormDB) SavePeerBan(b *models.PeerBan) (err error) {
+	err = model.db.Save(b)
+	err = models.GeneratDBError(err)
+	return
+}
+
+// RemovePeerBan :
+func (model *StormDB) RemovePeerBan(addr common.Address) (err error) {
+	err = model.db.DeleteStruct(&models.PeerBan{Address: addr})
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	err = models.GeneratDBError(err)
+	return
+}
+
+// GetAllPeerBans :
+func (model *StormDB) GetAllPeerBans() (bans []*models.PeerBan, err error) {
+	err = model.db.All(&bans)
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	err = models.GeneratDBError(err)
+	return
+}
@@ -0,0 +1,23 @@
+package stormdb
+
+import (
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/asdine/storm"
+)
+
+// SaveTCPAnnouncement :
+func (model *StormDB) SaveTCPAnnouncement(a *models.TCPAnnouncement) (err error) {
+	err = model.db.Save(a)
+	err = models.GeneratDBError(err)
+	return
+}
+
+// GetAllTCPAnnouncements :
+func (model *StormDB) GetAllTCPAnnouncements() (anns []*models.TCPAnnouncement, err error) {
+	err = model.db.All(&anns)
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	err = models.GeneratDBError(err)
+	return
+}
@@ -0,0 +1,14 @@
+package models
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// TCPAnnouncement :
+// 其他节点签名的tcp地址,保存下来重启以后还能直接连接它
+type TCPAnnouncement struct {
+	Address   common.Address `json:"address" storm:"id"`
+	HostPort  string         `json:"host_port"`
+	Timestamp int64          `json:"timestamp"`
+	Signature []byte         `json:"signature"`
+}
@@ -2,6 +2,10 @@ package network
 
 import (
 	"crypto/ecdsa"
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/utils"
 
 	"github.com/SmartMeshFoundation/Photon/params"
 
@@ -11,22 +15,25 @@ import (
 )
 
 /*
-MatrixMixTransport is a wrapper for two Transporter(UDP and Matrix)
+MatrixMixTransport is a wrapper for three Transporter(TCP,UDP and Matrix)
+if I know the node's tcp address,then TCP,
 if I can reach the node by UDP,then UDP,
 if I cannot reach the node, try Matrix
 */
 type MatrixMixTransport struct {
+	tcp      *TCPTransport
 	udp      *UDPTransport
 	matirx   *MatrixTransport
 	name     string
 	protocol ProtocolReceiver
 }
 
-//NewMatrixMixTransporter create a MixTransport and discover
-func NewMatrixMixTransporter(name, host string, port int, key *ecdsa.PrivateKey, protocol ProtocolReceiver, policy Policier, deviceType string) (t *MatrixMixTransport, err error) {
+//NewMatrixMixTransporter create a MixTransport and discover, tcp is optional
+func NewMatrixMixTransporter(name, host string, port int, key *ecdsa.PrivateKey, protocol ProtocolReceiver, policy Policier, deviceType string, tcp *TCPTransport) (t *MatrixMixTransport, err error) {
 	t = &MatrixMixTransport{
 		name:     name,
 		protocol: protocol,
+		tcp:      tcp,
 	}
 	t.udp, err = NewUDPTransport(name, host, port, protocol, policy)
 	if err != nil {
@@ -42,10 +49,17 @@ Send message
 优先选择局域网,在局域网走不通的情况下,才会考虑 matrix
 */
 /*
- *	Send message prefers to choose LAN,
+ *	Send message prefers to choose direct tcp connection, then LAN,
  *	after LAN does not work, then try matrix.
  */
 func (t *MatrixMixTransport) Send(receiver common.Address, data []byte) error {
+	if t.tcp != nil && t.tcp.CanReach(receiver) {
+		err := t.tcp.Send(receiver, data)
+		if err == nil {
+			return nil
+		}
+		log.Warn(fmt.Sprintf("tcp send to %s err %s, fall back", utils.APex2(receiver), err))
+	}
 	_, isOnline := t.udp.NodeStatus(receiver)
 	if isOnline {
 		err := t.udp.Send(receiver, data)
@@ -61,8 +75,11 @@ func (t *MatrixMixTransport) Send(receiver common.Address, data []byte) error {
 	return nil
 }
 
-//Start the two transporter
+//Start the three transporter
 func (t *MatrixMixTransport) Start() {
+	if t.tcp != nil {
+		t.tcp.Start()
+	}
 	if t.udp != nil {
 		t.udp.Start()
 	}
@@ -74,8 +91,11 @@ func (t *MatrixMixTransport) Start() {
 	}
 }
 
-//Stop the two transporter
+//Stop the three transporter
 func (t *MatrixMixTransport) Stop() {
+	if t.tcp != nil {
+		t.tcp.Stop()
+	}
 
 	if t.udp != nil {
 		t.udp.Stop()
@@ -85,8 +105,11 @@ func (t *MatrixMixTransport) Stop() {
 	}
 }
 
-//StopAccepting stops receiving for the two transporter
+//StopAccepting stops receiving for the three transporter
 func (t *MatrixMixTransport) StopAccepting() {
+	if t.tcp != nil {
+		t.tcp.StopAccepting()
+	}
 	if t.udp != nil {
 		t.udp.StopAccepting()
 	}
@@ -95,8 +118,11 @@ func (t *MatrixMixTransport) StopAccepting() {
 	}
 }
 
-//RegisterProtocol register receiver for the two transporter
+//RegisterProtocol register receiver for the three transporter
 func (t *MatrixMixTransport) RegisterProtocol(protcol ProtocolReceiver) {
+	if t.tcp != nil {
+		t.tcp.RegisterProtocol(protcol)
+	}
 	if t.udp != nil {
 		t.udp.RegisterProtocol(protcol)
 	}
@@ -107,6 +133,12 @@ func (t *MatrixMixTransport) RegisterProtocol(protcol ProtocolReceiver) {
 
 //NodeStatus get node's status and is online right now
 func (t *MatrixMixTransport) NodeStatus(addr common.Address) (deviceType string, isOnline bool) {
+	if t.tcp != nil {
+		deviceType, isOnline = t.tcp.NodeStatus(addr)
+		if isOnline {
+			return
+		}
+	}
 	deviceType, isOnline = t.udp.NodeStatus(addr)
 	if isOnline {
 		return
@@ -115,6 +147,14 @@ func (t *MatrixMixTransport) NodeStatus(addr common.Address) (deviceType string,
 	return t.matirx.NodeStatus(addr)
 }
 
+//MaxMessageSize the largest message which tcp or udp can receive
+func (t *MatrixMixTransport) MaxMessageSize() int {
+	if t.tcp != nil && t.tcp.MaxMessageSize() > t.udp.MaxMessageSize() {
+		return t.tcp.MaxMessageSize()
+	}
+	return t.udp.MaxMessageSize()
+}
+
 //GetNotify notification of connection status change
 func (t *MatrixMixTransport) GetNotify() (notify <-chan netshare.Status, err error) {
 	//if t.matirx != nil {
@@ -0,0 +1,77 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var addressAnnouncementPrefix = []byte("photon-tcp-address-announcement")
+
+/*
+AddressAnnouncement tells other nodes where `Address` accepts direct tcp connections.
+It is signed by the node's ethereum key, so anyone can relay it without being able to forge it.
+A newer announcement (bigger Timestamp) replaces an older one.
+*/
+type AddressAnnouncement struct {
+	Address   common.Address `json:"address"`
+	HostPort  string         `json:"host_port"`
+	Timestamp int64          `json:"timestamp"`
+	Signature hexutil.Bytes  `json:"signature"`
+}
+
+//NewAddressAnnouncement create a signed announcement for `hostPort`
+func NewAddressAnnouncement(key *ecdsa.PrivateKey, hostPort string) (a *AddressAnnouncement, err error) {
+	if _, _, err = net.SplitHostPort(hostPort); err != nil {
+		return
+	}
+	a = &AddressAnnouncement{
+		Address:   crypto.PubkeyToAddress(key.PublicKey),
+		HostPort:  hostPort,
+		Timestamp: time.Now().Unix(),
+	}
+	a.Signature, err = utils.SignData(key, a.dataToSign())
+	return
+}
+
+func (a *AddressAnnouncement) dataToSign() []byte {
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(a.Timestamp))
+	data := make([]byte, 0, len(addressAnnouncementPrefix)+len(a.Address)+len(a.HostPort)+len(ts))
+	data = append(data, addressAnnouncementPrefix...)
+	data = append(data, a.Address[:]...)
+	data = append(data, []byte(a.HostPort)...)
+	data = append(data, ts[:]...)
+	return data
+}
+
+//Verify checks the signature and the format of the announcement
+func (a *AddressAnnouncement) Verify() error {
+	if a.Address == utils.EmptyAddress {
+		return errors.New("announcement without address")
+	}
+	if _, _, err := net.SplitHostPort(a.HostPort); err != nil {
+		return fmt.Errorf("announcement host port err %s", err)
+	}
+	signer, err := utils.Ecrecover(utils.Sha3(a.dataToSign()), a.Signature)
+	if err != nil {
+		return err
+	}
+	if signer != a.Address {
+		return fmt.Errorf("announcement signer mismatch, address=%s,signer=%s", a.Address.String(), signer.String())
+	}
+	return nil
+}
+
+//String fmt.Stringer
+func (a *AddressAnnouncement) String() string {
+	return fmt.Sprintf("{address=%s,host_port=%s,timestamp=%d}", utils.APex2(a.Address), a.HostPort, a.Timestamp)
+}
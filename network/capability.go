@@ -0,0 +1,242 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/encoding"
+	"github.com/SmartMeshFoundation/Photon/internal/rpanic"
+	"github.com/SmartMeshFoundation/Photon/rerr"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	//capabilityQueryMinInterval a query may be lost or the node may be offline, ask again after this long if no answer
+	capabilityQueryMinInterval = 10 * time.Second
+	//capabilityQueryMaxInterval the interval doubles after every query without answer up to this, old nodes never answer
+	capabilityQueryMaxInterval = 10 * time.Minute
+)
+
+type capabilityQuery struct {
+	last     time.Time
+	interval time.Duration
+}
+
+/*
+peerCapabilities remembers public keys and capabilities of other nodes.
+Public keys are recovered from signatures of received messages,
+capabilities are learned from encoding.Capabilities.
+*/
+type peerCapabilities struct {
+	lock         sync.RWMutex
+	pubkeys      map[common.Address]*ecdsa.PublicKey
+	capabilities map[common.Address]*encoding.Capabilities
+	//nodes I have asked for capabilities but not answered yet
+	queries  map[common.Address]*capabilityQuery
+	timeFunc timeFunc
+}
+
+func newPeerCapabilities() *peerCapabilities {
+	return &peerCapabilities{
+		pubkeys:      make(map[common.Address]*ecdsa.PublicKey),
+		capabilities: make(map[common.Address]*encoding.Capabilities),
+		queries:      make(map[common.Address]*capabilityQuery),
+		timeFunc:     time.Now,
+	}
+}
+
+func (pc *peerCapabilities) getPubkey(addr common.Address) *ecdsa.PublicKey {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+	return pc.pubkeys[addr]
+}
+
+func (pc *peerCapabilities) setPubkey(addr common.Address, pub *ecdsa.PublicKey) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	pc.pubkeys[addr] = pub
+}
+
+//getCapabilities returns nil if unknown
+func (pc *peerCapabilities) getCapabilities(addr common.Address) *encoding.Capabilities {
+	pc.lock.RLock()
+	defer pc.lock.RUnlock()
+	return pc.capabilities[addr]
+}
+
+//setCapabilities returns false if `c` is older than the one I have
+func (pc *peerCapabilities) setCapabilities(c *encoding.Capabilities) bool {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	old, ok := pc.capabilities[c.Sender]
+	if ok && old.Timestamp > c.Timestamp {
+		return false
+	}
+	pc.capabilities[c.Sender] = c
+	delete(pc.queries, c.Sender)
+	return true
+}
+
+/*
+needQuery returns true if capabilities of the node are unknown and it's not asked recently,
+the interval between queries doubles from capabilityQueryMinInterval to capabilityQueryMaxInterval.
+*/
+func (pc *peerCapabilities) needQuery(addr common.Address) bool {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if _, ok := pc.capabilities[addr]; ok {
+		return false
+	}
+	now := pc.timeFunc()
+	q, ok := pc.queries[addr]
+	if !ok {
+		pc.queries[addr] = &capabilityQuery{last: now, interval: capabilityQueryMinInterval}
+		return true
+	}
+	if now.Sub(q.last) < q.interval {
+		return false
+	}
+	q.last = now
+	q.interval *= 2
+	if q.interval > capabilityQueryMaxInterval {
+		q.interval = capabilityQueryMaxInterval
+	}
+	return true
+}
+
+//PeerCapabilities returns what `addr` announced, nil if it never did, maybe it's an old node
+func (p *PhotonProtocol) PeerCapabilities(addr common.Address) *encoding.Capabilities {
+	return p.peers.getCapabilities(addr)
+}
+
+/*
+MessageVersion returns the highest version of message `cmdID` both I and `receiver` support.
+It returns rerr.ErrPeerNotSupport if `receiver` announced it cannot decode any version I can encode,
+A node which never announced its capabilities is assumed to support only my lowest version.
+*/
+func (p *PhotonProtocol) MessageVersion(receiver common.Address, cmdID int16) (version int16, err error) {
+	version, err = encoding.NegotiateVersion(cmdID, p.peers.getCapabilities(receiver))
+	if err != nil {
+		err = rerr.ErrPeerNotSupport.AppendError(err)
+	}
+	return
+}
+
+//CheckPeerVersion returns rerr.ErrPeerNotSupport if `receiver` may not decode version `version` of message `cmdID`
+func (p *PhotonProtocol) CheckPeerVersion(receiver common.Address, cmdID int16, version int16) error {
+	max, err := p.MessageVersion(receiver, cmdID)
+	if err != nil {
+		return err
+	}
+	if version > max {
+		return rerr.ErrPeerNotSupport.Errorf("%s cannot decode message %s version %d", utils.APex2(receiver), encoding.MessageType(cmdID), version)
+	}
+	return nil
+}
+
+/*
+CheckPeerSupports returns rerr.ErrPeerNotSupport if `receiver` announced
+it cannot decode message `cmdID` or doesn't support all of `features`.
+*/
+func (p *PhotonProtocol) CheckPeerSupports(receiver common.Address, cmdID int16, features uint32) error {
+	_, err := p.MessageVersion(receiver, cmdID)
+	if err != nil {
+		return err
+	}
+	c := p.peers.getCapabilities(receiver)
+	if c != nil && !c.HasFeature(features) {
+		return rerr.ErrPeerNotSupport.Errorf("%s doesn't support features %d", utils.APex2(receiver), features&^c.Features)
+	}
+	return nil
+}
+
+/*
+EnableTrampoline announces I find routes for MediatedTransfer whose Trampoline is me.
+It must be called before start.
+*/
+func (p *PhotonProtocol) EnableTrampoline() {
+	p.features |= encoding.FeatureTrampoline
+}
+
+//PeerSupportsTrampoline returns true if `addr` announced it works as a trampoline
+func (p *PhotonProtocol) PeerSupportsTrampoline(addr common.Address) bool {
+	c := p.peers.getCapabilities(addr)
+	if c == nil || !c.HasFeature(encoding.FeatureTrampoline) {
+		return false
+	}
+	version, err := encoding.NegotiateVersion(encoding.MediatedTransferCmdID, c)
+	return err == nil && version >= encoding.MediatedTransferTrampolineVersion
+}
+
+/*
+EnableOnion announces I forward onion routed MediatedTransfer.
+It must be called before start.
+*/
+func (p *PhotonProtocol) EnableOnion() {
+	p.features |= encoding.FeatureOnion
+}
+
+/*
+OnionPubkey returns the public key to encrypt onion for `addr`,
+nil if I don't use onion, or `addr` doesn't support it, or its public key is unknown.
+Capabilities of a node never talked with is queried in background, so it can be used next time.
+*/
+func (p *PhotonProtocol) OnionPubkey(addr common.Address) *ecdsa.PublicKey {
+	if p.features&encoding.FeatureOnion == 0 {
+		return nil
+	}
+	c := p.peers.getCapabilities(addr)
+	if c == nil {
+		p.queryCapabilities(addr)
+		return nil
+	}
+	if !c.HasFeature(encoding.FeatureOnion) {
+		return nil
+	}
+	version, err := encoding.NegotiateVersion(encoding.MediatedTransferCmdID, c)
+	if err != nil || version < encoding.MediatedTransferOnionVersion {
+		return nil
+	}
+	return p.peers.getPubkey(addr)
+}
+
+//handleCapabilities saves what sender supports, and tells mine if asked.
+func (p *PhotonProtocol) handleCapabilities(c *encoding.Capabilities) {
+	if !p.peers.setCapabilities(c) {
+		p.log.Info(fmt.Sprintf("ignore old capabilities %s", c))
+		return
+	}
+	if c.Query {
+		err := p.sendCapabilities(c.Sender, false)
+		if err != nil {
+			p.log.Info(fmt.Sprintf("send capabilities to %s err %s", utils.APex2(c.Sender), err))
+		}
+	}
+}
+
+//sendCapabilities tells receiver what I support, and ask for receiver's if `query`
+func (p *PhotonProtocol) sendCapabilities(receiver common.Address, query bool) error {
+	c := encoding.NewCapabilities(p.features, time.Now().UnixNano(), query)
+	err := c.Sign(p.privKey, c)
+	if err != nil {
+		return err
+	}
+	return p.sendRawWitNoAck(receiver, c.Pack())
+}
+
+//queryCapabilities asks receiver's capabilities if unknown and not asked recently, without blocking
+func (p *PhotonProtocol) queryCapabilities(receiver common.Address) {
+	if !p.peers.needQuery(receiver) {
+		return
+	}
+	go func() {
+		defer rpanic.PanicRecover("protocol queryCapabilities")
+		err := p.sendCapabilities(receiver, true)
+		if err != nil {
+			p.log.Info(fmt.Sprintf("query capabilities of %s err %s", utils.APex2(receiver), err))
+		}
+	}()
+}
@@ -2,7 +2,9 @@ package network
 
 import (
 	"crypto/ecdsa"
+	"errors"
 	"math/rand"
+	"sync"
 	"time"
 
 	"fmt"
@@ -33,6 +35,92 @@ func (p *dummyProtocol) receive(data []byte) {
 	p.data <- data
 }
 
+//MemoryNetwork connects MemoryTransports in one process with a fixed latency, test only
+type MemoryNetwork struct {
+	lock    sync.Mutex
+	nodes   map[common.Address]*MemoryTransport
+	latency time.Duration
+	//drop returns true if data to receiver should be lost
+	drop func(receiver common.Address, data []byte) bool
+}
+
+//NewMemoryNetwork test only
+func NewMemoryNetwork(latency time.Duration) *MemoryNetwork {
+	return &MemoryNetwork{
+		nodes:   make(map[common.Address]*MemoryTransport),
+		latency: latency,
+	}
+}
+
+//MemoryTransport delivers messages through MemoryNetwork, test only
+type MemoryTransport struct {
+	network  *MemoryNetwork
+	addr     common.Address
+	protocol ProtocolReceiver
+	stopped  bool
+}
+
+//NewTransport creates a transport of node `addr`
+func (n *MemoryNetwork) NewTransport(addr common.Address) *MemoryTransport {
+	t := &MemoryTransport{network: n, addr: addr}
+	n.lock.Lock()
+	n.nodes[addr] = t
+	n.lock.Unlock()
+	return t
+}
+
+//Send a message to receiver after latency
+func (t *MemoryTransport) Send(receiver common.Address, data []byte) error {
+	n := t.network
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	to, ok := n.nodes[receiver]
+	if !ok {
+		return errors.New("unknown receiver")
+	}
+	if n.drop != nil && n.drop(receiver, data) {
+		return nil
+	}
+	cdata := make([]byte, len(data))
+	copy(cdata, data)
+	time.AfterFunc(n.latency, func() {
+		n.lock.Lock()
+		stopped := to.stopped || to.protocol == nil
+		n.lock.Unlock()
+		if !stopped {
+			to.protocol.receive(cdata)
+		}
+	})
+	return nil
+}
+
+//Start ,ready for send and receive
+func (t *MemoryTransport) Start() {}
+
+//Stop send and receive
+func (t *MemoryTransport) Stop() {
+	t.StopAccepting()
+}
+
+//StopAccepting stops receiving
+func (t *MemoryTransport) StopAccepting() {
+	t.network.lock.Lock()
+	t.stopped = true
+	t.network.lock.Unlock()
+}
+
+//RegisterProtocol a receiver
+func (t *MemoryTransport) RegisterProtocol(protcol ProtocolReceiver) {
+	t.network.lock.Lock()
+	t.protocol = protcol
+	t.network.lock.Unlock()
+}
+
+//NodeStatus all nodes are online
+func (t *MemoryTransport) NodeStatus(addr common.Address) (deviceType string, isOnline bool) {
+	return DeviceTypeOther, true
+}
+
 //MakeTestUDPTransport test only
 func MakeTestUDPTransport(name string, port int) *UDPTransport {
 	params.DefaultMDNSQueryInterval = time.Millisecond * 50
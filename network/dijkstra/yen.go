@@ -0,0 +1,100 @@
+package dijkstra
+
+import "sort"
+
+/*
+KShortest calculates at most k loop-free shortest paths from src to dest with Yen's algorithm,
+ordered by distance. arcs of g are removed temporarily during the search and restored before return,
+so g must not be used by others at the same time.
+*/
+func (g *Graph) KShortest(src, dest, k int) ([]BestPath, error) {
+	first, err := g.Shortest(src, dest)
+	if err != nil {
+		return nil, err
+	}
+	paths := []BestPath{first}
+	var candidates []BestPath
+	for len(paths) < k {
+		prev := paths[len(paths)-1].Path
+		for i := 0; i < len(prev)-1; i++ {
+			spur := prev[i]
+			root := prev[:i+1]
+			rootDistance := g.pathDistance(root)
+			removed := make(map[[2]int]int64)
+			//下一跳不能和已经找到的共享root的路径相同
+			for _, p := range paths {
+				if len(p.Path) > i+1 && samePath(p.Path[:i+1], root) {
+					g.removeArc(p.Path[i], p.Path[i+1], removed)
+				}
+			}
+			//root中除spur外的节点都不能再经过
+			for _, n := range root[:i] {
+				for to := range g.Verticies[n].arcs {
+					g.removeArc(n, to, removed)
+				}
+			}
+			spurPath, err := g.Shortest(spur, dest)
+			for arc, dist := range removed {
+				g.Verticies[arc[0]].AddArc(arc[1], dist)
+			}
+			if err != nil {
+				continue
+			}
+			total := make([]int, 0, len(root)-1+len(spurPath.Path))
+			total = append(total, root[:i]...)
+			total = append(total, spurPath.Path...)
+			candidate := BestPath{rootDistance + spurPath.Distance, total}
+			if !containsPath(paths, candidate.Path) && !containsPath(candidates, candidate.Path) {
+				candidates = append(candidates, candidate)
+			}
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			if candidates[i].Distance != candidates[j].Distance {
+				return candidates[i].Distance < candidates[j].Distance
+			}
+			return len(candidates[i].Path) < len(candidates[j].Path)
+		})
+		paths = append(paths, candidates[0])
+		candidates = candidates[1:]
+	}
+	return paths, nil
+}
+
+func (g *Graph) removeArc(from, to int, removed map[[2]int]int64) {
+	if dist, ok := g.Verticies[from].GetArc(to); ok {
+		removed[[2]int{from, to}] = dist
+		g.Verticies[from].DeleteArc(to)
+	}
+}
+
+func (g *Graph) pathDistance(path []int) (distance int64) {
+	for i := 0; i < len(path)-1; i++ {
+		dist, _ := g.Verticies[path[i]].GetArc(path[i+1])
+		distance += dist
+	}
+	return
+}
+
+func samePath(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsPath(paths []BestPath, path []int) bool {
+	for _, p := range paths {
+		if samePath(p.Path, path) {
+			return true
+		}
+	}
+	return false
+}
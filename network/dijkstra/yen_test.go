@@ -0,0 +1,55 @@
+package dijkstra
+
+import (
+	"reflect"
+	"testing"
+)
+
+//C=0,D=1,E=2,F=3,G=4,H=5, the example of Yen's algorithm on wikipedia
+func getYenGraph() *Graph {
+	g := NewGraph()
+	for i := 0; i < 6; i++ {
+		g.AddVertex(i)
+	}
+	arcs := [][3]int64{
+		{0, 1, 3}, {0, 2, 2}, {1, 3, 4}, {2, 1, 1}, {2, 3, 2},
+		{2, 4, 3}, {3, 4, 2}, {3, 5, 1}, {4, 5, 2},
+	}
+	for _, a := range arcs {
+		g.AddArc(int(a[0]), int(a[1]), a[2])
+	}
+	return g
+}
+
+func TestKShortest(t *testing.T) {
+	g := getYenGraph()
+	paths, err := g.KShortest(0, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []BestPath{
+		{5, []int{0, 2, 3, 5}},
+		{7, []int{0, 2, 4, 5}},
+		{8, []int{0, 1, 3, 5}},
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expect %v,got %v", expected, paths)
+	}
+	//arcs must be restored
+	for i, v := range getYenGraph().Verticies {
+		if !reflect.DeepEqual(g.Verticies[i].arcs, v.arcs) {
+			t.Errorf("arcs of %d not restored", i)
+		}
+	}
+	paths, err = g.KShortest(0, 5, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 7 {
+		t.Errorf("expect 7 loop-free paths,got %d", len(paths))
+	}
+	_, err = g.KShortest(5, 0, 3)
+	if err != ErrNoPath {
+		t.Errorf("expect ErrNoPath,got %v", err)
+	}
+}
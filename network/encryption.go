@@ -0,0 +1,61 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/SmartMeshFoundation/Photon/encoding"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+EnableEncryption encrypts every message to nodes which support it,
+messages to other nodes are sent as before.
+It must be called before start.
+*/
+func (p *PhotonProtocol) EnableEncryption() {
+	p.features |= encoding.FeatureEncryption
+}
+
+//PeerSupportsEncryption returns true if I can encrypt messages to `addr`
+func (p *PhotonProtocol) PeerSupportsEncryption(addr common.Address) bool {
+	if p.features&encoding.FeatureEncryption == 0 {
+		return false
+	}
+	c := p.peers.getCapabilities(addr)
+	return c != nil && c.HasFeature(encoding.FeatureEncryption) && p.peers.getPubkey(addr) != nil
+}
+
+//rememberPubkey saves sender's public key recovered from a received message
+func (p *PhotonProtocol) rememberPubkey(msg encoding.SignedMessager, data []byte) {
+	sender := msg.GetSender()
+	if p.peers.getPubkey(sender) != nil {
+		return
+	}
+	pub := encoding.RecoverSenderPubkey(msg, data)
+	if pub != nil {
+		p.peers.setPubkey(sender, pub)
+	}
+}
+
+//encryptIfPossible returns the data to send, encrypted if receiver supports it
+func (p *PhotonProtocol) encryptIfPossible(receiver common.Address, data []byte) []byte {
+	if !p.PeerSupportsEncryption(receiver) {
+		return data
+	}
+	m, err := encoding.NewEncrypted(p.peers.getPubkey(receiver), data)
+	if err != nil {
+		p.log.Error(fmt.Sprintf("encrypt message to %s err %s", utils.APex2(receiver), err))
+		return data
+	}
+	return m.Pack()
+}
+
+func (p *PhotonProtocol) decrypt(data []byte) ([]byte, error) {
+	m := new(encoding.Encrypted)
+	err := m.UnPack(data)
+	if err != nil {
+		return nil, err
+	}
+	return m.Decrypt(p.privKey)
+}
@@ -45,6 +45,11 @@ type NodesStatusGetter interface {
 	GetNetworkStatus(addr common.Address) (deviceType string, isOnline bool)
 }
 
+//MediationPauser tells whether the operator paused a channel for forwarding transfers of others
+type MediationPauser interface {
+	IsOutboundMediationPaused(channelIdentifier common.Hash) bool
+}
+
 //ChannelGraph is a Graph based on the channels and can find path between participants.
 //整个 ChannelGraph 只能单线程访问
 // The whole ChannelGraph can only be accessed by a single process.
@@ -56,6 +61,13 @@ type ChannelGraph struct {
 	ChannelIdentifier2Channel map[common.Hash]*channel.Channel
 	address2index             map[common.Address]int
 	index2address             map[int]common.Address
+	capacities                map[channelEdge]*big.Int //已知的其他通道的押金,来自链上事件
+}
+
+//channelEdge is the direction from `from` to `to` of a channel
+type channelEdge struct {
+	from common.Address
+	to   common.Address
 }
 
 /*
@@ -69,6 +81,7 @@ func NewChannelGraph(ourAddress, tokenAddress common.Address, edges []common.Add
 		ChannelIdentifier2Channel: make(map[common.Hash]*channel.Channel),
 		address2index:             make(map[common.Address]int),
 		index2address:             make(map[int]common.Address),
+		capacities:                make(map[channelEdge]*big.Int),
 		g:                         dijkstra.NewGraph(),
 	}
 	cg.makeGraph(edges)
@@ -185,6 +198,31 @@ var errAddressNotFoundInGraph = errors.New("address not found in channelgraph")
 ShortestPath returns the shortestpath weight from source to target.  make sure only be called in one thread.
 */
 func (cg *ChannelGraph) ShortestPath(source, target common.Address, amount *big.Int, feeCharger fee.Charger) (totalWeight int64, err error) {
+	path, err := cg.shortestPath(source, target, amount, feeCharger)
+	if err != nil {
+		return
+	}
+	return path.Distance, nil
+}
+
+/*
+BestPath returns all nodes from source to target of the shortestpath, both are included. make sure only be called in one thread.
+*/
+func (cg *ChannelGraph) BestPath(source, target common.Address, amount *big.Int, feeCharger fee.Charger) (nodes []common.Address, err error) {
+	path, err := cg.shortestPath(source, target, amount, feeCharger)
+	if err != nil {
+		return
+	}
+	if len(path.Path) == 0 {
+		return []common.Address{source}, nil
+	}
+	for _, i := range path.Path {
+		nodes = append(nodes, cg.index2address[i])
+	}
+	return
+}
+
+func (cg *ChannelGraph) shortestPath(source, target common.Address, amount *big.Int, feeCharger fee.Charger) (path dijkstra.BestPath, err error) {
 	sourceIndex, ok := cg.address2index[source]
 	if !ok {
 		err = errAddressNotFoundInGraph
@@ -196,7 +234,7 @@ func (cg *ChannelGraph) ShortestPath(source, target common.Address, amount *big.
 		return
 	}
 	if sourceIndex == targetIndex {
-		return 0, nil
+		return
 	}
 	var g2 *dijkstra.Graph
 	if false { //make sure only be called in one thread.
@@ -207,17 +245,14 @@ func (cg *ChannelGraph) ShortestPath(source, target common.Address, amount *big.
 	for _, v := range g2.Verticies {
 		w := feeCharger.GetNodeChargeFee(cg.index2address[v.ID], cg.TokenAddress, amount).Int64()
 		log.Trace(fmt.Sprintf(fmt.Sprintf("setfee node=%s,fee=%d", cg.index2address[v.ID].String(), w)))
+		//给补贴的节点按不收费计算,保证权重不为负
 		if w > 0 { //for no fee policy, all nodes charge 0 ,so use the shortest path first.
 			v.SetWeight(w) // from v's fee is w.
 		}
 	}
 	//log.Trace(fmt.Sprintf("g2=%s", utils.StringInterface(g2, 20)))
 	//log.Trace(fmt.Sprintf("index2address=%s", utils.StringInterface(cg.index2address, 5)))
-	path, err := g2.Shortest(sourceIndex, targetIndex)
-	if err != nil {
-		return
-	}
-	return path.Distance, nil
+	return g2.Shortest(sourceIndex, targetIndex)
 }
 
 //RemoveChannel remove a channel from graph,and i'm a participant of this channel
@@ -245,6 +280,29 @@ func (cg *ChannelGraph) RemovePath(source, target common.Address) {
 	if err != nil {
 		log.Error(fmt.Sprintf("remove arc %d-%d err %s", sourceIndex, targetIndex, err))
 	}
+	delete(cg.capacities, channelEdge{source, target})
+	delete(cg.capacities, channelEdge{target, source})
+}
+
+/*
+SetCapacity records the deposit of `participant` in its channel with `partner`,
+local routing will not go from `participant` to `partner` if the amount is larger than it.
+*/
+func (cg *ChannelGraph) SetCapacity(participant, partner common.Address, deposit *big.Int) {
+	cg.capacities[channelEdge{participant, partner}] = new(big.Int).Set(deposit)
+}
+
+//capacity returns how much `from` can send to `to`, false if unknown.
+func (cg *ChannelGraph) capacity(from, to common.Address) (*big.Int, bool) {
+	if from == cg.OurAddress {
+		c := cg.PartenerAddress2Channel[to]
+		if c == nil {
+			return nil, false
+		}
+		return c.Distributable(), true
+	}
+	c, ok := cg.capacities[channelEdge{from, to}]
+	return c, ok
 }
 
 /*
@@ -275,6 +333,7 @@ func (cg *ChannelGraph) getNeighbours() []common.Address {
 type neighborWeight struct {
 	neighbor common.Address
 	weight   int64 //nerghbor to target's hops
+	hops     int   //our hops to target through neighbor
 }
 type neighborWeightList []*neighborWeight
 
@@ -300,11 +359,15 @@ func (cg *ChannelGraph) orderedNeighbours(ourAddress, targetAddress common.Addre
 	neighbors := cg.getNeighbours()
 	var nws neighborWeightList
 	for _, n := range neighbors {
-		w, err := cg.ShortestPath(n, targetAddress, amount, charger)
+		path, err := cg.shortestPath(n, targetAddress, amount, charger)
 		if err != nil {
 			continue
 		}
-		nws = append(nws, &neighborWeight{n, w})
+		hops := len(path.Path)
+		if hops == 0 {
+			hops = 1 //neighbor is target
+		}
+		nws = append(nws, &neighborWeight{n, path.Distance, hops})
 	}
 	sort.Sort(nws)
 	return nws
@@ -320,9 +383,10 @@ GetBestRoutes returns all neighbor nodes order by weight from it to target.
  *
  *	Note that the routing algorithm we currently use should be the shortest-path/minimized-fee algorithm with history record,
  *	which circumvents all routes that have been iterated.
+ *	pauser is nil when I'm the initiator, otherwise channels paused for mediation are skipped.
  */
 func (cg *ChannelGraph) GetBestRoutes(nodesStatus NodesStatusGetter, ourAddress common.Address,
-	targetAdress common.Address, amount *big.Int, targetAmount *big.Int, excludeAddresses map[common.Address]bool, feeCharger fee.Charger) (onlineNodes []*route.State) {
+	targetAdress common.Address, amount *big.Int, targetAmount *big.Int, excludeAddresses map[common.Address]bool, feeCharger fee.Charger, pauser MediationPauser) (onlineNodes []*route.State) {
 	/*
 
 	   XXX: consider using multiple channels for a single transfer. Useful
@@ -351,20 +415,15 @@ func (cg *ChannelGraph) GetBestRoutes(nodesStatus NodesStatusGetter, ourAddress
 		if excludeAddresses[nw.neighbor] {
 			continue
 		}
-		if !c.CanTransfer() {
-			log.Debug(fmt.Sprintf("channel %s-%s cannot transfer ,ignoring ..", utils.APex(ourAddress), utils.APex(nw.neighbor)))
-			continue
-		}
-		if amount.Cmp(c.Distributable()) > 0 {
-			log.Debug(fmt.Sprintf("channel %s-%s doesn't have enough funds[%d],ignoring...", utils.APex(ourAddress), utils.APex(nw.neighbor), amount))
+		if pauser != nil && pauser.IsOutboundMediationPaused(c.ChannelIdentifier.ChannelIdentifier) {
+			log.Debug(fmt.Sprintf("channel %s-%s is paused for mediation,ignoring...", utils.APex(cg.OurAddress), utils.APex(nw.neighbor)))
 			continue
 		}
-		deviceType, isOnline := nodesStatus.GetNetworkStatus(nw.neighbor)
-		if !isOnline || (deviceType == xmpptransport.TypeMobile && nw.neighbor != targetAdress) {
-			log.Debug(fmt.Sprintf("partener %s network ignored.. isOnline:%v,deviceType:%s", utils.APex(nw.neighbor), isOnline, deviceType))
+		if !cg.canSendTo(nodesStatus, c, targetAdress, amount) {
 			continue
 		}
 		routeState := Channel2RouteState(c, nw.neighbor, targetAmount, feeCharger, []common.Address{})
+		routeState.Hops = nw.hops
 		if routeState.Fee.Cmp(utils.BigInt0) > 0 {
 			routeState.TotalFee = big.NewInt(int64(nw.weight))
 		} else { //no fee policy,
@@ -375,6 +434,116 @@ func (cg *ChannelGraph) GetBestRoutes(nodesStatus NodesStatusGetter, ourAddress
 	}
 	return
 }
+
+//canSendTo returns true if we can send `amount` to the partner of `c` as the first hop to target
+func (cg *ChannelGraph) canSendTo(nodesStatus NodesStatusGetter, c *channel.Channel, targetAddress common.Address, amount *big.Int) bool {
+	partner := c.PartnerState.Address
+	if !c.CanTransfer() {
+		log.Debug(fmt.Sprintf("channel %s-%s cannot transfer ,ignoring ..", utils.APex(cg.OurAddress), utils.APex(partner)))
+		return false
+	}
+	if amount.Cmp(c.Distributable()) > 0 {
+		log.Debug(fmt.Sprintf("channel %s-%s doesn't have enough funds[%d],ignoring...", utils.APex(cg.OurAddress), utils.APex(partner), amount))
+		return false
+	}
+	deviceType, isOnline := nodesStatus.GetNetworkStatus(partner)
+	if !isOnline || (deviceType == xmpptransport.TypeMobile && partner != targetAddress) {
+		log.Debug(fmt.Sprintf("partener %s network ignored.. isOnline:%v,deviceType:%s", utils.APex(partner), isOnline, deviceType))
+		return false
+	}
+	return true
+}
+
+const (
+	hopWeight             = 1 //每一跳的权重,手续费相同的时候跳数少的优先
+	unknownCapacityWeight = 1 //不知道押金的通道额外的权重,优先走确定有足够押金的通道
+)
+
+/*
+GetKShortestRoutes returns at most k loop-free routes from us to target with Yen's algorithm,
+the whole path is filled in each route just like routes from PFS, so mediators will follow it.
+The weight of a hop is the fee charged by the node plus hopWeight, hops without enough known capacity are skipped
+and hops with unknown capacity weigh unknownCapacityWeight more. penalties of hops which failed before are added if `penalizer` is not nil.
+make sure only be called in one thread.
+*/
+func (cg *ChannelGraph) GetKShortestRoutes(nodesStatus NodesStatusGetter, targetAddress common.Address, amount *big.Int, k int, feeCharger fee.Charger, penalizer EdgePenalizer) (routes []*route.State) {
+	ourIndex, ok := cg.address2index[cg.OurAddress]
+	if !ok {
+		return
+	}
+	targetIndex, ok := cg.address2index[targetAddress]
+	if !ok || targetIndex == ourIndex || k <= 0 {
+		return
+	}
+	g := dijkstra.NewGraph()
+	for i := range cg.g.Verticies {
+		g.AddVertex(i)
+	}
+	for _, v := range cg.g.Verticies {
+		from := cg.index2address[v.ID]
+		var nodeFee int64
+		if v.ID != ourIndex { //发起方不收费
+			//给补贴的节点按不收费计算,保证权重不为负
+			f := feeCharger.GetNodeChargeFee(from, cg.TokenAddress, amount)
+			if f.Sign() > 0 {
+				if !f.IsInt64() {
+					continue
+				}
+				nodeFee = f.Int64()
+			}
+		}
+		neighbors, _ := cg.g.GetAllNeighbors(v.ID)
+		for _, n := range neighbors {
+			to := cg.index2address[n]
+			if n == ourIndex {
+				continue
+			}
+			if v.ID == ourIndex {
+				c := cg.PartenerAddress2Channel[to]
+				if c == nil || !cg.canSendTo(nodesStatus, c, targetAddress, amount) {
+					continue
+				}
+			}
+			w := nodeFee + hopWeight
+			capacity, known := cg.capacity(from, to)
+			if !known {
+				w += unknownCapacityWeight
+			} else if capacity.Cmp(amount) < 0 {
+				continue
+			}
+			if penalizer != nil {
+				penalty := penalizer.EdgePenalty(cg.TokenAddress, from, to, amount)
+				if !penalty.IsInt64() {
+					continue
+				}
+				w += penalty.Int64()
+			}
+			err := g.AddArc(v.ID, n, w)
+			if err != nil {
+				log.Error(fmt.Sprintf("add arc %d-%d err %s", v.ID, n, err))
+			}
+		}
+	}
+	paths, err := g.KShortest(ourIndex, targetIndex, k)
+	if err != nil {
+		log.Info(fmt.Sprintf("no routes avaiable from %s to %s, err=%s", utils.APex(cg.OurAddress), utils.APex(targetAddress), err))
+		return
+	}
+	for _, p := range paths {
+		var path []common.Address
+		for _, i := range p.Path[1:] {
+			path = append(path, cg.index2address[i])
+		}
+		r := Channel2RouteState(cg.PartenerAddress2Channel[path[0]], path[0], amount, feeCharger, path)
+		r.TotalFee = big.NewInt(0)
+		for _, mediator := range path[:len(path)-1] {
+			r.TotalFee.Add(r.TotalFee, feeCharger.GetNodeChargeFee(mediator, cg.TokenAddress, amount))
+		}
+		routes = append(routes, r)
+	}
+	return
+}
+
 func (cg *ChannelGraph) haveNodes() bool {
 	return len(cg.g.Verticies) > 0
 }
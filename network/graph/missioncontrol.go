@@ -0,0 +1,272 @@
+package graph
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/transfer/route"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	defaultEdgeStatHalfLife  = time.Hour
+	defaultAttemptCostPpm    = 10000 //一次失败的代价相当于多付1%的手续费
+	defaultMinAttemptCost    = 100
+	minSuccessProbability    = 0.01
+	minEdgeStatCountToRemain = 0.01
+)
+
+//EdgeStatStore saves learned edge stats, so they survive restart. models.Dao implements it.
+type EdgeStatStore interface {
+	SaveEdgeStat(e *models.EdgeStat) error
+	GetAllEdgeStats() (stats []*models.EdgeStat, err error)
+	RemoveAllEdgeStats() error
+}
+
+//EdgePenalizer gives extra weight to channels which failed recently, MissionControl implements it
+type EdgePenalizer interface {
+	EdgePenalty(token, from, to common.Address, amount *big.Int) *big.Int
+}
+
+/*
+MissionControl learns from transfers I initiated how likely a transfer passes each channel direction.
+Successes and failures of every edge decay by half every HalfLife, so a failed mediator gets another chance later.
+The penalty of an edge is the cost of one attempt, AttemptCostPpm of the amount but at least MinAttemptCost,
+times (1-p)/p where p is the success probability. It is added to the weight of the edge by local routing,
+and to the fee of the route when ordering routes from PFS or local routing.
+*/
+type MissionControl struct {
+	HalfLife       time.Duration
+	AttemptCostPpm int64
+	MinAttemptCost int64
+	lock           sync.Mutex
+	edges          map[string]*models.EdgeStat
+	store          EdgeStatStore
+	timeFunc       func() time.Time
+}
+
+//NewMissionControl create a MissionControl and load edge stats from `store` if not nil
+func NewMissionControl(store EdgeStatStore, timeFunc ...func() time.Time) *MissionControl {
+	mc := &MissionControl{
+		HalfLife:       defaultEdgeStatHalfLife,
+		AttemptCostPpm: defaultAttemptCostPpm,
+		MinAttemptCost: defaultMinAttemptCost,
+		edges:          make(map[string]*models.EdgeStat),
+		store:          store,
+		timeFunc:       time.Now,
+	}
+	if len(timeFunc) == 1 {
+		mc.timeFunc = timeFunc[0]
+	}
+	if store == nil {
+		return mc
+	}
+	stats, err := store.GetAllEdgeStats()
+	if err != nil {
+		log.Error(fmt.Sprintf("load edge stats err %s", err))
+		return mc
+	}
+	for _, e := range stats {
+		mc.edges[e.Key] = e
+	}
+	return mc
+}
+
+//pathEdges returns all edges from `from` through `path`
+func pathEdges(from common.Address, path []common.Address) (edges [][2]common.Address) {
+	for _, to := range path {
+		edges = append(edges, [2]common.Address{from, to})
+		from = to
+	}
+	return
+}
+
+//ReportSuccess every edge from `from` through `path` to target has passed a transfer
+func (mc *MissionControl) ReportSuccess(token, from common.Address, path []common.Address) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	for _, e := range pathEdges(from, path) {
+		s := mc.getEdge(token, e[0], e[1])
+		s.Successes++
+		mc.save(s)
+	}
+}
+
+/*
+ReportFailure a transfer from `from` through `path` failed.
+We don't know which edge failed, if the first hop disposed the transfer explicitly, the first edge works,
+so the failure is shared by the others. Otherwise, such as timeout, it's shared by all edges.
+If only the first hop is known, it takes the failure, because it cannot find a route to target.
+*/
+func (mc *MissionControl) ReportFailure(token, from common.Address, path []common.Address, disposed bool, reason string) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	edges := pathEdges(from, path)
+	if len(edges) == 0 {
+		return
+	}
+	if disposed && len(edges) > 1 {
+		edges = edges[1:]
+	}
+	share := 1 / float64(len(edges))
+	for _, e := range edges {
+		s := mc.getEdge(token, e[0], e[1])
+		s.Failures += share
+		s.LastFailure = reason
+		mc.save(s)
+		log.Trace(fmt.Sprintf("edge %s-%s failed because of %s, success probability=%f",
+			utils.APex2(e[0]), utils.APex2(e[1]), reason, s.SuccessProbability()))
+	}
+}
+
+//SuccessProbability of the edge from `from` to `to` on `token`, 1 if it never failed
+func (mc *MissionControl) SuccessProbability(token, from, to common.Address) float64 {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.probability(token, from, to)
+}
+
+//EdgePenalty implements EdgePenalizer
+func (mc *MissionControl) EdgePenalty(token, from, to common.Address, amount *big.Int) *big.Int {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.penalty(mc.probability(token, from, to), amount)
+}
+
+//RoutePenalty is the sum of penalties of all edges from `from` through `path`
+func (mc *MissionControl) RoutePenalty(token, from common.Address, path []common.Address, amount *big.Int) *big.Int {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	total := big.NewInt(0)
+	for _, e := range pathEdges(from, path) {
+		total.Add(total, mc.penalty(mc.probability(token, e[0], e[1]), amount))
+	}
+	return total
+}
+
+/*
+SortRoutes orders routes from `from` by fee plus penalty, routes with the same cost keep their order.
+Only the first hop is known for routes without path.
+*/
+func (mc *MissionControl) SortRoutes(token, from common.Address, amount *big.Int, routes []*route.State) {
+	costs := make(map[*route.State]*big.Int)
+	for _, r := range routes {
+		path := r.Path
+		if len(path) == 0 {
+			path = []common.Address{r.HopNode()}
+		}
+		cost := mc.RoutePenalty(token, from, path, amount)
+		if r.TotalFee != nil {
+			cost.Add(cost, r.TotalFee)
+		}
+		costs[r] = cost
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return costs[routes[i]].Cmp(costs[routes[j]]) < 0
+	})
+}
+
+//GetEdgeStats returns all learned edges with decay applied
+func (mc *MissionControl) GetEdgeStats() (stats []*models.EdgeStat) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	stats = []*models.EdgeStat{}
+	for key, e := range mc.edges {
+		mc.decay(e)
+		if e.Successes+e.Failures < minEdgeStatCountToRemain {
+			delete(mc.edges, key)
+			continue
+		}
+		s := *e
+		stats = append(stats, &s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		pi, pj := stats[i].SuccessProbability(), stats[j].SuccessProbability()
+		if pi != pj {
+			return pi < pj
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	return
+}
+
+//Reset forgets everything learned
+func (mc *MissionControl) Reset() error {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.edges = make(map[string]*models.EdgeStat)
+	if mc.store == nil {
+		return nil
+	}
+	return mc.store.RemoveAllEdgeStats()
+}
+
+func (mc *MissionControl) probability(token, from, to common.Address) float64 {
+	e, ok := mc.edges[models.EdgeStatKey(token, from, to)]
+	if !ok {
+		return 1
+	}
+	mc.decay(e)
+	return e.SuccessProbability()
+}
+
+func (mc *MissionControl) penalty(p float64, amount *big.Int) *big.Int {
+	if p >= 1 {
+		return big.NewInt(0)
+	}
+	p = math.Max(p, minSuccessProbability)
+	cost := new(big.Int).Mul(amount, big.NewInt(mc.AttemptCostPpm))
+	cost.Div(cost, big.NewInt(1000000))
+	if cost.Cmp(big.NewInt(mc.MinAttemptCost)) < 0 {
+		cost.SetInt64(mc.MinAttemptCost)
+	}
+	//(1-p)/p in thousandths
+	cost.Mul(cost, big.NewInt(int64((1-p)/p*1000)))
+	return cost.Div(cost, big.NewInt(1000))
+}
+
+func (mc *MissionControl) getEdge(token, from, to common.Address) *models.EdgeStat {
+	key := models.EdgeStatKey(token, from, to)
+	e, ok := mc.edges[key]
+	if ok {
+		mc.decay(e)
+		return e
+	}
+	e = &models.EdgeStat{
+		Key:       key,
+		Token:     token,
+		From:      from,
+		To:        to,
+		UpdatedAt: mc.timeFunc().Unix(),
+	}
+	mc.edges[key] = e
+	return e
+}
+
+func (mc *MissionControl) decay(e *models.EdgeStat) {
+	now := mc.timeFunc().Unix()
+	elapsed := time.Duration(now-e.UpdatedAt) * time.Second
+	if elapsed > 0 && mc.HalfLife > 0 {
+		factor := math.Pow(0.5, float64(elapsed)/float64(mc.HalfLife))
+		e.Successes *= factor
+		e.Failures *= factor
+	}
+	e.UpdatedAt = now
+}
+
+func (mc *MissionControl) save(e *models.EdgeStat) {
+	if mc.store == nil {
+		return
+	}
+	err := mc.store.SaveEdgeStat(e)
+	if err != nil {
+		log.Error(fmt.Sprintf("save edge stat err %s", err))
+	}
+}
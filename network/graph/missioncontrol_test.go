@@ -0,0 +1,88 @@
+package graph
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/transfer/route"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryEdgeStatStore struct {
+	stats map[string]*models.EdgeStat
+}
+
+func (s *memoryEdgeStatStore) SaveEdgeStat(e *models.EdgeStat) error {
+	s.stats[e.Key] = e
+	return nil
+}
+
+func (s *memoryEdgeStatStore) GetAllEdgeStats() (stats []*models.EdgeStat, err error) {
+	for _, e := range s.stats {
+		stats = append(stats, e)
+	}
+	return
+}
+
+func (s *memoryEdgeStatStore) RemoveAllEdgeStats() error {
+	s.stats = make(map[string]*models.EdgeStat)
+	return nil
+}
+
+func TestMissionControl(t *testing.T) {
+	now := time.Unix(1000, 0)
+	timeFunc := func() time.Time {
+		return now
+	}
+	store := &memoryEdgeStatStore{stats: make(map[string]*models.EdgeStat)}
+	mc := NewMissionControl(store, timeFunc)
+	token := utils.NewRandomAddress()
+	us, a, b, target := utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress()
+	amount := big.NewInt(100000)
+
+	//a disposed, so a-b and b-target share the failure
+	mc.ReportFailure(token, us, []common.Address{a, b, target}, true, "no route")
+	assert.EqualValues(t, 1, mc.SuccessProbability(token, us, a))
+	assert.EqualValues(t, 1/1.5, mc.SuccessProbability(token, a, b))
+	assert.EqualValues(t, 0, mc.EdgePenalty(token, us, a, amount).Int64())
+	//attempt cost is 1% of 100000, (1-p)/p is 0.5
+	assert.EqualValues(t, 500, mc.EdgePenalty(token, a, b, amount).Int64())
+	//only first hop known, it takes the whole failure
+	mc.ReportFailure(token, us, []common.Address{b}, true, "no route")
+	assert.EqualValues(t, 0.5, mc.SuccessProbability(token, us, b))
+	//timeout, shared by all
+	mc.ReportFailure(token, us, []common.Address{a, target}, false, "lock expired")
+	assert.EqualValues(t, 1/1.5, mc.SuccessProbability(token, us, a))
+
+	//decay by half after one half life
+	now = now.Add(mc.HalfLife)
+	assert.EqualValues(t, 1/1.25, mc.SuccessProbability(token, a, b))
+	mc.ReportSuccess(token, us, []common.Address{a, b, target})
+	assert.EqualValues(t, 2/2.25, mc.SuccessProbability(token, a, b))
+
+	//survive restart
+	mc2 := NewMissionControl(store, timeFunc)
+	assert.EqualValues(t, mc.GetEdgeStats(), mc2.GetEdgeStats())
+	assert.EqualValues(t, 5, len(mc2.GetEdgeStats()))
+	assert.NoError(t, mc2.Reset())
+	assert.EqualValues(t, 0, len(mc2.GetEdgeStats()))
+	assert.EqualValues(t, 0, len(store.stats))
+}
+
+func TestMissionControlSortRoutes(t *testing.T) {
+	mc := NewMissionControl(nil)
+	token := utils.NewRandomAddress()
+	us, a, b, target := utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress(), utils.NewRandomAddress()
+	viaA := &route.State{Path: []common.Address{a, target}, TotalFee: big.NewInt(10)}
+	viaB := &route.State{Path: []common.Address{b, target}, TotalFee: big.NewInt(20)}
+	routes := []*route.State{viaA, viaB}
+	mc.SortRoutes(token, us, big.NewInt(100), routes)
+	assert.EqualValues(t, []*route.State{viaA, viaB}, routes)
+	mc.ReportFailure(token, us, []common.Address{a, target}, true, "no route")
+	mc.SortRoutes(token, us, big.NewInt(100), routes)
+	assert.EqualValues(t, []*route.State{viaB, viaA}, routes)
+}
@@ -3,6 +3,7 @@ package helper
 import (
 	"context"
 	"math/big"
+	"strings"
 	"sync"
 
 	"github.com/SmartMeshFoundation/Photon/rerr"
@@ -68,6 +69,11 @@ func (c *SafeEthClient) IsConnected() bool {
 	return c.Status == netshare.Connected
 }
 
+//SupportSubscription returns true if connected with websocket or ipc, which can push new heads and logs
+func (c *SafeEthClient) SupportSubscription() bool {
+	return !strings.HasPrefix(c.url, "http")
+}
+
 //RegisterReConnectNotify register notify when reconnect
 func (c *SafeEthClient) RegisterReConnectNotify(name string) <-chan struct{} {
 	c.lock.Lock()
@@ -116,6 +116,11 @@ func (t *MixTransport) NodeStatus(addr common.Address) (deviceType string, isOnl
 	return t.xmpp.NodeStatus(addr)
 }
 
+//MaxMessageSize large messages are fragmented by udp
+func (t *MixTransport) MaxMessageSize() int {
+	return t.udp.MaxMessageSize()
+}
+
 //GetNotify notification of connection status change
 func (t *MixTransport) GetNotify() (notify <-chan netshare.Status, err error) {
 	//if t.xmpp.conn != nil {
@@ -0,0 +1,370 @@
+package network
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/rerr"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//Misbehaviour of a peer, each one raises its score
+type Misbehaviour int
+
+const (
+	//MisbehaviourFlooding sends messages faster than its token bucket allows
+	MisbehaviourFlooding Misbehaviour = iota
+	//MisbehaviourBadSignature balance proof or message is not signed by who it should be
+	MisbehaviourBadSignature
+	//MisbehaviourUnknownChannel message about a channel which doesn't exist between us
+	MisbehaviourUnknownChannel
+	//MisbehaviourInvalidNonce message with a nonce I don't expect
+	MisbehaviourInvalidNonce
+	//MisbehaviourUnsolicited response or ack for nothing I sent, or duplicates sent far more often than the resend interval
+	MisbehaviourUnsolicited
+)
+
+func (m Misbehaviour) String() string {
+	switch m {
+	case MisbehaviourFlooding:
+		return "flooding"
+	case MisbehaviourBadSignature:
+		return "bad signature"
+	case MisbehaviourUnknownChannel:
+		return "unknown channel"
+	case MisbehaviourInvalidNonce:
+		return "invalid nonce"
+	case MisbehaviourUnsolicited:
+		return "unsolicited message"
+	}
+	return "unknown"
+}
+
+/*
+misbehaviourPenalty is how much each misbehaviour adds to the score.
+A duplicate message re-sent because my ack is lost is normal and free,
+only copies arriving within DuplicateInterval of the previous one are unsolicited.
+Ack is not signed and its sender may be forged, so unsolicited is kept cheap.
+*/
+var misbehaviourPenalty = map[Misbehaviour]float64{
+	MisbehaviourFlooding:       1,
+	MisbehaviourBadSignature:   50,
+	MisbehaviourUnknownChannel: 10,
+	MisbehaviourInvalidNonce:   10,
+	MisbehaviourUnsolicited:    5,
+}
+
+const (
+	defaultPeerMessageBurst    = 100.
+	defaultPeerMessageRate     = 20.
+	defaultPeerBanThreshold    = 100.
+	defaultPeerScoreHalfLife   = 10 * time.Minute
+	defaultPeerBanDuration     = time.Hour
+	maxPeerStatesBeforeCleanup = 10000
+	//far below the resend interval of protocol, which is 6 seconds at least
+	defaultPeerDuplicateInterval   = time.Second
+	maxPeerDuplicatesBeforeCleanup = 100
+)
+
+//PeerBanStore saves bans, so they survive restart. models.Dao implements it.
+type PeerBanStore interface {
+	SavePeerBan(b *models.PeerBan) error
+	RemovePeerBan(addr common.Address) error
+	GetAllPeerBans() (bans []*models.PeerBan, err error)
+}
+
+type peerState struct {
+	bucket    *TokenBucket
+	score     float64
+	scoreTime time.Time
+	//when did I receive the last copy of each message
+	duplicates map[common.Hash]time.Time
+}
+
+/*
+PeerPolicy protects me from abusive peers.
+Every peer has its own token bucket, so a noisy peer cannot starve the others.
+Misbehaviour raises a peer's score, which decays by half every ScoreHalfLife.
+When the score reaches BanThreshold, all messages from the peer are dropped for BanDuration.
+*/
+type PeerPolicy struct {
+	//Burst and Rate(messages per second) of each peer's token bucket
+	Burst         float64
+	Rate          float64
+	BanThreshold  float64
+	ScoreHalfLife time.Duration
+	BanDuration   time.Duration
+	//a duplicate received within DuplicateInterval of the previous copy is unsolicited
+	DuplicateInterval time.Duration
+	lock              sync.Mutex
+	peers             map[common.Address]*peerState
+	bans              map[common.Address]*models.PeerBan
+	store             PeerBanStore
+	timeFunc          timeFunc
+}
+
+//NewPeerPolicy create a PeerPolicy and load bans from `store` if not nil
+func NewPeerPolicy(store PeerBanStore, timeFunc ...timeFunc) *PeerPolicy {
+	pp := &PeerPolicy{
+		Burst:             defaultPeerMessageBurst,
+		Rate:              defaultPeerMessageRate,
+		BanThreshold:      defaultPeerBanThreshold,
+		ScoreHalfLife:     defaultPeerScoreHalfLife,
+		BanDuration:       defaultPeerBanDuration,
+		DuplicateInterval: defaultPeerDuplicateInterval,
+		peers:             make(map[common.Address]*peerState),
+		bans:              make(map[common.Address]*models.PeerBan),
+		store:             store,
+		timeFunc:          time.Now,
+	}
+	if len(timeFunc) == 1 {
+		pp.timeFunc = timeFunc[0]
+	}
+	if store == nil {
+		return pp
+	}
+	bans, err := store.GetAllPeerBans()
+	if err != nil {
+		log.Error(fmt.Sprintf("load peer bans err %s", err))
+		return pp
+	}
+	now := pp.timeFunc()
+	for _, b := range bans {
+		if b.IsExpired(now) {
+			pp.removeBanFromStore(b.Address)
+			continue
+		}
+		pp.bans[b.Address] = b
+	}
+	return pp
+}
+
+//Allow returns false if messages from `addr` should be dropped without any further processing
+func (pp *PeerPolicy) Allow(addr common.Address) bool {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	if pp.isBanned(addr) {
+		return false
+	}
+	ps := pp.getPeer(addr)
+	if ps.bucket.TryConsume(1) {
+		return true
+	}
+	pp.punish(addr, ps, MisbehaviourFlooding)
+	return false
+}
+
+//Punish raises the score of `addr`, and bans it if the score is too high
+func (pp *PeerPolicy) Punish(addr common.Address, m Misbehaviour) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	if pp.isBanned(addr) {
+		return
+	}
+	pp.punish(addr, pp.getPeer(addr), m)
+}
+
+/*
+PunishForError raises the score of `addr` if `err`,returned by photon when handling its message,
+shows misbehaviour. Other errors such as insufficient balance are not punished.
+*/
+func (pp *PeerPolicy) PunishForError(addr common.Address, err error) {
+	m, ok := misbehaviourOfError(err)
+	if ok {
+		pp.Punish(addr, m)
+	}
+}
+
+/*
+Duplicate tells me that `addr` sent the message `echohash` again.
+It's free if the previous copy was received at least DuplicateInterval ago,
+otherwise `addr` is punished for an unsolicited message.
+*/
+func (pp *PeerPolicy) Duplicate(addr common.Address, echohash common.Hash) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	if pp.isBanned(addr) {
+		return
+	}
+	ps := pp.getPeer(addr)
+	now := pp.timeFunc()
+	if ps.duplicates == nil {
+		ps.duplicates = make(map[common.Hash]time.Time)
+	}
+	if len(ps.duplicates) >= maxPeerDuplicatesBeforeCleanup {
+		for h, t := range ps.duplicates {
+			if now.Sub(t) >= pp.DuplicateInterval {
+				delete(ps.duplicates, h)
+			}
+		}
+	}
+	last, ok := ps.duplicates[echohash]
+	ps.duplicates[echohash] = now
+	if ok && now.Sub(last) < pp.DuplicateInterval {
+		pp.punish(addr, ps, MisbehaviourUnsolicited)
+	}
+}
+
+//Score returns the current score of `addr`
+func (pp *PeerPolicy) Score(addr common.Address) float64 {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	ps, ok := pp.peers[addr]
+	if !ok {
+		return 0
+	}
+	pp.decay(ps)
+	return ps.score
+}
+
+//Ban drops all messages from `addr` for `duration`
+func (pp *PeerPolicy) Ban(addr common.Address, duration time.Duration, reason string) *models.PeerBan {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	var score float64
+	if ps, ok := pp.peers[addr]; ok {
+		score = ps.score
+	}
+	return pp.ban(addr, duration, score, reason)
+}
+
+//Unban accepts messages from `addr` again and resets its score
+func (pp *PeerPolicy) Unban(addr common.Address) error {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	delete(pp.bans, addr)
+	delete(pp.peers, addr)
+	if pp.store == nil {
+		return nil
+	}
+	return pp.store.RemovePeerBan(addr)
+}
+
+//GetBans returns all peers banned right now
+func (pp *PeerPolicy) GetBans() (bans []*models.PeerBan) {
+	pp.lock.Lock()
+	defer pp.lock.Unlock()
+	bans = []*models.PeerBan{}
+	for addr := range pp.bans {
+		if pp.isBanned(addr) {
+			b := *pp.bans[addr]
+			bans = append(bans, &b)
+		}
+	}
+	return
+}
+
+//isBanned removes the ban if it's expired
+func (pp *PeerPolicy) isBanned(addr common.Address) bool {
+	b, ok := pp.bans[addr]
+	if !ok {
+		return false
+	}
+	if !b.IsExpired(pp.timeFunc()) {
+		return true
+	}
+	delete(pp.bans, addr)
+	pp.removeBanFromStore(addr)
+	return false
+}
+
+func (pp *PeerPolicy) getPeer(addr common.Address) *peerState {
+	ps, ok := pp.peers[addr]
+	if ok {
+		return ps
+	}
+	if len(pp.peers) >= maxPeerStatesBeforeCleanup {
+		pp.cleanup()
+	}
+	ps = &peerState{
+		bucket:    NewTokenBucket(pp.Burst, pp.Rate, pp.timeFunc),
+		scoreTime: pp.timeFunc(),
+	}
+	pp.peers[addr] = ps
+	return ps
+}
+
+//cleanup forgets peers which have behaved well for a while, so that random addresses cannot eat my memory
+func (pp *PeerPolicy) cleanup() {
+	for addr, ps := range pp.peers {
+		pp.decay(ps)
+		ps.bucket.getTokens()
+		if ps.score < 1 && ps.bucket.Tokens >= ps.bucket.Capacity {
+			delete(pp.peers, addr)
+		}
+	}
+}
+
+func (pp *PeerPolicy) decay(ps *peerState) {
+	now := pp.timeFunc()
+	elapsed := now.Sub(ps.scoreTime)
+	if elapsed > 0 && pp.ScoreHalfLife > 0 {
+		ps.score *= math.Pow(0.5, float64(elapsed)/float64(pp.ScoreHalfLife))
+	}
+	ps.scoreTime = now
+}
+
+func (pp *PeerPolicy) punish(addr common.Address, ps *peerState, m Misbehaviour) {
+	pp.decay(ps)
+	ps.score += misbehaviourPenalty[m]
+	log.Trace(fmt.Sprintf("peer %s misbehaviour %s, score=%f", utils.APex2(addr), m, ps.score))
+	if ps.score >= pp.BanThreshold {
+		pp.ban(addr, pp.BanDuration, ps.score, m.String())
+		//start again when the ban is over
+		delete(pp.peers, addr)
+	}
+}
+
+func (pp *PeerPolicy) ban(addr common.Address, duration time.Duration, score float64, reason string) *models.PeerBan {
+	now := pp.timeFunc()
+	b := &models.PeerBan{
+		Address:  addr,
+		Reason:   reason,
+		Score:    score,
+		BannedAt: now.Unix(),
+		Until:    now.Add(duration).Unix(),
+	}
+	pp.bans[addr] = b
+	log.Warn(fmt.Sprintf("ban peer %s until %s because of %s", utils.APex2(addr), time.Unix(b.Until, 0), reason))
+	if pp.store != nil {
+		err := pp.store.SavePeerBan(b)
+		if err != nil {
+			log.Error(fmt.Sprintf("save peer ban err %s", err))
+		}
+	}
+	return b
+}
+
+func (pp *PeerPolicy) removeBanFromStore(addr common.Address) {
+	if pp.store == nil {
+		return
+	}
+	err := pp.store.RemovePeerBan(addr)
+	if err != nil {
+		log.Error(fmt.Sprintf("remove peer ban err %s", err))
+	}
+}
+
+//misbehaviourOfError tells which misbehaviour an error returned by photon stands for
+func misbehaviourOfError(err error) (m Misbehaviour, ok bool) {
+	e, ok := err.(rerr.StandardError)
+	if !ok {
+		return
+	}
+	switch e.ErrorCode {
+	case rerr.ErrChannelInvalidSender.ErrorCode, rerr.ErrChannelNotParticipant.ErrorCode:
+		return MisbehaviourBadSignature, true
+	case rerr.ErrChannelNotFound.ErrorCode, rerr.ErrChannelIdentifierMismatch.ErrorCode:
+		return MisbehaviourUnknownChannel, true
+	case rerr.ErrInvalidNonce.ErrorCode:
+		return MisbehaviourInvalidNonce, true
+	case rerr.ErrUnsolicitedMessage.ErrorCode:
+		return MisbehaviourUnsolicited, true
+	}
+	return m, false
+}
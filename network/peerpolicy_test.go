@@ -0,0 +1,148 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/rerr"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryBanStore struct {
+	bans map[common.Address]*models.PeerBan
+}
+
+func newMemoryBanStore() *memoryBanStore {
+	return &memoryBanStore{bans: make(map[common.Address]*models.PeerBan)}
+}
+
+func (s *memoryBanStore) SavePeerBan(b *models.PeerBan) error {
+	s.bans[b.Address] = b
+	return nil
+}
+
+func (s *memoryBanStore) RemovePeerBan(addr common.Address) error {
+	delete(s.bans, addr)
+	return nil
+}
+
+func (s *memoryBanStore) GetAllPeerBans() (bans []*models.PeerBan, err error) {
+	for _, b := range s.bans {
+		bans = append(bans, b)
+	}
+	return
+}
+
+func TestPeerPolicyRateLimit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	timeFunc := func() time.Time {
+		return now
+	}
+	pp := NewPeerPolicy(nil, timeFunc)
+	pp.Burst = 5
+	pp.Rate = 1
+	noisy := utils.NewRandomAddress()
+	quiet := utils.NewRandomAddress()
+	for i := 0; i < 5; i++ {
+		assert.True(t, pp.Allow(noisy))
+	}
+	assert.False(t, pp.Allow(noisy))
+	assert.EqualValues(t, misbehaviourPenalty[MisbehaviourFlooding], pp.Score(noisy))
+	//the noisy one doesn't affect others
+	assert.True(t, pp.Allow(quiet))
+	now = now.Add(time.Second)
+	assert.True(t, pp.Allow(noisy))
+	assert.False(t, pp.Allow(noisy))
+}
+
+func TestPeerPolicyBan(t *testing.T) {
+	now := time.Unix(1000, 0)
+	timeFunc := func() time.Time {
+		return now
+	}
+	store := newMemoryBanStore()
+	pp := NewPeerPolicy(store, timeFunc)
+	addr := utils.NewRandomAddress()
+	for i := 0; i < 9; i++ {
+		pp.Punish(addr, MisbehaviourInvalidNonce)
+	}
+	assert.True(t, pp.Allow(addr))
+	assert.EqualValues(t, 0, len(pp.GetBans()))
+	//score decays
+	now = now.Add(pp.ScoreHalfLife)
+	assert.InDelta(t, 45, pp.Score(addr), 0.001)
+	pp.PunishForError(addr, rerr.ErrInsufficientBalance)
+	assert.InDelta(t, 45, pp.Score(addr), 0.001)
+	pp.PunishForError(addr, rerr.ChannelNotFound("test"))
+	pp.PunishForError(addr, rerr.ErrChannelInvalidSender)
+	assert.False(t, pp.Allow(addr))
+	bans := pp.GetBans()
+	assert.EqualValues(t, 1, len(bans))
+	assert.EqualValues(t, addr, bans[0].Address)
+	assert.EqualValues(t, MisbehaviourBadSignature.String(), bans[0].Reason)
+	assert.EqualValues(t, 1, len(store.bans))
+
+	//bans survive restart
+	pp = NewPeerPolicy(store, timeFunc)
+	assert.False(t, pp.Allow(addr))
+	now = now.Add(pp.BanDuration)
+	assert.True(t, pp.Allow(addr))
+	assert.EqualValues(t, 0, pp.Score(addr))
+	assert.EqualValues(t, 0, len(store.bans))
+}
+
+func TestPeerPolicyUnban(t *testing.T) {
+	store := newMemoryBanStore()
+	pp := NewPeerPolicy(store)
+	addr := utils.NewRandomAddress()
+	pp.Ban(addr, time.Hour, "test")
+	assert.False(t, pp.Allow(addr))
+	//expired bans are dropped when loading
+	expired := utils.NewRandomAddress()
+	store.bans[expired] = &models.PeerBan{Address: expired, Until: time.Now().Add(-time.Second).Unix()}
+	pp = NewPeerPolicy(store)
+	assert.EqualValues(t, 1, len(pp.GetBans()))
+	assert.EqualValues(t, 1, len(store.bans))
+	err := pp.Unban(addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	assert.True(t, pp.Allow(addr))
+	assert.EqualValues(t, 0, len(pp.GetBans()))
+	assert.EqualValues(t, 0, len(store.bans))
+}
+
+func TestPeerPolicyUnsolicited(t *testing.T) {
+	now := time.Unix(1000, 0)
+	timeFunc := func() time.Time {
+		return now
+	}
+	pp := NewPeerPolicy(nil, timeFunc)
+	addr := utils.NewRandomAddress()
+	echohash := utils.NewRandomHash()
+	//resent because my ack is lost, it's free
+	for i := 0; i < 5; i++ {
+		pp.Duplicate(addr, echohash)
+		now = now.Add(pp.DuplicateInterval)
+	}
+	assert.EqualValues(t, 0, pp.Score(addr))
+	//other messages don't count as duplicates
+	pp.Duplicate(addr, utils.NewRandomHash())
+	assert.EqualValues(t, 0, pp.Score(addr))
+	//far more often than the resend interval
+	pp.Duplicate(addr, echohash)
+	pp.Duplicate(addr, echohash)
+	assert.EqualValues(t, misbehaviourPenalty[MisbehaviourUnsolicited], pp.Score(addr))
+	//response for a request i never sent
+	pp.PunishForError(addr, rerr.ErrUnsolicitedMessage.Errorf("test"))
+	assert.EqualValues(t, 2*misbehaviourPenalty[MisbehaviourUnsolicited], pp.Score(addr))
+	for i := 0; pp.Allow(addr); i++ {
+		pp.Punish(addr, MisbehaviourUnsolicited)
+		assert.True(t, i < 20)
+	}
+	assert.EqualValues(t, MisbehaviourUnsolicited.String(), pp.GetBans()[0].Reason)
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/SmartMeshFoundation/Photon/internal/rpanic"
 	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/params"
+	"github.com/SmartMeshFoundation/Photon/rerr"
 	"github.com/SmartMeshFoundation/Photon/utils"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -36,8 +37,17 @@ MessageToPhoton message and it's echo hash
 type MessageToPhoton struct {
 	Msg      encoding.SignedMessager
 	EchoHash common.Hash
+	//photon must write the result of handling the message here, it's buffered
+	Result chan error
 }
 
+const (
+	//deliverQueueSize messages of one sender waiting to be delivered to photon, more are dropped and resent by the sender
+	deliverQueueSize = 100
+	//deliverIdleTimeout the goroutine delivering messages of a sender quits after being idle so long
+	deliverIdleTimeout = time.Minute
+)
+
 // SentMessageState is the state of message on sending
 type SentMessageState struct {
 	AsyncResult     *utils.AsyncResult
@@ -48,6 +58,8 @@ type SentMessageState struct {
 	Message  encoding.Messager //message to send
 	EchoHash common.Hash       //message echo hash
 	Data     []byte            //packed message
+	//resendChan resend now instead of waiting for timeout, nil if not sent in window
+	resendChan chan struct{}
 }
 
 // PingSender do send ping task
@@ -110,6 +122,20 @@ type queueMessagesAndLock struct {
 	messages   []*SentMessageState //todo fixme use channel to avoid lock
 	lock       sync.Mutex
 	wakeUpChan chan int
+	//number of messages sent but not acked
+	sending int
+	//a message which must be sent alone is being sent
+	exclusive bool
+	//balance proof messages sent but not acked, nonce -> message
+	inflight map[uint64]*SentMessageState
+}
+
+//wakeUp never blocks
+func (ql *queueMessagesAndLock) wakeUp() {
+	select {
+	case ql.wakeUpChan <- 0:
+	default:
+	}
 }
 
 /*
@@ -121,47 +147,73 @@ type PhotonProtocol struct {
 	privKey             *ecdsa.PrivateKey
 	nodeAddr            common.Address
 	SentHashesToChannel map[common.Hash]*SentMessageState
-	retryTimes          int
-	retryInterval       time.Duration
-	mapLock             sync.Mutex
-	statusLock          sync.RWMutex
+	//messages acked recently, so a late duplicate ack is not taken as unsolicited
+	ackedHashes       map[common.Hash]time.Time
+	ackedHashesPruned time.Time
+	retryTimes        int
+	retryInterval     time.Duration
+	mapLock           sync.Mutex
+	statusLock        sync.RWMutex
 	/*
-		message from other nodes
+		message from other nodes, messages of different senders may be in flight at the same time,
+		messages of one sender are sent one by one, after the result of the previous one.
 	*/
-	ReceivedMessageChan chan *MessageToPhoton
-	/*
-		this is a synchronized chan,reading  process message result from photon
-	*/
-	ReceivedMessageResultChan chan error
-	sendingChanMap            map[string]chan *SentMessageState //write to this channel to send a message
-	sendingQueueMap           map[string]*queueMessagesAndLock
-	receivedMessageSaver      ReceivedMessageSaver
-	ChannelStatusGetter       ChannelStatusGetter
-	onStop                    bool //flag for stop
+	ReceivedMessageChan  chan *MessageToPhoton
+	sendingChanMap       map[string]chan *SentMessageState //write to this channel to send a message
+	sendingQueueMap      map[string]*queueMessagesAndLock
+	receivedMessageSaver ReceivedMessageSaver
+	ChannelStatusGetter  ChannelStatusGetter
+	onStop               bool //flag for stop
 	//notify quit
 	quitChan chan struct{}
 	//receive data
 	receiveChan chan []byte
 	log         log.Logger
 	isReceiving bool
+	//size of the largest message accepted by transport
+	maxMessageSize int
+	//optional features I support, see encoding.FeatureEncryption
+	features uint32
+	peers    *peerCapabilities
+	//nil if inbound messages are not limited
+	peerPolicy *PeerPolicy
+	//max balance proof messages sent but not acked per channel, 1 means one by one
+	sendWindow int
+	//balance proof messages received before the ones with smaller nonce, each one is used by the goroutine delivering its sender's messages
+	reorderBuffers map[string]*reorderBuffer
+	reorderLock    sync.Mutex
+	//messages waiting to be delivered to photon of each sender
+	deliverQueues map[common.Address]chan *MessageToPhoton
+	deliverLock   sync.Mutex
 }
 
 // NewPhotonProtocol create PhotonProtocol
 func NewPhotonProtocol(transport Transporter, privKey *ecdsa.PrivateKey, channelStatusGetter ChannelStatusGetter) *PhotonProtocol {
 	rp := &PhotonProtocol{
-		Transport:                 transport,
-		privKey:                   privKey,
-		retryTimes:                10,
-		retryInterval:             time.Millisecond * 6000,
-		SentHashesToChannel:       make(map[common.Hash]*SentMessageState),
-		ReceivedMessageChan:       make(chan *MessageToPhoton),
-		ReceivedMessageResultChan: make(chan error),
-		sendingChanMap:            make(map[string]chan *SentMessageState),
-		sendingQueueMap:           make(map[string]*queueMessagesAndLock),
-		ChannelStatusGetter:       channelStatusGetter,
-		quitChan:                  make(chan struct{}),
-		receiveChan:               make(chan []byte, 200),
-		mapLock:                   sync.Mutex{},
+		Transport:           transport,
+		privKey:             privKey,
+		retryTimes:          10,
+		retryInterval:       time.Millisecond * 6000,
+		SentHashesToChannel: make(map[common.Hash]*SentMessageState),
+		ackedHashes:         make(map[common.Hash]time.Time),
+		ReceivedMessageChan: make(chan *MessageToPhoton),
+		sendingChanMap:      make(map[string]chan *SentMessageState),
+		sendingQueueMap:     make(map[string]*queueMessagesAndLock),
+		ChannelStatusGetter: channelStatusGetter,
+		quitChan:            make(chan struct{}),
+		receiveChan:         make(chan []byte, 200),
+		mapLock:             sync.Mutex{},
+		maxMessageSize:      params.UDPMaxMessageSize,
+		peers:               newPeerCapabilities(),
+		sendWindow:          1,
+		reorderBuffers:      make(map[string]*reorderBuffer),
+		deliverQueues:       make(map[common.Address]chan *MessageToPhoton),
+	}
+	if _, ok := channelStatusGetter.(PartnerNonceGetter); ok {
+		rp.features |= encoding.FeatureReorder
+	}
+	if l, ok := transport.(messageSizeLimiter); ok {
+		rp.maxMessageSize = l.MaxMessageSize()
 	}
 	rp.nodeAddr = crypto.PubkeyToAddress(privKey.PublicKey)
 	transport.RegisterProtocol(rp)
@@ -180,6 +232,16 @@ func New(sample interface{}) interface{} {
 	return v
 }
 
+// SetPeerPolicy limit the rate of messages from each peer and drop messages from banned peers
+func (p *PhotonProtocol) SetPeerPolicy(pp *PeerPolicy) {
+	p.peerPolicy = pp
+}
+
+// GetPeerPolicy returns nil if not set
+func (p *PhotonProtocol) GetPeerPolicy() *PeerPolicy {
+	return p.peerPolicy
+}
+
 // SetReceivedMessageSaver set db saver
 func (p *PhotonProtocol) SetReceivedMessageSaver(saver ReceivedMessageSaver) {
 	p.receivedMessageSaver = saver
@@ -205,6 +267,7 @@ func (p *PhotonProtocol) sendRawWitNoAck(receiver common.Address, data []byte) e
 
 // SendPing PingSender
 func (p *PhotonProtocol) SendPing(receiver common.Address) error {
+	p.queryCapabilities(receiver)
 	ping := encoding.NewPing(utils.NewRandomInt64())
 	err := ping.Sign(p.privKey, ping)
 	if err != nil {
@@ -255,7 +318,7 @@ func (p *PhotonProtocol) processSentMessageState(receiver common.Address, channe
 		go p.sendMessage(receiver, msgState)
 		return
 	}
-	key := fmt.Sprintf("%s-%s", receiver.String(), channelIdentifier.String())
+	key := channelQueueKey(receiver, channelIdentifier)
 	p.mapLock.Lock()
 	defer p.mapLock.Unlock()
 	ql, ok := p.sendingQueueMap[key]
@@ -263,16 +326,13 @@ func (p *PhotonProtocol) processSentMessageState(receiver common.Address, channe
 		//存在,顺序投递并唤醒发送goroutine,然后退出
 		log.Trace(fmt.Sprintf("send message EchoHash=%s with exist SendingQueue", utils.HPex(msgState.EchoHash)))
 		ql.messages = append(ql.messages, msgState)
-		select {
-		case ql.wakeUpChan <- 0:
-		default:
-			// never block
-		}
+		ql.wakeUp()
 		return
 	}
 	// 创建ql并启动goroutine发送
 	ql = &queueMessagesAndLock{
-		wakeUpChan: make(chan int),
+		wakeUpChan: make(chan int, 1),
+		inflight:   make(map[uint64]*SentMessageState),
 	}
 	ql.messages = append(ql.messages, msgState)
 	p.sendingQueueMap[key] = ql
@@ -282,7 +342,12 @@ func (p *PhotonProtocol) processSentMessageState(receiver common.Address, channe
 		log.Trace(fmt.Sprintf("send message EchoHash=%s with New SendingQueue", utils.HPex(msgState.EchoHash)))
 		for {
 			p.mapLock.Lock()
-			if len(ql.messages) == 0 {
+			// 队列为空,窗口已满,或者正在发送的消息不允许其他消息同时发送
+			window := 0
+			if len(ql.messages) > 0 && !ql.exclusive {
+				window = p.sendWindowFor(receiver, ql.messages[0].Message)
+			}
+			if ql.sending >= window {
 				p.mapLock.Unlock()
 				// goroutine保留一段时间,防止频繁创建
 				select {
@@ -301,8 +366,29 @@ func (p *PhotonProtocol) processSentMessageState(receiver common.Address, channe
 			}
 			msg := ql.messages[0]
 			ql.messages = ql.messages[1:]
+			ql.sending++
+			exclusive := window == 1
+			ql.exclusive = exclusive
+			nonce := getMessageNonce(msg.Message)
+			if nonce != 0 {
+				msg.resendChan = make(chan struct{}, 1)
+				ql.inflight[nonce] = msg
+			}
 			p.mapLock.Unlock()
-			p.sendMessage(receiver, msg)
+			go func() {
+				defer rpanic.PanicRecover(fmt.Sprintf("protocol ChannelQueue %s send", key))
+				p.sendMessage(receiver, msg)
+				p.mapLock.Lock()
+				ql.sending--
+				if exclusive {
+					ql.exclusive = false
+				}
+				if nonce != 0 {
+					delete(ql.inflight, nonce)
+				}
+				p.mapLock.Unlock()
+				ql.wakeUp()
+			}()
 		}
 	}()
 }
@@ -320,7 +406,7 @@ func (p *PhotonProtocol) sendMessage(receiver common.Address, msgState *SentMess
 			return
 		}
 		nextTimeout := timeoutExponentialBackoff(p.retryTimes, p.retryInterval, p.retryInterval*10)
-		err := p.sendRawWitNoAck(receiver, msgState.Data)
+		err := p.sendRawWitNoAck(receiver, p.encryptIfPossible(receiver, msgState.Data))
 		if err != nil {
 			p.log.Info(fmt.Sprintf("sendRawWitNoAck msg echoHash=%s error %s", utils.HPex(msgState.EchoHash), err.Error()))
 		}
@@ -339,6 +425,8 @@ func (p *PhotonProtocol) sendMessage(receiver common.Address, msgState *SentMess
 				p.log.Info(fmt.Sprintf("sendMessage EchoHash=%s stop retry, because of chan closed", utils.HPex(msgState.EchoHash)))
 			}
 			return
+		case <-msgState.resendChan:
+			p.log.Debug(fmt.Sprintf("resend msg EchoHash=%s on request", utils.HPex(msgState.EchoHash)))
 		case <-timeout: //retry
 			// 如果是matrix且对方不在线,挂起并等待唤醒
 			_, isOnline := p.Transport.NodeStatus(receiver)
@@ -406,6 +494,12 @@ func (p *PhotonProtocol) sendWithResult(receiver common.Address,
 		}
 	}
 	data := msg.Pack()
+	//fail fast, receiver would drop it anyway
+	if c := p.peers.getCapabilities(receiver); c != nil {
+		if err := c.CanDecode(data); err != nil {
+			return utils.NewAsyncResultWithError(rerr.ErrPeerNotSupport.AppendError(err))
+		}
+	}
 	echohash := utils.Sha3(data, receiver[:])
 	p.mapLock.Lock()
 	msgState, ok := p.SentHashesToChannel[echohash]
@@ -427,6 +521,7 @@ because they sending same SecretRequest and RevealSecret,msg=%s`, msg))
 	p.SentHashesToChannel[echohash] = msgState
 	p.mapLock.Unlock()
 	result = msgState.AsyncResult
+	p.queryCapabilities(receiver)
 	channelIdentifier, _ := getMessageChannelIdentifier(msg)
 	p.processSentMessageState(receiver, channelIdentifier, msgState)
 	return
@@ -485,7 +580,7 @@ func (p *PhotonProtocol) loop() {
 }
 
 func (p *PhotonProtocol) receiveInternal(data []byte) {
-	if len(data) > params.UDPMaxMessageSize {
+	if len(data) > p.maxMessageSize {
 		p.log.Error("receive packet larger than maximum size :", len(data))
 		return
 	}
@@ -493,12 +588,35 @@ func (p *PhotonProtocol) receiveInternal(data []byte) {
 	if p.onStop {
 		return
 	}
+	if int(data[0]) == encoding.EncryptedCmdID {
+		plain, err := p.decrypt(data)
+		if err != nil {
+			p.log.Warn(fmt.Sprintf("decrypt message err %s", err))
+			return
+		}
+		data = plain
+	}
 	cmdid := int(data[0])
 	messager, ok := encoding.MessageMap[cmdid]
 	if !ok {
 		p.log.Warn("receive unknown message:", hex.Dump(data))
 		return
 	}
+	/*
+		ack is not signed, its sender may be forged, so only signed messages are limited.
+		check before unpacking the message and touching db or photon.
+	*/
+	if p.peerPolicy != nil && cmdid != encoding.AckCmdID {
+		sender, err := encoding.VerifyMessage(data)
+		if err != nil {
+			p.log.Warn(fmt.Sprintf("recover sender of message err %s", err))
+			return
+		}
+		if !p.peerPolicy.Allow(sender) {
+			p.log.Debug(fmt.Sprintf("drop message %s from %s by peer policy", encoding.MessageType(cmdid), utils.APex2(sender)))
+			return
+		}
+	}
 	messager = New(messager).(encoding.Messager)
 	err := messager.UnPack(data)
 	if err != nil {
@@ -514,6 +632,10 @@ func (p *PhotonProtocol) receiveInternal(data []byte) {
 				p.log.Error(fmt.Sprintf("received a message %s, not ack ,and don't signed", messager))
 				return
 			}
+			//resent because my ack is lost, it's normal, don't punish it unless it's resent too often
+			if p.peerPolicy != nil {
+				p.peerPolicy.Duplicate(sm.GetSender(), echohash)
+			}
 			p.sendRawAck(sm.GetSender(), ackdata)
 			return
 		}
@@ -523,14 +645,28 @@ func (p *PhotonProtocol) receiveInternal(data []byte) {
 		p.log.Debug(fmt.Sprintf("receive ack ,EchoHash=%s", utils.HPex(ackMsg.Echo)))
 		p.mapLock.Lock()
 		msgState, ok := p.SentHashesToChannel[ackMsg.Echo]
+		_, acked := p.ackedHashes[ackMsg.Echo]
 		if ok && msgState.Success == false {
 			msgState.AckChannel <- nil
 			close(msgState.AckChannel)
 			msgState.Success = true
-		} else {
+			p.rememberAcked(ackMsg.Echo)
+		} else if ok || acked {
 			p.log.Debug(fmt.Sprintf("receive duplicate ack  from %s", utils.APex(ackMsg.Sender)))
 		}
 		p.mapLock.Unlock()
+		/*
+			ack is not signed, so its sender may be forged,
+			the penalty of unsolicited message is small enough that a few forged acks cannot ban an honest peer.
+		*/
+		if p.peerPolicy != nil {
+			if ok || acked {
+				p.peerPolicy.Duplicate(ackMsg.Sender, ackMsg.Echo)
+			} else {
+				p.log.Info(fmt.Sprintf("receive ack from %s for a message i never sent, EchoHash=%s", utils.APex(ackMsg.Sender), utils.HPex(ackMsg.Echo)))
+				p.peerPolicy.Punish(ackMsg.Sender, MisbehaviourUnsolicited)
+			}
+		}
 	} else {
 		signedMessager, ok := messager.(encoding.SignedMessager)
 		p.log.Trace(fmt.Sprintf("received msg=%s from=%s,expect ack EchoHash=%s", messager, utils.APex2(signedMessager.GetSender()), utils.HPex(echohash)))
@@ -538,32 +674,131 @@ func (p *PhotonProtocol) receiveInternal(data []byte) {
 			p.log.Warn("message should be signed except for ack")
 			return
 		}
-		if messager.Cmd() == encoding.PingCmdID { //send ack
+		p.rememberPubkey(signedMessager, data)
+		if messager.Cmd() == encoding.CapabilitiesCmdID { //no ack
+			p.handleCapabilities(messager.(*encoding.Capabilities))
+		} else if messager.Cmd() == encoding.ResendRequestCmdID { //no ack
+			p.handleResendRequest(messager.(*encoding.ResendRequest))
+		} else if messager.Cmd() == encoding.PingCmdID { //send ack
 			p.sendAck(signedMessager.GetSender(), p.CreateAck(echohash))
 		} else {
-			//send message to photon ,and wait result
-			p.log.Trace(fmt.Sprintf("protocol send message to photon... %s", signedMessager))
-			p.ReceivedMessageChan <- &MessageToPhoton{signedMessager, echohash}
-			select {
-			case err, ok = <-p.ReceivedMessageResultChan:
-			case <-p.quitChan:
-				ok = false
-				err = errors.New("protocol stoped")
+			p.deliverInOrder(signedMessager, echohash)
+		}
+	}
+
+}
+
+/*
+rememberAcked keeps `echohash` long enough for the acks of all my resent copies to arrive,
+must be called with mapLock held.
+*/
+func (p *PhotonProtocol) rememberAcked(echohash common.Hash) {
+	now := time.Now()
+	p.ackedHashes[echohash] = now
+	if now.Sub(p.ackedHashesPruned) < p.retryInterval {
+		return
+	}
+	p.ackedHashesPruned = now
+	for h, t := range p.ackedHashes {
+		if now.Sub(t) > p.retryInterval*10 {
+			delete(p.ackedHashes, h)
+		}
+	}
+}
+
+//deliverToPhoton send message to photon ,and wait result, returns true if photon accepts it
+func (p *PhotonProtocol) deliverToPhoton(signedMessager encoding.SignedMessager, echohash common.Hash) bool {
+	var err error
+	var ok bool
+	p.log.Trace(fmt.Sprintf("protocol send message to photon... %s", signedMessager))
+	m := &MessageToPhoton{signedMessager, echohash, make(chan error, 1)}
+	select {
+	case p.ReceivedMessageChan <- m:
+		select {
+		case err, ok = <-m.Result:
+		case <-p.quitChan:
+			ok = false
+			err = errors.New("protocol stoped")
+		}
+	case <-p.quitChan:
+		ok = false
+		err = errors.New("protocol stoped")
+	}
+	p.log.Trace(fmt.Sprintf("protocol receive message response from photon ok=%v,err=%v", ok, err))
+	//only send the Ack if the message was handled without exceptions
+	if err == nil && ok {
+		ack := p.CreateAck(echohash)
+		p.sendAck(signedMessager.GetSender(), ack)
+		if p.receivedMessageSaver != nil {
+			p.receivedMessageSaver.SaveAck(echohash, signedMessager, ack.Pack())
+		}
+		return true
+	}
+	p.log.Info(fmt.Sprintf("and photon report error %s, for Received Message %s", err, utils.StringInterface(signedMessager, 3)))
+	if p.peerPolicy != nil {
+		p.peerPolicy.PunishForError(signedMessager.GetSender(), err)
+	}
+	return false
+}
+
+/*
+deliverInOrder delivers messages of different senders to photon in parallel,
+and messages of one sender in the order received.
+*/
+func (p *PhotonProtocol) deliverInOrder(msg encoding.SignedMessager, echohash common.Hash) {
+	sender := msg.GetSender()
+	p.deliverLock.Lock()
+	defer p.deliverLock.Unlock()
+	q, ok := p.deliverQueues[sender]
+	if !ok {
+		q = make(chan *MessageToPhoton, deliverQueueSize)
+		p.deliverQueues[sender] = q
+		go p.deliverLoop(sender, q)
+	}
+	select {
+	case q <- &MessageToPhoton{Msg: msg, EchoHash: echohash}:
+	default:
+		p.log.Warn(fmt.Sprintf("too many messages from %s waiting, drop %s", utils.APex2(sender), msg))
+	}
+}
+
+func (p *PhotonProtocol) deliverLoop(sender common.Address, q chan *MessageToPhoton) {
+	defer rpanic.PanicRecover(fmt.Sprintf("protocol deliver %s", utils.APex2(sender)))
+	for {
+		select {
+		case m := <-q:
+			//the same message may be queued twice if my ack is lost while it's waiting
+			if p.ackIfHandled(m.Msg, m.EchoHash) || p.bufferIfOutOfOrder(m.Msg, m.EchoHash) {
+				continue
 			}
-			p.log.Trace(fmt.Sprintf("protocol receive message response from photon ok=%v,err=%v", ok, err))
-			//only send the Ack if the message was handled without exceptions
-			if err == nil && ok {
-				ack := p.CreateAck(echohash)
-				p.sendAck(signedMessager.GetSender(), ack)
-				if p.receivedMessageSaver != nil {
-					p.receivedMessageSaver.SaveAck(echohash, messager, ack.Pack())
-				}
-			} else {
-				p.log.Info(fmt.Sprintf("and photon report error %s, for Received Message %s", err, utils.StringInterface(signedMessager, 3)))
+			if p.deliverToPhoton(m.Msg, m.EchoHash) {
+				p.deliverBuffered(m.Msg)
 			}
+		case <-time.After(deliverIdleTimeout):
+			p.deliverLock.Lock()
+			if len(q) == 0 {
+				delete(p.deliverQueues, sender)
+				p.deliverLock.Unlock()
+				return
+			}
+			p.deliverLock.Unlock()
+		case <-p.quitChan:
+			return
 		}
 	}
+}
 
+//ackIfHandled sends the ack again and returns true if `msg` has been handled by photon
+func (p *PhotonProtocol) ackIfHandled(msg encoding.SignedMessager, echohash common.Hash) bool {
+	if p.receivedMessageSaver == nil {
+		return false
+	}
+	ackdata := p.receivedMessageSaver.GetAck(echohash)
+	if len(ackdata) == 0 {
+		return false
+	}
+	p.sendRawAck(msg.GetSender(), ackdata)
+	return true
 }
 
 // StopAndWait stop andf wait for clean.
@@ -599,12 +834,15 @@ type NodeInfo struct {
 	Address    string `json:"address"`
 	IPPort     string `json:"ip_port"`
 	DeviceType string `json:"device_type"` // must be mobile?
+	//MTU largest udp datagram to this node, messages larger than it are sent in fragments, default params.UDPMaxMessageSize
+	MTU int `json:"mtu,omitempty"`
 }
 
 // UpdateMeshNetworkNodes update nodes in this intranet
 func (p *PhotonProtocol) UpdateMeshNetworkNodes(nodes []*NodeInfo) error {
 	//p.log.Trace(fmt.Sprintf("nodes=%s", utils.StringInterface(nodes, 3)))
 	nodesmap := make(map[common.Address]*net.UDPAddr)
+	mtus := make(map[common.Address]int)
 	for _, n := range nodes {
 		addr := common.HexToAddress(n.Address)
 		host, port, err := net.SplitHostPort(n.IPPort)
@@ -620,15 +858,51 @@ func (p *PhotonProtocol) UpdateMeshNetworkNodes(nodes []*NodeInfo) error {
 			Port: porti,
 		}
 		nodesmap[addr] = ua
+		if n.MTU > 0 {
+			mtus[addr] = n.MTU
+		}
 	}
+	var udp *UDPTransport
 	if transport, ok := p.Transport.(*MixTransport); ok {
-		transport.udp.setHostPort(nodesmap)
+		udp = transport.udp
 	} else if transport, ok := p.Transport.(*MatrixMixTransport); ok {
-		transport.udp.setHostPort(nodesmap)
+		udp = transport.udp
 	} else if transport, ok := p.Transport.(*UDPTransport); ok {
-		transport.setHostPort(nodesmap)
+		udp = transport
 	} else {
 		return errors.New("no need to register nodes while udp doesn't work")
 	}
+	err := udp.setPeerMTU(mtus)
+	if err != nil {
+		return err
+	}
+	udp.setHostPort(nodesmap)
+	return nil
+}
+
+func (p *PhotonProtocol) getTCPTransport() *TCPTransport {
+	if transport, ok := p.Transport.(*MatrixMixTransport); ok {
+		return transport.tcp
+	} else if transport, ok := p.Transport.(*TCPTransport); ok {
+		return transport
+	}
 	return nil
 }
+
+// UpdateTCPPeers save signed tcp addresses of other nodes
+func (p *PhotonProtocol) UpdateTCPPeers(anns []*AddressAnnouncement) error {
+	t := p.getTCPTransport()
+	if t == nil {
+		return errors.New("tcp transport is not enabled")
+	}
+	return t.AddAnnouncements(anns)
+}
+
+// TCPAnnouncement returns my signed tcp address, other nodes need it to connect to me directly
+func (p *PhotonProtocol) TCPAnnouncement() (*AddressAnnouncement, error) {
+	t := p.getTCPTransport()
+	if t == nil {
+		return nil, errors.New("tcp transport is not enabled")
+	}
+	return t.Announcement(), nil
+}
@@ -18,10 +18,13 @@ import (
 	"github.com/SmartMeshFoundation/Photon/encoding"
 	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/network/rpc/contracts"
+	"github.com/SmartMeshFoundation/Photon/rerr"
 	"github.com/SmartMeshFoundation/Photon/transfer/mtree"
 	"github.com/SmartMeshFoundation/Photon/utils"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
 )
 
 func init() {
@@ -89,7 +92,7 @@ func TestPhotonProtocolSendReceiveNormalMessage(t *testing.T) {
 		m := <-p2.ReceivedMessageChan
 		t.Logf("received msg :%#v", m)
 		msg = m.Msg
-		p2.ReceivedMessageResultChan <- nil
+		m.Result <- nil
 	}()
 	err := p1.SendAndWait(p2.nodeAddr, revealSecretMsg, time.Minute)
 	if err != nil {
@@ -106,6 +109,108 @@ func TestPhotonProtocolSendReceiveNormalMessage(t *testing.T) {
 	}
 }
 
+//recordTransport remembers every packet sent
+type recordTransport struct {
+	*TCPTransport
+	lock sync.Mutex
+	sent [][]byte
+}
+
+func (r *recordTransport) Send(receiver common.Address, data []byte) error {
+	r.lock.Lock()
+	r.sent = append(r.sent, data)
+	r.lock.Unlock()
+	return r.TCPTransport.Send(receiver, data)
+}
+
+func (r *recordTransport) sentCmds() (cmds []int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, d := range r.sent {
+		cmds = append(cmds, int(d[0]))
+	}
+	return
+}
+
+func TestPhotonProtocolEncryption(t *testing.T) {
+	makeProtocol := func(name string) (*PhotonProtocol, *recordTransport) {
+		key, _ := crypto.GenerateKey()
+		tt, err := NewTCPTransport(name, fmt.Sprintf("127.0.0.1:%d", randomPort()), "", key, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt := &recordTransport{TCPTransport: tt}
+		p := NewPhotonProtocol(rt, key, &testChannelStatusGetter{})
+		p.EnableEncryption()
+		return p, rt
+	}
+	p1, t1 := makeProtocol("p1")
+	p2, t2 := makeProtocol("p2")
+	err := t1.AddAnnouncements([]*AddressAnnouncement{t2.Announcement()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1.Start(true)
+	p2.Start(true)
+	defer p1.StopAndWait()
+	defer p2.StopAndWait()
+	go func() {
+		for {
+			select {
+			case m := <-p2.ReceivedMessageChan:
+				m.Result <- nil
+			case <-p2.quitChan:
+				return
+			}
+		}
+	}()
+	send := func() {
+		msg := encoding.NewRevealSecret(utils.ShaSecret(utils.NewRandomHash().Bytes()))
+		err = msg.Sign(p1.privKey, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p1.SendAndWait(p2.nodeAddr, msg, time.Second*5)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	//first message is plain, capabilities are exchanged at the same time
+	send()
+	for i := 0; i < 50 && !p1.PeerSupportsEncryption(p2.nodeAddr); i++ {
+		time.Sleep(time.Millisecond * 20)
+	}
+	assert.True(t, p1.PeerSupportsEncryption(p2.nodeAddr))
+	assert.True(t, p2.PeerSupportsEncryption(p1.nodeAddr))
+	send()
+	cmds := t1.sentCmds()
+	assert.Contains(t, cmds, encoding.RevealSecretCmdID)
+	assert.Equal(t, encoding.EncryptedCmdID, cmds[len(cmds)-1])
+
+	//p2 announces it cannot decode RevealSecret any more
+	c := encoding.NewCapabilities(0, time.Now().UnixNano(), false)
+	for i, r := range c.Versions {
+		if r.CmdID == encoding.RevealSecretCmdID {
+			c.Versions = append(c.Versions[:i], c.Versions[i+1:]...)
+			break
+		}
+	}
+	c.Sign(p2.privKey, c)
+	p1.handleCapabilities(c)
+	assert.False(t, p1.PeerSupportsEncryption(p2.nodeAddr))
+	msg := encoding.NewRevealSecret(utils.ShaSecret(utils.NewRandomHash().Bytes()))
+	msg.Sign(p1.privKey, msg)
+	isNotSupport := func(err error) bool {
+		se, ok := err.(rerr.StandardError)
+		return ok && se.ErrorCode == rerr.ErrPeerNotSupport.ErrorCode
+	}
+	err = p1.SendAndWait(p2.nodeAddr, msg, time.Second*5)
+	assert.True(t, isNotSupport(err))
+	assert.True(t, isNotSupport(p1.CheckPeerSupports(p2.nodeAddr, encoding.RevealSecretCmdID, 0)))
+	assert.True(t, isNotSupport(p1.CheckPeerSupports(p2.nodeAddr, encoding.SecretRequestCmdID, encoding.FeatureEncryption)))
+	assert.Nil(t, p1.CheckPeerSupports(p2.nodeAddr, encoding.SecretRequestCmdID, 0))
+}
+
 func TestNew(t *testing.T) {
 	msger := encoding.MessageMap[encoding.UnlockCmdID]
 	msg := New(msger)
@@ -134,7 +239,7 @@ func TestPhotonProtocolSendReceiveNormalMessage2(t *testing.T) {
 		m := <-p2.ReceivedMessageChan
 		t.Logf("client2 received msg :%#v", m)
 		msg = m.Msg
-		p2.ReceivedMessageResultChan <- nil
+		m.Result <- nil
 		secretRequest := encoding.NewSecretRequest(utils.EmptyHash, big.NewInt(12))
 		secretRequest.Sign(p2.privKey, secretRequest)
 		err := p2.SendAndWait(p1.nodeAddr, secretRequest, time.Minute)
@@ -145,7 +250,7 @@ func TestPhotonProtocolSendReceiveNormalMessage2(t *testing.T) {
 	go func() {
 		m := <-p1.ReceivedMessageChan
 		t.Logf("client1 received msg:%#v", m)
-		p1.ReceivedMessageResultChan <- nil
+		m.Result <- nil
 		time.Sleep(time.Millisecond * 10)
 		wg.Done()
 	}()
@@ -207,3 +312,58 @@ func TestPhotonProtocolSendMediatedTransferExpired(t *testing.T) {
 	}
 
 }
+
+func TestPeerSupportsTrampoline(t *testing.T) {
+	p := &PhotonProtocol{peers: newPeerCapabilities()}
+	addr := utils.NewRandomAddress()
+	//unknown node is an old node
+	assert.False(t, p.PeerSupportsTrampoline(addr))
+	c := encoding.NewCapabilities(encoding.FeatureTrampoline, 1, false)
+	c.Sender = addr
+	p.peers.setCapabilities(c)
+	assert.True(t, p.PeerSupportsTrampoline(addr))
+	//announced the feature but cannot decode MediatedTransfer with trampoline
+	c = encoding.NewCapabilities(encoding.FeatureTrampoline, 2, false)
+	c.Sender = addr
+	for i, r := range c.Versions {
+		if r.CmdID == encoding.MediatedTransferCmdID {
+			c.Versions[i].MaxVersion = encoding.MediatedTransferTrampolineVersion - 1
+		}
+	}
+	p.peers.setCapabilities(c)
+	assert.False(t, p.PeerSupportsTrampoline(addr))
+	c = encoding.NewCapabilities(0, 3, false)
+	c.Sender = addr
+	p.peers.setCapabilities(c)
+	assert.False(t, p.PeerSupportsTrampoline(addr))
+}
+
+func TestCapabilityQueryRetry(t *testing.T) {
+	pc := newPeerCapabilities()
+	now := time.Unix(1000, 0)
+	pc.timeFunc = func() time.Time {
+		return now
+	}
+	addr := utils.NewRandomAddress()
+	assert.True(t, pc.needQuery(addr))
+	assert.False(t, pc.needQuery(addr))
+	//the query or the answer is lost, ask again later
+	now = now.Add(capabilityQueryMinInterval)
+	assert.True(t, pc.needQuery(addr))
+	now = now.Add(capabilityQueryMinInterval)
+	assert.False(t, pc.needQuery(addr))
+	now = now.Add(capabilityQueryMinInterval)
+	assert.True(t, pc.needQuery(addr))
+	//an old node never answers, don't ask too often
+	for i := 0; i < 10; i++ {
+		now = now.Add(capabilityQueryMaxInterval)
+		assert.True(t, pc.needQuery(addr))
+	}
+	now = now.Add(capabilityQueryMaxInterval - time.Second)
+	assert.False(t, pc.needQuery(addr))
+	c := encoding.NewCapabilities(0, 1, false)
+	c.Sender = addr
+	pc.setCapabilities(c)
+	now = now.Add(capabilityQueryMaxInterval)
+	assert.False(t, pc.needQuery(addr))
+}
@@ -0,0 +1,380 @@
+package network
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+)
+
+/*
+The handshake follows the Noise XX pattern, but uses the nodes' ethereum keys as static keys:
+
+	-> e
+	<- e, ee, sig(s_r, e_i||e_r), announcement_r
+	-> sig(s_i, e_i||e_r), announcement_i
+
+Both sides prove the possession of their ethereum key by signing the two ephemeral keys,
+so a recorded handshake cannot be replayed and the session keys derived from `ee` are bound to the two identities.
+Everything after the first two ephemeral keys is encrypted.
+*/
+const (
+	tcpHandshakeVersion   = 1
+	tcpHandshakeTimeout   = 10 * time.Second
+	tcpPubkeyLength       = 65
+	tcpSignatureLength    = 65
+	tcpMaxRecordSize      = 64 * 1024
+	tcpRecordLengthPrefix = 4
+)
+
+var (
+	tcpInitiatorLabel = []byte("photon-tcp-initiator")
+	tcpResponderLabel = []byte("photon-tcp-responder")
+	errRecordTooLarge = errors.New("tcp record too large")
+)
+
+/*
+secureConn encrypts every record with AES-256-GCM,
+each direction has its own key and a counter nonce, so records cannot be replayed or reordered.
+*/
+type secureConn struct {
+	conn      net.Conn
+	sendAead  cipher.AEAD
+	recvAead  cipher.AEAD
+	sendNonce uint64
+	recvNonce uint64
+	writeLock sync.Mutex
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newSecureConn(conn net.Conn, sendKey, recvKey []byte) (sc *secureConn, err error) {
+	sc = &secureConn{conn: conn}
+	sc.sendAead, err = newAead(sendKey)
+	if err != nil {
+		return
+	}
+	sc.recvAead, err = newAead(recvKey)
+	return
+}
+
+func gcmNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+//writeRecord is safe to be called from different goroutines
+func (sc *secureConn) writeRecord(plain []byte) error {
+	sc.writeLock.Lock()
+	defer sc.writeLock.Unlock()
+	ciphertext := sc.sendAead.Seal(nil, gcmNonce(sc.sendAead, sc.sendNonce), plain, nil)
+	sc.sendNonce++
+	if len(ciphertext) > tcpMaxRecordSize {
+		return errRecordTooLarge
+	}
+	buf := make([]byte, tcpRecordLengthPrefix+len(ciphertext))
+	binary.BigEndian.PutUint32(buf, uint32(len(ciphertext)))
+	copy(buf[tcpRecordLengthPrefix:], ciphertext)
+	_, err := sc.conn.Write(buf)
+	return err
+}
+
+//readRecord must be called from only one goroutine
+func (sc *secureConn) readRecord() ([]byte, error) {
+	var lenBuf [tcpRecordLengthPrefix]byte
+	if _, err := io.ReadFull(sc.conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	l := binary.BigEndian.Uint32(lenBuf[:])
+	if l > tcpMaxRecordSize {
+		return nil, errRecordTooLarge
+	}
+	ciphertext := make([]byte, l)
+	if _, err := io.ReadFull(sc.conn, ciphertext); err != nil {
+		return nil, err
+	}
+	plain, err := sc.recvAead.Open(nil, gcmNonce(sc.recvAead, sc.recvNonce), ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	sc.recvNonce++
+	return plain, nil
+}
+
+func (sc *secureConn) Close() error {
+	return sc.conn.Close()
+}
+
+//handshakeKeys derives the keys of both directions for the handshake and for the session
+type handshakeKeys struct {
+	hsI2R, hsR2I           []byte
+	sessionI2R, sessionR2I []byte
+}
+
+func deriveHandshakeKeys(ephemeral *ecdsa.PrivateKey, remoteEphemeral *ecdsa.PublicKey, ei, er []byte) (keys *handshakeKeys, err error) {
+	shared, err := ecies.ImportECDSA(ephemeral).GenerateShared(ecies.ImportECDSAPublic(remoteEphemeral), 32, 0)
+	if err != nil {
+		return
+	}
+	derive := func(label string) []byte {
+		h := utils.Sha3([]byte(label), shared, ei, er)
+		return h[:]
+	}
+	keys = &handshakeKeys{
+		hsI2R:      derive("hs-i2r"),
+		hsR2I:      derive("hs-r2i"),
+		sessionI2R: derive("session-i2r"),
+		sessionR2I: derive("session-r2i"),
+	}
+	return
+}
+
+func sealHandshakePayload(key []byte, payload []byte) ([]byte, error) {
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, gcmNonce(aead, 0), payload, nil), nil
+}
+
+func openHandshakePayload(key []byte, ciphertext []byte) ([]byte, error) {
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, gcmNonce(aead, 0), ciphertext, nil)
+}
+
+func writeLengthPrefixed(w io.Writer, data []byte) error {
+	buf := make([]byte, tcpRecordLengthPrefix+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[tcpRecordLengthPrefix:], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readLengthPrefixed(r io.Reader) ([]byte, error) {
+	var lenBuf [tcpRecordLengthPrefix]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	l := binary.BigEndian.Uint32(lenBuf[:])
+	if l > tcpMaxRecordSize {
+		return nil, errRecordTooLarge
+	}
+	data := make([]byte, l)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+/*
+identity payload: signature of the two ephemeral keys followed by the json announcement of the signer.
+announcement may be empty if the node doesn't accept incoming connections.
+*/
+func makeIdentityPayload(key *ecdsa.PrivateKey, label, ei, er []byte, ann *AddressAnnouncement) (payload []byte, err error) {
+	sig, err := utils.SignData(key, append(append(append([]byte{}, label...), ei...), er...))
+	if err != nil {
+		return
+	}
+	payload = sig
+	if ann != nil {
+		var annData []byte
+		annData, err = json.Marshal(ann)
+		if err != nil {
+			return
+		}
+		payload = append(payload, annData...)
+	}
+	return
+}
+
+func parseIdentityPayload(payload, label, ei, er []byte) (remote common.Address, ann *AddressAnnouncement, err error) {
+	if len(payload) < tcpSignatureLength {
+		err = errors.New("handshake identity payload too short")
+		return
+	}
+	sig := payload[:tcpSignatureLength]
+	remote, err = utils.Ecrecover(utils.Sha3(label, ei, er), sig)
+	if err != nil {
+		return
+	}
+	if len(payload) > tcpSignatureLength {
+		ann = new(AddressAnnouncement)
+		err = json.Unmarshal(payload[tcpSignatureLength:], ann)
+		if err != nil {
+			return
+		}
+		err = ann.Verify()
+		if err != nil {
+			return
+		}
+		if ann.Address != remote {
+			err = fmt.Errorf("handshake announcement of %s from %s", ann.Address.String(), remote.String())
+			return
+		}
+	}
+	return
+}
+
+/*
+clientHandshake runs the initiator side of the handshake,
+the connection fails if the responder is not `expected`.
+*/
+func clientHandshake(conn net.Conn, key *ecdsa.PrivateKey, expected common.Address, ann *AddressAnnouncement) (sc *secureConn, remoteAnn *AddressAnnouncement, err error) {
+	err = conn.SetDeadline(time.Now().Add(tcpHandshakeTimeout))
+	if err != nil {
+		return
+	}
+	ephemeral, err := crypto.GenerateKey()
+	if err != nil {
+		return
+	}
+	ei := crypto.FromECDSAPub(&ephemeral.PublicKey)
+	// -> e
+	_, err = conn.Write(append([]byte{tcpHandshakeVersion}, ei...))
+	if err != nil {
+		return
+	}
+	// <- e, ee, s
+	er := make([]byte, tcpPubkeyLength)
+	if _, err = io.ReadFull(conn, er); err != nil {
+		return
+	}
+	remoteEphemeral, err := unmarshalPubkey(er)
+	if err != nil {
+		return
+	}
+	keys, err := deriveHandshakeKeys(ephemeral, remoteEphemeral, ei, er)
+	if err != nil {
+		return
+	}
+	ciphertext, err := readLengthPrefixed(conn)
+	if err != nil {
+		return
+	}
+	payload, err := openHandshakePayload(keys.hsR2I, ciphertext)
+	if err != nil {
+		return
+	}
+	remote, remoteAnn, err := parseIdentityPayload(payload, tcpResponderLabel, ei, er)
+	if err != nil {
+		return
+	}
+	if remote != expected {
+		err = fmt.Errorf("tcp handshake expect %s,but got %s", utils.APex2(expected), utils.APex2(remote))
+		return
+	}
+	// -> s
+	payload, err = makeIdentityPayload(key, tcpInitiatorLabel, ei, er, ann)
+	if err != nil {
+		return
+	}
+	ciphertext, err = sealHandshakePayload(keys.hsI2R, payload)
+	if err != nil {
+		return
+	}
+	err = writeLengthPrefixed(conn, ciphertext)
+	if err != nil {
+		return
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+	sc, err = newSecureConn(conn, keys.sessionI2R, keys.sessionR2I)
+	return
+}
+
+//serverHandshake runs the responder side of the handshake and returns the authenticated remote address
+func serverHandshake(conn net.Conn, key *ecdsa.PrivateKey, ann *AddressAnnouncement) (sc *secureConn, remote common.Address, remoteAnn *AddressAnnouncement, err error) {
+	err = conn.SetDeadline(time.Now().Add(tcpHandshakeTimeout))
+	if err != nil {
+		return
+	}
+	// <- e
+	msg1 := make([]byte, 1+tcpPubkeyLength)
+	if _, err = io.ReadFull(conn, msg1); err != nil {
+		return
+	}
+	if msg1[0] != tcpHandshakeVersion {
+		err = fmt.Errorf("unsupported tcp handshake version %d", msg1[0])
+		return
+	}
+	ei := msg1[1:]
+	remoteEphemeral, err := unmarshalPubkey(ei)
+	if err != nil {
+		return
+	}
+	ephemeral, err := crypto.GenerateKey()
+	if err != nil {
+		return
+	}
+	er := crypto.FromECDSAPub(&ephemeral.PublicKey)
+	keys, err := deriveHandshakeKeys(ephemeral, remoteEphemeral, ei, er)
+	if err != nil {
+		return
+	}
+	// -> e, ee, s
+	payload, err := makeIdentityPayload(key, tcpResponderLabel, ei, er, ann)
+	if err != nil {
+		return
+	}
+	ciphertext, err := sealHandshakePayload(keys.hsR2I, payload)
+	if err != nil {
+		return
+	}
+	_, err = conn.Write(er)
+	if err != nil {
+		return
+	}
+	err = writeLengthPrefixed(conn, ciphertext)
+	if err != nil {
+		return
+	}
+	// <- s
+	ciphertext, err = readLengthPrefixed(conn)
+	if err != nil {
+		return
+	}
+	payload, err = openHandshakePayload(keys.hsI2R, ciphertext)
+	if err != nil {
+		return
+	}
+	remote, remoteAnn, err = parseIdentityPayload(payload, tcpInitiatorLabel, ei, er)
+	if err != nil {
+		return
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+	sc, err = newSecureConn(conn, keys.sessionR2I, keys.sessionI2R)
+	return
+}
+
+func unmarshalPubkey(pub []byte) (*ecdsa.PublicKey, error) {
+	key := crypto.ToECDSAPub(pub)
+	if key == nil || key.X == nil || key.Y == nil {
+		return nil, errors.New("invalid public key")
+	}
+	return key, nil
+}
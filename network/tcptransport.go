@@ -0,0 +1,454 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/internal/rpanic"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/params"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	tcpDialTimeout = 5 * time.Second
+	//every message is split into chunks, so a big message doesn't block small ones on the same connection
+	tcpChunkSize = 16 * 1024
+	//chunk header: flags(1) + stream id(4)
+	tcpChunkHeaderSize = 5
+	tcpFlagFin         = 0x01
+	//limit of messages being reassembled at the same time on one connection
+	tcpMaxOpenStreams = 64
+	//a duplicate connection is closed after messages already sent on it are read
+	tcpDuplicateCloseDelay = 10 * time.Second
+)
+
+var errTCPPeerUnknown = errors.New("tcp address of peer unknown")
+
+/*
+tcpPeer is an authenticated and encrypted connection to another node.
+Every message is sent on its own stream, streams are interleaved chunk by chunk.
+*/
+type tcpPeer struct {
+	remote       common.Address
+	sc           *secureConn
+	dialer       common.Address
+	nextStreamID uint32
+	closeOnce    sync.Once
+	closed       chan struct{}
+}
+
+func (tp *tcpPeer) send(data []byte) error {
+	streamID := atomic.AddUint32(&tp.nextStreamID, 1)
+	for {
+		n := len(data)
+		flags := byte(0)
+		if n <= tcpChunkSize {
+			flags = tcpFlagFin
+		} else {
+			n = tcpChunkSize
+		}
+		chunk := make([]byte, tcpChunkHeaderSize+n)
+		chunk[0] = flags
+		binary.BigEndian.PutUint32(chunk[1:], streamID)
+		copy(chunk[tcpChunkHeaderSize:], data[:n])
+		err := tp.sc.writeRecord(chunk)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+		if flags == tcpFlagFin {
+			return nil
+		}
+	}
+}
+
+func (tp *tcpPeer) close() {
+	tp.closeOnce.Do(func() {
+		close(tp.closed)
+		err := tp.sc.Close()
+		if err != nil {
+			log.Trace(fmt.Sprintf("close tcp connection to %s err %s", utils.APex2(tp.remote), err))
+		}
+	})
+}
+
+/*
+TCPTransport sends messages over direct tcp connections.
+Connections are authenticated by the ethereum keys of both nodes and encrypted,
+so it can be used on the public internet without any relay server.
+There is no limit of message size, messages are sent in chunks of tcpMaxRecordSize at most.
+params.TCPMaxMessageSize, which is independent of udp, only protects against a peer eating all my memory:
+a connection is dropped when its unfinished messages together are larger than it.
+A node can only be reached if its signed AddressAnnouncement is known,
+announcements are saved to the store, so known nodes can still be reached after restart.
+*/
+type TCPTransport struct {
+	protocol      ProtocolReceiver
+	key           *ecdsa.PrivateKey
+	nodeAddr      common.Address
+	listenAddr    string
+	announcement  *AddressAnnouncement
+	listener      net.Listener
+	announcements map[common.Address]*AddressAnnouncement
+	store         TCPAnnouncementStore
+	peers         map[common.Address]*tcpPeer
+	lock          sync.RWMutex
+	stopped       int32 //accessed atomically
+	stopReceiving int32 //accessed atomically
+	name          string
+	log           log.Logger
+}
+
+//TCPAnnouncementStore saves announcements of other nodes, so they survive restart. models.Dao implements it.
+type TCPAnnouncementStore interface {
+	SaveTCPAnnouncement(a *models.TCPAnnouncement) error
+	GetAllTCPAnnouncements() (anns []*models.TCPAnnouncement, err error)
+}
+
+/*
+NewTCPTransport create a TCPTransport listening on `listenAddr`,
+`announceAddr` is the host:port other nodes use to connect to me, it's the same as `listenAddr` if empty.
+announcements are loaded from `store` if not nil.
+*/
+func NewTCPTransport(name, listenAddr, announceAddr string, key *ecdsa.PrivateKey, protocol ProtocolReceiver, store TCPAnnouncementStore) (t *TCPTransport, err error) {
+	if announceAddr == "" {
+		announceAddr = listenAddr
+	}
+	t = &TCPTransport{
+		protocol:      protocol,
+		key:           key,
+		nodeAddr:      crypto.PubkeyToAddress(key.PublicKey),
+		listenAddr:    listenAddr,
+		announcements: make(map[common.Address]*AddressAnnouncement),
+		store:         store,
+		peers:         make(map[common.Address]*tcpPeer),
+		name:          name,
+		log:           log.New("name", name, "transport", "tcp"),
+	}
+	t.announcement, err = NewAddressAnnouncement(key, announceAddr)
+	if err != nil || store == nil {
+		return
+	}
+	anns, err2 := store.GetAllTCPAnnouncements()
+	if err2 != nil {
+		t.log.Error(fmt.Sprintf("load tcp announcements err %s", err2))
+		return
+	}
+	for _, m := range anns {
+		a := &AddressAnnouncement{
+			Address:   m.Address,
+			HostPort:  m.HostPort,
+			Timestamp: m.Timestamp,
+			Signature: m.Signature,
+		}
+		//db may be modified by others
+		if a.Verify() != nil || a.Address == t.nodeAddr {
+			continue
+		}
+		t.announcements[a.Address] = a
+	}
+	return
+}
+
+//Start tcp listening
+func (t *TCPTransport) Start() {
+	listener, err := net.Listen("tcp", t.listenAddr)
+	if err != nil {
+		t.log.Error(fmt.Sprintf("listen tcp %s error %s", t.listenAddr, err))
+		return
+	}
+	t.listener = listener
+	t.log.Info(fmt.Sprintf("tcp server listening on %s", listener.Addr()))
+	go func() {
+		defer rpanic.PanicRecover("tcptransport Start")
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if atomic.LoadInt32(&t.stopped) == 0 {
+					t.log.Error(fmt.Sprintf("tcp accept err %s", err))
+				}
+				return
+			}
+			go t.accept(conn)
+		}
+	}()
+}
+
+func (t *TCPTransport) accept(conn net.Conn) {
+	defer rpanic.PanicRecover("tcptransport accept")
+	sc, remote, remoteAnn, err := serverHandshake(conn, t.key, t.announcement)
+	if err != nil {
+		t.log.Info(fmt.Sprintf("tcp handshake with %s err %s", conn.RemoteAddr(), err))
+		err = conn.Close()
+		if err != nil {
+			t.log.Trace(fmt.Sprintf("close conn err %s", err))
+		}
+		return
+	}
+	if remoteAnn != nil {
+		t.addAnnouncement(remoteAnn)
+	}
+	t.addPeer(remote, sc, remote)
+}
+
+/*
+addPeer returns the connection to send on.
+If both nodes dial at the same time, both keep the one dialed by the smaller address,
+the other one is closed a little later, so messages already sent on it are not lost.
+*/
+func (t *TCPTransport) addPeer(remote common.Address, sc *secureConn, dialer common.Address) *tcpPeer {
+	tp := &tcpPeer{
+		remote: remote,
+		sc:     sc,
+		dialer: dialer,
+		closed: make(chan struct{}),
+	}
+	keep, duplicate := tp, (*tcpPeer)(nil)
+	t.lock.Lock()
+	old, ok := t.peers[remote]
+	if ok {
+		duplicate = old
+		if old.dialer != dialer && bytes.Compare(old.dialer[:], dialer[:]) < 0 {
+			keep, duplicate = old, tp
+		}
+	}
+	t.peers[remote] = keep
+	t.lock.Unlock()
+	t.log.Trace(fmt.Sprintf("tcp connection to %s established", utils.APex2(remote)))
+	go t.readLoop(tp)
+	if duplicate != nil {
+		t.log.Trace(fmt.Sprintf("duplicate tcp connection to %s", utils.APex2(remote)))
+		time.AfterFunc(tcpDuplicateCloseDelay, duplicate.close)
+	}
+	return keep
+}
+
+func (t *TCPTransport) removePeer(tp *tcpPeer) {
+	tp.close()
+	t.lock.Lock()
+	if t.peers[tp.remote] == tp {
+		delete(t.peers, tp.remote)
+	}
+	t.lock.Unlock()
+}
+
+func (t *TCPTransport) readLoop(tp *tcpPeer) {
+	defer rpanic.PanicRecover(fmt.Sprintf("tcptransport read %s", utils.APex2(tp.remote)))
+	defer t.removePeer(tp)
+	streams := make(map[uint32][]byte)
+	buffered := 0 //所有没有收完的消息的总长度
+	for {
+		record, err := tp.sc.readRecord()
+		if err != nil {
+			if atomic.LoadInt32(&t.stopped) == 0 {
+				t.log.Trace(fmt.Sprintf("tcp read from %s err %s", utils.APex2(tp.remote), err))
+			}
+			return
+		}
+		if len(record) < tcpChunkHeaderSize {
+			t.log.Warn(fmt.Sprintf("tcp receive invalid chunk from %s", utils.APex2(tp.remote)))
+			return
+		}
+		flags := record[0]
+		streamID := binary.BigEndian.Uint32(record[1:])
+		buf, ok := streams[streamID]
+		if !ok && len(streams) >= tcpMaxOpenStreams {
+			t.log.Warn(fmt.Sprintf("tcp too many open streams from %s", utils.APex2(tp.remote)))
+			return
+		}
+		buf = append(buf, record[tcpChunkHeaderSize:]...)
+		buffered += len(record) - tcpChunkHeaderSize
+		if buffered > params.TCPMaxMessageSize {
+			t.log.Warn(fmt.Sprintf("tcp messages from %s too large", utils.APex2(tp.remote)))
+			return
+		}
+		if flags&tcpFlagFin == 0 {
+			streams[streamID] = buf
+			continue
+		}
+		delete(streams, streamID)
+		buffered -= len(buf)
+		err = t.Receive(buf)
+		if err != nil {
+			return
+		}
+	}
+}
+
+//Receive a message
+func (t *TCPTransport) Receive(data []byte) error {
+	if atomic.LoadInt32(&t.stopReceiving) != 0 {
+		return errors.New("stop receive")
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if t.protocol != nil {
+		t.protocol.receive(data)
+	}
+	return nil
+}
+
+func (t *TCPTransport) getPeer(receiver common.Address) (tp *tcpPeer, err error) {
+	t.lock.RLock()
+	tp, ok := t.peers[receiver]
+	ann := t.announcements[receiver]
+	t.lock.RUnlock()
+	if ok {
+		return
+	}
+	if ann == nil {
+		err = errTCPPeerUnknown
+		return
+	}
+	conn, err := net.DialTimeout("tcp", ann.HostPort, tcpDialTimeout)
+	if err != nil {
+		return
+	}
+	sc, remoteAnn, err := clientHandshake(conn, t.key, receiver, t.announcement)
+	if err != nil {
+		err2 := conn.Close()
+		if err2 != nil {
+			t.log.Trace(fmt.Sprintf("close conn err %s", err2))
+		}
+		return
+	}
+	if remoteAnn != nil {
+		t.addAnnouncement(remoteAnn)
+	}
+	tp = t.addPeer(receiver, sc, t.nodeAddr)
+	return
+}
+
+//Send a message to `receiver`, connect to it first if there is no connection.
+func (t *TCPTransport) Send(receiver common.Address, data []byte) error {
+	if atomic.LoadInt32(&t.stopped) != 0 {
+		return fmt.Errorf("%s closed", t.name)
+	}
+	tp, err := t.getPeer(receiver)
+	if err != nil {
+		return err
+	}
+	t.log.Trace(fmt.Sprintf("%s send to %s, len=%d,response hash=%s", t.name,
+		utils.APex2(receiver), len(data), utils.HPex(utils.Sha3(data, receiver[:]))))
+	err = tp.send(data)
+	if err != nil {
+		t.removePeer(tp)
+	}
+	return err
+}
+
+//Stop tcp listening and close all connections
+func (t *TCPTransport) Stop() {
+	atomic.StoreInt32(&t.stopReceiving, 1)
+	atomic.StoreInt32(&t.stopped, 1)
+	if t.listener != nil {
+		err := t.listener.Close()
+		if err != nil {
+			t.log.Warn(fmt.Sprintf("close tcp listener err %s", err))
+		}
+	}
+	t.lock.Lock()
+	peers := t.peers
+	t.peers = make(map[common.Address]*tcpPeer)
+	t.lock.Unlock()
+	for _, tp := range peers {
+		tp.close()
+	}
+}
+
+//StopAccepting stop receiving
+func (t *TCPTransport) StopAccepting() {
+	atomic.StoreInt32(&t.stopReceiving, 1)
+}
+
+//RegisterProtocol register receiver
+func (t *TCPTransport) RegisterProtocol(proto ProtocolReceiver) {
+	t.protocol = proto
+}
+
+/*
+NodeStatus a node is online if there is a connection to it.
+If I only know its address, I don't know whether it's online until I try to connect.
+*/
+func (t *TCPTransport) NodeStatus(addr common.Address) (deviceType string, isOnline bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	_, isOnline = t.peers[addr]
+	return DeviceTypeOther, isOnline
+}
+
+//CanReach returns true if I know how to connect `addr`
+func (t *TCPTransport) CanReach(addr common.Address) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if _, ok := t.peers[addr]; ok {
+		return true
+	}
+	_, ok := t.announcements[addr]
+	return ok
+}
+
+//MaxMessageSize the largest message a peer may send over tcp
+func (t *TCPTransport) MaxMessageSize() int {
+	return params.TCPMaxMessageSize
+}
+
+//Announcement returns my signed announcement, other nodes need it to connect to me
+func (t *TCPTransport) Announcement() *AddressAnnouncement {
+	return t.announcement
+}
+
+//addAnnouncement saves a verified announcement, returns false if it's not newer than the known one
+func (t *TCPTransport) addAnnouncement(a *AddressAnnouncement) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	old, ok := t.announcements[a.Address]
+	if ok && old.Timestamp >= a.Timestamp {
+		return false
+	}
+	t.announcements[a.Address] = a
+	if t.store != nil {
+		err := t.store.SaveTCPAnnouncement(&models.TCPAnnouncement{
+			Address:   a.Address,
+			HostPort:  a.HostPort,
+			Timestamp: a.Timestamp,
+			Signature: a.Signature,
+		})
+		if err != nil {
+			t.log.Error(fmt.Sprintf("save tcp announcement of %s err %s", utils.APex2(a.Address), err))
+		}
+	}
+	return true
+}
+
+/*
+AddAnnouncements verifies and saves other nodes' addresses,
+an announcement older than the one I know is ignored.
+*/
+func (t *TCPTransport) AddAnnouncements(anns []*AddressAnnouncement) error {
+	for _, a := range anns {
+		err := a.Verify()
+		if err != nil {
+			return err
+		}
+		if a.Address == t.nodeAddr {
+			continue
+		}
+		if t.addAnnouncement(a) {
+			t.log.Info(fmt.Sprintf("tcp address of %s updated", a))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/params"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestTCPTransport(t *testing.T, name string) *TCPTransport {
+	key, _ := crypto.GenerateKey()
+	tt, err := NewTCPTransport(name, fmt.Sprintf("127.0.0.1:%d", randomPort()), "", key, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tt
+}
+
+func TestAddressAnnouncement(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	a, err := NewAddressAnnouncement(key, "1.2.3.4:5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, a.Verify())
+	a.HostPort = "1.2.3.4:6"
+	assert.NotNil(t, a.Verify())
+	a.HostPort = "1.2.3.4:5"
+	a.Address = utils.NewRandomAddress()
+	assert.NotNil(t, a.Verify())
+	_, err = NewAddressAnnouncement(key, "1.2.3.4")
+	assert.NotNil(t, err)
+}
+
+func TestTCPTransport(t *testing.T) {
+	t1 := makeTestTCPTransport(t, "t1")
+	t2 := makeTestTCPTransport(t, "t2")
+	d1 := newDummyProtocol("t1")
+	d2 := newDummyProtocol("t2")
+	t1.RegisterProtocol(d1)
+	t2.RegisterProtocol(d2)
+	t1.Start()
+	t2.Start()
+	defer t1.Stop()
+	defer t2.Stop()
+
+	err := t1.Send(t2.nodeAddr, []byte("abc"))
+	assert.Equal(t, errTCPPeerUnknown, err)
+	assert.False(t, t1.CanReach(t2.nodeAddr))
+
+	err = t1.AddAnnouncements([]*AddressAnnouncement{t2.Announcement()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, t1.CanReach(t2.nodeAddr))
+	small := []byte("abc")
+	err = t1.Send(t2.nodeAddr, small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-d2.data:
+		assert.True(t, bytes.Equal(small, data))
+	case <-time.After(time.Second * 3):
+		t.Fatal("timeout")
+	}
+	_, isOnline := t1.NodeStatus(t2.nodeAddr)
+	assert.True(t, isOnline)
+
+	//t2 learned t1's address from handshake, and a message larger than udp limit
+	big := make([]byte, params.UDPMaxFragmentedMessageSize*2+100)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	assert.True(t, t2.CanReach(t1.nodeAddr))
+	err = t2.Send(t1.nodeAddr, big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-d1.data:
+		assert.True(t, bytes.Equal(big, data))
+	case <-time.After(time.Second * 3):
+		t.Fatal("timeout")
+	}
+}
+
+type memoryAnnouncementStore struct {
+	anns map[common.Address]*models.TCPAnnouncement
+}
+
+func (s *memoryAnnouncementStore) SaveTCPAnnouncement(a *models.TCPAnnouncement) error {
+	s.anns[a.Address] = a
+	return nil
+}
+
+func (s *memoryAnnouncementStore) GetAllTCPAnnouncements() (anns []*models.TCPAnnouncement, err error) {
+	for _, a := range s.anns {
+		anns = append(anns, a)
+	}
+	return
+}
+
+func TestTCPTransportAnnouncementStore(t *testing.T) {
+	store := &memoryAnnouncementStore{anns: make(map[common.Address]*models.TCPAnnouncement)}
+	key, _ := crypto.GenerateKey()
+	listenAddr := fmt.Sprintf("127.0.0.1:%d", randomPort())
+	t1, err := NewTCPTransport("t1", listenAddr, "", key, nil, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2 := makeTestTCPTransport(t, "t2")
+	t3 := makeTestTCPTransport(t, "t3")
+	err = t1.AddAnnouncements([]*AddressAnnouncement{t2.Announcement(), t3.Announcement()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, 2, len(store.anns))
+	//an announcement modified in db is ignored
+	store.anns[t3.nodeAddr].HostPort = "1.2.3.4:5"
+	//after restart
+	t1, err = NewTCPTransport("t1", listenAddr, "", key, nil, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, t1.CanReach(t2.nodeAddr))
+	assert.False(t, t1.CanReach(t3.nodeAddr))
+}
+
+func TestTCPTransportWrongPeer(t *testing.T) {
+	t1 := makeTestTCPTransport(t, "t1")
+	t2 := makeTestTCPTransport(t, "t2")
+	t3 := makeTestTCPTransport(t, "t3")
+	t2.Start()
+	defer t2.Stop()
+	// someone claims to be t3 but listens on t2's address
+	key3 := t3.key
+	a, err := NewAddressAnnouncement(key3, t2.Announcement().HostPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = t1.AddAnnouncements([]*AddressAnnouncement{a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = t1.Send(t3.nodeAddr, []byte("abc"))
+	assert.NotNil(t, err)
+	_, isOnline := t1.NodeStatus(t3.nodeAddr)
+	assert.False(t, isOnline)
+}
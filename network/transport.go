@@ -57,6 +57,11 @@ type Transporter interface {
 	NodeStatus(addr common.Address) (deviceType string, isOnline bool)
 }
 
+//messageSizeLimiter is implemented by transports which can receive messages bigger than params.UDPMaxMessageSize
+type messageSizeLimiter interface {
+	MaxMessageSize() int
+}
+
 type dummyPolicy struct {
 }
 
@@ -105,6 +110,17 @@ func (tb *TokenBucket) Consume(tokens float64) time.Duration {
 	}
 	return time.Duration(waitTime * float64(time.Second))
 }
+
+//TryConsume takes `tokens` only if there are enough, it never waits
+func (tb *TokenBucket) TryConsume(tokens float64) bool {
+	tb.getTokens()
+	if tb.Tokens < tokens {
+		return false
+	}
+	tb.Tokens -= tokens
+	return true
+}
+
 func (tb *TokenBucket) getTokens() {
 	now := tb.timeFunc()
 	fill := float64(now.Sub(tb.Timestamp)) / float64(time.Second)
@@ -141,6 +157,11 @@ type UDPTransport struct {
 	log                    log.Logger
 	msrv                   mdns.Service
 	cf                     context.CancelFunc
+	fragmenter             *udpFragmenter
+	//mtu configured by user
+	peerMTU map[common.Address]int
+	//largest datagram received from a udp address, so the path can carry it
+	discoveredMTU map[string]int
 }
 
 //NewUDPTransport create UDPTransport,name必须是完整的地址
@@ -156,6 +177,9 @@ func NewUDPTransport(name, host string, port int, protocol ProtocolReceiver, pol
 		log:                    log.New("name", name),
 		intranetNodes:          make(map[common.Address]*net.UDPAddr),
 		intranetNodesTimestamp: make(map[common.Address]time.Time),
+		fragmenter:             newUDPFragmenter(),
+		peerMTU:                make(map[common.Address]int),
+		discoveredMTU:          make(map[string]int),
 	}
 	//127.0.0.1 作为一个特殊地址来处理,作为不启用mdns的指示,但是127.1.0.1等其他本机ip地址都认为有效
 	if params.EnableMDNS {
@@ -174,7 +198,7 @@ func NewUDPTransport(name, host string, port int, protocol ProtocolReceiver, pol
 //Start udp listening
 func (ut *UDPTransport) Start() {
 	go func() {
-		data := make([]byte, 4096)
+		data := make([]byte, udpMaxDatagramSize)
 		defer rpanic.PanicRecover("udptransport Start")
 		for {
 			conn, err := NewSafeUDPConnection("udp", ut.UAddr)
@@ -201,9 +225,23 @@ func (ut *UDPTransport) Start() {
 					}
 
 				}
+				if read == 0 {
+					continue
+				}
+				ut.discoverMTU(remoteAddr, read)
+				msg := data[:read]
+				if isUDPFragment(msg) {
+					msg, err = ut.fragmenter.reassemble(remoteAddr.String(), msg)
+					if err != nil {
+						ut.log.Warn(fmt.Sprintf("receive fragment from %s err %s", remoteAddr, err))
+					}
+					if msg == nil {
+						continue
+					}
+				}
 				ut.log.Trace(fmt.Sprintf("receive from %s ,message=%s,hash=%s", remoteAddr,
-					encoding.MessageType(data[0]), utils.HPex(utils.Sha3(data[:read]))))
-				err = ut.Receive(data[:read])
+					encoding.MessageType(msg[0]), utils.HPex(utils.Sha3(msg))))
+				err = ut.Receive(msg)
 			}
 		}
 
@@ -244,8 +282,64 @@ func (ut *UDPTransport) Send(receiver common.Address, data []byte) error {
 	//ut.log.Trace(fmt.Sprintf("send data  \n%s", hex.Dump(data)))
 	//only comment this line,if you want to test.
 	//time.Sleep(ut.policy.Consume(1)) //force to wait,
-	_, err = ut.conn.WriteToUDP(data, ua)
-	return err
+	fragments, err := ut.fragmenter.split(data, ut.getMTU(receiver, ua))
+	if err != nil {
+		return err
+	}
+	for _, fragment := range fragments {
+		_, err = ut.conn.WriteToUDP(fragment, ua)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//getMTU returns the largest datagram I can send to `addr`
+func (ut *UDPTransport) getMTU(addr common.Address, ua *net.UDPAddr) int {
+	ut.lock.RLock()
+	defer ut.lock.RUnlock()
+	if mtu, ok := ut.peerMTU[addr]; ok {
+		return mtu
+	}
+	if mtu, ok := ut.discoveredMTU[ua.String()]; ok && mtu > params.UDPMaxMessageSize {
+		return mtu
+	}
+	return params.UDPMaxMessageSize
+}
+
+func (ut *UDPTransport) setPeerMTU(mtus map[common.Address]int) error {
+	for addr, mtu := range mtus {
+		if mtu <= udpFragmentHeaderLength || mtu > udpMaxDatagramSize {
+			return fmt.Errorf("invalid mtu %d for %s", mtu, utils.APex(addr))
+		}
+	}
+	ut.lock.Lock()
+	defer ut.lock.Unlock()
+	for addr, mtu := range mtus {
+		ut.peerMTU[addr] = mtu
+	}
+	return nil
+}
+
+func (ut *UDPTransport) discoverMTU(remoteAddr *net.UDPAddr, size int) {
+	if size <= params.UDPMaxMessageSize {
+		return
+	}
+	key := remoteAddr.String()
+	ut.lock.Lock()
+	defer ut.lock.Unlock()
+	if _, ok := ut.discoveredMTU[key]; !ok && len(ut.discoveredMTU) >= maxUDPDiscoveredMTUs {
+		return
+	}
+	if ut.discoveredMTU[key] < size {
+		ut.discoveredMTU[key] = size
+	}
+}
+
+//MaxMessageSize messages larger than mtu are sent in fragments
+func (ut *UDPTransport) MaxMessageSize() int {
+	return params.UDPMaxFragmentedMessageSize
 }
 
 func (ut *UDPTransport) getHostPort(addr common.Address) (ua *net.UDPAddr, err error) {
@@ -0,0 +1,166 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/params"
+)
+
+/*
+A message larger than the mtu of receiver is split into fragments,
+each one is sent in a datagram:
+	flag(1 byte,0xff)|message id(4 bytes)|index(2 bytes)|count(2 bytes)|payload
+The first byte of every photon message is its cmd id, which is never 0xff,
+so a message fitting in one datagram is sent as before.
+*/
+const (
+	udpFragmentFlag         byte = 0xff
+	udpFragmentHeaderLength      = 9
+	//udpMaxDatagramSize the largest payload of an udp datagram
+	udpMaxDatagramSize = 65507
+	//udpReassemblyTimeout fragments of a message are dropped if not all of them are received in time
+	udpReassemblyTimeout = 10 * time.Second
+	//maxUDPReassemblies protects me from a peer sending first fragments only
+	maxUDPReassemblies = 256
+	maxUDPFragments    = 1024
+	//maxUDPDiscoveredMTUs limits memory used by mtu discovery, source addresses may be forged
+	maxUDPDiscoveredMTUs = 1024
+)
+
+var errUDPFragmentInvalid = errors.New("invalid udp fragment")
+
+type udpReassembly struct {
+	fragments [][]byte
+	received  int
+	size      int
+	deadline  time.Time
+}
+
+//udpFragmenter splits messages and reassembles fragments from all peers
+type udpFragmenter struct {
+	lock     sync.Mutex
+	nextID   uint32
+	pending  map[string]*udpReassembly
+	timeFunc timeFunc
+}
+
+func newUDPFragmenter() *udpFragmenter {
+	return &udpFragmenter{
+		nextID:   rand.Uint32(),
+		pending:  make(map[string]*udpReassembly),
+		timeFunc: time.Now,
+	}
+}
+
+func isUDPFragment(data []byte) bool {
+	return len(data) > 0 && data[0] == udpFragmentFlag
+}
+
+//split returns `data` itself if it fits in `mtu`, otherwise fragments no larger than `mtu`
+func (f *udpFragmenter) split(data []byte, mtu int) ([][]byte, error) {
+	if len(data) <= mtu {
+		return [][]byte{data}, nil
+	}
+	if len(data) > params.UDPMaxFragmentedMessageSize {
+		return nil, fmt.Errorf("message too large for udp, size=%d", len(data))
+	}
+	payloadSize := mtu - udpFragmentHeaderLength
+	if payloadSize <= 0 {
+		return nil, fmt.Errorf("mtu %d too small", mtu)
+	}
+	count := (len(data) + payloadSize - 1) / payloadSize
+	if count > maxUDPFragments {
+		return nil, fmt.Errorf("mtu %d too small for message size %d", mtu, len(data))
+	}
+	f.lock.Lock()
+	f.nextID++
+	id := f.nextID
+	f.lock.Unlock()
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		start := i * payloadSize
+		end := start + payloadSize
+		if end > len(data) {
+			end = len(data)
+		}
+		fragment := make([]byte, udpFragmentHeaderLength+end-start)
+		fragment[0] = udpFragmentFlag
+		binary.BigEndian.PutUint32(fragment[1:], id)
+		binary.BigEndian.PutUint16(fragment[5:], uint16(i))
+		binary.BigEndian.PutUint16(fragment[7:], uint16(count))
+		copy(fragment[udpFragmentHeaderLength:], data[start:end])
+		fragments = append(fragments, fragment)
+	}
+	return fragments, nil
+}
+
+/*
+reassemble saves a fragment from `from`,
+and returns the whole message when the last missing fragment arrives, otherwise nil.
+*/
+func (f *udpFragmenter) reassemble(from string, fragment []byte) (data []byte, err error) {
+	if len(fragment) <= udpFragmentHeaderLength || fragment[0] != udpFragmentFlag {
+		return nil, errUDPFragmentInvalid
+	}
+	id := binary.BigEndian.Uint32(fragment[1:])
+	index := int(binary.BigEndian.Uint16(fragment[5:]))
+	count := int(binary.BigEndian.Uint16(fragment[7:]))
+	if count < 2 || count > maxUDPFragments || index >= count {
+		return nil, errUDPFragmentInvalid
+	}
+	key := fmt.Sprintf("%s-%d", from, id)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	r, ok := f.pending[key]
+	if !ok {
+		f.removeExpired()
+		if len(f.pending) >= maxUDPReassemblies {
+			return nil, errors.New("too many incomplete udp messages")
+		}
+		r = &udpReassembly{
+			fragments: make([][]byte, count),
+			deadline:  f.timeFunc().Add(udpReassemblyTimeout),
+		}
+		f.pending[key] = r
+	}
+	if len(r.fragments) != count {
+		delete(f.pending, key)
+		return nil, errUDPFragmentInvalid
+	}
+	if r.fragments[index] != nil {
+		//duplicate
+		return nil, nil
+	}
+	payload := fragment[udpFragmentHeaderLength:]
+	r.size += len(payload)
+	if r.size > params.UDPMaxFragmentedMessageSize {
+		delete(f.pending, key)
+		return nil, fmt.Errorf("udp message from %s too large", from)
+	}
+	r.fragments[index] = append([]byte{}, payload...)
+	r.received++
+	if r.received < count {
+		return nil, nil
+	}
+	delete(f.pending, key)
+	data = make([]byte, 0, r.size)
+	for _, p := range r.fragments {
+		data = append(data, p...)
+	}
+	return data, nil
+}
+
+//removeExpired drops messages whose fragments are not all received in time
+func (f *udpFragmenter) removeExpired() {
+	now := f.timeFunc()
+	for key, r := range f.pending {
+		if now.After(r.deadline) {
+			delete(f.pending, key)
+		}
+	}
+}
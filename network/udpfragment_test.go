@@ -0,0 +1,143 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/params"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPFragmenter(t *testing.T) {
+	f := newUDPFragmenter()
+	small := []byte{1, 2, 3}
+	fragments, err := f.split(small, params.UDPMaxMessageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, 1, len(fragments))
+	assert.True(t, bytes.Equal(small, fragments[0]))
+
+	big := make([]byte, 3000)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	fragments, err = f.split(big, params.UDPMaxMessageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, 3, len(fragments))
+	for _, fragment := range fragments {
+		assert.True(t, len(fragment) <= params.UDPMaxMessageSize)
+		assert.True(t, isUDPFragment(fragment))
+	}
+	//out of order and duplicate
+	data, err := f.reassemble("a", fragments[2])
+	assert.Nil(t, err)
+	assert.Nil(t, data)
+	data, err = f.reassemble("a", fragments[2])
+	assert.Nil(t, err)
+	assert.Nil(t, data)
+	data, err = f.reassemble("a", fragments[0])
+	assert.Nil(t, err)
+	assert.Nil(t, data)
+	//the same fragments from another peer are another message
+	data, err = f.reassemble("b", fragments[1])
+	assert.Nil(t, err)
+	assert.Nil(t, data)
+	data, err = f.reassemble("a", fragments[1])
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(big, data))
+
+	_, err = f.reassemble("a", fragments[0][:udpFragmentHeaderLength])
+	assert.NotNil(t, err)
+	_, err = f.split(make([]byte, params.UDPMaxFragmentedMessageSize+1), params.UDPMaxMessageSize)
+	assert.NotNil(t, err)
+}
+
+func TestUDPFragmenterTimeout(t *testing.T) {
+	now := time.Unix(1000, 0)
+	f := newUDPFragmenter()
+	f.timeFunc = func() time.Time {
+		return now
+	}
+	fragments, err := f.split(make([]byte, 2000), params.UDPMaxMessageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.reassemble("a", fragments[0])
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, len(f.pending))
+	now = now.Add(udpReassemblyTimeout + time.Second)
+	//a new message removes expired ones
+	fragments2, err := f.split(make([]byte, 2000), params.UDPMaxMessageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.reassemble("a", fragments2[0])
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, len(f.pending))
+	data, err := f.reassemble("a", fragments[1])
+	assert.Nil(t, err)
+	assert.Nil(t, data)
+}
+
+func TestUDPTransportFragmentation(t *testing.T) {
+	addr1 := utils.NewRandomAddress()
+	addr2 := utils.NewRandomAddress()
+	port1 := randomPort()
+	port2 := port1 + 1000
+	udp1 := MakeTestUDPTransport(addr1.String(), port1)
+	udp2 := MakeTestUDPTransport(addr2.String(), port2)
+	d1 := newDummyProtocol("u1")
+	d2 := newDummyProtocol("u2")
+	udp1.RegisterProtocol(d1)
+	udp2.RegisterProtocol(d2)
+	udp1.Start()
+	udp2.Start()
+	defer udp1.Stop()
+	defer udp2.Stop()
+	udp1.setHostPort(map[common.Address]*net.UDPAddr{addr2: {IP: net.ParseIP("127.0.0.1"), Port: port2}})
+	udp2.setHostPort(map[common.Address]*net.UDPAddr{addr1: {IP: net.ParseIP("127.0.0.1"), Port: port1}})
+
+	big := make([]byte, 5000)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	err := udp1.Send(addr2, big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	case data := <-d2.data:
+		assert.True(t, bytes.Equal(big, data))
+	}
+
+	//udp1 sends 5000 bytes in one datagram, then udp2 knows the path can carry it
+	err = udp1.setPeerMTU(map[common.Address]int{addr2: 6000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = udp1.Send(addr2, big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	case data := <-d2.data:
+		assert.True(t, bytes.Equal(big, data))
+	}
+	ua, err := udp2.getHostPort(addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, 5000, udp2.getMTU(addr1, ua))
+	assert.NotNil(t, udp1.setPeerMTU(map[common.Address]int{addr2: udpMaxDatagramSize + 1}))
+}
@@ -0,0 +1,194 @@
+package network
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/encoding"
+	"github.com/SmartMeshFoundation/Photon/internal/rpanic"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+A sender may have several balance proof messages of a channel in flight,
+but photon only accepts the one whose nonce is partner's nonce plus 1.
+So the receiver buffers messages which arrive too early,
+asks the sender to resend the missing one, and delivers all of them in nonce order.
+*/
+const (
+	//maxReorderedMessages messages further than this from the expected nonce are dropped
+	maxReorderedMessages = 64
+	//resendRequestInterval don't ask the same message again too often
+	resendRequestInterval = time.Second
+)
+
+/*
+PartnerNonceGetter is implemented by a ChannelStatusGetter which knows nonce of partner's balance proof,
+only then messages can be received out of order.
+*/
+type PartnerNonceGetter interface {
+	//GetPartnerNonce returns nonce of the latest balance proof partner sent, false if channel is unknown
+	GetPartnerNonce(channelIdentifier common.Hash) (nonce uint64, ok bool)
+}
+
+type reorderBuffer struct {
+	pending        map[uint64]*MessageToPhoton
+	requestedNonce uint64
+	requestedAt    time.Time
+}
+
+//SetSendWindow allow `window` unacked balance proof messages per channel to peers supporting it, 1 means one by one
+func (p *PhotonProtocol) SetSendWindow(window int) {
+	if window < 1 {
+		window = 1
+	}
+	p.mapLock.Lock()
+	p.sendWindow = window
+	p.mapLock.Unlock()
+}
+
+//sendWindowFor returns how many messages can be in flight when `msg` is sent, must be called with p.mapLock
+func (p *PhotonProtocol) sendWindowFor(receiver common.Address, msg encoding.Messager) int {
+	if p.sendWindow <= 1 || getMessageNonce(msg) == 0 {
+		return 1
+	}
+	c := p.peers.getCapabilities(receiver)
+	if c == nil || !c.HasFeature(encoding.FeatureReorder) {
+		return 1
+	}
+	return p.sendWindow
+}
+
+//getMessageNonce returns 0 if msg doesn't contain a balance proof
+func getMessageNonce(msg encoding.Messager) uint64 {
+	env, ok := msg.(encoding.EnvelopMessager)
+	if !ok {
+		return 0
+	}
+	return env.GetEnvelopMessage().Nonce
+}
+
+func channelQueueKey(addr common.Address, channelIdentifier common.Hash) string {
+	return fmt.Sprintf("%s-%s", addr.String(), channelIdentifier.String())
+}
+
+//expectedNonce returns nonce photon will accept next from `msg`'s sender, false if unknown
+func (p *PhotonProtocol) expectedNonce(msg encoding.SignedMessager) (env *encoding.EnvelopMessage, nonce uint64, ok bool) {
+	getter, ok := p.ChannelStatusGetter.(PartnerNonceGetter)
+	if !ok {
+		return
+	}
+	em, ok := msg.(encoding.EnvelopMessager)
+	if !ok {
+		return
+	}
+	env = em.GetEnvelopMessage()
+	nonce, ok = getter.GetPartnerNonce(env.ChannelIdentifier)
+	nonce++
+	return
+}
+
+/*
+bufferIfOutOfOrder returns true if msg arrives before messages with smaller nonce,
+it will be delivered after them or dropped.
+*/
+func (p *PhotonProtocol) bufferIfOutOfOrder(msg encoding.SignedMessager, echohash common.Hash) bool {
+	env, expected, ok := p.expectedNonce(msg)
+	if !ok || env.Nonce <= expected {
+		return false
+	}
+	key := channelQueueKey(msg.GetSender(), env.ChannelIdentifier)
+	p.reorderLock.Lock()
+	rb, ok := p.reorderBuffers[key]
+	if !ok {
+		rb = &reorderBuffer{pending: make(map[uint64]*MessageToPhoton)}
+		p.reorderBuffers[key] = rb
+	}
+	p.reorderLock.Unlock()
+	for nonce := range rb.pending {
+		if nonce < expected {
+			delete(rb.pending, nonce)
+		}
+	}
+	if env.Nonce-expected >= maxReorderedMessages {
+		p.log.Info(fmt.Sprintf("drop message %s, too far from expected nonce %d", msg, expected))
+		return true
+	}
+	p.log.Debug(fmt.Sprintf("buffer message %s, expected nonce %d", msg, expected))
+	rb.pending[env.Nonce] = &MessageToPhoton{Msg: msg, EchoHash: echohash}
+	if rb.pending[expected] == nil &&
+		(rb.requestedNonce != expected || time.Since(rb.requestedAt) > resendRequestInterval) {
+		rb.requestedNonce = expected
+		rb.requestedAt = time.Now()
+		p.sendResendRequest(msg.GetSender(), env.ChannelIdentifier, env.OpenBlockNumber, expected)
+	}
+	return true
+}
+
+//deliverBuffered delivers buffered messages following `msg` until a gap
+func (p *PhotonProtocol) deliverBuffered(msg encoding.SignedMessager) {
+	env, expected, ok := p.expectedNonce(msg)
+	if !ok {
+		return
+	}
+	key := channelQueueKey(msg.GetSender(), env.ChannelIdentifier)
+	p.reorderLock.Lock()
+	rb, ok := p.reorderBuffers[key]
+	p.reorderLock.Unlock()
+	if !ok {
+		return
+	}
+	for {
+		m := rb.pending[expected]
+		if m == nil {
+			break
+		}
+		delete(rb.pending, expected)
+		if !p.deliverToPhoton(m.Msg, m.EchoHash) {
+			break
+		}
+		_, expected, ok = p.expectedNonce(m.Msg)
+		if !ok {
+			break
+		}
+	}
+	if len(rb.pending) == 0 {
+		p.reorderLock.Lock()
+		delete(p.reorderBuffers, key)
+		p.reorderLock.Unlock()
+	}
+}
+
+//sendResendRequest asks sender to resend the message with `nonce`, without blocking
+func (p *PhotonProtocol) sendResendRequest(sender common.Address, channelIdentifier common.Hash, openBlockNumber int64, nonce uint64) {
+	go func() {
+		defer rpanic.PanicRecover("protocol sendResendRequest")
+		m := encoding.NewResendRequest(channelIdentifier, openBlockNumber, nonce)
+		err := m.Sign(p.privKey, m)
+		if err == nil {
+			err = p.sendRawWitNoAck(sender, m.Pack())
+		}
+		if err != nil {
+			p.log.Info(fmt.Sprintf("send %s to %s err %s", m, utils.APex2(sender), err))
+		}
+	}()
+}
+
+//handleResendRequest resends the requested message now if it's still in flight
+func (p *PhotonProtocol) handleResendRequest(m *encoding.ResendRequest) {
+	p.mapLock.Lock()
+	defer p.mapLock.Unlock()
+	ql, ok := p.sendingQueueMap[channelQueueKey(m.Sender, m.ChannelIdentifier)]
+	if !ok {
+		return
+	}
+	msgState, ok := ql.inflight[m.Nonce]
+	if !ok {
+		return
+	}
+	select {
+	case msgState.resendChan <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,186 @@
+package network
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/channel/channeltype"
+	"github.com/SmartMeshFoundation/Photon/encoding"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+//nonceChannel is a fake photon which accepts balance proofs only in nonce order
+type nonceChannel struct {
+	lock     sync.Mutex
+	nonce    uint64
+	received []uint64
+}
+
+const testOpenBlockNumber = 3
+
+func (c *nonceChannel) GetChannelStatus(channelIdentifier common.Hash) (int, int64) {
+	return channeltype.StateOpened, testOpenBlockNumber
+}
+
+func (c *nonceChannel) GetPartnerNonce(channelIdentifier common.Hash) (uint64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.nonce, true
+}
+
+func (c *nonceChannel) run(p *PhotonProtocol) {
+	for {
+		select {
+		case m := <-p.ReceivedMessageChan:
+			nonce := getMessageNonce(m.Msg)
+			var err error
+			c.lock.Lock()
+			if nonce == c.nonce+1 {
+				c.nonce = nonce
+				c.received = append(c.received, nonce)
+			} else {
+				err = fmt.Errorf("invalid nonce %d, expect %d", nonce, c.nonce+1)
+			}
+			c.lock.Unlock()
+			m.Result <- err
+		case <-p.quitChan:
+			return
+		}
+	}
+}
+
+func makeWindowProtocols(latency time.Duration, window int) (p1, p2 *PhotonProtocol, n *MemoryNetwork, c *nonceChannel) {
+	n = NewMemoryNetwork(latency)
+	key1, _ := crypto.GenerateKey()
+	key2, _ := crypto.GenerateKey()
+	p1 = NewPhotonProtocol(n.NewTransport(crypto.PubkeyToAddress(key1.PublicKey)), key1, &nonceChannel{})
+	c = &nonceChannel{}
+	p2 = NewPhotonProtocol(n.NewTransport(crypto.PubkeyToAddress(key2.PublicKey)), key2, c)
+	p1.SetSendWindow(window)
+	p1.Start(true)
+	p2.Start(true)
+	go c.run(p2)
+	return
+}
+
+func newTestDirectTransfer(p *PhotonProtocol, channelIdentifier common.Hash, nonce uint64) *encoding.DirectTransfer {
+	tr := encoding.NewDirectTransfer(&encoding.BalanceProof{
+		Nonce:             nonce,
+		ChannelIdentifier: channelIdentifier,
+		OpenBlockNumber:   testOpenBlockNumber,
+		TransferAmount:    new(big.Int).SetUint64(nonce),
+	})
+	err := tr.Sign(p.privKey, tr)
+	if err != nil {
+		panic(err)
+	}
+	return tr
+}
+
+//exchangeCapabilities makes sure p1 knows whether p2 can receive out of order
+func exchangeCapabilities(t testing.TB, p1, p2 *PhotonProtocol) {
+	err := p1.sendCapabilities(p2.nodeAddr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && p1.PeerCapabilities(p2.nodeAddr) == nil; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if p1.PeerCapabilities(p2.nodeAddr) == nil {
+		t.Fatal("capabilities not exchanged")
+	}
+}
+
+func TestPhotonProtocolSendWindow(t *testing.T) {
+	p1, p2, n, c := makeWindowProtocols(time.Millisecond*5, 8)
+	defer p1.StopAndWait()
+	defer p2.StopAndWait()
+	exchangeCapabilities(t, p1, p2)
+	assert.True(t, p1.PeerCapabilities(p2.nodeAddr).HasFeature(encoding.FeatureReorder))
+	//lose the first transmission of nonce 3, it's recovered by ResendRequest long before retry timeout
+	var dropped bool
+	n.drop = func(receiver common.Address, data []byte) bool {
+		if dropped || receiver != p2.nodeAddr || int(data[0]) != encoding.DirectTransferCmdID {
+			return false
+		}
+		tr := new(encoding.DirectTransfer)
+		if tr.UnPack(data) == nil && tr.Nonce == 3 {
+			dropped = true
+			return true
+		}
+		return false
+	}
+	channelIdentifier := utils.NewRandomHash()
+	var results []*utils.AsyncResult
+	for i := uint64(1); i <= 20; i++ {
+		results = append(results, p1.SendAsync(p2.nodeAddr, newTestDirectTransfer(p1, channelIdentifier, i)))
+	}
+	timeout := time.After(p1.retryInterval / 2)
+	for i, r := range results {
+		select {
+		case err := <-r.Result:
+			assert.Nil(t, err)
+		case <-timeout:
+			t.Fatalf("message %d timeout", i+1)
+		}
+	}
+	assert.True(t, dropped)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	assert.EqualValues(t, 20, len(c.received))
+	for i, nonce := range c.received {
+		assert.EqualValues(t, i+1, nonce)
+	}
+}
+
+func TestPhotonProtocolSendWindowOldPeer(t *testing.T) {
+	p1, p2, _, _ := makeWindowProtocols(time.Millisecond, 8)
+	defer p1.StopAndWait()
+	defer p2.StopAndWait()
+	//p2 doesn't announce FeatureReorder, so messages are sent one by one
+	c := encoding.NewCapabilities(0, time.Now().UnixNano(), false)
+	c.Sign(p2.privKey, c)
+	p1.handleCapabilities(c)
+	tr := newTestDirectTransfer(p1, utils.NewRandomHash(), 1)
+	assert.EqualValues(t, 1, p1.sendWindowFor(p2.nodeAddr, tr))
+	assert.EqualValues(t, 1, p1.sendWindowFor(p2.nodeAddr, encoding.NewRevealSecret(utils.NewRandomHash())))
+}
+
+func benchmarkSendWindow(b *testing.B, window int) {
+	p1, p2, _, _ := makeWindowProtocols(time.Millisecond*5, window)
+	defer p1.StopAndWait()
+	defer p2.StopAndWait()
+	exchangeCapabilities(b, p1, p2)
+	channelIdentifier := utils.NewRandomHash()
+	msgs := make([]*encoding.DirectTransfer, b.N)
+	for i := range msgs {
+		msgs[i] = newTestDirectTransfer(p1, channelIdentifier, uint64(i+1))
+	}
+	b.ResetTimer()
+	results := make([]*utils.AsyncResult, b.N)
+	for i, m := range msgs {
+		results[i] = p1.SendAsync(p2.nodeAddr, m)
+	}
+	for _, r := range results {
+		err := <-r.Result
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+//BenchmarkPhotonProtocolSendWindow1 one message per round trip
+func BenchmarkPhotonProtocolSendWindow1(b *testing.B) {
+	benchmarkSendWindow(b, 1)
+}
+
+//BenchmarkPhotonProtocolSendWindow16 up to 16 messages per round trip
+func BenchmarkPhotonProtocolSendWindow16(b *testing.B) {
+	benchmarkSendWindow(b, 16)
+}
@@ -43,6 +43,10 @@ const (
 
 	// InfoTypeContractCallTXInfo 4 自己发起的tx执行完成,通知执行结果,Message类型为models.TXInfo
 	InfoTypeContractCallTXInfo
+
+	// InfoTypeHistorySyncProgress 12 分段同步链上历史事件的进度,Message类型为models.HistorySyncProgress
+	// 5-11已在docs/mobie.md中使用
+	InfoTypeHistorySyncProgress = 12
 )
 
 //InfoStruct for notify to mobile
@@ -161,3 +161,13 @@ func (h *Handler) NotifyContractCallTXInfo(txInfo *models.TXInfo) {
 		Message: txInfo,
 	})
 }
+
+/*
+NotifyHistorySyncProgress 长时间离线后同步链上历史事件时,通知上层同步进度
+*/
+func (h *Handler) NotifyHistorySyncProgress(progress *models.HistorySyncProgress) {
+	h.Notify(LevelInfo, &InfoStruct{
+		Type:    InfoTypeHistorySyncProgress,
+		Message: progress,
+	})
+}
@@ -0,0 +1,74 @@
+package photon
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"github.com/SmartMeshFoundation/Photon/encoding"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/params"
+	"github.com/SmartMeshFoundation/Photon/transfer/route"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+buildOnion 路由上所有节点都支持onion并且知道公钥时,为路由构造onion,这样mediator只知道上家和下家.
+每个mediator的手续费按我的费率估算,路由给出的手续费更多时多出来的给第一个mediator,
+过期时间每一跳减少DefaultRevealTimeout,mediator还会根据自己的通道调整.
+*/
+func (rs *Service) buildOnion(r *route.State, tokenAddress common.Address, amount *big.Int, expiration int64) {
+	if !rs.Config.Onion || r.Trampoline != utils.EmptyAddress || len(r.Path) < 2 || len(r.Path) > encoding.MaxOnionHops {
+		return
+	}
+	n := len(r.Path)
+	pubkeys := make([]*ecdsa.PublicKey, n)
+	for i, addr := range r.Path {
+		pubkeys[i] = rs.Protocol.OnionPubkey(addr)
+		if pubkeys[i] == nil {
+			log.Trace(fmt.Sprintf("%s doesn't support onion or its key is unknown,send route %s as plain path", utils.APex2(addr), utils.StringInterface(r.Path, 2)))
+			return
+		}
+	}
+	lockExpiration := rs.GetBlockNumber() + int64(r.SettleTimeout()) - int64(params.DefaultRevealTimeout)
+	if expiration != 0 && lockExpiration > expiration {
+		lockExpiration = expiration
+	}
+	hops := make([]*encoding.OnionHop, n)
+	keys := make([]common.Hash, n)
+	for i := range hops {
+		hops[i] = &encoding.OnionHop{
+			Expiration: lockExpiration - int64(i+1)*int64(params.DefaultRevealTimeout),
+		}
+		_, err := rand.Read(keys[i][:])
+		if err != nil {
+			log.Error(fmt.Sprintf("generate onion error key err %s", err))
+			return
+		}
+		hops[i].ErrorKey = keys[i]
+	}
+	target := hops[n-1]
+	target.Amount = new(big.Int).Set(amount)
+	target.Initiator = rs.NodeAddress
+	target.Expiration = hops[n-2].Expiration
+	//从target往前算每个mediator转出的金额
+	forward := new(big.Int).Set(amount)
+	for i := n - 2; i >= 0; i-- {
+		hops[i].NextHop = r.Path[i+1]
+		hops[i].Amount = new(big.Int).Set(forward)
+		forward.Add(forward, rs.FeePolicy.GetNodeChargeFee(r.Path[i], tokenAddress, forward))
+	}
+	totalFee := forward.Sub(forward, amount)
+	if r.TotalFee == nil || r.TotalFee.Cmp(totalFee) < 0 {
+		r.TotalFee = totalFee
+	}
+	onion, err := encoding.NewOnion(hops, pubkeys)
+	if err != nil {
+		log.Error(fmt.Sprintf("build onion for route %s err %s", utils.StringInterface(r.Path, 2), err))
+		return
+	}
+	r.Onion = onion
+	r.OnionKeys = keys
+}
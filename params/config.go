@@ -2,6 +2,7 @@ package params
 
 import (
 	"crypto/ecdsa"
+	"math/big"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -67,10 +68,30 @@ type Config struct {
 	IgnoreMediatedNodeRequest bool // true: this node will ignore any mediated transfer who's target is not me.
 	EnableHealthCheck         bool //send ping periodically?
 	XMPPServer                string
-	IsMeshNetwork             bool   //is mesh now?
-	PfsHost                   string // pathfinder server host
+	IsMeshNetwork             bool          //is mesh now?
+	PfsHost                   string        // pathfinder server host, several hosts are separated by comma
+	PfsCrossCheck             bool          // ask two pathfinder servers and prefer routes both agree on
+	PfsServerAddress          string        // host:port of the embedded pathfinder service, empty means disabled
+	PfsSubmitWindow           time.Duration // changes of a channel within the window are submitted to pfs once
+	PfsSubmitBuckets          int           // submit to pfs only when our share of a channel moves into another of these equal buckets, 0 means every change
+	PfsSubmitThresholds       []int         // submit to pfs only when our share of a channel crosses one of these percents
 	HTTPUsername              string
 	HTTPPassword              string
+	TCPListenAddress          string           // host:port for encrypted direct tcp transport, empty means disabled
+	TCPAnnounceAddress        string           // host:port announced to other nodes, default is TCPListenAddress
+	EnableEncryption          bool             // encrypt messages to nodes which support it, so relay servers cannot read them
+	SendWindow                int              // max unacked balance proof messages per channel, 1 means wait ack of each message
+	ChannelWorkers            int              // workers handling messages and events of a single channel in parallel, 0 means all in main loop
+	DbCacheSize               int              // max cached channels, acks and locks of each kind, 0 means no cache
+	LocalRoutes               int              // max full paths the initiator computes with local routing, 0 means only order neighbours
+	Trampoline                bool             // find the rest of the route for transfers from partners which cannot, such as mobile nodes
+	TrampolineFeeRate         int64            // ppm of the amount paid as fee through a trampoline when max fee isn't given
+	Onion                     bool             // forward onion routed transfers, and send onion routed when every node of the route supports it
+	JitChannel                bool             // as a mediator, open or deposit to a channel to the next hop which has no enough capacity, and forward after it's confirmed
+	JitMaxDeposit             *big.Int         // max tokens deposited for one transfer
+	JitMaxPendingDeposit      *big.Int         // max tokens deposited for all transfers waiting for their channels
+	JitTargets                []common.Address // next hops channels may be opened to, empty means any node
+	DisableAutoSettle         bool             // don't unlock and settle closed channels automatically when the settle window expires
 }
 
 //DefaultConfig default config
@@ -89,6 +110,11 @@ var DefaultConfig = Config{
 	MsgTimeout:        100 * time.Second,
 	EnableHealthCheck: false,
 	XMPPServer:        DefaultXMPPServer,
+	SendWindow:        1,
+	ChannelWorkers:    0,
+	DbCacheSize:       0,
+	LocalRoutes:       5,
+	TrampolineFeeRate: 10000,
 }
 
 //ConditionQuit is for test
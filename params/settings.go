@@ -60,9 +60,15 @@ ChannelSettleTimeoutMax The maximum settle timeout is chosen as something above
 */
 const ChannelSettleTimeoutMax = 2700000
 
-//UDPMaxMessageSize message size
+//UDPMaxMessageSize message size, also the default mtu of udp
 const UDPMaxMessageSize = 1200
 
+//UDPMaxFragmentedMessageSize messages larger than mtu are sent in fragments over udp, this is the limit of the whole message
+const UDPMaxFragmentedMessageSize = 64 * 1024
+
+//TCPMaxMessageSize tcp has no limit of message size, this is only a protection against a peer eating all my memory
+const TCPMaxMessageSize = 16 * 1024 * 1024
+
 //DefaultXMPPServer xmpp server
 const DefaultXMPPServer = "193.112.248.133:5222"
 
@@ -13,9 +13,10 @@ api to call pfg server
 */
 type PfsProxy interface {
 	/*
-		submit partner's balance proof to pfg
+		submit partner's balance proof to pfg,
+		paused means I refuse transfers from the partner through this channel, pfg finds no capacity in that direction
 	*/
-	SubmitBalance(nonce uint64, transferAmount, lockAmount *big.Int, openBlockNumber int64, locksroot, channelIdentifier, additionHash common.Hash, proofSigner common.Address, signature []byte) error
+	SubmitBalance(nonce uint64, transferAmount, lockAmount *big.Int, paused bool, openBlockNumber int64, locksroot, channelIdentifier, additionHash common.Hash, proofSigner common.Address, signature []byte) error
 
 	/*
 		find path
@@ -0,0 +1,497 @@
+package pfsproxy
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/rerr"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	defaultFindPathCacheTTL = 10 * time.Second
+	minPfsRetryInterval     = 5 * time.Second
+	maxPfsRetryInterval     = 5 * time.Minute
+	//defaultFindPathCacheSize 缓存的路径最多这么多条,超过以后先删除过期的,再删除最早过期的
+	defaultFindPathCacheSize = 1000
+	//findPathAmountBandBits 金额只保留最高的这么多位作为缓存的key,同一个区间的金额相差不超过1/8
+	findPathAmountBandBits = 4
+	//maxPfsBacklog 每个pfs最多积压的请求数,超过以后丢弃最早的
+	maxPfsBacklog = 1000
+	//crossCheckLimitPaths 交叉验证时向每个pfs要的路径数
+	crossCheckLimitPaths = 3
+)
+
+//isConnectError 连不上pfs,而不是pfs拒绝了请求
+func isConnectError(err error) bool {
+	if err == ErrConnect {
+		return true
+	}
+	if e, ok := err.(rerr.StandardError); ok {
+		return e.ErrorCode == rerr.ErrPFS.ErrorCode
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+/*
+pfsEndpoint is one of the pfs a multiPfsClient uses.
+It's down for a while after connecting failed, the interval doubles every time until maxPfsRetryInterval.
+Submissions failed to connect are kept in backlog, the later submission of the same subject replaces the former.
+Once the server recovers, the backlog is sent in background, submissions during that go to the backlog too,
+so they are sent in order, and queries never wait for it.
+*/
+type pfsEndpoint struct {
+	client *pfsClient
+	//lock guards fields below, it's never held during a request
+	lock        sync.Mutex
+	failures    int
+	downUntil   time.Time
+	seq         uint64
+	flushing    bool
+	backlogKeys []string
+	backlog     map[string]*pfsSubmission
+}
+
+//pfsSubmission the later one has a larger seq
+type pfsSubmission struct {
+	seq uint64
+	f   func(c *pfsClient) error
+}
+
+func newPfsEndpoint(host string, privateKey *ecdsa.PrivateKey) *pfsEndpoint {
+	return &pfsEndpoint{
+		client: &pfsClient{
+			host:       host,
+			privateKey: privateKey,
+		},
+		backlog: make(map[string]*pfsSubmission),
+	}
+}
+
+//call 离线时直接返回ErrConnect
+func (s *pfsEndpoint) call(timeFunc func() time.Time, f func(c *pfsClient) error) error {
+	s.lock.Lock()
+	down := timeFunc().Before(s.downUntil)
+	s.lock.Unlock()
+	if down {
+		return ErrConnect
+	}
+	err := f(s.client)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.report(timeFunc(), err)
+	s.startFlush(timeFunc)
+	return err
+}
+
+/*
+submit sends `f` now if there is no backlog,
+otherwise it goes to the backlog and ErrConnect is returned.
+*/
+func (s *pfsEndpoint) submit(timeFunc func() time.Time, key string, f func(c *pfsClient) error) error {
+	s.lock.Lock()
+	s.seq++
+	sub := &pfsSubmission{s.seq, f}
+	if timeFunc().Before(s.downUntil) || s.flushing || len(s.backlogKeys) > 0 {
+		s.addBacklog(key, sub)
+		s.startFlush(timeFunc)
+		s.lock.Unlock()
+		return ErrConnect
+	}
+	s.lock.Unlock()
+	err := f(s.client)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.report(timeFunc(), err)
+	if isConnectError(err) {
+		s.addBacklog(key, sub)
+		return err
+	}
+	s.startFlush(timeFunc)
+	return err
+}
+
+func (s *pfsEndpoint) report(now time.Time, err error) {
+	if !isConnectError(err) {
+		if s.failures > 0 {
+			log.Info(fmt.Sprintf("pfs %s recovered", s.client.host))
+		}
+		s.failures = 0
+		s.downUntil = time.Time{}
+		return
+	}
+	interval := minPfsRetryInterval << uint(s.failures)
+	if interval > maxPfsRetryInterval || interval <= 0 {
+		interval = maxPfsRetryInterval
+	}
+	s.failures++
+	s.downUntil = now.Add(interval)
+	log.Warn(fmt.Sprintf("pfs %s is down, retry after %s, err %s", s.client.host, interval, err))
+}
+
+//startFlush starts sending the backlog in background if the server is up, lock must be held
+func (s *pfsEndpoint) startFlush(timeFunc func() time.Time) {
+	if s.flushing || len(s.backlogKeys) == 0 || timeFunc().Before(s.downUntil) {
+		return
+	}
+	s.flushing = true
+	go s.flushBacklog(timeFunc)
+}
+
+//flushBacklog sends the backlog in order until it's empty or the server is down again
+func (s *pfsEndpoint) flushBacklog(timeFunc func() time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.backlogKeys) > 0 {
+		key := s.backlogKeys[0]
+		sub := s.backlog[key]
+		s.lock.Unlock()
+		err := sub.f(s.client)
+		s.lock.Lock()
+		s.report(timeFunc(), err)
+		if isConnectError(err) {
+			break
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("pfs %s rejected %s in backlog, err %s", s.client.host, key, err))
+		}
+		//replaced by a later submission while sending, send it again
+		if s.backlog[key] != sub {
+			continue
+		}
+		s.backlogKeys = s.backlogKeys[1:]
+		delete(s.backlog, key)
+	}
+	s.flushing = false
+}
+
+//addBacklog an earlier submission never replaces a later one, lock must be held
+func (s *pfsEndpoint) addBacklog(key string, sub *pfsSubmission) {
+	old, ok := s.backlog[key]
+	if ok {
+		if old.seq < sub.seq {
+			s.backlog[key] = sub
+		}
+		return
+	}
+	if len(s.backlogKeys) >= maxPfsBacklog {
+		log.Warn(fmt.Sprintf("pfs %s backlog is full, drop %s", s.client.host, s.backlogKeys[0]))
+		delete(s.backlog, s.backlogKeys[0])
+		s.backlogKeys = s.backlogKeys[1:]
+	}
+	s.backlogKeys = append(s.backlogKeys, key)
+	s.backlog[key] = sub
+}
+
+type findPathCacheKey struct {
+	peerFrom    common.Address
+	peerTo      common.Address
+	token       common.Address
+	amountBand  string
+	isInitiator bool
+}
+
+type findPathCacheEntry struct {
+	amount *big.Int
+	resp   []FindPathResponse
+	expire time.Time
+}
+
+//amountBand 金额的最高findPathAmountBandBits位,其余位清零
+func amountBand(amount *big.Int) string {
+	shift := amount.BitLen() - findPathAmountBandBits
+	if shift <= 0 {
+		return amount.String()
+	}
+	band := new(big.Int).Rsh(amount, uint(shift))
+	return new(big.Int).Lsh(band, uint(shift)).String()
+}
+
+/*
+multiPfsClient uses several pfs.
+FindPath asks the servers in order and fails over to the next one,
+responses are cached for cacheTTL by the band of amount, at most cacheSize of them.
+Fees depend on the amount, so a cached response is used only for an amount not larger than the one it was found for.
+If crossCheck, FindPath asks two servers and routes both of them returned come first.
+Balances and fees are submitted to all servers.
+*/
+type multiPfsClient struct {
+	endpoints  []*pfsEndpoint
+	crossCheck bool
+	cacheTTL   time.Duration
+	cacheSize  int
+	lock       sync.Mutex
+	cache      map[findPathCacheKey]*findPathCacheEntry
+	timeFunc   func() time.Time
+}
+
+/*
+NewMultiPfsProxy :
+hosts are tried in order
+*/
+func NewMultiPfsProxy(hosts []string, privateKey *ecdsa.PrivateKey, crossCheck bool) PfsProxy {
+	m := &multiPfsClient{
+		crossCheck: crossCheck,
+		cacheTTL:   defaultFindPathCacheTTL,
+		cacheSize:  defaultFindPathCacheSize,
+		cache:      make(map[findPathCacheKey]*findPathCacheEntry),
+		timeFunc:   time.Now,
+	}
+	for _, host := range hosts {
+		m.endpoints = append(m.endpoints, newPfsEndpoint(host, privateKey))
+	}
+	return m
+}
+
+//submit 提交到所有的pfs,只要有一个接受了就算成功,连不上的放到积压队列中等待恢复后重发
+func (m *multiPfsClient) submit(key string, f func(c *pfsClient) error) (err error) {
+	accepted := false
+	for _, s := range m.endpoints {
+		err2 := s.submit(m.timeFunc, key, f)
+		if err2 == nil {
+			accepted = true
+			continue
+		}
+		if isConnectError(err2) {
+			err2 = ErrConnect
+		} else {
+			log.Error(fmt.Sprintf("pfs %s rejected %s, err %s", s.client.host, key, err2))
+		}
+		err = err2
+	}
+	if accepted {
+		return nil
+	}
+	return
+}
+
+//query 依次询问,直到有一个pfs回答
+func (m *multiPfsClient) query(f func(c *pfsClient) error) (err error) {
+	for _, s := range m.endpoints {
+		err = s.call(m.timeFunc, f)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+/*
+SubmitBalance :
+*/
+func (m *multiPfsClient) SubmitBalance(nonce uint64, transferAmount, lockAmount *big.Int, paused bool, openBlockNumber int64, locksroot, channelIdentifier, additionHash common.Hash, proofSigner common.Address, signature []byte) (err error) {
+	return m.submit("balance "+channelIdentifier.String(), func(c *pfsClient) error {
+		return c.SubmitBalance(nonce, transferAmount, lockAmount, paused, openBlockNumber, locksroot, channelIdentifier, additionHash, proofSigner, signature)
+	})
+}
+
+/*
+FindPath : find path
+*/
+func (m *multiPfsClient) FindPath(peerFrom, peerTo, token common.Address, amount *big.Int, isInitiator bool) (resp []FindPathResponse, err error) {
+	key := findPathCacheKey{
+		peerFrom:    peerFrom,
+		peerTo:      peerTo,
+		token:       token,
+		amountBand:  amountBand(amount),
+		isInitiator: isInitiator,
+	}
+	if resp, ok := m.getCachedPaths(key, amount); ok {
+		return resp, nil
+	}
+	want, limitPaths := 1, 1
+	if m.crossCheck {
+		want, limitPaths = 2, crossCheckLimitPaths
+	}
+	var results [][]FindPathResponse
+	for _, s := range m.endpoints {
+		var paths []FindPathResponse
+		err = s.call(m.timeFunc, func(c *pfsClient) (err2 error) {
+			paths, err2 = c.findPath(peerFrom, peerTo, token, amount, isInitiator, limitPaths)
+			return
+		})
+		if err != nil {
+			continue
+		}
+		results = append(results, paths)
+		if len(results) >= want {
+			break
+		}
+	}
+	if len(results) == 0 {
+		return
+	}
+	resp = results[0]
+	if len(results) > 1 {
+		resp = agreedPathsFirst(results[0], results[1])
+	}
+	m.cachePaths(key, amount, resp)
+	return append([]FindPathResponse{}, resp...), nil
+}
+
+func (m *multiPfsClient) getCachedPaths(key findPathCacheKey, amount *big.Int) (resp []FindPathResponse, ok bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entry, ok := m.cache[key]
+	if !ok {
+		return
+	}
+	if !m.timeFunc().Before(entry.expire) {
+		delete(m.cache, key)
+		return nil, false
+	}
+	if entry.amount.Cmp(amount) < 0 {
+		return nil, false
+	}
+	return append([]FindPathResponse{}, entry.resp...), true
+}
+
+func (m *multiPfsClient) cachePaths(key findPathCacheKey, amount *big.Int, resp []FindPathResponse) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := m.timeFunc()
+	if _, ok := m.cache[key]; !ok && len(m.cache) >= m.cacheSize {
+		var oldestKey findPathCacheKey
+		var oldest *findPathCacheEntry
+		for k, e := range m.cache {
+			if !now.Before(e.expire) {
+				delete(m.cache, k)
+			} else if oldest == nil || e.expire.Before(oldest.expire) {
+				oldestKey, oldest = k, e
+			}
+		}
+		if len(m.cache) >= m.cacheSize && oldest != nil {
+			delete(m.cache, oldestKey)
+		}
+	}
+	m.cache[key] = &findPathCacheEntry{
+		amount: new(big.Int).Set(amount),
+		resp:   resp,
+		expire: now.Add(m.cacheTTL),
+	}
+}
+
+func samePath(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if common.HexToAddress(a[i]) != common.HexToAddress(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+agreedPathsFirst 两个pfs都给出的路径排在前面,手续费取较高的那个,以免手续费不够,
+然后是其余的路径
+*/
+func agreedPathsFirst(first, second []FindPathResponse) (paths []FindPathResponse) {
+	var rest []FindPathResponse
+	agreed := make(map[int]bool)
+	for _, p := range first {
+		found := false
+		for j, p2 := range second {
+			if samePath(p.Result, p2.Result) {
+				found = true
+				agreed[j] = true
+				if p2.Fee != nil && (p.Fee == nil || p2.Fee.Cmp(p.Fee) > 0) {
+					p.Fee = p2.Fee
+				}
+				break
+			}
+		}
+		if found {
+			paths = append(paths, p)
+		} else {
+			rest = append(rest, p)
+		}
+	}
+	for j, p := range second {
+		if !agreed[j] {
+			rest = append(rest, p)
+		}
+	}
+	paths = append(paths, rest...)
+	for i := range paths {
+		paths[i].PathID = i
+	}
+	return
+}
+
+/*
+SetFeePolicy :set fee rate by account
+*/
+func (m *multiPfsClient) SetFeePolicy(fp *models.FeePolicy) (err error) {
+	return m.submit("fee policy", func(c *pfsClient) error {
+		return c.SetFeePolicy(fp)
+	})
+}
+
+/*
+SetAccountFee :set fee rate by account
+*/
+func (m *multiPfsClient) SetAccountFee(feeConstant *big.Int, feePercent int64) (err error) {
+	return m.submit("account fee", func(c *pfsClient) error {
+		return c.SetAccountFee(feeConstant, feePercent)
+	})
+}
+
+/*
+GetAccountFee : get fee rate by account
+*/
+func (m *multiPfsClient) GetAccountFee() (feeConstant *big.Int, feePercent int64, err error) {
+	err = m.query(func(c *pfsClient) (err2 error) {
+		feeConstant, feePercent, err2 = c.GetAccountFee()
+		return
+	})
+	return
+}
+
+/*
+SetTokenFee :set fee rate of a token
+*/
+func (m *multiPfsClient) SetTokenFee(feeConstant *big.Int, feePercent int64, tokenAddress common.Address) (err error) {
+	return m.submit("token fee "+tokenAddress.String(), func(c *pfsClient) error {
+		return c.SetTokenFee(feeConstant, feePercent, tokenAddress)
+	})
+}
+
+/*
+GetTokenFee : get fee rate by token
+*/
+func (m *multiPfsClient) GetTokenFee(tokenAddress common.Address) (feeConstant *big.Int, feePercent int64, err error) {
+	err = m.query(func(c *pfsClient) (err2 error) {
+		feeConstant, feePercent, err2 = c.GetTokenFee(tokenAddress)
+		return
+	})
+	return
+}
+
+/*
+SetChannelFee :set fee rate of a channel
+*/
+func (m *multiPfsClient) SetChannelFee(feeConstant *big.Int, feePercent int64, channelIdentifier common.Hash) (err error) {
+	return m.submit("channel fee "+channelIdentifier.String(), func(c *pfsClient) error {
+		return c.SetChannelFee(feeConstant, feePercent, channelIdentifier)
+	})
+}
+
+/*
+GetChannelFee : get fee rate by channel
+*/
+func (m *multiPfsClient) GetChannelFee(channelIdentifier common.Hash) (feeConstant *big.Int, feePercent int64, err error) {
+	err = m.query(func(c *pfsClient) (err2 error) {
+		feeConstant, feePercent, err2 = c.GetChannelFee(channelIdentifier)
+		return
+	})
+	return
+}
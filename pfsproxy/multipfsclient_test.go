@@ -0,0 +1,159 @@
+package pfsproxy
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+//waitFlushed waits the backlog of `s` is sent in background
+func waitFlushed(t *testing.T, s *pfsEndpoint) {
+	for i := 0; i < 100; i++ {
+		s.lock.Lock()
+		flushing := s.flushing
+		s.lock.Unlock()
+		if !flushing {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("backlog is not flushed")
+}
+
+func TestMultiPfsClient_Failover(t *testing.T) {
+	env1 := newTestPfsEnv()
+	defer env1.Close()
+	env2 := newTestPfsEnvWithToken(env1.token, env1.tokensNetwork)
+	defer env2.Close()
+	alice, bob, carol := newTestAccount(), newTestAccount(), newTestAccount()
+	for _, env := range []*testPfsEnv{env1, env2} {
+		env.newChannel(alice, bob, 100, 100)
+		env.newChannel(bob, carol, 100, 100)
+	}
+	now := time.Now()
+	m := NewMultiPfsProxy([]string{env1.host, env2.host}, alice.PrivateKey, false).(*multiPfsClient)
+	m.timeFunc = func() time.Time {
+		return now
+	}
+	env1.setOffline(true)
+	routes, err := m.FindPath(alice.Address, carol.Address, env1.token, big.NewInt(20), true)
+	if assert.NoError(t, err) && assert.EqualValues(t, 1, len(routes)) {
+		assert.EqualValues(t, []common.Address{bob.Address, carol.Address}, routes[0].GetPath())
+	}
+	assert.EqualValues(t, 1, m.endpoints[0].failures)
+
+	//env1离线期间的提交先积压,恢复以后重发
+	assert.NoError(t, m.SetAccountFee(big.NewInt(5), 1000))
+	assert.NoError(t, m.SetAccountFee(big.NewInt(6), 1000))
+	assert.EqualValues(t, []string{"account fee"}, m.endpoints[0].backlogKeys)
+	env1.setOffline(false)
+	//还没到重试时间,由env2回答
+	feeConstant, _, err := m.GetAccountFee()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 6, feeConstant.Int64())
+	assert.EqualValues(t, 1, len(m.endpoints[0].backlogKeys))
+	now = now.Add(minPfsRetryInterval)
+	//排在积压的后面,在后台一起发送
+	assert.NoError(t, m.SetTokenFee(big.NewInt(7), 1000, env1.token))
+	waitFlushed(t, m.endpoints[0])
+	assert.EqualValues(t, 0, len(m.endpoints[0].backlogKeys))
+	assert.EqualValues(t, 0, m.endpoints[0].failures)
+	for _, env := range []*testPfsEnv{env1, env2} {
+		feeConstant, _, err := NewPfsProxy(env.host, alice.PrivateKey).GetAccountFee()
+		assert.NoError(t, err)
+		assert.EqualValues(t, 6, feeConstant.Int64())
+		feeConstant, _, err = NewPfsProxy(env.host, alice.PrivateKey).GetTokenFee(env.token)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 7, feeConstant.Int64())
+	}
+
+	//都连不上
+	env1.setOffline(true)
+	env2.setOffline(true)
+	assert.Equal(t, ErrConnect, m.SetAccountFee(big.NewInt(8), 1000))
+	assert.EqualValues(t, now.Add(minPfsRetryInterval), m.endpoints[0].downUntil)
+	//连续失败,重试间隔加倍
+	now = now.Add(minPfsRetryInterval)
+	_, err = m.FindPath(alice.Address, carol.Address, env1.token, big.NewInt(300), true)
+	assert.Error(t, err)
+	assert.EqualValues(t, now.Add(2*minPfsRetryInterval), m.endpoints[0].downUntil)
+}
+
+func TestMultiPfsClient_Cache(t *testing.T) {
+	env := newTestPfsEnv()
+	defer env.Close()
+	alice, bob, carol := newTestAccount(), newTestAccount(), newTestAccount()
+	env.newChannel(alice, bob, 100, 100)
+	env.newChannel(bob, carol, 100, 100)
+	now := time.Now()
+	m := NewMultiPfsProxy([]string{env.host}, alice.PrivateKey, false).(*multiPfsClient)
+	m.timeFunc = func() time.Time {
+		return now
+	}
+	routes, err := m.FindPath(alice.Address, carol.Address, env.token, big.NewInt(21), true)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, len(routes))
+	env.setOffline(true)
+	//同一个区间内不超过缓存时的金额使用缓存,手续费和金额有关,更大的金额不能用
+	for _, amount := range []int64{21, 20} {
+		routes, err = m.FindPath(alice.Address, carol.Address, env.token, big.NewInt(amount), true)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, len(routes))
+	}
+	_, err = m.FindPath(alice.Address, carol.Address, env.token, big.NewInt(22), true)
+	assert.Error(t, err)
+	//过期的在查询时删除
+	now = now.Add(m.cacheTTL)
+	_, err = m.FindPath(alice.Address, carol.Address, env.token, big.NewInt(20), true)
+	assert.Error(t, err)
+	assert.EqualValues(t, 0, len(m.cache))
+
+	//超过数量限制时删除最早过期的
+	env.setOffline(false)
+	now = now.Add(maxPfsRetryInterval)
+	m.cacheSize = 1
+	_, err = m.FindPath(alice.Address, carol.Address, env.token, big.NewInt(20), true)
+	assert.NoError(t, err)
+	now = now.Add(time.Second)
+	_, err = m.FindPath(alice.Address, bob.Address, env.token, big.NewInt(20), true)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, len(m.cache))
+	for key := range m.cache {
+		assert.EqualValues(t, bob.Address, key.peerTo)
+	}
+}
+
+func TestAmountBand(t *testing.T) {
+	assert.EqualValues(t, "15", amountBand(big.NewInt(15)))
+	assert.EqualValues(t, "20", amountBand(big.NewInt(21)))
+	assert.EqualValues(t, amountBand(big.NewInt(1050000)), amountBand(big.NewInt(1100000)))
+	assert.NotEqual(t, amountBand(big.NewInt(1050000)), amountBand(big.NewInt(1200000)))
+}
+
+func TestMultiPfsClient_CrossCheck(t *testing.T) {
+	env1 := newTestPfsEnv()
+	defer env1.Close()
+	env2 := newTestPfsEnvWithToken(env1.token, env1.tokensNetwork)
+	defer env2.Close()
+	alice, bob, carol, dave := newTestAccount(), newTestAccount(), newTestAccount(), newTestAccount()
+	env1.newChannel(alice, bob, 100, 100)
+	env1.newChannel(bob, carol, 100, 100)
+	env1.newChannel(alice, dave, 100, 100)
+	env1.newChannel(dave, carol, 100, 100)
+	//env2不知道dave的通道
+	env2.newChannel(alice, bob, 100, 100)
+	env2.newChannel(bob, carol, 100, 100)
+	assert.NoError(t, NewPfsProxy(env1.host, bob.PrivateKey).SetAccountFee(big.NewInt(5), 0))
+	m := NewMultiPfsProxy([]string{env1.host, env2.host}, alice.PrivateKey, true)
+	routes, err := m.FindPath(alice.Address, carol.Address, env1.token, big.NewInt(20), true)
+	if assert.NoError(t, err) && assert.EqualValues(t, 2, len(routes)) {
+		assert.EqualValues(t, []common.Address{bob.Address, carol.Address}, routes[0].GetPath())
+		//手续费取较高的
+		assert.EqualValues(t, 5, routes[0].Fee.Int64())
+		assert.EqualValues(t, 0, routes[0].PathID)
+		assert.EqualValues(t, []common.Address{dave.Address, carol.Address}, routes[1].GetPath())
+	}
+}
@@ -66,6 +66,7 @@ type submitBalancePayload struct {
 	BalanceSignature []byte         `json:"balance_signature"`
 	ProofSigner      common.Address `json:"proof_signer"`
 	LockAmount       *big.Int       `json:"lock_amount"`
+	Paused           bool           `json:"paused,omitempty"` // 提交方暂停了从ProofSigner收款或者转发
 }
 
 type balanceProof struct {
@@ -78,7 +79,7 @@ type balanceProof struct {
 	Signature         []byte      `json:"signature"`
 }
 
-func (p *submitBalancePayload) sign(key *ecdsa.PrivateKey) []byte {
+func (p *submitBalancePayload) signData() []byte {
 	var err error
 	buf := new(bytes.Buffer)
 	err = binary.Write(buf, binary.BigEndian, p.BalanceProof.Nonce)
@@ -90,10 +91,19 @@ func (p *submitBalancePayload) sign(key *ecdsa.PrivateKey) []byte {
 	_, err = buf.Write(p.BalanceProof.Signature)
 	_, err = buf.Write(utils.BigIntTo32Bytes(p.LockAmount))
 	_, err = buf.Write(p.ProofSigner[:])
+	//没有暂停时与老格式一样,不认识这个标志的pfs也能验证
+	if p.Paused {
+		err = buf.WriteByte(1)
+	}
 	if err != nil {
 		log.Error(fmt.Sprintf("signData err %s", err))
 	}
-	p.BalanceSignature, err = utils.SignData(key, buf.Bytes())
+	return buf.Bytes()
+}
+
+func (p *submitBalancePayload) sign(key *ecdsa.PrivateKey) []byte {
+	var err error
+	p.BalanceSignature, err = utils.SignData(key, p.signData())
 	if err != nil {
 		log.Crit(fmt.Sprintf("signDataFor submitBalancePayload err %s", err))
 	}
@@ -103,7 +113,7 @@ func (p *submitBalancePayload) sign(key *ecdsa.PrivateKey) []byte {
 /*
 SubmitBalance :
 */
-func (pfg *pfsClient) SubmitBalance(nonce uint64, transferAmount, lockAmount *big.Int, openBlockNumber int64, locksroot, channelIdentifier, additionHash common.Hash, proofSigner common.Address, signature []byte) (err error) {
+func (pfg *pfsClient) SubmitBalance(nonce uint64, transferAmount, lockAmount *big.Int, paused bool, openBlockNumber int64, locksroot, channelIdentifier, additionHash common.Hash, proofSigner common.Address, signature []byte) (err error) {
 	if pfg.host == "" || pfg.privateKey == nil {
 		return ErrNotInit
 	}
@@ -118,6 +128,7 @@ func (pfg *pfsClient) SubmitBalance(nonce uint64, transferAmount, lockAmount *bi
 			Signature:         signature,
 		},
 		LockAmount:  lockAmount,
+		Paused:      paused,
 		ProofSigner: proofSigner,
 	}
 	payload.sign(pfg.privateKey)
@@ -155,7 +166,7 @@ type findPathPayload struct {
 	PeerFromChargeFee bool           `json:"peer_from_charge_fee"`
 }
 
-func (p *findPathPayload) sign(key *ecdsa.PrivateKey) []byte {
+func (p *findPathPayload) signData() []byte {
 	var err error
 	buf := new(bytes.Buffer)
 	_, err = buf.Write(p.PeerFrom[:])
@@ -173,7 +184,12 @@ func (p *findPathPayload) sign(key *ecdsa.PrivateKey) []byte {
 	if err != nil {
 		log.Error(fmt.Sprintf("signData err %s", err))
 	}
-	p.Signature, err = utils.SignData(key, buf.Bytes())
+	return buf.Bytes()
+}
+
+func (p *findPathPayload) sign(key *ecdsa.PrivateKey) []byte {
+	var err error
+	p.Signature, err = utils.SignData(key, p.signData())
 	if err != nil {
 		log.Crit(fmt.Sprintf("signDataFor FindPathPayload err %s", err))
 	}
@@ -201,6 +217,11 @@ func (fpr *FindPathResponse) GetPath() []common.Address {
 FindPath : find path
 */
 func (pfg *pfsClient) FindPath(peerFrom, peerTo, token common.Address, amount *big.Int, isInitiator bool) (resp []FindPathResponse, err error) {
+	return pfg.findPath(peerFrom, peerTo, token, amount, isInitiator, 1)
+}
+
+//findPath 最多返回limitPaths条路径
+func (pfg *pfsClient) findPath(peerFrom, peerTo, token common.Address, amount *big.Int, isInitiator bool, limitPaths int) (resp []FindPathResponse, err error) {
 	if pfg.host == "" || pfg.privateKey == nil {
 		err = ErrNotInit
 		return
@@ -209,7 +230,7 @@ func (pfg *pfsClient) FindPath(peerFrom, peerTo, token common.Address, amount *b
 		PeerFrom:          peerFrom,
 		PeerTo:            peerTo,
 		TokenAddress:      token,
-		LimitPaths:        1,
+		LimitPaths:        limitPaths,
 		SendAmount:        amount,
 		SortDemand:        "",
 		PeerFromChargeFee: !isInitiator,
@@ -249,7 +270,7 @@ type setFeePayload struct {
 	Signature   []byte   `json:"signature"`
 }
 
-func (p *setFeePayload) sign(key *ecdsa.PrivateKey) []byte {
+func (p *setFeePayload) signData() []byte {
 	var err error
 	buf := new(bytes.Buffer)
 	err = binary.Write(buf, binary.BigEndian, p.FeePercent)
@@ -257,7 +278,12 @@ func (p *setFeePayload) sign(key *ecdsa.PrivateKey) []byte {
 	if err != nil {
 		log.Error(fmt.Sprintf("signData err %s", err))
 	}
-	p.Signature, err = utils.SignData(key, buf.Bytes())
+	return buf.Bytes()
+}
+
+func (p *setFeePayload) sign(key *ecdsa.PrivateKey) []byte {
+	var err error
+	p.Signature, err = utils.SignData(key, p.signData())
 	if err != nil {
 		log.Crit(fmt.Sprintf("signDataFor SetFeeRatePayload err %s", err))
 	}
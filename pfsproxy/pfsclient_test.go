@@ -3,7 +3,10 @@ package pfsproxy
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
 
 	"math/big"
@@ -14,46 +17,161 @@ import (
 
 	"github.com/SmartMeshFoundation/Photon/codefortest"
 	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/models"
 	"github.com/SmartMeshFoundation/Photon/params"
 	"github.com/SmartMeshFoundation/Photon/utils"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
 )
 
-var testPfgHost = "http://transport01.smartmesh.cn:7002"
-
 func init() {
 	log.Root().SetHandler(log.LvlFilterHandler(log.LvlTrace, utils.MyStreamHandler(os.Stderr)))
 }
 
-func TestPfsClient_SubmitBalance(t *testing.T) {
-	if testing.Short() {
+//testChannelStore 内存中的通道信息,代替NonParticipantChannelDao
+type testChannelStore struct {
+	token    common.Address
+	channels map[common.Hash][2]common.Address
+}
+
+func (s *testChannelStore) GetAllNonParticipantChannelByToken(token common.Address) (edges []common.Address, err error) {
+	if token != s.token {
 		return
 	}
+	for _, c := range s.channels {
+		edges = append(edges, c[0], c[1])
+	}
+	return
+}
+
+func (s *testChannelStore) GetNonParticipantChannelByID(channelIdentifierForQuery common.Hash) (
+	tokenAddress common.Address, participant1, participant2 common.Address, err error) {
+	c, ok := s.channels[channelIdentifierForQuery]
+	if !ok {
+		err = fmt.Errorf("channel %s not found", channelIdentifierForQuery.String())
+		return
+	}
+	return s.token, c[0], c[1], nil
+}
+
+//testPfsEnv 本地的pfs server,代替远程的pfs, offline时直接断开连接
+type testPfsEnv struct {
+	*httptest.Server
+	server        *PfsServer
+	store         *testChannelStore
+	host          string
+	token         common.Address
+	tokensNetwork common.Address
+	offline       int32
+}
+
+//setOffline the server runs in other goroutines
+func (env *testPfsEnv) setOffline(offline bool) {
+	var v int32
+	if offline {
+		v = 1
+	}
+	atomic.StoreInt32(&env.offline, v)
+}
+
+func newTestPfsEnv() *testPfsEnv {
+	return newTestPfsEnvWithToken(utils.NewRandomAddress(), utils.NewRandomAddress())
+}
+
+func newTestPfsEnvWithToken(token, tokensNetwork common.Address) *testPfsEnv {
 	params.ChainID = big.NewInt(8888)
-	key, addr := utils.MakePrivateKeyAddress()
-	alice := codefortest.TestAccount{
-		Address:    addr,
-		PrivateKey: key,
+	env := &testPfsEnv{
+		token:         token,
+		tokensNetwork: tokensNetwork,
 	}
-	key, addr = utils.MakePrivateKeyAddress()
-	bob := codefortest.TestAccount{
+	env.store = &testChannelStore{
+		token:    env.token,
+		channels: make(map[common.Hash][2]common.Address),
+	}
+	env.server = NewPfsServer(env.store, env.tokensNetwork)
+	handler, err := env.server.Handler()
+	if err != nil {
+		panic(err)
+	}
+	env.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&env.offline) == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				err = conn.Close()
+			}
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	env.host = env.Server.URL
+	return env
+}
+
+func (env *testPfsEnv) newChannel(p1, p2 codefortest.TestAccount, deposit1, deposit2 int64) common.Hash {
+	channelIdentifier := utils.CalcChannelID(env.token, env.tokensNetwork, p1.Address, p2.Address)
+	env.store.channels[channelIdentifier] = [2]common.Address{p1.Address, p2.Address}
+	env.server.SetDeposit(channelIdentifier, p1.Address, big.NewInt(deposit1))
+	env.server.SetDeposit(channelIdentifier, p2.Address, big.NewInt(deposit2))
+	return channelIdentifier
+}
+
+//submitBalance `submitter` submits balance proof of `signer`
+func (env *testPfsEnv) submitBalance(t *testing.T, submitter, signer codefortest.TestAccount, nonce uint64, transferAmount int64) {
+	env.submitBalancePaused(t, submitter, signer, nonce, transferAmount, false)
+}
+
+//submitBalancePaused `submitter` submits balance proof of `signer`, paused means it refuses transfers from `signer`
+func (env *testPfsEnv) submitBalancePaused(t *testing.T, submitter, signer codefortest.TestAccount, nonce uint64, transferAmount int64, paused bool) {
+	channelIdentifier := utils.CalcChannelID(env.token, env.tokensNetwork, submitter.Address, signer.Address)
+	openBlockNumber := big.NewInt(7218036)
+	additionHash := utils.NewRandomHash()
+	bp := createPartnerBalanceProof(signer, big.NewInt(transferAmount), utils.EmptyHash, additionHash, nonce, openBlockNumber, channelIdentifier)
+	c := NewPfsProxy(env.host, submitter.PrivateKey)
+	err := c.SubmitBalance(nonce, big.NewInt(transferAmount), big.NewInt(0), paused, openBlockNumber.Int64(), utils.EmptyHash, channelIdentifier, additionHash, signer.Address, bp.Signature)
+	assert.NoError(t, err)
+}
+
+func newTestAccount() codefortest.TestAccount {
+	key, addr := utils.MakePrivateKeyAddress()
+	return codefortest.TestAccount{
 		Address:    addr,
 		PrivateKey: key,
 	}
-	c := NewPfsProxy(testPfgHost, alice.PrivateKey)
+}
+
+func TestPfsClient_SubmitBalance(t *testing.T) {
+	env := newTestPfsEnv()
+	defer env.Close()
+	alice, bob, carol := newTestAccount(), newTestAccount(), newTestAccount()
+	c := NewPfsProxy(env.host, alice.PrivateKey)
 	nonce := big.NewInt(10)
 	transferAmount := big.NewInt(210)
 	lockAmount := big.NewInt(0)
 	openBlockNumber := big.NewInt(7218036)
 	locksroot := utils.EmptyHash
-	channelIdentifier := utils.CalcChannelID(utils.EmptyAddress, utils.EmptyAddress, alice.Address, bob.Address)
+	channelIdentifier := env.newChannel(alice, bob, 100, 100)
 	additionHash := utils.NewRandomHash()
 	bp := createPartnerBalanceProof(bob, transferAmount, locksroot, additionHash, nonce.Uint64(), openBlockNumber, channelIdentifier)
 
-	err := c.SubmitBalance(nonce.Uint64(), transferAmount, lockAmount, openBlockNumber.Int64(), locksroot, channelIdentifier, additionHash, bob.Address, bp.Signature)
+	err := c.SubmitBalance(nonce.Uint64(), transferAmount, lockAmount, false, openBlockNumber.Int64(), locksroot, channelIdentifier, additionHash, bob.Address, bp.Signature)
 	if err != nil {
 		t.Error(err)
 	}
+	capacity, _ := env.server.channels[channelIdentifier].capacity(alice.Address, bob.Address)
+	assert.EqualValues(t, 310, capacity.Int64())
+	//老的balance proof被忽略
+	bp = createPartnerBalanceProof(bob, big.NewInt(10), locksroot, additionHash, 9, openBlockNumber, channelIdentifier)
+	err = c.SubmitBalance(9, big.NewInt(10), lockAmount, false, openBlockNumber.Int64(), locksroot, channelIdentifier, additionHash, bob.Address, bp.Signature)
+	assert.NoError(t, err)
+	capacity, _ = env.server.channels[channelIdentifier].capacity(bob.Address, alice.Address)
+	assert.EqualValues(t, -110, capacity.Int64())
+	//签名和金额不符
+	err = c.SubmitBalance(11, big.NewInt(300), lockAmount, false, openBlockNumber.Int64(), locksroot, channelIdentifier, additionHash, bob.Address, bp.Signature)
+	assert.Error(t, err)
+	//不是通道参与方
+	bp = createPartnerBalanceProof(carol, transferAmount, locksroot, additionHash, nonce.Uint64(), openBlockNumber, channelIdentifier)
+	err = c.SubmitBalance(nonce.Uint64(), transferAmount, lockAmount, false, openBlockNumber.Int64(), locksroot, channelIdentifier, additionHash, carol.Address, bp.Signature)
+	assert.Error(t, err)
 }
 
 //BalanceProofForContract for contract
@@ -104,106 +222,181 @@ func createPartnerBalanceProof(
 }
 
 func TestPfsClient_FindPath(t *testing.T) {
-	if testing.Short() {
-		return
+	env := newTestPfsEnv()
+	defer env.Close()
+	alice, bob, carol, dave := newTestAccount(), newTestAccount(), newTestAccount(), newTestAccount()
+	env.newChannel(alice, bob, 100, 100)
+	env.newChannel(bob, carol, 100, 100)
+	env.newChannel(alice, dave, 100, 100)
+	env.newChannel(dave, carol, 100, 100)
+	//bob收费更高,走dave
+	assert.NoError(t, NewPfsProxy(env.host, bob.PrivateKey).SetAccountFee(big.NewInt(5), 0))
+	c := NewPfsProxy(env.host, alice.PrivateKey)
+	routes, err := c.FindPath(alice.Address, carol.Address, env.token, big.NewInt(20), true)
+	if assert.NoError(t, err) && assert.EqualValues(t, 1, len(routes)) {
+		assert.EqualValues(t, []common.Address{dave.Address, carol.Address}, routes[0].GetPath())
+		assert.EqualValues(t, 0, routes[0].Fee.Int64())
+		assert.EqualValues(t, 2, routes[0].PathHop)
 	}
-	tokenAddress := common.HexToAddress("0x76fCe6fF759B208D27E4D48828F820d79d1719f3")
-	alice, err := codefortest.GetAccountsByAddress(common.HexToAddress("0x10b256b3C83904D524210958FA4E7F9cAFFB76c6"))
-	bob, err := codefortest.GetAccountsByAddress(common.HexToAddress("0x201B20123b3C489b47Fde27ce5b451a0fA55FD60"))
-	c := NewPfsProxy(testPfgHost, alice.PrivateKey)
-	routes, err := c.FindPath(alice.Address, bob.Address, tokenAddress, big.NewInt(20), true)
-	if err != nil {
-		t.Error(err)
+	//dave转给carol 90以后,dave到carol的余额不够了,只能走bob
+	env.submitBalance(t, carol, dave, 1, 90)
+	routes, err = c.FindPath(alice.Address, carol.Address, env.token, big.NewInt(20), true)
+	if assert.NoError(t, err) && assert.EqualValues(t, 1, len(routes)) {
+		assert.EqualValues(t, []common.Address{bob.Address, carol.Address}, routes[0].GetPath())
+		assert.EqualValues(t, 5, routes[0].Fee.Int64())
 	}
-	fmt.Println(routes)
+	//作为中间节点查询时,自己的手续费也要算上
+	c = NewPfsProxy(env.host, bob.PrivateKey)
+	routes, err = c.FindPath(bob.Address, carol.Address, env.token, big.NewInt(20), false)
+	if assert.NoError(t, err) && assert.EqualValues(t, 1, len(routes)) {
+		assert.EqualValues(t, 5, routes[0].Fee.Int64())
+	}
+	_, err = c.FindPath(bob.Address, carol.Address, env.token, big.NewInt(200), true)
+	assert.Error(t, err)
+	//签名必须是peer from的
+	payload := &findPathPayload{
+		PeerFrom:     alice.Address,
+		PeerTo:       carol.Address,
+		TokenAddress: env.token,
+		SendAmount:   big.NewInt(20),
+	}
+	payload.sign(bob.PrivateKey)
+	_, err = env.server.FindPath(payload)
+	assert.Error(t, err)
 }
 
-func TestPfsClient_SetAccountFee(t *testing.T) {
-	if testing.Short() {
-		return
+func TestPfsClient_SubmitBalancePaused(t *testing.T) {
+	env := newTestPfsEnv()
+	defer env.Close()
+	alice, bob, carol := newTestAccount(), newTestAccount(), newTestAccount()
+	env.newChannel(alice, bob, 100, 100)
+	env.newChannel(bob, carol, 100, 100)
+	c := NewPfsProxy(env.host, alice.PrivateKey)
+	//carol refuses transfers from bob
+	env.submitBalancePaused(t, carol, bob, 1, 10, true)
+	_, err := c.FindPath(alice.Address, carol.Address, env.token, big.NewInt(20), true)
+	assert.Error(t, err)
+	//but can still send to bob
+	routes, err := NewPfsProxy(env.host, carol.PrivateKey).FindPath(carol.Address, alice.Address, env.token, big.NewInt(20), true)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1, len(routes))
 	}
-	feeConstant := big.NewInt(5)
-	feePercent := int64(10000)
-	alice, err := codefortest.GetAccountsByAddress(common.HexToAddress("0x10b256b3C83904D524210958FA4E7F9cAFFB76c6"))
-	c := NewPfsProxy(testPfgHost, alice.PrivateKey)
-	err = c.SetAccountFee(feeConstant, feePercent)
-	if err != nil {
-		t.Error(err)
+	env.submitBalance(t, carol, bob, 1, 10)
+	routes, err = c.FindPath(alice.Address, carol.Address, env.token, big.NewInt(20), true)
+	if assert.NoError(t, err) && assert.EqualValues(t, 1, len(routes)) {
+		assert.EqualValues(t, []common.Address{bob.Address, carol.Address}, routes[0].GetPath())
 	}
+	//a submission not paused is signed in the old format
+	p := &submitBalancePayload{
+		BalanceProof: &balanceProof{TransferAmount: big.NewInt(10)},
+		LockAmount:   big.NewInt(0),
+	}
+	data := p.signData()
+	p.Paused = true
+	assert.EqualValues(t, append(data, 1), p.signData())
 }
 
-func TestPfsClient_GetAccountFee(t *testing.T) {
-	if testing.Short() {
-		return
+func TestPfsClient_SetFeePolicy(t *testing.T) {
+	env := newTestPfsEnv()
+	defer env.Close()
+	alice, bob := newTestAccount(), newTestAccount()
+	fp := models.NewDefaultFeePolicy()
+	fp.TokenFeeMap[env.token] = &models.FeeSetting{
+		FeeConstant: big.NewInt(3),
+		FeeRate:     1000,
 	}
-	alice, err := codefortest.GetAccountsByAddress(common.HexToAddress("0x10b256b3C83904D524210958FA4E7F9cAFFB76c6"))
-	c := NewPfsProxy(testPfgHost, alice.PrivateKey)
-	//channelIdentifier := common.HexToHash("0x622924d11071238ac70c39b508c37216d1a392097a80b26f5299a8d8f4bc0b7a")
+	c := NewPfsProxy(env.host, alice.PrivateKey)
+	assert.NoError(t, c.SetFeePolicy(fp))
+	feeConstant, feePercent, err := c.GetTokenFee(env.token)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, feeConstant.Int64())
+	assert.EqualValues(t, 1000, feePercent)
+	//别人签名的设置不能生效
+	fp.Sign(bob.PrivateKey)
+	assert.Error(t, env.server.SetFeePolicy(alice.Address, fp))
+}
+
+func TestPfsClient_SetAccountFee(t *testing.T) {
+	env := newTestPfsEnv()
+	defer env.Close()
+	alice := newTestAccount()
+	c := NewPfsProxy(env.host, alice.PrivateKey)
+	err := c.SetAccountFee(big.NewInt(5), 10000)
+	assert.NoError(t, err)
+	err = c.SetAccountFee(big.NewInt(-5), 10000)
+	assert.Error(t, err)
+}
+
+func TestPfsClient_GetAccountFee(t *testing.T) {
+	env := newTestPfsEnv()
+	defer env.Close()
+	alice := newTestAccount()
+	c := NewPfsProxy(env.host, alice.PrivateKey)
+	//默认万分之一
 	feeConstant, feePercent, err := c.GetAccountFee()
-	if err != nil {
-		t.Error(err)
-		return
-	}
-	fmt.Println(feeConstant, feePercent)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, feeConstant.Int64())
+	assert.EqualValues(t, 10000, feePercent)
+	assert.NoError(t, c.SetAccountFee(big.NewInt(5), 1000))
+	feeConstant, feePercent, err = c.GetAccountFee()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, feeConstant.Int64())
+	assert.EqualValues(t, 1000, feePercent)
 }
 
 func TestPfsClient_SetTokenFee(t *testing.T) {
-	if testing.Short() {
-		return
-	}
-	feeConstant := big.NewInt(6)
-	feePercent := int64(30000)
-	tokenAddress := common.HexToAddress("0x76fCe6fF759B208D27E4D48828F820d79d1719f3")
-	alice, err := codefortest.GetAccountsByAddress(common.HexToAddress("0x10b256b3C83904D524210958FA4E7F9cAFFB76c6"))
-	c := NewPfsProxy(testPfgHost, alice.PrivateKey)
-	err = c.SetTokenFee(feeConstant, feePercent, tokenAddress)
-	if err != nil {
-		t.Error(err)
-	}
+	env := newTestPfsEnv()
+	defer env.Close()
+	alice := newTestAccount()
+	c := NewPfsProxy(env.host, alice.PrivateKey)
+	err := c.SetTokenFee(big.NewInt(6), 50000, env.token)
+	assert.NoError(t, err)
 }
 
 func TestPfsClient_GetTokenFee(t *testing.T) {
-	if testing.Short() {
-		return
-	}
-	tokenAddress := common.HexToAddress("0x76fCe6fF759B208D27E4D48828F820d79d1719f3")
-	alice, err := codefortest.GetAccountsByAddress(common.HexToAddress("0x10b256b3C83904D524210958FA4E7F9cAFFB76c6"))
-	c := NewPfsProxy(testPfgHost, alice.PrivateKey)
-	feeConstant, feePercent, err := c.GetTokenFee(tokenAddress)
-	if err != nil {
-		t.Error(err)
-		return
-	}
-	fmt.Println(feeConstant, feePercent)
+	env := newTestPfsEnv()
+	defer env.Close()
+	alice := newTestAccount()
+	c := NewPfsProxy(env.host, alice.PrivateKey)
+	assert.NoError(t, c.SetAccountFee(big.NewInt(5), 1000))
+	//没有设置token的手续费时使用账户的
+	feeConstant, feePercent, err := c.GetTokenFee(env.token)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, feeConstant.Int64())
+	assert.EqualValues(t, 1000, feePercent)
+	assert.NoError(t, c.SetTokenFee(big.NewInt(6), 50000, env.token))
+	feeConstant, feePercent, err = c.GetTokenFee(env.token)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 6, feeConstant.Int64())
+	assert.EqualValues(t, 50000, feePercent)
 }
 
 func TestPfsClient_SetChannelFee(t *testing.T) {
-	if testing.Short() {
-		return
-	}
-	feeConstant := big.NewInt(5)
-	feePercent := int64(20000)
-	channelIdentifier := common.HexToHash("0x640b3a6c160eadc37f133400b6a6be62d4d8a2b7ccd67beb04426e84251455ea")
-	alice, err := codefortest.GetAccountsByAddress(common.HexToAddress("0x10b256b3C83904D524210958FA4E7F9cAFFB76c6"))
-	c := NewPfsProxy(testPfgHost, alice.PrivateKey)
-	err = c.SetChannelFee(feeConstant, feePercent, channelIdentifier)
-	if err != nil {
-		t.Error(err)
-	}
+	env := newTestPfsEnv()
+	defer env.Close()
+	alice, bob, carol := newTestAccount(), newTestAccount(), newTestAccount()
+	channelIdentifier := env.newChannel(alice, bob, 100, 100)
+	err := NewPfsProxy(env.host, alice.PrivateKey).SetChannelFee(big.NewInt(5), 20000, channelIdentifier)
+	assert.NoError(t, err)
+	//不是通道参与方
+	err = NewPfsProxy(env.host, carol.PrivateKey).SetChannelFee(big.NewInt(5), 20000, channelIdentifier)
+	assert.Error(t, err)
 }
 
 func TestPfsClient_GetChannelFee(t *testing.T) {
-	if testing.Short() {
-		return
-	}
-	channelIdentifier := common.HexToHash("0x640b3a6c160eadc37f133400b6a6be62d4d8a2b7ccd67beb04426e84251455ea")
-	alice, err := codefortest.GetAccountsByAddress(common.HexToAddress("0x10b256b3C83904D524210958FA4E7F9cAFFB76c6"))
-	c := NewPfsProxy(testPfgHost, alice.PrivateKey)
-	//channelIdentifier := common.HexToHash("0x622924d11071238ac70c39b508c37216d1a392097a80b26f5299a8d8f4bc0b7a")
+	env := newTestPfsEnv()
+	defer env.Close()
+	alice, bob := newTestAccount(), newTestAccount()
+	channelIdentifier := env.newChannel(alice, bob, 100, 100)
+	c := NewPfsProxy(env.host, alice.PrivateKey)
+	assert.NoError(t, c.SetTokenFee(big.NewInt(6), 50000, env.token))
 	feeConstant, feePercent, err := c.GetChannelFee(channelIdentifier)
-	if err != nil {
-		t.Error(err)
-		return
-	}
-	fmt.Println(feeConstant, feePercent)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 6, feeConstant.Int64())
+	assert.EqualValues(t, 50000, feePercent)
+	assert.NoError(t, c.SetChannelFee(big.NewInt(5), 20000, channelIdentifier))
+	feeConstant, feePercent, err = c.GetChannelFee(channelIdentifier)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, feeConstant.Int64())
+	assert.EqualValues(t, 20000, feePercent)
 }
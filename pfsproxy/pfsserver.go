@@ -0,0 +1,681 @@
+package pfsproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/network/dijkstra"
+	"github.com/SmartMeshFoundation/Photon/params"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	//pfsHopWeight 每多一跳的代价,手续费相同时选择跳数少的路径
+	pfsHopWeight = 1
+	//defaultLimitPaths 请求中没有指定路径数量时返回的最多路径数
+	defaultLimitPaths = 1
+	//maxLimitPaths 一次最多返回的路径数
+	maxLimitPaths = 10
+)
+
+//ChannelStore provides all channels of the network, models.Dao implements it
+type ChannelStore interface {
+	GetAllNonParticipantChannelByToken(token common.Address) (edges []common.Address, err error)
+	GetNonParticipantChannelByID(channelIdentifierForQuery common.Hash) (
+		tokenAddress common.Address, participant1, participant2 common.Address, err error)
+}
+
+//pfsBalanceProof 通道中Signer签名给对方的最新balance proof
+type pfsBalanceProof struct {
+	Nonce           uint64
+	OpenBlockNumber int64
+	TransferAmount  *big.Int
+	LockAmount      *big.Int
+	Paused          bool //对方暂停了从Signer收款或者转发
+}
+
+//pfsChannel 内置路由服务记录的一个通道的押金和双方的balance proof, key都是参与方
+type pfsChannel struct {
+	deposits map[common.Address]*big.Int
+	proofs   map[common.Address]*pfsBalanceProof
+}
+
+/*
+PfsServer is an embedded pathfinder service, it serves the same http api as pfsClient calls.
+Channels come from ChannelStore, deposits come from chain events,
+balances and fee policies are submitted by participants and signatures are verified.
+Paths are ordered by the fee charged by mediators.
+*/
+type PfsServer struct {
+	store         ChannelStore
+	tokensNetwork common.Address
+	lock          sync.Mutex
+	channels      map[common.Hash]*pfsChannel
+	feePolicies   map[common.Address]*models.FeePolicy
+	server        *http.Server
+}
+
+//NewPfsServer create a PfsServer, `tokensNetwork` is used to calculate channel identifiers
+func NewPfsServer(store ChannelStore, tokensNetwork common.Address) *PfsServer {
+	return &PfsServer{
+		store:         store,
+		tokensNetwork: tokensNetwork,
+		channels:      make(map[common.Hash]*pfsChannel),
+		feePolicies:   make(map[common.Address]*models.FeePolicy),
+	}
+}
+
+//Handler returns http handler of all pfs api
+func (s *PfsServer) Handler() (http.Handler, error) {
+	api := rest.NewApi()
+	api.Use(rest.DefaultProdStack...)
+	router, err := rest.MakeRouter(
+		rest.Put("/pfs/1/:peer/balance", s.submitBalance),
+		rest.Post("/pfs/1/paths", s.findPath),
+		rest.Put("/pfs/1/feerate/:peer", s.setFeePolicy),
+		rest.Put("/pfs/1/account_rate/:peer", s.setAccountFee),
+		rest.Get("/pfs/1/account_rate/:peer", s.getAccountFee),
+		rest.Put("/pfs/1/token_rate/:token/:peer", s.setTokenFee),
+		rest.Get("/pfs/1/token_rate/:token/:peer", s.getTokenFee),
+		rest.Put("/pfs/1/channel_rate/:channel/:peer", s.setChannelFee),
+		rest.Get("/pfs/1/channel_rate/:channel/:peer", s.getChannelFee),
+	)
+	if err != nil {
+		return nil, err
+	}
+	api.SetApp(router)
+	return api.MakeHandler(), nil
+}
+
+//Start listen on `listen`,such as 127.0.0.1:7000
+func (s *PfsServer) Start(listen string) error {
+	handler, err := s.Handler()
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	s.server = &http.Server{Handler: handler}
+	go func() {
+		err := s.server.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			log.Error(fmt.Sprintf("pfs server on %s stopped err %s", listen, err))
+		}
+	}()
+	log.Info(fmt.Sprintf("pfs server listen on %s", listen))
+	return nil
+}
+
+//Stop the http server
+func (s *PfsServer) Stop() {
+	if s.server == nil {
+		return
+	}
+	err := s.server.Close()
+	if err != nil {
+		log.Error(fmt.Sprintf("stop pfs server err %s", err))
+	}
+}
+
+//ResetChannel forgets deposits and balances of a channel, it's called when the channel is opened or withdrawn
+func (s *PfsServer) ResetChannel(channelIdentifier common.Hash) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.channels, channelIdentifier)
+}
+
+//SetDeposit update deposit of `participant` from chain events
+func (s *PfsServer) SetDeposit(channelIdentifier common.Hash, participant common.Address, deposit *big.Int) {
+	if deposit == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.getChannel(channelIdentifier).deposits[participant] = new(big.Int).Set(deposit)
+}
+
+func (s *PfsServer) getChannel(channelIdentifier common.Hash) *pfsChannel {
+	c, ok := s.channels[channelIdentifier]
+	if !ok {
+		c = &pfsChannel{
+			deposits: make(map[common.Address]*big.Int),
+			proofs:   make(map[common.Address]*pfsBalanceProof),
+		}
+		s.channels[channelIdentifier] = c
+	}
+	return c
+}
+
+/*
+capacity how many tokens `from` can send to `to` in this channel,
+false if deposit of `from` is unknown
+*/
+func (c *pfsChannel) capacity(from, to common.Address) (*big.Int, bool) {
+	deposit, ok := c.deposits[from]
+	if !ok {
+		return nil, false
+	}
+	capacity := new(big.Int).Set(deposit)
+	if p, ok := c.proofs[to]; ok {
+		capacity.Add(capacity, p.TransferAmount)
+	}
+	if p, ok := c.proofs[from]; ok {
+		capacity.Sub(capacity, p.TransferAmount)
+		capacity.Sub(capacity, p.LockAmount)
+	}
+	return capacity, true
+}
+
+//paused `from`的对方暂停了这个通道,不接受从`from`转来的交易
+func (c *pfsChannel) paused(from common.Address) bool {
+	p, ok := c.proofs[from]
+	return ok && p.Paused
+}
+
+//signData 合约格式的balance proof签名数据,与encoding.EnvelopMessage签名的一致
+func (bp *balanceProof) signData() []byte {
+	var err error
+	buf := new(bytes.Buffer)
+	_, err = buf.Write(params.ContractSignaturePrefix)
+	_, err = buf.Write([]byte(params.ContractBalanceProofMessageLength))
+	_, err = buf.Write(utils.BigIntTo32Bytes(bp.TransferAmount))
+	_, err = buf.Write(bp.Locksroot[:])
+	err = binary.Write(buf, binary.BigEndian, bp.Nonce)
+	_, err = buf.Write(bp.AdditionHash[:])
+	_, err = buf.Write(bp.ChannelIdentifier[:])
+	err = binary.Write(buf, binary.BigEndian, bp.OpenBlockNumber)
+	_, err = buf.Write(utils.BigIntTo32Bytes(params.ChainID))
+	if err != nil {
+		log.Error(fmt.Sprintf("signData err %s", err))
+	}
+	return buf.Bytes()
+}
+
+func verifySigner(data, signature []byte, signer common.Address) error {
+	addr, err := utils.Ecrecover(utils.Sha3(data), signature)
+	if err != nil {
+		return err
+	}
+	if addr != signer {
+		return fmt.Errorf("signature signed by %s,expect %s", addr.String(), signer.String())
+	}
+	return nil
+}
+
+/*
+SubmitBalance `submitter` submits the balance proof its partner signed,
+both of them must be participants of the channel, older balance proofs are ignored.
+*/
+func (s *PfsServer) SubmitBalance(submitter common.Address, p *submitBalancePayload) error {
+	bp := p.BalanceProof
+	if bp == nil || bp.TransferAmount == nil || p.LockAmount == nil {
+		return errors.New("balance proof and lock amount are required")
+	}
+	err := verifySigner(p.signData(), p.BalanceSignature, submitter)
+	if err != nil {
+		return err
+	}
+	err = verifySigner(bp.signData(), bp.Signature, p.ProofSigner)
+	if err != nil {
+		return err
+	}
+	_, p1, p2, err := s.store.GetNonParticipantChannelByID(bp.ChannelIdentifier)
+	if err != nil {
+		return err
+	}
+	if !(submitter == p1 && p.ProofSigner == p2) && !(submitter == p2 && p.ProofSigner == p1) {
+		return fmt.Errorf("%s and %s are not participants of channel %s", submitter.String(), p.ProofSigner.String(), bp.ChannelIdentifier.String())
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := s.getChannel(bp.ChannelIdentifier)
+	old, ok := c.proofs[p.ProofSigner]
+	if ok {
+		if bp.OpenBlockNumber < old.OpenBlockNumber {
+			return errors.New("balance proof of a settled channel")
+		}
+		if bp.OpenBlockNumber == old.OpenBlockNumber && bp.Nonce < old.Nonce {
+			log.Trace(fmt.Sprintf("ignore old balance proof of %s, nonce=%d,known nonce=%d", utils.HPex(bp.ChannelIdentifier), bp.Nonce, old.Nonce))
+			return nil
+		}
+	}
+	c.proofs[p.ProofSigner] = &pfsBalanceProof{
+		Nonce:           bp.Nonce,
+		OpenBlockNumber: bp.OpenBlockNumber,
+		TransferAmount:  bp.TransferAmount,
+		LockAmount:      p.LockAmount,
+		Paused:          p.Paused,
+	}
+	return nil
+}
+
+//getFeePolicy 没有提交过手续费设置的节点使用默认设置
+func (s *PfsServer) getFeePolicy(peer common.Address) *models.FeePolicy {
+	fp, ok := s.feePolicies[peer]
+	if !ok {
+		fp = models.NewDefaultFeePolicy()
+		s.feePolicies[peer] = fp
+	}
+	return fp
+}
+
+//SetFeePolicy every fee setting must be signed by `peer`
+func (s *PfsServer) SetFeePolicy(peer common.Address, fp *models.FeePolicy) error {
+	if fp == nil {
+		return errors.New("can not set nil fee policy")
+	}
+	err := fp.Validate()
+	if err != nil {
+		return err
+	}
+	//the signature covers FeePercent of old versions, verify before upgrade
+	err = fp.VerifySignature(peer)
+	if err != nil {
+		return err
+	}
+	fp.Upgrade()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.feePolicies[peer] = fp
+	return nil
+}
+
+//feeSetting 旧版本接口中的FeePercent为 交易金额/FeePercent
+func (p *setFeePayload) feeSetting(peer common.Address) (*models.FeeSetting, error) {
+	if p.FeeConstant == nil || p.FeeConstant.Sign() < 0 || p.FeePercent < 0 {
+		return nil, errors.New("FeeConstant and FeePercent can not be negative")
+	}
+	err := verifySigner(p.signData(), p.Signature, peer)
+	if err != nil {
+		return nil, err
+	}
+	fs := &models.FeeSetting{
+		FeeConstant: p.FeeConstant,
+		FeePercent:  p.FeePercent,
+	}
+	return fs, nil
+}
+
+func newGetFeeResponse(fs *models.FeeSetting) *getFeeResponse {
+	resp := &getFeeResponse{
+		FeeConstant: fs.FeeConstant,
+	}
+	feePercent, ok := fs.LegacyFeePercent()
+	if !ok && fs.FeeRate > 0 {
+		//can't be exact in the old api, it's only for display
+		feePercent = models.FeeRateDenominator / fs.FeeRate
+	}
+	resp.FeePercent = feePercent
+	return resp
+}
+
+//nodeFee `peer` charges for a transfer to `partner` through channel `channelIdentifier`
+func (s *PfsServer) nodeFee(peer, partner, token common.Address, channelIdentifier common.Hash, amount *big.Int) *big.Int {
+	fp := s.getFeePolicy(peer)
+	feeSetting, ok := fp.ChannelFeeMap[channelIdentifier]
+	if !ok {
+		feeSetting, ok = fp.TokenFeeMap[token]
+	}
+	if !ok {
+		feeSetting = fp.AccountFee
+	}
+	fee := feeSetting.CalculateFee(amount)
+	if fp.ImbalanceFee == nil {
+		return fee
+	}
+	//不知道从哪个通道转入,按平衡计算
+	outRatio := int64(models.BalancedRatio)
+	c := s.channels[channelIdentifier]
+	if c != nil {
+		payer, ok1 := c.capacity(peer, partner)
+		payee, ok2 := c.capacity(partner, peer)
+		if ok1 && ok2 && payer.Sign() >= 0 && payee.Sign() >= 0 {
+			outRatio = models.BalanceRatio(payer, payee)
+		}
+	}
+	return fp.ImbalanceFee.AdjustFee(fee, amount, outRatio, models.BalancedRatio)
+}
+
+/*
+FindPath finds at most `LimitPaths` paths ordered by total fee of mediators,
+channels whose capacity is known and less than `SendAmount` are skipped.
+`PeerFrom` charges fee too if `PeerFromChargeFee`, it's a mediator then.
+*/
+func (s *PfsServer) FindPath(p *findPathPayload) (resp []FindPathResponse, err error) {
+	if p.SendAmount == nil || p.SendAmount.Sign() <= 0 {
+		return nil, errors.New("send amount must be positive")
+	}
+	if p.PeerFrom == p.PeerTo {
+		return nil, errors.New("peer from and peer to must be different")
+	}
+	err = verifySigner(p.signData(), p.Signature, p.PeerFrom)
+	if err != nil {
+		return
+	}
+	limit := p.LimitPaths
+	if limit <= 0 {
+		limit = defaultLimitPaths
+	}
+	if limit > maxLimitPaths {
+		limit = maxLimitPaths
+	}
+	edges, err := s.store.GetAllNonParticipantChannelByToken(p.TokenAddress)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	address2index := make(map[common.Address]int)
+	var index2address []common.Address
+	g := dijkstra.NewGraph()
+	indexOf := func(addr common.Address) int {
+		i, ok := address2index[addr]
+		if !ok {
+			i = len(index2address)
+			address2index[addr] = i
+			index2address = append(index2address, addr)
+			g.AddVertex(i)
+		}
+		return i
+	}
+	indexOf(p.PeerFrom)
+	indexOf(p.PeerTo)
+	fees := make(map[[2]int]*big.Int)
+	addArc := func(from, to common.Address, channelIdentifier common.Hash) {
+		c := s.channels[channelIdentifier]
+		if c != nil {
+			if c.paused(from) {
+				return
+			}
+			capacity, ok := c.capacity(from, to)
+			if ok && capacity.Cmp(p.SendAmount) < 0 {
+				return
+			}
+		}
+		fee := big.NewInt(0)
+		if from != p.PeerFrom || p.PeerFromChargeFee {
+			fee = s.nodeFee(from, to, p.TokenAddress, channelIdentifier, p.SendAmount)
+		}
+		//给补贴的节点按不收费计算,保证权重不为负
+		w := int64(pfsHopWeight)
+		if fee.Sign() > 0 {
+			if !fee.IsInt64() {
+				return
+			}
+			w += fee.Int64()
+		}
+		arc := [2]int{indexOf(from), indexOf(to)}
+		err := g.AddArc(arc[0], arc[1], w)
+		if err != nil {
+			log.Error(fmt.Sprintf("add arc %s-%s err %s", utils.APex2(from), utils.APex2(to), err))
+			return
+		}
+		fees[arc] = fee
+	}
+	for i := 0; i+1 < len(edges); i += 2 {
+		p1, p2 := edges[i], edges[i+1]
+		channelIdentifier := utils.CalcChannelID(p.TokenAddress, s.tokensNetwork, p1, p2)
+		addArc(p1, p2, channelIdentifier)
+		addArc(p2, p1, channelIdentifier)
+	}
+	paths, err := g.KShortest(address2index[p.PeerFrom], address2index[p.PeerTo], limit)
+	if err != nil {
+		return nil, fmt.Errorf("no path from %s to %s err %s", utils.APex2(p.PeerFrom), utils.APex2(p.PeerTo), err)
+	}
+	for i, path := range paths {
+		r := FindPathResponse{
+			PathID:  i,
+			PathHop: len(path.Path) - 1,
+			Fee:     big.NewInt(0),
+		}
+		for j, n := range path.Path {
+			if j > 0 {
+				r.Result = append(r.Result, index2address[n].String())
+				r.Fee.Add(r.Fee, fees[[2]int{path.Path[j-1], n}])
+			}
+		}
+		resp = append(resp, r)
+	}
+	return
+}
+
+func pathAddress(r *rest.Request, name string) (addr common.Address, err error) {
+	s := r.PathParam(name)
+	if !common.IsHexAddress(s) {
+		err = fmt.Errorf("%s is not a valid address", s)
+		return
+	}
+	return common.HexToAddress(s), nil
+}
+
+func pathHash(r *rest.Request, name string) (hash common.Hash, err error) {
+	s := r.PathParam(name)
+	hash = common.HexToHash(s)
+	if len(s) != 66 || hash == utils.EmptyHash {
+		err = fmt.Errorf("%s is not a valid hash", s)
+	}
+	return
+}
+
+func writeError(w rest.ResponseWriter, err error) {
+	log.Trace(fmt.Sprintf("pfs server response err %s", err))
+	rest.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func writeOK(w rest.ResponseWriter, v interface{}) {
+	err := w.WriteJson(v)
+	if err != nil {
+		log.Warn(fmt.Sprintf("writejson err %s", err))
+	}
+}
+
+func (s *PfsServer) submitBalance(w rest.ResponseWriter, r *rest.Request) {
+	peer, err := pathAddress(r, "peer")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	payload := &submitBalancePayload{}
+	err = r.DecodeJsonPayload(payload)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	err = s.SubmitBalance(peer, payload)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, "ok")
+}
+
+func (s *PfsServer) findPath(w rest.ResponseWriter, r *rest.Request) {
+	payload := &findPathPayload{}
+	err := r.DecodeJsonPayload(payload)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp, err := s.FindPath(payload)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, resp)
+}
+
+func (s *PfsServer) setFeePolicy(w rest.ResponseWriter, r *rest.Request) {
+	peer, err := pathAddress(r, "peer")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fp := &models.FeePolicy{}
+	err = r.DecodeJsonPayload(fp)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	err = s.SetFeePolicy(peer, fp)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, "ok")
+}
+
+//decodeFeeSetting 解析并验证旧版本接口设置的手续费
+func decodeFeeSetting(r *rest.Request, peer common.Address) (*models.FeeSetting, error) {
+	payload := &setFeePayload{}
+	err := r.DecodeJsonPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	return payload.feeSetting(peer)
+}
+
+func (s *PfsServer) setAccountFee(w rest.ResponseWriter, r *rest.Request) {
+	peer, err := pathAddress(r, "peer")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fs, err := decodeFeeSetting(r, peer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.lock.Lock()
+	s.getFeePolicy(peer).AccountFee = fs
+	s.lock.Unlock()
+	writeOK(w, "ok")
+}
+
+func (s *PfsServer) getAccountFee(w rest.ResponseWriter, r *rest.Request) {
+	peer, err := pathAddress(r, "peer")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.lock.Lock()
+	resp := newGetFeeResponse(s.getFeePolicy(peer).AccountFee)
+	s.lock.Unlock()
+	writeOK(w, resp)
+}
+
+func (s *PfsServer) setTokenFee(w rest.ResponseWriter, r *rest.Request) {
+	peer, err := pathAddress(r, "peer")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	token, err := pathAddress(r, "token")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fs, err := decodeFeeSetting(r, peer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.lock.Lock()
+	s.getFeePolicy(peer).TokenFeeMap[token] = fs
+	s.lock.Unlock()
+	writeOK(w, "ok")
+}
+
+func (s *PfsServer) getTokenFee(w rest.ResponseWriter, r *rest.Request) {
+	peer, err := pathAddress(r, "peer")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	token, err := pathAddress(r, "token")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.lock.Lock()
+	fp := s.getFeePolicy(peer)
+	fs, ok := fp.TokenFeeMap[token]
+	if !ok {
+		fs = fp.AccountFee
+	}
+	resp := newGetFeeResponse(fs)
+	s.lock.Unlock()
+	writeOK(w, resp)
+}
+
+func (s *PfsServer) setChannelFee(w rest.ResponseWriter, r *rest.Request) {
+	peer, err := pathAddress(r, "peer")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	channelIdentifier, err := pathHash(r, "channel")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	_, p1, p2, err := s.store.GetNonParticipantChannelByID(channelIdentifier)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if peer != p1 && peer != p2 {
+		writeError(w, fmt.Errorf("%s is not a participant of channel %s", peer.String(), channelIdentifier.String()))
+		return
+	}
+	fs, err := decodeFeeSetting(r, peer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.lock.Lock()
+	s.getFeePolicy(peer).ChannelFeeMap[channelIdentifier] = fs
+	s.lock.Unlock()
+	writeOK(w, "ok")
+}
+
+func (s *PfsServer) getChannelFee(w rest.ResponseWriter, r *rest.Request) {
+	peer, err := pathAddress(r, "peer")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	channelIdentifier, err := pathHash(r, "channel")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	token, _, _, err := s.store.GetNonParticipantChannelByID(channelIdentifier)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.lock.Lock()
+	fp := s.getFeePolicy(peer)
+	fs, ok := fp.ChannelFeeMap[channelIdentifier]
+	if !ok {
+		fs, ok = fp.TokenFeeMap[token]
+	}
+	if !ok {
+		fs = fp.AccountFee
+	}
+	resp := newGetFeeResponse(fs)
+	s.lock.Unlock()
+	writeOK(w, resp)
+}
@@ -0,0 +1,234 @@
+package photon
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/channel"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//ChannelFlagsStore saves settings of channels, models.Dao implements it.
+type ChannelFlagsStore interface {
+	SaveChannelFlags(f *models.ChannelFlags) error
+	GetAllChannelFlags() (flags []*models.ChannelFlags, err error)
+}
+
+/*
+PfsSubmitter decides when the partner's balance proof of a channel is submitted to pfs.
+The balance proof is signed by the partner, so it's always submitted as is, pfs can verify it,
+but we choose when to submit:
+ 1. changes within Window are coalesced, only the latest state of each channel is submitted after the window.
+ 2. with Buckets or Thresholds, a channel is submitted only when the share of the channel we own moves into
+    another bucket or crosses a threshold. The submitted capacity is exact, but pfs doesn't learn changes
+    within a bucket, so what it knows may be stale by up to one bucket.
+ 3. channels opted out are never submitted.
+*/
+type PfsSubmitter struct {
+	Window     time.Duration
+	cuts       []int64 //分界线,万分之一,BalanceRatio落在哪两条线之间
+	store      ChannelFlagsStore
+	lock       sync.Mutex
+	flags      map[common.Hash]*models.ChannelFlags
+	levels     map[common.Hash]int //上次提交时所处的区间
+	pending    map[common.Hash]*pfsChannelState
+	pendingIDs []common.Hash
+}
+
+/*
+pfsChannelState 要提交给pfs的通道状态,在通道所属的goroutine中复制,
+因为提交可能在Window以后,那时通道已经被其他goroutine修改了
+*/
+type pfsChannelState struct {
+	ChannelIdentifier common.Hash
+	OpenBlockNumber   int64
+	Partner           common.Address
+	Nonce             uint64
+	TransferAmount    *big.Int
+	LocksRoot         common.Hash
+	MessageHash       common.Hash
+	Signature         []byte
+	Outstanding       *big.Int
+	Paused            bool
+	Ratio             int64 //我们拥有的份额,万分之一
+}
+
+//newPfsChannelState copies the partner's balance proof of ch, must be called by the goroutine owning ch
+func newPfsChannelState(ch *channel.Channel, paused bool) *pfsChannelState {
+	bp := ch.PartnerState.BalanceProofState
+	return &pfsChannelState{
+		ChannelIdentifier: ch.ChannelIdentifier.ChannelIdentifier,
+		OpenBlockNumber:   ch.ChannelIdentifier.OpenBlockNumber,
+		Partner:           ch.PartnerState.Address,
+		Nonce:             bp.Nonce,
+		TransferAmount:    new(big.Int).Set(bp.TransferAmount),
+		LocksRoot:         bp.LocksRoot,
+		MessageHash:       bp.MessageHash,
+		Signature:         append([]byte(nil), bp.Signature...),
+		Outstanding:       new(big.Int).Set(ch.Outstanding()),
+		Paused:            paused,
+		Ratio:             models.BalanceRatio(ch.Balance(), ch.PartnerBalance()),
+	}
+}
+
+/*
+NewPfsSubmitter :
+buckets splits our share of a channel into equal buckets, thresholds are percents of our share,
+a channel is submitted when its share moves across any of them, or on every change if both are empty.
+*/
+func NewPfsSubmitter(store ChannelFlagsStore, window time.Duration, buckets int, thresholds []int) *PfsSubmitter {
+	s := &PfsSubmitter{
+		Window:  window,
+		store:   store,
+		flags:   make(map[common.Hash]*models.ChannelFlags),
+		levels:  make(map[common.Hash]int),
+		pending: make(map[common.Hash]*pfsChannelState),
+	}
+	cuts := make(map[int64]bool)
+	for i := 1; i < buckets; i++ {
+		cuts[int64(i*10000/buckets)] = true
+	}
+	for _, t := range thresholds {
+		if t > 0 && t < 100 {
+			cuts[int64(t*100)] = true
+		}
+	}
+	for c := range cuts {
+		s.cuts = append(s.cuts, c)
+	}
+	sort.Slice(s.cuts, func(i, j int) bool {
+		return s.cuts[i] < s.cuts[j]
+	})
+	if store == nil {
+		return s
+	}
+	flags, err := store.GetAllChannelFlags()
+	if err != nil {
+		log.Error(fmt.Sprintf("load channel flags err %s", err))
+		return s
+	}
+	for _, f := range flags {
+		s.flags[f.ChannelIdentifier] = f
+	}
+	return s
+}
+
+//level 我方份额所处的区间
+func (s *PfsSubmitter) level(ratio int64) int {
+	return sort.Search(len(s.cuts), func(i int) bool {
+		return s.cuts[i] > ratio
+	})
+}
+
+//SetOptOut stops or resumes submitting the channel to pfs
+func (s *PfsSubmitter) SetOptOut(channelIdentifier common.Hash, optOut bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f := &models.ChannelFlags{ChannelIdentifier: channelIdentifier}
+	if old, ok := s.flags[channelIdentifier]; ok {
+		c := *old
+		f = &c
+	}
+	f.NoPfsSubmit = optOut
+	if s.store != nil {
+		err := s.store.SaveChannelFlags(f)
+		if err != nil {
+			return err
+		}
+	}
+	s.flags[channelIdentifier] = f
+	if optOut {
+		delete(s.levels, channelIdentifier)
+	}
+	return nil
+}
+
+//IsOptedOut returns true if the channel is never submitted to pfs
+func (s *PfsSubmitter) IsOptedOut(channelIdentifier common.Hash) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.isOptedOut(channelIdentifier)
+}
+
+func (s *PfsSubmitter) isOptedOut(channelIdentifier common.Hash) bool {
+	f, ok := s.flags[channelIdentifier]
+	return ok && f.NoPfsSubmit
+}
+
+//GetOptedOutChannels returns all channels not submitted to pfs
+func (s *PfsSubmitter) GetOptedOutChannels() (channels []common.Hash) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	channels = []common.Hash{}
+	for id, f := range s.flags {
+		if f.NoPfsSubmit {
+			channels = append(channels, id)
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].String() < channels[j].String()
+	})
+	return
+}
+
+//Forget submit every channel next time regardless of its last level, such as after pfs reconnected
+func (s *PfsSubmitter) Forget() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.levels = make(map[common.Hash]int)
+}
+
+//ForgetChannel submit the channel next time, such as the last submission failed
+func (s *PfsSubmitter) ForgetChannel(channelIdentifier common.Hash) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.levels, channelIdentifier)
+}
+
+//Add a channel changed, returns false if it's opted out
+func (s *PfsSubmitter) Add(cs *pfsChannelState) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id := cs.ChannelIdentifier
+	if s.isOptedOut(id) {
+		return false
+	}
+	if _, ok := s.pending[id]; !ok {
+		s.pendingIDs = append(s.pendingIDs, id)
+	}
+	s.pending[id] = cs
+	return true
+}
+
+//Take returns the latest states of pending channels which should be submitted now, in the order they changed first
+func (s *PfsSubmitter) Take() (states []*pfsChannelState) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, id := range s.pendingIDs {
+		cs := s.pending[id]
+		if s.shouldSubmit(id, cs.Ratio) {
+			states = append(states, cs)
+		}
+	}
+	s.pending = make(map[common.Hash]*pfsChannelState)
+	s.pendingIDs = nil
+	return
+}
+
+func (s *PfsSubmitter) shouldSubmit(channelIdentifier common.Hash, ratio int64) bool {
+	if s.isOptedOut(channelIdentifier) {
+		return false
+	}
+	l := s.level(ratio)
+	last, ok := s.levels[channelIdentifier]
+	if ok && len(s.cuts) > 0 && last == l {
+		return false
+	}
+	s.levels[channelIdentifier] = l
+	return true
+}
@@ -0,0 +1,94 @@
+package photon
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/SmartMeshFoundation/Photon/models"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryChannelFlagsStore struct {
+	flags map[string]*models.ChannelFlags
+}
+
+func (s *memoryChannelFlagsStore) SaveChannelFlags(f *models.ChannelFlags) error {
+	s.flags[f.ChannelIdentifier.String()] = f
+	return nil
+}
+
+func (s *memoryChannelFlagsStore) GetAllChannelFlags() (flags []*models.ChannelFlags, err error) {
+	for _, f := range s.flags {
+		flags = append(flags, f)
+	}
+	return
+}
+
+func TestPfsSubmitter_EveryChange(t *testing.T) {
+	s := NewPfsSubmitter(nil, 0, 0, nil)
+	id := utils.NewRandomHash()
+	assert.True(t, s.shouldSubmit(id, 5000))
+	assert.True(t, s.shouldSubmit(id, 5000))
+	assert.True(t, s.shouldSubmit(id, 5001))
+}
+
+func TestPfsSubmitter_Buckets(t *testing.T) {
+	//4 buckets and a threshold at 10%
+	s := NewPfsSubmitter(nil, 0, 4, []int{10, 50})
+	assert.EqualValues(t, []int64{1000, 2500, 5000, 7500}, s.cuts)
+	id := utils.NewRandomHash()
+	assert.True(t, s.shouldSubmit(id, 5000))
+	assert.False(t, s.shouldSubmit(id, 6000))
+	assert.False(t, s.shouldSubmit(id, 7499))
+	assert.True(t, s.shouldSubmit(id, 7500))
+	assert.True(t, s.shouldSubmit(id, 2000))
+	assert.True(t, s.shouldSubmit(id, 999))
+	assert.False(t, s.shouldSubmit(id, 0))
+	//submit again after pfs reconnected
+	s.Forget()
+	assert.True(t, s.shouldSubmit(id, 0))
+	s.ForgetChannel(id)
+	assert.True(t, s.shouldSubmit(id, 0))
+}
+
+func TestPfsSubmitter_OptOut(t *testing.T) {
+	store := &memoryChannelFlagsStore{flags: make(map[string]*models.ChannelFlags)}
+	s := NewPfsSubmitter(store, 0, 4, nil)
+	id, id2 := utils.NewRandomHash(), utils.NewRandomHash()
+	assert.True(t, s.shouldSubmit(id, 5000))
+	assert.NoError(t, s.SetOptOut(id, true))
+	assert.False(t, s.shouldSubmit(id, 9000))
+	assert.True(t, s.shouldSubmit(id2, 9000))
+	//survive restart
+	s = NewPfsSubmitter(store, 0, 4, nil)
+	assert.True(t, s.IsOptedOut(id))
+	assert.EqualValues(t, 1, len(s.GetOptedOutChannels()))
+	assert.NoError(t, s.SetOptOut(id, false))
+	assert.EqualValues(t, 0, len(s.GetOptedOutChannels()))
+	assert.True(t, s.shouldSubmit(id, 9000))
+	assert.False(t, NewPfsSubmitter(store, 0, 4, nil).IsOptedOut(id))
+}
+
+func TestPfsSubmitter_Snapshot(t *testing.T) {
+	rs, channels := newTestWorkerService(t, 1, 1)
+	ch := channels[0]
+	rs.PfsSubmitter = NewPfsSubmitter(nil, time.Hour, 0, nil)
+	rs.ChanSubmitBalanceProofToPFS = make(chan *pfsChannelState, 1)
+	ch.PartnerState.BalanceProofState.Nonce = 3
+	ch.PartnerState.BalanceProofState.TransferAmount.SetInt64(10)
+	ratio := models.BalanceRatio(ch.Balance(), ch.PartnerBalance())
+	rs.submitBalanceProofToPfs(ch)
+	cs := <-rs.ChanSubmitBalanceProofToPFS
+	assert.True(t, rs.PfsSubmitter.Add(cs))
+	//the channel changes before the window ends
+	ch.PartnerState.BalanceProofState.Nonce = 4
+	ch.PartnerState.BalanceProofState.TransferAmount.SetInt64(20)
+	states := rs.PfsSubmitter.Take()
+	assert.EqualValues(t, 1, len(states))
+	assert.EqualValues(t, 3, states[0].Nonce)
+	assert.EqualValues(t, big.NewInt(10), states[0].TransferAmount)
+	assert.EqualValues(t, ch.PartnerState.Address, states[0].Partner)
+	assert.EqualValues(t, ratio, states[0].Ratio)
+}
@@ -94,6 +94,11 @@ type Service struct {
 	FeePolicy                fee.Charger //Mediation fee
 	NotifyHandler            *notify.Handler
 	PfsProxy                 pfsproxy.PfsProxy
+	PfsServer                *pfsproxy.PfsServer   //内置路由服务,为nil表示不启用
+	MissionControl           *graph.MissionControl //learns which channels transfers I initiated pass
+	ChannelFlags             *ChannelFlagsCache    //settings of single channels
+	PfsSubmitter             *PfsSubmitter         //decides when balance proofs are submitted to pfs
+	JitPolicy                *JitPolicy            //为nil表示mediator不会为了转发打开通道或者存款
 
 	/*
 	 */
@@ -103,6 +108,8 @@ type Service struct {
 	Token2TokenNetwork    map[common.Address]common.Address
 	Transfer2StateManager map[common.Hash]*transfer.StateManager
 	Transfer2Result       map[common.Hash]*utils.AsyncResult
+	JitTransfers          map[common.Hash]*jitTransfer //等待到下一跳的通道确认的交易
+	AutoSettleStates      map[common.Hash]*autoSettleState
 	SwapKey2TokenSwap     map[swapKey]*TokenSwap
 	/*
 		   This is a map from a hashlock to a list of channels, the same
@@ -138,7 +145,9 @@ type Service struct {
 	EthConnectionStatus                   chan netshare.Status
 	ChanHistoryContractEventsDealComplete chan struct{}
 	BuildInfo                             *BuildInfo
-	ChanSubmitBalanceProofToPFS           chan *channel.Channel // 供submitBalanceProofToPfsLoop线程使用
+	ChanSubmitBalanceProofToPFS           chan *pfsChannelState // 供submitBalanceProofToPfsLoop线程使用
+	channelWorkers                        *channelWorkers       // work of a single channel runs here in parallel
+	jitStateChangeChan                    chan *jitStateChange  // 通知Service.loop检查等待通道的交易
 }
 
 //NewPhotonService create photon service
@@ -156,6 +165,8 @@ func NewPhotonService(chain *rpc.BlockChainService, privateKey *ecdsa.PrivateKey
 		Token2TokenNetwork:                    make(map[common.Address]common.Address),
 		Transfer2StateManager:                 make(map[common.Hash]*transfer.StateManager),
 		Transfer2Result:                       make(map[common.Hash]*utils.AsyncResult),
+		JitTransfers:                          make(map[common.Hash]*jitTransfer),
+		AutoSettleStates:                      make(map[common.Hash]*autoSettleState),
 		Token2LockSecretHash2Channels:         make(map[common.Address]map[common.Hash][]*channel.Channel),
 		SwapKey2TokenSwap:                     make(map[swapKey]*TokenSwap),
 		UserReqChan:                           make(chan *apiReq, 10),
@@ -172,12 +183,24 @@ func NewPhotonService(chain *rpc.BlockChainService, privateKey *ecdsa.PrivateKey
 		EthConnectionStatus:                   make(chan netshare.Status, 10),
 		ChanHistoryContractEventsDealComplete: make(chan struct{}),
 		BuildInfo:                             new(BuildInfo),
-		ChanSubmitBalanceProofToPFS:           make(chan *channel.Channel, 100),
+		ChanSubmitBalanceProofToPFS:           make(chan *pfsChannelState, 100),
+		channelWorkers:                        newChannelWorkers(config.ChannelWorkers),
+		jitStateChangeChan:                    make(chan *jitStateChange, 10),
 	}
 	rs.BlockNumber.Store(int64(0))
 	rs.MessageHandler = newPhotonMessageHandler(rs)
 	rs.StateMachineEventHandler = newStateMachineEventHandler(rs)
 	rs.Protocol = network.NewPhotonProtocol(transport, privateKey, rs)
+	if config.EnableEncryption {
+		rs.Protocol.EnableEncryption()
+	}
+	if config.Trampoline {
+		rs.Protocol.EnableTrampoline()
+	}
+	if config.Onion {
+		rs.Protocol.EnableOnion()
+	}
+	rs.Protocol.SetSendWindow(config.SendWindow)
 	//todo fixme MatrixTransport should have a better contructor function
 	mtransport, ok := rs.Transport.(*network.MatrixMixTransport)
 	if ok {
@@ -187,6 +210,13 @@ func NewPhotonService(chain *rpc.BlockChainService, privateKey *ecdsa.PrivateKey
 		}
 	}
 	rs.Protocol.SetReceivedMessageSaver(NewAckHelper(rs.dao))
+	rs.Protocol.SetPeerPolicy(network.NewPeerPolicy(rs.dao))
+	rs.MissionControl = graph.NewMissionControl(rs.dao)
+	rs.ChannelFlags = NewChannelFlagsCache(rs.dao)
+	rs.PfsSubmitter = NewPfsSubmitter(rs.ChannelFlags.PfsSubmitterStore(), config.PfsSubmitWindow, config.PfsSubmitBuckets, config.PfsSubmitThresholds)
+	if config.JitChannel {
+		rs.JitPolicy = NewJitPolicy(config.JitMaxDeposit, config.JitMaxPendingDeposit, config.JitTargets)
+	}
 	/*
 		only one instance for one data directory
 	*/
@@ -203,10 +233,13 @@ func NewPhotonService(chain *rpc.BlockChainService, privateKey *ecdsa.PrivateKey
 		return
 	}
 	rs.BlockChainEvents = blockchain.NewBlockChainEvents(chain.Client, chain, rs.dao)
+	rs.BlockChainEvents.SetHistorySyncNotifier(rs.NotifyHandler.NotifyHistorySyncProgress)
 	// fee module
 	if config.EnableMediationFee {
 		// pathfinder
-		if config.PfsHost != "" {
+		if hosts := strings.Split(config.PfsHost, ","); len(hosts) > 1 {
+			rs.PfsProxy = pfsproxy.NewMultiPfsProxy(hosts, rs.PrivateKey, config.PfsCrossCheck)
+		} else if config.PfsHost != "" {
 			rs.PfsProxy = pfsproxy.NewPfsProxy(config.PfsHost, rs.PrivateKey)
 		}
 		rs.FeePolicy, err = NewFeeModule(dao, rs.PfsProxy)
@@ -216,6 +249,9 @@ func NewPhotonService(chain *rpc.BlockChainService, privateKey *ecdsa.PrivateKey
 	} else {
 		rs.FeePolicy = &NoFeePolicy{}
 	}
+	if config.PfsServerAddress != "" {
+		rs.PfsServer = pfsproxy.NewPfsServer(dao, rs.Chain.GetRegistryAddress())
+	}
 	return rs, nil
 }
 
@@ -292,6 +328,12 @@ func (rs *Service) Start() (err error) {
 		启动定时提交balance_proof到pfs的线程
 	*/
 	go rs.submitBalanceProofToPfsLoop()
+	if rs.PfsServer != nil {
+		err = rs.PfsServer.Start(rs.Config.PfsServerAddress)
+		if err != nil {
+			return
+		}
+	}
 	//
 	rs.isStarting = false
 	rs.startNeighboursHealthCheck()
@@ -309,6 +351,9 @@ func (rs *Service) Stop() {
 	log.Info("photon service stop...")
 	close(rs.quitChan)
 	rs.Protocol.StopAndWait()
+	if rs.PfsServer != nil {
+		rs.PfsServer.Stop()
+	}
 	rs.BlockChainEvents.Stop()
 	rs.Chain.Client.Close()
 	rs.NotifyHandler.Stop()
@@ -330,7 +375,6 @@ process  events below:
 3. message from other nodes.
 */
 func (rs *Service) loop() {
-	var err error
 	var ok bool
 	var m *network.MessageToPhoton
 	var st transfer.StateChange
@@ -338,16 +382,13 @@ func (rs *Service) loop() {
 	var sentMessage *protocolMessage
 
 	defer rpanic.PanicRecover("photon service")
+	defer rs.channelWorkers.stop()
 	for {
 		select {
 		//message from other nodes
 		case m, ok = <-rs.Protocol.ReceivedMessageChan:
 			if ok {
-				err = rs.MessageHandler.onMessage(m.Msg, m.EchoHash)
-				if err != nil {
-					log.Error(fmt.Sprintf("MessageHandler.onMessage %v", err))
-				}
-				rs.Protocol.ReceivedMessageResultChan <- err
+				rs.dispatchMessage(m)
 			} else {
 				log.Info("Protocol.ReceivedMessageChan closed")
 				return
@@ -355,28 +396,7 @@ func (rs *Service) loop() {
 			// contract events from block chain
 		case st, ok = <-rs.BlockChainEvents.StateChangeChannel:
 			if ok {
-				blockStateChange, ok2 := st.(*transfer.BlockStateChange)
-				if ok2 {
-					rs.handleBlockNumber(blockStateChange)
-				} else {
-					log.Trace(fmt.Sprintf("statechange received :%s", utils.StringInterface(st, 2)))
-					_, isHistoryComplete := st.(*mediatedtransfer.ContractHistoryEventCompleteStateChange)
-					if isHistoryComplete {
-						if rs.ChanHistoryContractEventsDealComplete != nil {
-							close(rs.ChanHistoryContractEventsDealComplete)
-							rs.ChanHistoryContractEventsDealComplete = nil
-						} else {
-							panic("only can receive ContractHistoryEventCompleteStateChange once")
-						}
-					} else {
-						err = rs.StateMachineEventHandler.OnBlockchainStateChange(st)
-						if err != nil {
-							log.Error(fmt.Sprintf("stateMachineEventHandler.OnBlockchainStateChange %s", err))
-						}
-
-					}
-				}
-
+				rs.dispatchStateChange(st)
 			} else {
 				log.Info("Events.StateChangeChannel closed")
 				return
@@ -384,7 +404,7 @@ func (rs *Service) loop() {
 		//user's request
 		case req, ok = <-rs.UserReqChan:
 			if ok {
-				rs.handleReq(req)
+				rs.dispatchReq(req)
 			} else {
 				log.Info("req closed")
 				return
@@ -392,11 +412,16 @@ func (rs *Service) loop() {
 			//i have sent a message complete
 		case sentMessage, ok = <-rs.ProtocolMessageSendComplete:
 			if ok {
-				rs.handleSentMessage(sentMessage)
+				rs.dispatchSentMessage(sentMessage)
 			} else {
 				log.Info("ProtocolMessageSendComplete closed")
 				return
 			}
+		//jit deposit failed or a deposit confirmed
+		case st := <-rs.jitStateChangeChan:
+			rs.channelWorkers.exclusive(func() {
+				rs.handleJitStateChange(st)
+			})
 		case s := <-rs.Chain.Client.StatusChan:
 			select {
 			case rs.EthConnectionStatus <- s:
@@ -404,7 +429,7 @@ func (rs *Service) loop() {
 				//never block
 			}
 			if s == netshare.Connected {
-				rs.handleEthRPCConnectionOK()
+				rs.channelWorkers.exclusive(rs.handleEthRPCConnectionOK)
 			} else {
 				rs.NotifyHandler.NotifyString(notify.LevelWarn, "公链连接失败,正在尝试重连")
 			}
@@ -468,6 +493,8 @@ it's the core of HTLC
 func (rs *Service) handleBlockNumber(st *transfer.BlockStateChange) {
 	rs.BlockNumber.Store(st.BlockNumber)
 	rs.StateMachineEventHandler.dispatchToAllTasks(st)
+	rs.checkJitTransfers()
+	rs.autoSettle(st.BlockNumber)
 	for _, cg := range rs.Token2ChannelGraph {
 		for _, c := range cg.ChannelIdentifier2Channel {
 			err := rs.StateMachineEventHandler.ChannelStateTransition(c, st)
@@ -494,6 +521,15 @@ func (rs *Service) GetChannelStatus(channelIdentifier common.Hash) (int, int64)
 	return int(c.State), c.ChannelIdentifier.OpenBlockNumber
 }
 
+//GetPartnerNonce implements network.PartnerNonceGetter
+func (rs *Service) GetPartnerNonce(channelIdentifier common.Hash) (uint64, bool) {
+	c := rs.getChannelWithAddr(channelIdentifier)
+	if c == nil {
+		return 0, false
+	}
+	return c.PartnerState.BalanceProofState.Nonce, true
+}
+
 func (rs *Service) findChannelByIdentifier(channelIdentifier common.Hash) (*channel.Channel, error) {
 	for _, g := range rs.Token2ChannelGraph {
 		ch := g.ChannelIdentifier2Channel[channelIdentifier]
@@ -766,6 +802,11 @@ func (rs *Service) directTransferAsync(tokenAddress, target common.Address, amou
 		result.Result <- rerr.ErrChannelNoEnoughBalance
 		return
 	}
+	err := rs.Protocol.CheckPeerSupports(target, encoding.DirectTransferCmdID, 0)
+	if err != nil {
+		result.Result <- err
+		return
+	}
 	tr, err := directChannel.CreateDirectTransfer(amount)
 	if err != nil {
 		result.Result <- err
@@ -845,7 +886,7 @@ Calls:
  *			2.1 taker should contain lockSecretHash, but no secret.
  *			2.2 maker should contain lockSecretHash and secret.
  */
-func (rs *Service) startMediatedTransferInternal(tokenAddress, target common.Address, amount *big.Int, lockSecretHash common.Hash, expiration int64, secret common.Hash, data string, routeInfo []pfsproxy.FindPathResponse) (result *utils.AsyncResult, stateManager *transfer.StateManager) {
+func (rs *Service) startMediatedTransferInternal(tokenAddress, target common.Address, amount *big.Int, lockSecretHash common.Hash, expiration int64, secret common.Hash, data string, routeInfo []pfsproxy.FindPathResponse, limit *TransferLimit) (result *utils.AsyncResult, stateManager *transfer.StateManager) {
 	var availableRoutes []*route.State
 	//var err error
 	//targetAmount := new(big.Int).Sub(amount, fee)
@@ -860,7 +901,10 @@ func (rs *Service) startMediatedTransferInternal(tokenAddress, target common.Add
 		// 当前为不支持收费的网络下时,使用本地路由
 		if rs.PfsProxy == nil {
 			log.Trace("get available routes without fee from local channel graph")
-			availableRoutes = g.GetBestRoutes(rs.Protocol, rs.NodeAddress, target, amount, amount, graph.EmptyExlude, rs)
+			availableRoutes = g.GetKShortestRoutes(rs.Protocol, target, amount, rs.Config.LocalRoutes, rs, rs.MissionControl)
+			if len(availableRoutes) == 0 {
+				availableRoutes = g.GetBestRoutes(rs.Protocol, rs.NodeAddress, target, amount, amount, graph.EmptyExlude, rs, nil)
+			}
 		} else {
 			log.Trace("get available routes to partner from local channel graph")
 			ch := rs.getChannel(tokenAddress, target)
@@ -870,6 +914,10 @@ func (rs *Service) startMediatedTransferInternal(tokenAddress, target common.Add
 				availableRoutes = append(availableRoutes, r)
 			}
 		}
+		// 没有到target的路由,比如手机节点没有完整的通道图,交给trampoline
+		if len(availableRoutes) == 0 {
+			availableRoutes = rs.getTrampolineRoutes(tokenAddress, target, amount, limit)
+		}
 	} else {
 		// 用户指定了路由的话,采用用户指定的路由,否则从pfs或者本地查询路由
 		log.Trace("get available routes from user req")
@@ -888,8 +936,29 @@ func (rs *Service) startMediatedTransferInternal(tokenAddress, target common.Add
 			availableRoutes = append(availableRoutes, r)
 		}
 	}
+	//先尝试最近没有失败过的路由
+	rs.MissionControl.SortRoutes(tokenAddress, rs.NodeAddress, amount, availableRoutes)
 	log.Trace(fmt.Sprintf("availableRoutes=%s", utils.StringInterface(availableRoutes, 3)))
+	//skip first hops which cannot decode MediatedTransfer, fail fast if none left
+	var notSupportErr error
+	supportedRoutes := availableRoutes[:0]
+	for _, r := range availableRoutes {
+		err := rs.Protocol.CheckPeerSupports(r.HopNode(), encoding.MediatedTransferCmdID, 0)
+		if err != nil {
+			notSupportErr = err
+			continue
+		}
+		supportedRoutes = append(supportedRoutes, r)
+	}
+	availableRoutes = supportedRoutes
+	for _, r := range availableRoutes {
+		rs.buildOnion(r, tokenAddress, amount, expiration)
+	}
 	if len(availableRoutes) <= 0 {
+		if notSupportErr != nil {
+			result.Result <- notSupportErr
+			return
+		}
 		result.Result <- rerr.ErrNoAvailabeRoute
 		return
 	}
@@ -932,6 +1001,10 @@ func (rs *Service) startMediatedTransferInternal(tokenAddress, target common.Add
 		LockSecretHash: lockSecretHash,
 		Db:             rs.dao,
 	}
+	if limit != nil {
+		initInitiator.MaxFee = limit.MaxFee
+		initInitiator.MaxHops = limit.MaxHops
+	}
 	//log.Trace(fmt.Sprintf("start mediated transfer availableRoutes=%s", utils.StringInterface(availableRoutes, 2)))
 	stateManager = transfer.NewStateManager(initiator.StateTransition, nil, initiator.NameInitiatorTransition, lockSecretHash, transferState.Token)
 	smkey := utils.Sha3(lockSecretHash[:], tokenAddress[:])
@@ -951,7 +1024,7 @@ func (rs *Service) startMediatedTransferInternal(tokenAddress, target common.Add
 1. user start a mediated transfer
 2. user start a mediated transfer with secret
 */
-func (rs *Service) startMediatedTransfer(tokenAddress, target common.Address, amount *big.Int, secret common.Hash, data string, routeInfo []pfsproxy.FindPathResponse) (result *utils.AsyncResult) {
+func (rs *Service) startMediatedTransfer(tokenAddress, target common.Address, amount *big.Int, secret common.Hash, data string, routeInfo []pfsproxy.FindPathResponse, limit *TransferLimit) (result *utils.AsyncResult) {
 	lockSecretHash := utils.EmptyHash
 	if secret != utils.EmptyHash {
 		lockSecretHash = utils.ShaSecret(secret.Bytes())
@@ -982,13 +1055,13 @@ func (rs *Service) startMediatedTransfer(tokenAddress, target common.Address, am
 	*/
 	rs.dao.NewSentTransferDetail(tokenAddress, target, amount, data, false, lockSecretHash)
 	//rs.dao.NewTransferStatus(tokenAddress, lockSecretHash)
-	result, _ = rs.startMediatedTransferInternal(tokenAddress, target, amount, lockSecretHash, 0, secret, data, routeInfo)
+	result, _ = rs.startMediatedTransferInternal(tokenAddress, target, amount, lockSecretHash, 0, secret, data, routeInfo, limit)
 	result.LockSecretHash = lockSecretHash
 	return
 }
 
 //receive a MediatedTransfer, i'm a hop node
-func (rs *Service) mediateMediatedTransfer(msg *encoding.MediatedTransfer, ch *channel.Channel) {
+func (rs *Service) mediateMediatedTransfer(msg *encoding.MediatedTransfer, ch *channel.Channel, hop *encoding.OnionHop, onion []byte) {
 	tokenAddress := ch.TokenAddress
 	smkey := utils.Sha3(msg.LockSecretHash[:], tokenAddress[:])
 	stateManager := rs.Transfer2StateManager[smkey]
@@ -1029,18 +1102,46 @@ func (rs *Service) mediateMediatedTransfer(msg *encoding.MediatedTransfer, ch *c
 			FromTransfer: fromTransfer,
 			FromRoute:    fromRoute,
 			BlockNumber:  rs.GetBlockNumber(),
+			RejectReason: rs.mediationRejectReason(tokenAddress, msg.Sender, utils.EmptyAddress),
 		}
 		rs.StateMachineEventHandler.dispatch(stateManager, stateChange)
 	} else {
+		if _, ok := rs.JitTransfers[smkey]; ok {
+			log.Error(fmt.Sprintf("receive mediator transfer %s,but it's waiting for a channel to the next hop", utils.HPex(msg.LockSecretHash)))
+			return
+		}
+		//到下一跳没有通道或者余额不够时,可以先打开通道或者存款
+		var jt *jitTransfer
+		//下一跳不确定时为空
+		var next common.Address
 		// 2019-03 消息升级后,路由以mtr中带有的path为准,有且只有一条,如果在不支持手续费的网络中,则根据本地路由继续交易
-		if len(msg.Path) == 0 {
+		if hop != nil {
+			// onion交易只知道下一跳,没有通道时由mediator通过加密的AnnounceDisposed告诉发起方
+			next = hop.NextHop
+			path := []common.Address{hop.NextHop}
+			if availableRoute := rs.newMediatorRoute(msg.Sender, ch.TokenAddress, hop.NextHop, path, hop.Amount); availableRoute != nil {
+				avaiableRoutes = append(avaiableRoutes, availableRoute)
+			}
+			jt = &jitTransfer{next: hop.NextHop, path: path, amount: hop.Amount, feeAmount: hop.Amount}
+		} else if msg.Trampoline != utils.EmptyAddress {
+			if msg.Trampoline != rs.NodeAddress {
+				log.Error(fmt.Sprintf("receive MediatedTransfer whose trampoline is %s,ignore", utils.APex2(msg.Trampoline)))
+				return
+			}
+			// 我是trampoline,自己计算剩余的路由
+			avaiableRoutes = rs.getTrampolineForwardRoutes(msg, ch.TokenAddress)
+		} else if len(msg.Path) == 0 {
 			if rs.PfsProxy != nil {
 				log.Error("receive MediatedTransfer without route info,ignore")
 				return
 			}
 			exclude := graph.MakeExclude(msg.Sender, msg.Initiator)
 			g := rs.getToken2ChannelGraph(ch.TokenAddress) //must exist
-			avaiableRoutes = g.GetBestRoutes(rs.Protocol, rs.NodeAddress, msg.Target, amount, msg.PaymentAmount, exclude, rs)
+			avaiableRoutes = g.GetBestRoutes(rs.Protocol, rs.NodeAddress, msg.Target, amount, msg.PaymentAmount, exclude, rs, rs)
+			if len(avaiableRoutes) == 0 {
+				path := []common.Address{msg.Target}
+				jt = &jitTransfer{next: msg.Target, path: path, amount: msg.PaymentAmount, feeAmount: new(big.Int).Sub(msg.PaymentAmount, msg.Fee)}
+			}
 		} else {
 			// 获取下一跳的通道
 			myIndexInPath := -1
@@ -1054,12 +1155,22 @@ func (rs *Service) mediateMediatedTransfer(msg *encoding.MediatedTransfer, ch *c
 				log.Error("can not found myself in msg.Path")
 				return
 			}
-			nextChan := rs.getChannel(ch.TokenAddress, msg.Path[myIndexInPath+1])
+			if myIndexInPath == len(msg.Path)-1 {
+				log.Error("i'm the last node of msg.Path,but not the target")
+				return
+			}
 			// 构造路由,手续费根据TargetAmount在下家通道中的费率计算
-			availableRoute := route.NewState(nextChan, msg.Path)
+			next = msg.Path[myIndexInPath+1]
 			targetAmount := new(big.Int).Sub(msg.PaymentAmount, msg.Fee)
-			availableRoute.Fee = rs.FeePolicy.GetNodeChargeFee(nextChan.PartnerState.Address, nextChan.TokenAddress, targetAmount)
-			avaiableRoutes = append(avaiableRoutes, availableRoute)
+			availableRoute := rs.newMediatorRoute(msg.Sender, ch.TokenAddress, next, msg.Path, targetAmount)
+			jt = &jitTransfer{next: next, path: msg.Path, amount: msg.PaymentAmount, feeAmount: targetAmount}
+			if availableRoute == nil && rs.JitPolicy == nil {
+				log.Error(fmt.Sprintf("no channel with next hop %s in msg.Path", utils.APex2(next)))
+				return
+			}
+			if availableRoute != nil {
+				avaiableRoutes = append(avaiableRoutes, availableRoute)
+			}
 		}
 
 		//ourAddress := rs.NodeAddress
@@ -1079,23 +1190,31 @@ func (rs *Service) mediateMediatedTransfer(msg *encoding.MediatedTransfer, ch *c
 		routesState := route.NewRoutesState(avaiableRoutes)
 		blockNumber := rs.GetBlockNumber()
 		initMediator := &mediatedtransfer.ActionInitMediatorStateChange{
-			OurAddress:  rs.NodeAddress,
-			FromTranfer: fromTransfer,
-			Routes:      routesState,
-			FromRoute:   fromRoute,
-			BlockNumber: blockNumber,
-			Message:     msg,
-			Db:          rs.dao,
-		}
-		stateManager = transfer.NewStateManager(mediator.StateTransition, nil, mediator.NameMediatorTransition, fromTransfer.LockSecretHash, fromTransfer.Token)
+			OurAddress:   rs.NodeAddress,
+			FromTranfer:  fromTransfer,
+			Routes:       routesState,
+			FromRoute:    fromRoute,
+			BlockNumber:  blockNumber,
+			Message:      msg,
+			Db:           rs.dao,
+			OnionHop:     hop,
+			Onion:        onion,
+			RejectReason: rs.mediationRejectReason(tokenAddress, msg.Sender, next),
+		}
+		if jt != nil && initMediator.RejectReason == nil {
+			jt.tokenAddress = ch.TokenAddress
+			jt.init = initMediator
+			if rs.holdForJitChannel(smkey, jt) {
+				return
+			}
+		}
 		//rs.dao.AddStateManager(stateManager)
-		rs.Transfer2StateManager[smkey] = stateManager //for path A-B-C-F-B-D-E ,node B will have two StateManagers for one identifier
-		rs.StateMachineEventHandler.dispatch(stateManager, initMediator)
+		rs.startMediator(smkey, initMediator)
 	}
 }
 
 //receive a MediatedTransfer, i'm the target
-func (rs *Service) targetMediatedTransfer(msg *encoding.MediatedTransfer, ch *channel.Channel) {
+func (rs *Service) targetMediatedTransfer(msg *encoding.MediatedTransfer, ch *channel.Channel, hop *encoding.OnionHop) {
 	smkey := utils.Sha3(msg.LockSecretHash[:], ch.TokenAddress[:])
 	stateManager := rs.Transfer2StateManager[smkey]
 	/*
@@ -1131,18 +1250,36 @@ func (rs *Service) targetMediatedTransfer(msg *encoding.MediatedTransfer, ch *ch
 	}
 	fromRoute := graph.Channel2RouteState(fromChannel, msg.Sender, msg.PaymentAmount, rs, msg.Path)
 	fromTransfer := mediatedtransfer.LockedTransferFromMessage(msg, ch.TokenAddress)
+	if hop != nil {
+		// onion交易,发起方和我应收的金额只在给我的指令中
+		if msg.PaymentAmount.Cmp(hop.Amount) < 0 {
+			log.Error(fmt.Sprintf("receive onion transfer %s,amount %s is less than %s", utils.HPex(msg.LockSecretHash), msg.PaymentAmount, hop.Amount))
+			return
+		}
+		fromTransfer.Initiator = hop.Initiator
+		fromTransfer.Target = rs.NodeAddress
+		fromTransfer.TargetAmount = new(big.Int).Set(hop.Amount)
+		fromTransfer.Fee = new(big.Int).Sub(msg.PaymentAmount, hop.Amount)
+	}
 	initTarget := &mediatedtransfer.ActionInitTargetStateChange{
-		OurAddress:  rs.NodeAddress,
-		FromRoute:   fromRoute,
-		FromTranfer: fromTransfer,
-		BlockNumber: rs.GetBlockNumber(),
-		Message:     msg,
-		Db:          rs.dao,
+		OurAddress:   rs.NodeAddress,
+		FromRoute:    fromRoute,
+		FromTranfer:  fromTransfer,
+		BlockNumber:  rs.GetBlockNumber(),
+		Message:      msg,
+		Db:           rs.dao,
+		RejectReason: rs.receiveRejectReason(ch),
+	}
+	if initTarget.RejectReason != nil && hop != nil {
+		initTarget.ErrorKey = hop.ErrorKey
 	}
 	stateManager = transfer.NewStateManager(target.StateTransiton, nil, target.NameTargetTransition, fromTransfer.LockSecretHash, fromTransfer.Token)
 	//rs.dao.AddStateManager(stateManager)
 	rs.Transfer2StateManager[smkey] = stateManager
 	rs.StateMachineEventHandler.dispatch(stateManager, initTarget)
+	if initTarget.RejectReason != nil {
+		return
+	}
 	// notify upper
 	rs.NotifyHandler.NotifyReceiveMediatedTransfer(msg, ch.TokenAddress)
 }
@@ -1460,7 +1597,7 @@ func (rs *Service) tokenSwapMaker(tokenswap *TokenSwap) (result *utils.AsyncResu
 	}
 	rs.SentMediatedTransferListenerMap[&sentMtrHook] = true
 	rs.ReceivedMediatedTrasnferListenerMap[&receiveMtrHook] = true
-	result, _ = rs.startMediatedTransferInternal(tokenswap.FromToken, tokenswap.ToNodeAddress, tokenswap.FromAmount, tokenswap.LockSecretHash, 0, tokenswap.Secret, "", tokenswap.RouteInfo)
+	result, _ = rs.startMediatedTransferInternal(tokenswap.FromToken, tokenswap.ToNodeAddress, tokenswap.FromAmount, tokenswap.LockSecretHash, 0, tokenswap.Secret, "", tokenswap.RouteInfo, nil)
 	return
 }
 
@@ -1514,7 +1651,7 @@ func (rs *Service) messageTokenSwapTaker(msg *encoding.MediatedTransfer, tokensw
 		taker and maker may have direct channels on these two tokens.
 	*/
 	takerExpiration := msg.Expiration - int64(rs.Config.RevealTimeout)
-	result, stateManager := rs.startMediatedTransferInternal(tokenswap.ToToken, tokenswap.FromNodeAddress, tokenswap.ToAmount, tokenswap.LockSecretHash, takerExpiration, utils.EmptyHash, "", tokenswap.RouteInfo)
+	result, stateManager := rs.startMediatedTransferInternal(tokenswap.ToToken, tokenswap.FromNodeAddress, tokenswap.ToAmount, tokenswap.LockSecretHash, takerExpiration, utils.EmptyHash, "", tokenswap.RouteInfo, nil)
 	if stateManager == nil {
 		log.Error(fmt.Sprintf("taker tokenwap error %s", <-result.Result))
 		return false
@@ -1687,6 +1824,7 @@ func (rs *Service) handleEthRPCConnectionOK() {
 		}
 	}
 	// 重连或启动时，刷新所有通道状态信息到pfs
+	rs.PfsSubmitter.Forget()
 	for _, cg := range rs.Token2ChannelGraph {
 		for _, ch := range cg.ChannelIdentifier2Channel {
 			if ch.State != channeltype.StateOpened {
@@ -1707,7 +1845,7 @@ func (rs *Service) handleReq(req *apiReq) {
 		if r.IsDirectTransfer {
 			result = rs.directTransferAsync(r.TokenAddress, r.Target, r.Amount, r.Data)
 		} else {
-			result = rs.startMediatedTransfer(r.TokenAddress, r.Target, r.Amount, r.Secret, r.Data, r.RouteInfo)
+			result = rs.startMediatedTransfer(r.TokenAddress, r.Target, r.Amount, r.Secret, r.Data, r.RouteInfo, r.Limit)
 		}
 	case newChannelReqName:
 		r := req.Req.(*newChannelReq)
@@ -1758,12 +1896,18 @@ func (rs *Service) handleReq(req *apiReq) {
 	case registerSecretOnChainReqName:
 		r := req.Req.(*registerSecretReq)
 		result = rs.registerSecretOnChain(r)
+	case quoteReqName:
+		r := req.Req.(*quoteReq)
+		result = rs.quoteRoutes(r.TokenAddress, r.Target, r.Amount)
 	case getUnfinishedReceviedTransferReqName:
 		r := req.Req.(*getUnfinishedReceivedTransferReq)
 		result = rs.getUnfinishedReceivedTransfer(r)
 	case forceUnlockReqName:
 		r := req.Req.(*forceUnlockReq)
 		result = rs.forceUnlock(r)
+	case pauseChannelReqName:
+		r := req.Req.(*pauseChannelReq)
+		result = rs.pauseChannel(r)
 	default:
 		panic("unkown req")
 	}
@@ -1787,7 +1931,7 @@ func (rs *Service) UpdateChannelAndSaveAck(c *channel.Channel, tag interface{})
 	echohash := t.EchoHash
 	ack := rs.Protocol.CreateAck(echohash)
 	cs := channel.NewChannelSerialization(c)
-	rs.NotifyHandler.NotifyChannelStatus(channeltype.ChannelSerialization2ChannelDataDetail(cs))
+	rs.NotifyHandler.NotifyChannelStatus(rs.ChannelDataDetail(cs))
 	err := rs.dao.UpdateChannelAndSaveAck(cs, echohash, ack.Pack())
 	if err != nil {
 		log.Error(fmt.Sprintf("UpdateChannelAndSaveAck %s", err))
@@ -1796,25 +1940,25 @@ func (rs *Service) UpdateChannelAndSaveAck(c *channel.Channel, tag interface{})
 
 //UpdateChannel 数据库中更新通道状态,同时通知App
 func (rs *Service) UpdateChannel(c *channeltype.Serialization, tx models.TX) error {
-	rs.NotifyHandler.NotifyChannelStatus(channeltype.ChannelSerialization2ChannelDataDetail(c))
+	rs.NotifyHandler.NotifyChannelStatus(rs.ChannelDataDetail(c))
 	return rs.dao.UpdateChannel(c, tx)
 }
 
 //UpdateChannelNoTx  数据库更新,同时通知App,与updateChannelState的区别就在于回调函数的
 func (rs *Service) UpdateChannelNoTx(c *channeltype.Serialization) error {
-	rs.NotifyHandler.NotifyChannelStatus(channeltype.ChannelSerialization2ChannelDataDetail(c))
+	rs.NotifyHandler.NotifyChannelStatus(rs.ChannelDataDetail(c))
 	return rs.dao.UpdateChannelNoTx(c)
 }
 
 //UpdateChannelState 数据库更新,同时通知app
 func (rs *Service) UpdateChannelState(c *channeltype.Serialization) error {
-	rs.NotifyHandler.NotifyChannelStatus(channeltype.ChannelSerialization2ChannelDataDetail(c))
+	rs.NotifyHandler.NotifyChannelStatus(rs.ChannelDataDetail(c))
 	return rs.dao.UpdateChannelState(c)
 }
 
 //UpdateChannelContractBalance 数据库更新,同时通知app
 func (rs *Service) UpdateChannelContractBalance(c *channeltype.Serialization) error {
-	rs.NotifyHandler.NotifyChannelStatus(channeltype.ChannelSerialization2ChannelDataDetail(c))
+	rs.NotifyHandler.NotifyChannelStatus(rs.ChannelDataDetail(c))
 	return rs.dao.UpdateChannelContractBalance(c)
 }
 
@@ -1859,44 +2003,68 @@ func (rs *Service) findAllChannelsByLockSecretHash(lockSecretHash common.Hash) (
 	return
 }
 
+/*
+submitBalanceProofToPfsLoop 通道变化以后由PfsSubmitter决定什么时候提交,
+有窗口时窗口内的变化合并为一次提交
+*/
 func (rs *Service) submitBalanceProofToPfsLoop() {
 	log.Trace("submitBalanceProofToPfsLoop start...")
+	if rs.PfsProxy == nil {
+		log.Trace("submitBalanceProofToPfsLoop stop because PfsProxy is nil")
+		return
+	}
+	var flush <-chan time.Time
 	for {
-		if rs.PfsProxy == nil {
-			log.Trace("submitBalanceProofToPfsLoop stop because PfsProxy is nil")
-			return
-		}
-		ch, ok := <-rs.ChanSubmitBalanceProofToPFS
-		if !ok {
-			log.Trace("submitBalanceProofToPfsLoop stop because chan close")
-			return
+		select {
+		case cs, ok := <-rs.ChanSubmitBalanceProofToPFS:
+			if !ok {
+				log.Trace("submitBalanceProofToPfsLoop stop because chan close")
+				return
+			}
+			if !rs.PfsSubmitter.Add(cs) {
+				continue
+			}
+			if rs.PfsSubmitter.Window <= 0 {
+				rs.submitPendingBalanceProofsToPfs()
+			} else if flush == nil {
+				flush = time.After(rs.PfsSubmitter.Window)
+			}
+		case <-flush:
+			flush = nil
+			rs.submitPendingBalanceProofsToPfs()
 		}
-		bpPartner := ch.PartnerState.BalanceProofState
+	}
+}
+
+func (rs *Service) submitPendingBalanceProofsToPfs() {
+	for _, cs := range rs.PfsSubmitter.Take() {
 		err := rs.PfsProxy.SubmitBalance(
-			bpPartner.Nonce,
-			bpPartner.TransferAmount,
-			ch.Outstanding(),
-			ch.ChannelIdentifier.OpenBlockNumber,
-			bpPartner.LocksRoot,
-			ch.ChannelIdentifier.ChannelIdentifier,
-			bpPartner.MessageHash,
-			ch.PartnerState.Address,
-			bpPartner.Signature,
+			cs.Nonce,
+			cs.TransferAmount,
+			cs.Outstanding,
+			cs.Paused,
+			cs.OpenBlockNumber,
+			cs.LocksRoot,
+			cs.ChannelIdentifier,
+			cs.MessageHash,
+			cs.Partner,
+			cs.Signature,
 		)
 		if err == pfsproxy.ErrConnect {
-			log.Warn(fmt.Sprintf("connect to pfs err when submit BalanceProof of channel %s, retry 3 times...", ch.ChannelIdentifier.ChannelIdentifier.String()))
+			log.Warn(fmt.Sprintf("connect to pfs err when submit BalanceProof of channel %s, retry 3 times...", cs.ChannelIdentifier.String()))
 			// 网络错误,重发3次
 			for i := 0; i < 3; i++ {
 				err = rs.PfsProxy.SubmitBalance(
-					bpPartner.Nonce,
-					bpPartner.TransferAmount,
-					ch.Outstanding(),
-					ch.ChannelIdentifier.OpenBlockNumber,
-					bpPartner.LocksRoot,
-					ch.ChannelIdentifier.ChannelIdentifier,
-					bpPartner.MessageHash,
-					ch.PartnerState.Address,
-					bpPartner.Signature,
+					cs.Nonce,
+					cs.TransferAmount,
+					cs.Outstanding,
+					cs.Paused,
+					cs.OpenBlockNumber,
+					cs.LocksRoot,
+					cs.ChannelIdentifier,
+					cs.MessageHash,
+					cs.Partner,
+					cs.Signature,
 				)
 				if err == pfsproxy.ErrConnect {
 					continue
@@ -1905,13 +2073,20 @@ func (rs *Service) submitBalanceProofToPfsLoop() {
 		}
 		if err != nil {
 			log.Error(err.Error())
+			//下次变化时重新提交
+			rs.PfsSubmitter.ForgetChannel(cs.ChannelIdentifier)
 		}
 	}
 }
 
+/*
+submitBalanceProofToPfs 复制通道现在的状态交给submitBalanceProofToPfsLoop,
+必须在通道所属的goroutine中调用,从不阻塞
+*/
 func (rs *Service) submitBalanceProofToPfs(ch *channel.Channel) {
+	cs := newPfsChannelState(ch, rs.IsInboundPaused(ch.ChannelIdentifier.ChannelIdentifier))
 	select {
-	case rs.ChanSubmitBalanceProofToPFS <- ch:
+	case rs.ChanSubmitBalanceProofToPFS <- cs:
 	default:
 		// never block
 	}
@@ -1955,6 +2130,7 @@ func (rs *Service) getBestRoutesFromPfs(peerFrom, peerTo, token common.Address,
 		r.TotalFee = path.Fee
 		routes = append(routes, r)
 	}
+	rs.MissionControl.SortRoutes(token, peerFrom, amount, routes)
 	return
 }
 func (rs *Service) forceUnlock(req *forceUnlockReq) (result *utils.AsyncResult) {
@@ -255,8 +255,8 @@ func (r *API) GetTokenTokenNetorks() (tokens []string) {
 }
 
 //Transfer transfer and wait
-func (r *API) Transfer(token common.Address, amount *big.Int, target common.Address, secret common.Hash, timeout time.Duration, isDirectTransfer bool, data string, routeInfo []pfsproxy.FindPathResponse) (result *utils.AsyncResult, err error) {
-	result, err = r.TransferInternal(token, amount, target, secret, isDirectTransfer, data, routeInfo)
+func (r *API) Transfer(token common.Address, amount *big.Int, target common.Address, secret common.Hash, timeout time.Duration, isDirectTransfer bool, data string, routeInfo []pfsproxy.FindPathResponse, limit *TransferLimit) (result *utils.AsyncResult, err error) {
+	result, err = r.TransferInternal(token, amount, target, secret, isDirectTransfer, data, routeInfo, limit)
 	if err != nil {
 		return
 	}
@@ -274,8 +274,8 @@ func (r *API) Transfer(token common.Address, amount *big.Int, target common.Addr
 }
 
 // TransferAsync :
-func (r *API) TransferAsync(tokenAddress common.Address, amount *big.Int, target common.Address, secret common.Hash, isDirectTransfer bool, data string, routeInfo []pfsproxy.FindPathResponse) (result *utils.AsyncResult, err error) {
-	result, err = r.TransferInternal(tokenAddress, amount, target, secret, isDirectTransfer, data, routeInfo)
+func (r *API) TransferAsync(tokenAddress common.Address, amount *big.Int, target common.Address, secret common.Hash, isDirectTransfer bool, data string, routeInfo []pfsproxy.FindPathResponse, limit *TransferLimit) (result *utils.AsyncResult, err error) {
+	result, err = r.TransferInternal(tokenAddress, amount, target, secret, isDirectTransfer, data, routeInfo, limit)
 	if err != nil {
 		return
 	}
@@ -288,11 +288,11 @@ func (r *API) TransferAsync(tokenAddress common.Address, amount *big.Int, target
 	return result, err
 }
 
-//TransferInternal :
-func (r *API) TransferInternal(tokenAddress common.Address, amount *big.Int, target common.Address, secret common.Hash, isDirectTransfer bool, data string, routeInfo []pfsproxy.FindPathResponse) (result *utils.AsyncResult, err error) {
+//TransferInternal : limit 限制中转交易的手续费和跳数,nil不限制
+func (r *API) TransferInternal(tokenAddress common.Address, amount *big.Int, target common.Address, secret common.Hash, isDirectTransfer bool, data string, routeInfo []pfsproxy.FindPathResponse, limit *TransferLimit) (result *utils.AsyncResult, err error) {
 	log.Debug(fmt.Sprintf("initiating transfer initiator=%s target=%s token=%s amount=%d secret=%s,currentblock=%d",
 		r.Photon.NodeAddress.String(), target.String(), tokenAddress.String(), amount, secret.String(), r.Photon.GetBlockNumber()))
-	result = r.Photon.transferAsyncClient(tokenAddress, amount, target, secret, isDirectTransfer, data, routeInfo)
+	result = r.Photon.transferAsyncClient(tokenAddress, amount, target, secret, isDirectTransfer, data, routeInfo, limit)
 	return
 }
 
@@ -911,6 +911,13 @@ func (r *API) CancelTransfer(lockSecretHash common.Hash, tokenAddress common.Add
 	return <-result.Result
 }
 
+// PauseChannel : pause or resume a direction of a channel for routing without closing it,
+// direction is one of PauseOutboundMediation,PauseInboundMediation and PauseReceive
+func (r *API) PauseChannel(channelIdentifier common.Hash, direction string, pause bool) error {
+	result := r.Photon.pauseChannelClient(channelIdentifier, direction, pause)
+	return <-result.Result
+}
+
 type balanceProof struct {
 	Nonce             uint64      `json:"nonce"`
 	TransferAmount    *big.Int    `json:"transfer_amount"`
@@ -1011,6 +1018,40 @@ func (r *API) FindPath(targetAddress, tokenAddress common.Address, amount *big.I
 	return
 }
 
+/*
+Quote 交易之前查询到target的路由和每一跳的手续费,按总手续费从小到大排列,
+启用PFS时由PFS给出路由,否则根据本地的ChannelGraph计算. limit不为nil时只返回满足限制的路由
+*/
+func (r *API) Quote(targetAddress, tokenAddress common.Address, amount *big.Int, limit *TransferLimit) (quotes []*RouteQuote, err error) {
+	var all []*RouteQuote
+	if r.Photon.PfsProxy != nil {
+		all, err = r.Photon.quoteRoutesFromPfs(tokenAddress, targetAddress, amount)
+		if err != nil {
+			return
+		}
+	} else {
+		result := r.Photon.quoteClient(tokenAddress, targetAddress, amount)
+		err = <-result.Result
+		if err != nil {
+			return
+		}
+		all = result.Tag.([]*RouteQuote)
+	}
+	if len(all) == 0 {
+		err = rerr.ErrNoAvailabeRoute
+		return
+	}
+	for _, q := range all {
+		if limit.allow(q) {
+			quotes = append(quotes, q)
+		}
+	}
+	if len(quotes) == 0 {
+		err = rerr.ErrNoRouteWithinLimit
+	}
+	return
+}
+
 // GetAllFeeChargeRecord :
 func (r *API) GetAllFeeChargeRecord() (resp interface{}, err error) {
 	type responce struct {
@@ -1055,6 +1096,7 @@ func (r *API) SystemStatus() (resp interface{}, err error) {
 		FeePolicy           *models.FeePolicy                 `json:"fee_policy"`
 		ChannelNum          int                               `json:"channel_num"`
 		Transfers           *transfers                        `json:"transfers,omitempty"`
+		HistorySync         *models.HistorySyncProgress       `json:"history_sync,omitempty"`
 	}
 	var data systemStatus
 	data.EthRPCEndpoint = r.Photon.Config.EthRPCEndPoint
@@ -1075,6 +1117,7 @@ func (r *API) SystemStatus() (resp interface{}, err error) {
 	data.TokenToTokenNetwork = r.Photon.Token2TokenNetwork
 	data.LastBlockNumber = r.Photon.dao.GetLatestBlockNumber()
 	data.LastBlockNumberTime = r.Photon.dao.GetLastBlockNumberTime()
+	data.HistorySync = r.Photon.BlockChainEvents.HistorySyncProgress()
 	data.IsMobileMode = params.MobileMode
 	// network type
 	switch r.Photon.Transport.(type) {
@@ -0,0 +1,118 @@
+package photon
+
+import (
+	"math/big"
+	"sort"
+
+	"github.com/SmartMeshFoundation/Photon/rerr"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+//TransferLimit 发起方对一笔中转交易的限制,零值表示不限制
+type TransferLimit struct {
+	MaxFee  *big.Int `json:"max_fee,omitempty"`  //最多支付的手续费,nil不限制
+	MaxHops int      `json:"max_hops,omitempty"` //路由最多的跳数,0不限制
+}
+
+//allow returns true if quote `q` is within the limit
+func (l *TransferLimit) allow(q *RouteQuote) bool {
+	if l == nil {
+		return true
+	}
+	if l.MaxFee != nil && q.TotalFee.Cmp(l.MaxFee) > 0 {
+		return false
+	}
+	return l.MaxHops <= 0 || q.Hops <= l.MaxHops
+}
+
+/*
+RouteQuote 交易之前对一条路由的报价
+Path 从第一跳到target的所有节点,不包括自己
+Fees 每个中转节点收取的手续费,和Path中除target外的节点一一对应,PFS给出的路由没有
+*/
+type RouteQuote struct {
+	Path     []common.Address `json:"path"`
+	Fees     []*big.Int       `json:"fees,omitempty"`
+	TotalFee *big.Int         `json:"total_fee"`
+	Hops     int              `json:"hops"`
+}
+
+type routeQuotes []*RouteQuote
+
+func (rq routeQuotes) Len() int {
+	return len(rq)
+}
+func (rq routeQuotes) Less(i, j int) bool {
+	c := rq[i].TotalFee.Cmp(rq[j].TotalFee)
+	if c != 0 {
+		return c < 0
+	}
+	return rq[i].Hops < rq[j].Hops
+}
+func (rq routeQuotes) Swap(i, j int) {
+	rq[i], rq[j] = rq[j], rq[i]
+}
+
+/*
+quoteRoutes 根据本地的ChannelGraph和收费策略,给出经过每个有足够余额的邻居到target的最便宜路由,
+按总手续费从小到大排列. 中转节点的收费按本节点的收费策略估算,和GetBestRoutes一样.
+must be called in loop, ChannelGraph is not thread safe.
+*/
+func (rs *Service) quoteRoutes(tokenAddress, target common.Address, amount *big.Int) (result *utils.AsyncResult) {
+	result = utils.NewAsyncResult()
+	g := rs.getToken2ChannelGraph(tokenAddress)
+	if g == nil {
+		result.Result <- rerr.ErrTokenNotFound
+		return
+	}
+	var quotes routeQuotes
+	for partner, ch := range g.PartenerAddress2Channel {
+		if !ch.CanTransfer() || ch.Distributable().Cmp(amount) < 0 {
+			continue
+		}
+		path, err := g.BestPath(partner, target, amount, rs)
+		if err != nil {
+			continue
+		}
+		q := &RouteQuote{
+			Path:     path,
+			TotalFee: big.NewInt(0),
+			Hops:     len(path),
+		}
+		for _, node := range path[:len(path)-1] {
+			fee := rs.FeePolicy.GetNodeChargeFee(node, tokenAddress, amount)
+			q.Fees = append(q.Fees, fee)
+			q.TotalFee.Add(q.TotalFee, fee)
+		}
+		quotes = append(quotes, q)
+	}
+	sort.Sort(quotes)
+	result.Tag = []*RouteQuote(quotes)
+	result.Result <- nil
+	return
+}
+
+//quoteRoutesFromPfs 向PFS询问路由,PFS只给出总手续费
+func (rs *Service) quoteRoutesFromPfs(tokenAddress, target common.Address, amount *big.Int) (quotes []*RouteQuote, err error) {
+	paths, err := rs.PfsProxy.FindPath(rs.NodeAddress, target, tokenAddress, amount, true)
+	if err != nil {
+		return
+	}
+	for _, p := range paths {
+		if len(p.Result) == 0 {
+			continue
+		}
+		q := &RouteQuote{
+			Path:     p.GetPath(),
+			TotalFee: p.Fee,
+			Hops:     len(p.Result),
+		}
+		if q.TotalFee == nil {
+			q.TotalFee = big.NewInt(0)
+		}
+		quotes = append(quotes, q)
+	}
+	sort.Sort(routeQuotes(quotes))
+	return
+}
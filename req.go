@@ -49,6 +49,8 @@ const registerSecretReqName = "RegisterSecret"
 const getUnfinishedReceviedTransferReqName = "GetUnfinishedReceivedTransfer"
 const forceUnlockReqName = "ForceUnlock"
 const registerSecretOnChainReqName = "registerSecretOnChain"
+const quoteReqName = "quote"
+const pauseChannelReqName = "pauseChannel"
 
 /*
 transfer api
@@ -61,6 +63,7 @@ type transferReq struct {
 	IsDirectTransfer bool
 	Data             string
 	RouteInfo        []pfsproxy.FindPathResponse
+	Limit            *TransferLimit
 }
 
 /*
@@ -138,7 +141,7 @@ Transfer `amount` between this node and `target`.
            - Network speed, making the transfer sufficiently fast so it doesn't
              expire.
 */
-func (rs *Service) transferAsyncClient(tokenAddress common.Address, amount *big.Int, target common.Address, secret common.Hash, isDirectTransfer bool, data string, routeInfo []pfsproxy.FindPathResponse) *utils.AsyncResult {
+func (rs *Service) transferAsyncClient(tokenAddress common.Address, amount *big.Int, target common.Address, secret common.Hash, isDirectTransfer bool, data string, routeInfo []pfsproxy.FindPathResponse, limit *TransferLimit) *utils.AsyncResult {
 	req := &apiReq{
 		ReqID: utils.RandomString(10),
 		Name:  transferReqName,
@@ -150,6 +153,7 @@ func (rs *Service) transferAsyncClient(tokenAddress common.Address, amount *big.
 			IsDirectTransfer: isDirectTransfer,
 			Data:             data,
 			RouteInfo:        routeInfo,
+			Limit:            limit,
 		},
 	}
 	return rs.sendReqClient(req)
@@ -362,3 +366,41 @@ func (rs *Service) registerSecretOnChainClient(secret common.Hash) *utils.AsyncR
 	}
 	return rs.sendReqClient(req)
 }
+
+type pauseChannelReq struct {
+	ChannelIdentifier common.Hash
+	Direction         string
+	Pause             bool
+}
+
+func (rs *Service) pauseChannelClient(channelIdentifier common.Hash, direction string, pause bool) *utils.AsyncResult {
+	req := &apiReq{
+		ReqID: utils.RandomString(10),
+		Name:  pauseChannelReqName,
+		Req: &pauseChannelReq{
+			ChannelIdentifier: channelIdentifier,
+			Direction:         direction,
+			Pause:             pause,
+		},
+	}
+	return rs.sendReqClient(req)
+}
+
+type quoteReq struct {
+	TokenAddress common.Address
+	Target       common.Address
+	Amount       *big.Int
+}
+
+func (rs *Service) quoteClient(tokenAddress, target common.Address, amount *big.Int) *utils.AsyncResult {
+	req := &apiReq{
+		ReqID: utils.RandomString(10),
+		Name:  quoteReqName,
+		Req: &quoteReq{
+			TokenAddress: tokenAddress,
+			Target:       target,
+			Amount:       amount,
+		},
+	}
+	return rs.sendReqClient(req)
+}
@@ -233,6 +233,16 @@ var (
 	ErrRejectTransferBecausePayerChannelClosed = newError(3007, "payer's channel already closed ,reject mediated transfer")
 	// ErrChannelNoEnoughBalance 通道余额不足
 	ErrChannelNoEnoughBalance = newError(3008, "no enough balance")
+	//ErrNoRouteWithinLimit 有路由,但是手续费或者跳数超过了发起方的限制
+	ErrNoRouteWithinLimit = newError(3009, "NoRouteWithinFeeOrHopLimit")
+	//ErrOnionRouteFailed onion交易失败,真正的原因加密给了发起方
+	ErrOnionRouteFailed = newError(3010, "onion routed transfer failed, the reason is encrypted to the initiator")
+	//ErrOutboundMediationPaused 到下一跳的通道暂停了转发
+	ErrOutboundMediationPaused = newError(3011, "channel to the next hop is paused for mediated transfers")
+	//ErrInboundMediationPaused 上家的通道暂停了转发
+	ErrInboundMediationPaused = newError(3012, "payer's channel is paused for mediated transfers")
+	//ErrReceivePaused 上家的通道暂停了收款
+	ErrReceivePaused = newError(3013, "payer's channel is paused for receiving transfers")
 	/*ErrPFS PFS Error
 	向PFS发起请求错误
 	*/
@@ -309,6 +319,10 @@ var (
 	ErrTransportTypeUnknown = newError(6000, "transport type error")
 	//ErrSubScribeNeighbor 订阅节点在线信息错误
 	ErrSubScribeNeighbor = newError(6001, "ErrSubScribeNeighbor")
+	//ErrPeerNotSupport 对方节点不支持需要的消息版本或者功能
+	ErrPeerNotSupport = newError(6002, "peer doesn't support required message version or feature")
+	//ErrUnsolicitedMessage 收到的响应对应的请求我并没有发送过
+	ErrUnsolicitedMessage = newError(6003, "unsolicited message")
 
 	// ErrUnknown 未知错误
 	ErrUnknown = newError(9999, "unknown error")
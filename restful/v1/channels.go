@@ -114,7 +114,7 @@ func SpecifiedChannel(w rest.ResponseWriter, r *rest.Request) {
 	if err != nil {
 		resp = dto.NewExceptionAPIResponse(err)
 	} else {
-		d := channeltype.ChannelSerialization2ChannelDataDetail(c)
+		d := API.Photon.ChannelDataDetail(c)
 		resp = dto.NewSuccessAPIResponse(d)
 	}
 	return
@@ -111,6 +111,7 @@ func Start() {
 			utils
 		*/
 		rest.Get("/api/1/path/:target_address/:token/:amount", FindPath),
+		rest.Get("/api/1/quote/:target_address/:token/:amount", Quote),
 		rest.Get("/api/1/secret", GetRandomSecret), // api to provide random secret and lockSecretHash pair
 		rest.Get("/api/1/version", GetBuildInfo),
 
@@ -133,6 +134,21 @@ func Start() {
 		rest.Get("/api/1/stop", Stop),
 		rest.Get("/api/1/switch/:mesh", SwitchNetwork),
 		rest.Post("/api/1/updatenodes", UpdateMeshNetworkNodes),
+		rest.Get("/api/1/tcp/announcement", GetTCPAnnouncement),
+		rest.Post("/api/1/tcp/peers", UpdateTCPPeers),
+		rest.Get("/api/1/peers/bans", GetPeerBans),
+		rest.Delete("/api/1/peers/bans/:addr", UnbanPeer),
+		rest.Get("/api/1/missioncontrol", GetMissionControl),
+		rest.Delete("/api/1/missioncontrol", ResetMissionControl),
+		rest.Get("/api/1/pfs/optout", GetPfsOptOutChannels),
+		rest.Put("/api/1/pfs/optout/:channel", SetPfsOptOut),
+		rest.Delete("/api/1/pfs/optout/:channel", SetPfsOptOut),
+		rest.Get("/api/1/autosettle/optout", GetAutoSettleOptOutChannels),
+		rest.Put("/api/1/autosettle/optout/:channel", SetAutoSettleOptOut),
+		rest.Delete("/api/1/autosettle/optout/:channel", SetAutoSettleOptOut),
+		rest.Get("/api/1/pause", GetPausedChannels),
+		rest.Put("/api/1/pause/:channel/:direction", PauseChannel),
+		rest.Delete("/api/1/pause/:channel/:direction", PauseChannel),
 
 		/*
 			1. withdraw
@@ -2,11 +2,13 @@ package v1
 
 import (
 	"fmt"
+	"net/http"
 
 	"github.com/SmartMeshFoundation/Photon/rerr"
 
 	"strconv"
 
+	photon "github.com/SmartMeshFoundation/Photon"
 	"github.com/SmartMeshFoundation/Photon/dto"
 	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/models"
@@ -37,6 +39,192 @@ func UpdateMeshNetworkNodes(w rest.ResponseWriter, r *rest.Request) {
 	resp = dto.NewAPIResponse(err, "ok")
 }
 
+/*
+GetTCPAnnouncement returns the signed tcp address of this node,
+give it to other nodes so they can connect to this node directly
+*/
+func GetTCPAnnouncement(w rest.ResponseWriter, r *rest.Request) {
+	var resp *dto.APIResponse
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> GetTCPAnnouncement ,err=%s", resp.ToFormatString()))
+		writejson(w, resp)
+	}()
+	ann, err := API.Photon.Protocol.TCPAnnouncement()
+	resp = dto.NewAPIResponse(err, ann)
+}
+
+/*
+UpdateTCPPeers saves signed tcp addresses of other nodes
+*/
+func UpdateTCPPeers(w rest.ResponseWriter, r *rest.Request) {
+	var resp *dto.APIResponse
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> UpdateTCPPeers ,err=%s", resp.ToFormatString()))
+		writejson(w, resp)
+	}()
+	var err error
+	var anns []*network.AddressAnnouncement
+	err = r.DecodeJsonPayload(&anns)
+	if err != nil {
+		resp = dto.NewExceptionAPIResponse(rerr.ErrArgumentError)
+		return
+	}
+	err = API.Photon.Protocol.UpdateTCPPeers(anns)
+	resp = dto.NewAPIResponse(err, "ok")
+}
+
+/*
+GetPeerBans returns peers whose messages are dropped because of misbehaviour
+*/
+func GetPeerBans(w rest.ResponseWriter, r *rest.Request) {
+	var resp *dto.APIResponse
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> GetPeerBans ,err=%s", resp.ToFormatString()))
+		writejson(w, resp)
+	}()
+	pp := API.Photon.Protocol.GetPeerPolicy()
+	if pp == nil {
+		resp = dto.NewSuccessAPIResponse([]*models.PeerBan{})
+		return
+	}
+	resp = dto.NewSuccessAPIResponse(pp.GetBans())
+}
+
+/*
+UnbanPeer accepts messages from a banned peer again
+*/
+func UnbanPeer(w rest.ResponseWriter, r *rest.Request) {
+	var resp *dto.APIResponse
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> UnbanPeer ,err=%s", resp.ToFormatString()))
+		writejson(w, resp)
+	}()
+	addr, err := utils.HexToAddress(r.PathParam("addr"))
+	if err != nil {
+		resp = dto.NewExceptionAPIResponse(rerr.ErrArgumentError.Append("invalid address"))
+		return
+	}
+	pp := API.Photon.Protocol.GetPeerPolicy()
+	if pp != nil {
+		err = pp.Unban(addr)
+	}
+	resp = dto.NewAPIResponse(err, "ok")
+}
+
+/*
+GetMissionControl returns what has been learned about channels from transfers I initiated
+*/
+func GetMissionControl(w rest.ResponseWriter, r *rest.Request) {
+	var resp *dto.APIResponse
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> GetMissionControl ,err=%s", resp.ToFormatString()))
+		writejson(w, resp)
+	}()
+	resp = dto.NewSuccessAPIResponse(API.Photon.MissionControl.GetEdgeStats())
+}
+
+/*
+ResetMissionControl forgets what has been learned about channels
+*/
+func ResetMissionControl(w rest.ResponseWriter, r *rest.Request) {
+	var resp *dto.APIResponse
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> ResetMissionControl ,err=%s", resp.ToFormatString()))
+		writejson(w, resp)
+	}()
+	err := API.Photon.MissionControl.Reset()
+	resp = dto.NewAPIResponse(err, "ok")
+}
+
+/*
+GetPfsOptOutChannels returns channels whose balance proofs are never submitted to pfs
+*/
+func GetPfsOptOutChannels(w rest.ResponseWriter, r *rest.Request) {
+	var resp *dto.APIResponse
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> GetPfsOptOutChannels ,err=%s", resp.ToFormatString()))
+		writejson(w, resp)
+	}()
+	resp = dto.NewSuccessAPIResponse(API.Photon.PfsSubmitter.GetOptedOutChannels())
+}
+
+/*
+SetPfsOptOut stops submitting balance proofs of a channel to pfs, DELETE resumes
+*/
+func SetPfsOptOut(w rest.ResponseWriter, r *rest.Request) {
+	var resp *dto.APIResponse
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> SetPfsOptOut ,err=%s", resp.ToFormatString()))
+		writejson(w, resp)
+	}()
+	channelIdentifier := common.HexToHash(r.PathParam("channel"))
+	_, err := API.GetChannel(channelIdentifier)
+	if err != nil {
+		resp = dto.NewExceptionAPIResponse(err)
+		return
+	}
+	//恢复以后,通道下次变化时提交
+	err = API.Photon.PfsSubmitter.SetOptOut(channelIdentifier, r.Method != http.MethodDelete)
+	resp = dto.NewAPIResponse(err, "ok")
+}
+
+/*
+GetAutoSettleOptOutChannels returns channels which are never settled automatically
+*/
+func GetAutoSettleOptOutChannels(w rest.ResponseWriter, r *rest.Request) {
+	var resp *dto.APIResponse
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> GetAutoSettleOptOutChannels ,err=%s", resp.ToFormatString()))
+		writejson(w, resp)
+	}()
+	resp = dto.NewSuccessAPIResponse(API.Photon.GetAutoSettleOptOutChannels())
+}
+
+/*
+SetAutoSettleOptOut stops settling a channel automatically, DELETE resumes
+*/
+func SetAutoSettleOptOut(w rest.ResponseWriter, r *rest.Request) {
+	var resp *dto.APIResponse
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> SetAutoSettleOptOut ,err=%s", resp.ToFormatString()))
+		writejson(w, resp)
+	}()
+	channelIdentifier := common.HexToHash(r.PathParam("channel"))
+	_, err := API.GetChannel(channelIdentifier)
+	if err != nil {
+		resp = dto.NewExceptionAPIResponse(err)
+		return
+	}
+	err = API.Photon.SetAutoSettleOptOut(channelIdentifier, r.Method != http.MethodDelete)
+	resp = dto.NewAPIResponse(err, "ok")
+}
+
+/*
+GetPausedChannels returns channels paused for routing in any direction
+*/
+func GetPausedChannels(w rest.ResponseWriter, r *rest.Request) {
+	var resp *dto.APIResponse
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> GetPausedChannels ,err=%s", resp.ToFormatString()))
+		writejson(w, resp)
+	}()
+	resp = dto.NewSuccessAPIResponse(API.Photon.GetPausedChannels())
+}
+
+/*
+PauseChannel pauses a direction of a channel for routing without closing it, DELETE resumes
+*/
+func PauseChannel(w rest.ResponseWriter, r *rest.Request) {
+	var resp *dto.APIResponse
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> PauseChannel ,err=%s", resp.ToFormatString()))
+		writejson(w, resp)
+	}()
+	channelIdentifier := common.HexToHash(r.PathParam("channel"))
+	err := API.PauseChannel(channelIdentifier, r.PathParam("direction"), r.Method != http.MethodDelete)
+	resp = dto.NewAPIResponse(err, "ok")
+}
+
 /*
 SwitchNetwork  switch between mesh and internet
 */
@@ -146,6 +334,56 @@ func FindPath(w rest.ResponseWriter, r *rest.Request) {
 
 }
 
+/*
+Quote is the api of /quote/:target_address/:token/:amount?max_fee=xx&max_hops=xx
+returns routes and fees of each hop before transfer
+*/
+func Quote(w rest.ResponseWriter, r *rest.Request) {
+	var resp *dto.APIResponse
+	defer func() {
+		log.Trace(fmt.Sprintf("Restful Api Call ----> Quote ,err=%s", resp.ToFormatString()))
+		writejson(w, resp)
+	}()
+	targetAddress, err := utils.HexToAddress(r.PathParam("target_address"))
+	if err != nil {
+		resp = dto.NewExceptionAPIResponse(rerr.ErrArgumentError.AppendError(err))
+		return
+	}
+	tokenAddress, err := utils.HexToAddress(r.PathParam("token"))
+	if err != nil {
+		resp = dto.NewExceptionAPIResponse(rerr.ErrArgumentError.AppendError(err))
+		return
+	}
+	amount, ok := math.ParseBig256(r.PathParam("amount"))
+	if !ok || amount.Sign() <= 0 {
+		resp = dto.NewExceptionAPIResponse(rerr.ErrInvalidAmount)
+		return
+	}
+	var limit *photon.TransferLimit
+	query := r.URL.Query()
+	if s := query.Get("max_fee"); s != "" {
+		maxFee, ok := math.ParseBig256(s)
+		if !ok || maxFee.Sign() < 0 {
+			resp = dto.NewExceptionAPIResponse(rerr.ErrArgumentError.Append("invalid max_fee"))
+			return
+		}
+		limit = &photon.TransferLimit{MaxFee: maxFee}
+	}
+	if s := query.Get("max_hops"); s != "" {
+		maxHops, err := strconv.Atoi(s)
+		if err != nil || maxHops < 0 {
+			resp = dto.NewExceptionAPIResponse(rerr.ErrArgumentError.Append("invalid max_hops"))
+			return
+		}
+		if limit == nil {
+			limit = &photon.TransferLimit{}
+		}
+		limit.MaxHops = maxHops
+	}
+	result, err := API.Quote(targetAddress, tokenAddress, amount, limit)
+	resp = dto.NewAPIResponse(err, result)
+}
+
 // GetAllFeeChargeRecord :
 func GetAllFeeChargeRecord(w rest.ResponseWriter, r *rest.Request) {
 	var resp *dto.APIResponse
@@ -7,6 +7,7 @@ import (
 
 	"github.com/SmartMeshFoundation/Photon/rerr"
 
+	photon "github.com/SmartMeshFoundation/Photon"
 	"github.com/SmartMeshFoundation/Photon/dto"
 	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/params"
@@ -28,6 +29,8 @@ type TransferData struct {
 	Sync           bool                        `json:"sync,omitempty"` //是否同步
 	Data           string                      `json:"data"`           // 交易附加信息,长度不超过256
 	RouteInfo      []pfsproxy.FindPathResponse `json:"route_info"`     // 指定的路由信息
+	MaxFee         *big.Int                    `json:"max_fee,omitempty"`  // 最多支付的手续费,不指定则不限制
+	MaxHops        int                         `json:"max_hops,omitempty"` // 路由最多的跳数,不指定则不限制
 }
 
 /*
@@ -106,11 +109,22 @@ func Transfers(w rest.ResponseWriter, r *rest.Request) {
 		resp = dto.NewExceptionAPIResponse(rerr.ErrArgumentError.Append("Invalid data, length must < 256"))
 		return
 	}
+	if (req.MaxFee != nil && req.MaxFee.Sign() < 0) || req.MaxHops < 0 {
+		resp = dto.NewExceptionAPIResponse(rerr.ErrArgumentError.Append("max_fee and max_hops can not be negative"))
+		return
+	}
+	var limit *photon.TransferLimit
+	if req.MaxFee != nil || req.MaxHops > 0 {
+		limit = &photon.TransferLimit{
+			MaxFee:  req.MaxFee,
+			MaxHops: req.MaxHops,
+		}
+	}
 	var result *utils.AsyncResult
 	if req.Sync {
-		result, err = API.Transfer(tokenAddr, req.Amount, targetAddr, common.HexToHash(req.Secret), params.MaxRequestTimeout, req.IsDirect, req.Data, req.RouteInfo)
+		result, err = API.Transfer(tokenAddr, req.Amount, targetAddr, common.HexToHash(req.Secret), params.MaxRequestTimeout, req.IsDirect, req.Data, req.RouteInfo, limit)
 	} else {
-		result, err = API.TransferAsync(tokenAddr, req.Amount, targetAddr, common.HexToHash(req.Secret), req.IsDirect, req.Data, req.RouteInfo)
+		result, err = API.TransferAsync(tokenAddr, req.Amount, targetAddr, common.HexToHash(req.Secret), req.IsDirect, req.Data, req.RouteInfo, limit)
 	}
 	if err != nil {
 		resp = dto.NewExceptionAPIResponse(err)
@@ -35,6 +35,9 @@ func (rs *Service) restore() {
 	//2. 为发送成功的 EnvelopMessage 继续发送
 	// 2. keep sending EnvelopMessage that failed previously.
 	rs.reSendEnvelopMessage()
+	//3. 重启前等待通道的交易没有mediator了,退回给上家
+	// 3. refund transfers which were waiting for channels to the next hop.
+	rs.refundJitTransfers()
 }
 func (rs *Service) reSendEnvelopMessage() {
 	msgs := rs.dao.GetAllOrderedSentEnvelopMessager()
@@ -0,0 +1,128 @@
+package photon
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/SmartMeshFoundation/Photon/encoding"
+	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/transfer/route"
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+trampolineFeeBudget 通过trampoline发送时,付给trampoline和后续节点的全部手续费,
+没有指定max fee时按TrampolineFeeRate估算
+*/
+func (rs *Service) trampolineFeeBudget(amount *big.Int, limit *TransferLimit) *big.Int {
+	if !rs.Config.EnableMediationFee {
+		return big.NewInt(0)
+	}
+	if limit != nil && limit.MaxFee != nil {
+		return new(big.Int).Set(limit.MaxFee)
+	}
+	budget := new(big.Int).Mul(amount, big.NewInt(rs.Config.TrampolineFeeRate))
+	return budget.Div(budget, big.NewInt(1000000))
+}
+
+/*
+getTrampolineRoutes 找不到到target的路由时,比如手机节点没有完整的通道图,
+把交易交给声明支持trampoline的对手,由它计算剩余的路由.
+余额多的对手优先,跳数由trampoline决定,所以限制了max hops时不使用trampoline.
+*/
+func (rs *Service) getTrampolineRoutes(tokenAddress, target common.Address, amount *big.Int, limit *TransferLimit) (routes []*route.State) {
+	if limit != nil && limit.MaxHops > 0 {
+		return
+	}
+	g := rs.getToken2ChannelGraph(tokenAddress)
+	if g == nil {
+		return
+	}
+	budget := rs.trampolineFeeBudget(amount, limit)
+	need := new(big.Int).Add(amount, budget)
+	for partner, ch := range g.PartenerAddress2Channel {
+		if partner == target || !rs.Protocol.PeerSupportsTrampoline(partner) {
+			continue
+		}
+		if !ch.CanTransfer() || ch.Distributable().Cmp(need) < 0 {
+			continue
+		}
+		if _, isOnline := rs.Protocol.GetNetworkStatus(partner); !isOnline {
+			continue
+		}
+		r := route.NewState(ch, []common.Address{partner, target})
+		r.Hops = 0
+		r.Trampoline = partner
+		r.Fee = utils.BigInt0
+		r.TotalFee = budget
+		routes = append(routes, r)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Channel().Distributable().Cmp(routes[j].Channel().Distributable()) > 0
+	})
+	log.Trace(fmt.Sprintf("trampoline routes to %s, fee budget %s: %s", utils.APex2(target), budget, utils.StringInterface(routes, 3)))
+	return
+}
+
+/*
+getTrampolineForwardRoutes 我是msg的trampoline,计算从我到target的路由.
+Fee是我的手续费,DownstreamFee是后续节点的手续费,两者之和超过msg.Fee的路由会被mediator拒绝,
+没有可用的路由时mediator通过AnnounceDisposed把失败原因告诉上家.
+*/
+func (rs *Service) getTrampolineForwardRoutes(msg *encoding.MediatedTransfer, tokenAddress common.Address) (routes []*route.State) {
+	if !rs.Config.Trampoline {
+		log.Warn(fmt.Sprintf("receive trampoline transfer %s,but i'm not a trampoline", utils.HPex(msg.LockSecretHash)))
+		return
+	}
+	g := rs.getToken2ChannelGraph(tokenAddress)
+	if g == nil {
+		return
+	}
+	targetAmount := new(big.Int).Sub(msg.PaymentAmount, msg.Fee)
+	var candidates []*route.State
+	if ch := g.GetPartenerAddress2Channel(msg.Target); ch != nil {
+		r := route.NewState(ch, []common.Address{msg.Target})
+		r.TotalFee = utils.BigInt0
+		candidates = append(candidates, r)
+	} else if rs.PfsProxy != nil {
+		var err error
+		//我的手续费单独计算,pfs给出的是后续节点的手续费
+		candidates, err = rs.getBestRoutesFromPfs(rs.NodeAddress, msg.Target, tokenAddress, targetAmount, true)
+		if err != nil {
+			log.Warn(fmt.Sprintf("trampoline get routes from pfs err %s", err))
+		}
+	} else {
+		k := rs.Config.LocalRoutes
+		if k <= 0 {
+			k = 1
+		}
+		candidates = g.GetKShortestRoutes(rs.Protocol, msg.Target, targetAmount, k, rs, rs.MissionControl)
+	}
+	for _, r := range candidates {
+		if r.HopNode() == msg.Sender || pathContains(r.Path, msg.Initiator) || rs.IsOutboundMediationPaused(r.ChannelIdentifier) {
+			continue
+		}
+		if fm, ok := rs.FeePolicy.(*FeeModule); ok {
+			r.Fee = fm.GetMediatorChargeFee(msg.Sender, r.HopNode(), tokenAddress, targetAmount)
+		} else {
+			r.Fee = rs.FeePolicy.GetNodeChargeFee(r.HopNode(), tokenAddress, targetAmount)
+		}
+		r.DownstreamFee = big.NewInt(0)
+		if r.TotalFee != nil {
+			r.DownstreamFee.Set(r.TotalFee)
+		}
+		routes = append(routes, r)
+	}
+	return
+}
+
+func pathContains(path []common.Address, addr common.Address) bool {
+	for _, a := range path {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
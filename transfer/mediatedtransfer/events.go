@@ -29,6 +29,8 @@ type EventSendMediatedTransfer struct {
 	// If I am the transfer initiator, then FromChannel should be null.
 	FromChannel common.Hash
 	Path        []common.Address //2019-03 消息升级后,带全路径path
+	Trampoline  common.Address   //不为空时由它计算剩余路由
+	Onion       []byte           //不为空时按onion发送,消息中不带Target,Initiator和Path
 }
 
 //NewEventSendMediatedTransfer create EventSendMediatedTransfer
@@ -127,12 +129,14 @@ EventSendAnnounceDisposed used to cleanly backtrack the current node in the rout
     of losing token.
 */
 type EventSendAnnounceDisposed struct {
-	Amount         *big.Int
-	LockSecretHash common.Hash
-	Expiration     int64
-	Token          common.Address
-	Receiver       common.Address
-	Reason         rerr.StandardError
+	Amount               *big.Int
+	LockSecretHash       common.Hash
+	Expiration           int64
+	Token                common.Address
+	Receiver             common.Address
+	Reason               rerr.StandardError
+	ErrorKey             common.Hash //onion交易用它把Reason加密给发起方
+	DownstreamOnionError []byte      //onion交易中下游加密的失败原因,包起来转给上家
 }
 
 /*
@@ -219,6 +223,26 @@ type EventWithdrawFailed struct {
 	Reason            string
 }
 
+//EventRouteSuccess emitted by the initiator when a transfer succeeded through route `Path`, HopNode is the first of it.
+type EventRouteSuccess struct {
+	Token   common.Address
+	HopNode common.Address
+	Path    []common.Address
+}
+
+/*
+EventRouteFailed emitted by the initiator when a route is given up.
+Disposed 表示第一跳用AnnounceDisposed明确放弃了交易,否则是锁过期等原因.
+Path 为空的时候只知道第一跳
+*/
+type EventRouteFailed struct {
+	Token    common.Address
+	HopNode  common.Address
+	Path     []common.Address
+	Disposed bool
+	Reason   string
+}
+
 // EventSaveFeeChargeRecord :
 // 记录本次中转收取手续费的流水
 type EventSaveFeeChargeRecord struct {
@@ -247,4 +271,6 @@ func init() {
 	gob.Register(&EventUnlockFailed{})
 	gob.Register(&EventWithdrawSuccess{})
 	gob.Register(&EventWithdrawFailed{})
+	gob.Register(&EventRouteSuccess{})
+	gob.Register(&EventRouteFailed{})
 }
@@ -148,6 +148,46 @@ func TestInitWithoutRoutes(t *testing.T) {
 	assert(t, ok, true)
 }
 
+func TestInitWithLimit(t *testing.T) {
+	amount := utest.UnitTransferAmount
+	targetAddress := utest.HOP4
+	makeRoutes := func() []*route.State {
+		expensive := utest.MakeRoute(utest.HOP1, amount, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash())
+		expensive.TotalFee = big.NewInt(10)
+		expensive.Hops = 2
+		long := utest.MakeRoute(utest.HOP2, amount, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash())
+		long.TotalFee = big.NewInt(3)
+		long.Hops = 4
+		return []*route.State{expensive, long}
+	}
+	//route over max fee is ignored
+	routes := makeRoutes()
+	initStateChange := makeInitStateChange(routes, targetAddress, amount, utest.UnitBlockNumber, utest.ADDR, utest.UnitTokenAddress)
+	initStateChange.MaxFee = big.NewInt(5)
+	it := StateTransition(nil, initStateChange)
+	state := it.NewState.(*mediatedtransfer.InitiatorState)
+	assert(t, state.Route, routes[1])
+	assert(t, state.Transfer.Fee, big.NewInt(3))
+	assert(t, len(state.Routes.IgnoredRoutes), 1)
+
+	//no route within both limits
+	initStateChange = makeInitStateChange(makeRoutes(), targetAddress, amount, utest.UnitBlockNumber, utest.ADDR, utest.UnitTokenAddress)
+	initStateChange.MaxFee = big.NewInt(5)
+	initStateChange.MaxHops = 3
+	it = StateTransition(nil, initStateChange)
+	assert(t, it.NewState == nil, true)
+	failed, ok := it.Events[0].(*transfer.EventTransferSentFailed)
+	assert(t, ok, true)
+	assert(t, failed.Reason, ReasonNoRouteWithinLimit)
+
+	//no limit
+	routes = makeRoutes()
+	initStateChange = makeInitStateChange(routes, targetAddress, amount, utest.UnitBlockNumber, utest.ADDR, utest.UnitTokenAddress)
+	it = StateTransition(nil, initStateChange)
+	state = it.NewState.(*mediatedtransfer.InitiatorState)
+	assert(t, state.Route, routes[0])
+}
+
 func TestStateWaitSecretRequestValid(t *testing.T) {
 	amount := utest.UnitTransferAmount
 	blockNumber := utest.UnitBlockNumber
@@ -199,10 +239,11 @@ func TestStateWaitUnlockValid(t *testing.T) {
 		Sender: mediatorAddress,
 	}
 	events := sm.Dispatch(stateChange)
-	assert(t, len(events), 4)
+	assert(t, len(events), 5)
 	var EventSendBalanceProof *mediatedtransfer.EventSendBalanceProof
 	var EventTransferSentSuccess *transfer.EventTransferSentSuccess
 	var EventUnlockSuccess *mediatedtransfer.EventUnlockSuccess
+	var EventRouteSuccess *mediatedtransfer.EventRouteSuccess
 	for _, e := range events {
 		switch e2 := e.(type) {
 		case *mediatedtransfer.EventSendBalanceProof:
@@ -211,13 +252,17 @@ func TestStateWaitUnlockValid(t *testing.T) {
 			EventTransferSentSuccess = e2
 		case *mediatedtransfer.EventUnlockSuccess:
 			EventUnlockSuccess = e2
+		case *mediatedtransfer.EventRouteSuccess:
+			EventRouteSuccess = e2
 		}
 	}
 	assert(t, EventSendBalanceProof != nil, true)
 	assert(t, EventTransferSentSuccess != nil, true)
 	assert(t, EventUnlockSuccess != nil, true)
+	assert(t, EventRouteSuccess != nil, true)
 
 	assert(t, EventSendBalanceProof.Receiver, mediatorAddress)
+	assert(t, EventRouteSuccess.HopNode, mediatorAddress)
 	assert(t, sm.CurrentState, nil, "state must be cleaned")
 }
 
@@ -292,9 +337,13 @@ func TestRefundTransferNextRoute(t *testing.T) {
 	sm := transfer.NewStateManager(StateTransition, currentState, NameInitiatorTransition, utils.ShaSecret([]byte("3")), utils.NewRandomAddress())
 
 	events := sm.Dispatch(stateChange)
-	assert(t, len(events), 2)
+	assert(t, len(events), 3)
 	_, ok := events[0].(*mediatedtransfer.EventSendMediatedTransfer)
 	assert(t, ok, true, "No mediated transfer event emitted, should have tried a new route")
+	routeFailed, ok := events[2].(*mediatedtransfer.EventRouteFailed)
+	assert(t, ok, true)
+	assert(t, routeFailed.HopNode, mediatorAddress)
+	assert(t, routeFailed.Disposed, true)
 	assert(t, sm.CurrentState != nil, true)
 	//assert(t, currentState.Routes.CanceledRoutes[0], priorState.Route)
 }
@@ -326,7 +375,7 @@ func TestRefundTransferNoMoreRoutes(t *testing.T) {
 	sm := transfer.NewStateManager(StateTransition, currentState, NameInitiatorTransition, utils.ShaSecret([]byte("3")), utils.NewRandomAddress())
 
 	events := sm.Dispatch(stateChange)
-	assert(t, len(events), 3)
+	assert(t, len(events), 4)
 	_, ok := events[0].(*transfer.EventTransferSentFailed)
 	assert(t, ok, true)
 	assert(t, sm.CurrentState == nil, true)
@@ -5,6 +5,7 @@ import (
 
 	"math/big"
 
+	"github.com/SmartMeshFoundation/Photon/encoding"
 	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/params"
 	"github.com/SmartMeshFoundation/Photon/rerr"
@@ -18,6 +19,17 @@ import (
 //NameInitiatorTransition name for state manager
 const NameInitiatorTransition = "InitiatorTransition"
 
+//ReasonNoRouteWithinLimit 有可用的路由,但是手续费或者跳数都超过了发起方的限制
+const ReasonNoRouteWithinLimit = "no route within max fee or max hops"
+
+//overLimit 路由的手续费或者跳数超过了发起方的限制
+func overLimit(state *mt.InitiatorState, r *route.State) bool {
+	if state.MaxFee != nil && r.TotalFee != nil && r.TotalFee.Cmp(state.MaxFee) > 0 {
+		return true
+	}
+	return state.MaxHops > 0 && r.Hops > state.MaxHops
+}
+
 /*
 Clear current state and try a new route.
 
@@ -71,12 +83,16 @@ func tryNewRoute(state *mt.InitiatorState) *transfer.TransitionResult {
 		panic("cannot try a new route while one is being used")
 	}
 	var tryRoute *route.State
+	limited := false
 	for len(state.Routes.AvailableRoutes) > 0 {
 		r := state.Routes.AvailableRoutes[0]
 		state.Routes.AvailableRoutes = state.Routes.AvailableRoutes[1:]
 		//if !r.CanTransfer() /*交易发起方不应该考虑收费*/ || r.AvailableBalance().Cmp(new(big.Int).Add(state.Transfer.TargetAmount, r.Fee)) < 0 {
 		if !r.CanTransfer() || r.AvailableBalance().Cmp(state.Transfer.TargetAmount) < 0 {
 			state.Routes.IgnoredRoutes = append(state.Routes.IgnoredRoutes, r)
+		} else if overLimit(state, r) {
+			limited = true
+			state.Routes.IgnoredRoutes = append(state.Routes.IgnoredRoutes, r)
 		} else {
 			tryRoute = r
 			break
@@ -103,6 +119,9 @@ func tryNewRoute(state *mt.InitiatorState) *transfer.TransitionResult {
 		if transferFailed.Reason == "" {
 			transferFailed.Reason = "no route available"
 		}
+		if limited && len(state.Routes.CanceledRoutes) == 0 {
+			transferFailed.Reason = ReasonNoRouteWithinLimit
+		}
 		events := []transfer.Event{transferFailed}
 		removeManager := &mt.EventRemoveStateManager{
 			Key: utils.Sha3(state.LockSecretHash[:], state.Transfer.Token[:]),
@@ -141,6 +160,8 @@ func tryNewRoute(state *mt.InitiatorState) *transfer.TransitionResult {
 		Data:           state.Transfer.Data,
 	}
 	msg := mt.NewEventSendMediatedTransfer(tr, tryRoute.HopNode(), tryRoute.Path)
+	msg.Trampoline = tryRoute.Trampoline
+	msg.Onion = tryRoute.Onion
 	if len(state.Routes.CanceledRoutes) > 0 {
 		/*
 			保存上次尝试的路由信息,否则当发起方收到AnnounceDisposed的时候,尝试新路由时,会出现异常
@@ -173,6 +194,10 @@ func expiredHashLockEvents(state *mt.InitiatorState) (events []transfer.Event) {
 				Token:          state.Transfer.Token,
 			}
 			events = append(events, unlockFailed, transferFailed)
+			//密码已经发出去的话,路由是通的
+			if state.RevealSecret == nil {
+				events = append(events, routeFailedEvent(state, false, "lock expired"))
+			}
 		}
 	}
 	return
@@ -207,16 +232,21 @@ func handleBlock(state *mt.InitiatorState, stateChange *transfer.BlockStateChang
 
 func handleRefund(state *mt.InitiatorState, stateChange *mt.ReceiveAnnounceDisposedStateChange) *transfer.TransitionResult {
 	if mediator.IsValidRefund(state.Transfer, state.Route, stateChange) {
-		it := cancelCurrentRoute(state, rerr.StandardError{
+		reason := rerr.StandardError{
 			ErrorCode: stateChange.Message.ErrorCode,
 			ErrorMsg:  stateChange.Message.ErrorMsg,
-		}.Error())
+		}.Error()
+		routeFailed := routeFailedEvent(state, true, reason)
+		if len(state.Route.OnionKeys) > 0 && len(stateChange.Message.ErrorOnion) > 0 {
+			reason = openOnionError(state.Route, stateChange.Message.ErrorOnion, routeFailed)
+		}
+		it := cancelCurrentRoute(state, reason)
 		ev := &mt.EventSendAnnounceDisposedResponse{
 			LockSecretHash: stateChange.Lock.LockSecretHash,
 			Token:          state.Transfer.Token,
 			Receiver:       stateChange.Sender,
 		}
-		it.Events = append(it.Events, ev)
+		it.Events = append(it.Events, ev, routeFailed)
 		return it
 	}
 	return &transfer.TransitionResult{
@@ -343,10 +373,48 @@ func transferSuccessEvents(state *mt.InitiatorState) (events []transfer.Event) {
 	removeManager := &mt.EventRemoveStateManager{
 		Key: utils.Sha3(tr.LockSecretHash[:], tr.Token[:]),
 	}
-	events = []transfer.Event{unlockLock, transferSuccess, unlockSuccess, removeManager}
+	routeSuccess := &mt.EventRouteSuccess{
+		Token:   tr.Token,
+		HopNode: state.Route.HopNode(),
+		Path:    state.Route.Path,
+	}
+	events = []transfer.Event{unlockLock, transferSuccess, unlockSuccess, routeSuccess, removeManager}
 	return events
 }
 
+//routeFailedEvent tells which route is given up, state.Route must not be nil
+func routeFailedEvent(state *mt.InitiatorState, disposed bool, reason string) *mt.EventRouteFailed {
+	return &mt.EventRouteFailed{
+		Token:    state.Transfer.Token,
+		HopNode:  state.Route.HopNode(),
+		Path:     state.Route.Path,
+		Disposed: disposed,
+		Reason:   reason,
+	}
+}
+
+/*
+openOnionError 解密onion交易的失败原因,知道了是哪个节点失败的,
+只有它和它的下一跳之间的通道需要为失败负责
+*/
+func openOnionError(r *route.State, errorOnion []byte, routeFailed *mt.EventRouteFailed) (reason string) {
+	index, errorCode, errorMsg, err := encoding.OpenOnionError(r.OnionKeys, errorOnion)
+	if err != nil {
+		reason = fmt.Sprintf("cannot decrypt reason of onion route %s", err)
+		routeFailed.Reason = reason
+		return
+	}
+	reason = rerr.StandardError{ErrorCode: errorCode, ErrorMsg: errorMsg}.Error()
+	if index < len(r.Path) {
+		reason = fmt.Sprintf("%s at %s", reason, utils.APex2(r.Path[index]))
+	}
+	if index+2 <= len(r.Path) {
+		routeFailed.Path = r.Path[:index+2]
+	}
+	routeFailed.Reason = reason
+	return
+}
+
 /*
 Send a balance proof to the next hop with the current mediated transfer
     lock removed and the balance updated.
@@ -414,6 +482,8 @@ func StateTransition(originalState transfer.State, st transfer.StateChange) *tra
 				Secret:                         staii.Secret,
 				Db:                             staii.Db,
 				CancelByExceptionSecretRequest: false,
+				MaxFee:                         staii.MaxFee,
+				MaxHops:                        staii.MaxHops,
 			}
 			return tryNewRoute(state)
 		}
@@ -11,6 +11,7 @@ import (
 	"os"
 
 	"github.com/SmartMeshFoundation/Photon/channel/channeltype"
+	"github.com/SmartMeshFoundation/Photon/encoding"
 	"github.com/SmartMeshFoundation/Photon/log"
 	"github.com/SmartMeshFoundation/Photon/transfer"
 	"github.com/SmartMeshFoundation/Photon/transfer/mediatedtransfer"
@@ -282,22 +283,22 @@ func TestNextRouteAmount(t *testing.T) {
 	}
 	fromRoute := utest.MakeRoute(utest.HOP6, amount, 0, revealTimeout, 0, utils.NewRandomHash())
 	routesState := route.NewRoutesState(routes)
-	route1, _ := nextRoute(fromRoute, routesState, timeoutBlocks, amount, utils.BigInt0)
+	route1, _ := nextRoute(fromRoute, routesState, timeoutBlocks, fixedPayeeAmount(amount), utils.BigInt0)
 	assert(t, route1, routes[0])
 	assert(t, routesState.AvailableRoutes, routes[1:])
 	assert(t, len(routesState.IgnoredRoutes), 0)
 
-	route2, _ := nextRoute(fromRoute, routesState, timeoutBlocks, amount, utils.BigInt0)
+	route2, _ := nextRoute(fromRoute, routesState, timeoutBlocks, fixedPayeeAmount(amount), utils.BigInt0)
 	assert(t, route2, routes[1])
 	assert(t, routesState.AvailableRoutes, routes[2:])
 	assert(t, len(routesState.IgnoredRoutes), 0)
 
-	route3, _ := nextRoute(fromRoute, routesState, timeoutBlocks, amount, utils.BigInt0)
+	route3, _ := nextRoute(fromRoute, routesState, timeoutBlocks, fixedPayeeAmount(amount), utils.BigInt0)
 	assert(t, route3, routes[3])
 	assert(t, len(routesState.AvailableRoutes), 0)
 	assert(t, routesState.IgnoredRoutes, []*route.State{routes[2]})
 
-	route4, _ := nextRoute(fromRoute, routesState, timeoutBlocks, amount, utils.BigInt0)
+	route4, _ := nextRoute(fromRoute, routesState, timeoutBlocks, fixedPayeeAmount(amount), utils.BigInt0)
 	assert(t, route4 == nil, true)
 
 }
@@ -316,11 +317,11 @@ func TestNextRouteRevealTimeout(t *testing.T) {
 	}
 	fromRoute := utest.MakeRoute(utest.HOP6, amount, 0, 10, 0, utils.NewRandomHash())
 	routesState := route.NewRoutesState(routes)
-	route1, _ := nextRoute(fromRoute, routesState, timeoutBlocks, amount, utils.BigInt0)
+	route1, _ := nextRoute(fromRoute, routesState, timeoutBlocks, fixedPayeeAmount(amount), utils.BigInt0)
 	assert(t, route1, routes[2])
 	assert(t, routesState.AvailableRoutes, routes[3:])
 	assert(t, routesState.IgnoredRoutes, routes[0:2])
-	route2, _ := nextRoute(fromRoute, routesState, timeoutBlocks, amount, utils.BigInt0)
+	route2, _ := nextRoute(fromRoute, routesState, timeoutBlocks, fixedPayeeAmount(amount), utils.BigInt0)
 	assert(t, route2 == nil, true)
 	assert(t, len(routesState.AvailableRoutes), 0)
 	assert(t, routesState.IgnoredRoutes, append(routes[0:2], routes[3]))
@@ -359,6 +360,37 @@ func TestNextTransferPair(t *testing.T) {
 	assert(t, len(routesState.AvailableRoutes), 0)
 }
 
+//a mediator which subsidises the transfer sends more than it received, the balance must cover what it sends
+func TestNextTransferPairSubsidy(t *testing.T) {
+	timeoutBlocks := 47
+	var blockNumber int64 = 3
+	amount := big.NewInt(10)
+	payerRoute := utest.MakeRoute(utest.HOP1, amount, 0, 0, 0, utils.NewRandomHash())
+	payerTransfer := utest.MakeTransfer(amount, utest.HOP1, utest.ADDR, 50, utils.EmptyHash, utils.EmptyHash, utest.UnitTokenAddress)
+	makeSubsidyRoute := func(hop common.Address, balance int64) *route.State {
+		r := utest.MakeRoute(hop, big.NewInt(balance), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash())
+		r.Fee = big.NewInt(-2)
+		return r
+	}
+	//enough for what it received, but not for what it sends
+	notEnough := makeSubsidyRoute(utest.HOP2, 11)
+	enough := makeSubsidyRoute(utest.HOP3, 12)
+	routesState := route.NewRoutesState([]*route.State{notEnough, enough})
+	pair, _, _ := nextTransferPair(payerRoute, payerTransfer, routesState, timeoutBlocks, blockNumber)
+	assert(t, pair.PayeeRoute, enough)
+	assert(t, pair.PayeeTransfer.Amount, big.NewInt(12))
+	assert(t, routesState.IgnoredRoutes, []*route.State{notEnough})
+
+	//nodes before me subsidised the transfer, the target gets more than I received
+	payerTransfer.TargetAmount = big.NewInt(12)
+	routesState = route.NewRoutesState([]*route.State{
+		utest.MakeRoute(utest.ADDR, big.NewInt(11), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash()),
+	})
+	pair, _, err := nextTransferPair(payerRoute, payerTransfer, routesState, timeoutBlocks, blockNumber)
+	assert(t, pair == nil, true)
+	assert(t, err != nil, true)
+}
+
 func TestSetPayee(t *testing.T) {
 	pairs := makeTransfersPair(utest.HOP1, []common.Address{utest.HOP2, utest.HOP3, utest.HOP4}, utest.HOP6, 10, utest.UnitSecret, 0, utest.UnitRevealTimeout)
 	assert(t, pairs[0].PayerState, mediatedtransfer.StatePayerPending)
@@ -785,3 +817,112 @@ func TestNoValidRoutes(t *testing.T) {
 	_, ok := events[0].(*mediatedtransfer.EventSendAnnounceDisposed)
 	assert(t, ok, true)
 }
+
+//a transfer from a channel paused by the operator is refunded even if there is a valid route
+func TestRejectedMediator(t *testing.T) {
+	fromRoute, FromTransfer := utest.MakeFrom(utest.UnitTransferAmount, utest.HOP2, int64(utest.Hop1Timeout), utils.NewRandomAddress(), utils.EmptyHash)
+	var routes = []*route.State{utest.MakeRoute(utest.HOP2, utest.UnitTransferAmount, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash())}
+	initStateChange := makeInitStateChange(FromTransfer, fromRoute, routes, utest.ADDR)
+	reason := rerr.ErrInboundMediationPaused
+	initStateChange.RejectReason = &reason
+	sm := transfer.NewStateManager(StateTransition, nil, "mediator", utils.ShaSecret([]byte("3")), utils.NewRandomAddress())
+	events := sm.Dispatch(initStateChange)
+	for _, e := range events {
+		_, ok := e.(*mediatedtransfer.EventSendMediatedTransfer)
+		assert(t, ok, false)
+	}
+	ev, ok := events[0].(*mediatedtransfer.EventSendAnnounceDisposed)
+	assert(t, ok, true)
+	assert(t, ev.Reason, rerr.ErrInboundMediationPaused)
+	assert(t, ev.Receiver, fromRoute.HopNode())
+	assert(t, ev.LockSecretHash, FromTransfer.LockSecretHash)
+}
+
+//a trampoline must leave enough fee for the nodes after it, otherwise the payer learns why from AnnounceDisposed
+func TestTrampolineFeeBudget(t *testing.T) {
+	fromRoute, fromTransfer := utest.MakeFrom(utest.UnitTransferAmount, utest.HOP6, int64(utest.Hop1Timeout), utils.NewRandomAddress(), utils.EmptyHash)
+	fromTransfer.Fee = big.NewInt(10)
+	fromTransfer.TargetAmount = new(big.Int).Sub(fromTransfer.Amount, fromTransfer.Fee)
+	makeTrampolineRoute := func(hop common.Address, fee, downstreamFee int64) *route.State {
+		r := utest.MakeRoute(hop, utest.UnitTransferAmount, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash())
+		r.Path = []common.Address{hop, utest.HOP6}
+		r.Fee = big.NewInt(fee)
+		r.DownstreamFee = big.NewInt(downstreamFee)
+		return r
+	}
+	//3+8 is more than 10
+	overBudget := makeTrampolineRoute(utest.HOP2, 3, 8)
+	withinBudget := makeTrampolineRoute(utest.HOP3, 3, 7)
+	routesState := route.NewRoutesState([]*route.State{overBudget, withinBudget})
+	r, _ := nextRoute(fromRoute, routesState, utest.UnitSettleTimeout, mediatorPayeeAmount(fromTransfer), fromTransfer.Fee)
+	assert(t, r, withinBudget)
+	assert(t, routesState.IgnoredRoutes, []*route.State{overBudget})
+
+	sm := transfer.NewStateManager(StateTransition, nil, "mediator", utils.ShaSecret([]byte("3")), utils.NewRandomAddress())
+	events := sm.Dispatch(makeInitStateChange(fromTransfer, fromRoute, []*route.State{makeTrampolineRoute(utest.HOP3, 3, 7)}, utest.ADDR))
+	assert(t, len(events), 1)
+	mtr, ok := events[0].(*mediatedtransfer.EventSendMediatedTransfer)
+	assert(t, ok, true)
+	//the rest of the budget goes to the nodes after me
+	assert(t, mtr.Fee, big.NewInt(7))
+	assert(t, mtr.Amount, new(big.Int).Sub(fromTransfer.Amount, big.NewInt(3)))
+
+	sm = transfer.NewStateManager(StateTransition, nil, "mediator", utils.ShaSecret([]byte("3")), utils.NewRandomAddress())
+	events = sm.Dispatch(makeInitStateChange(fromTransfer, fromRoute, []*route.State{makeTrampolineRoute(utest.HOP2, 3, 8)}, utest.ADDR))
+	var disposed *mediatedtransfer.EventSendAnnounceDisposed
+	for _, e := range events {
+		if d, ok := e.(*mediatedtransfer.EventSendAnnounceDisposed); ok {
+			disposed = d
+		}
+	}
+	if assert(t, disposed != nil, true) {
+		assert(t, disposed.Receiver, fromRoute.HopNode())
+		assert(t, disposed.Reason.ErrorCode, rerr.ErrNoAvailabeRoute.ErrorCode)
+		assert2.Contains(t, disposed.Reason.Error(), "no enough fee")
+	}
+}
+
+//an onion routed transfer is forwarded as the per-hop payload says, and the failure reason is encrypted to the initiator
+func TestOnionMediator(t *testing.T) {
+	fromRoute, fromTransfer := utest.MakeFrom(utest.UnitTransferAmount, utest.HOP6, int64(utest.Hop1Timeout), utils.EmptyAddress, utils.EmptyHash)
+	fromTransfer.Target = utils.EmptyAddress
+	hop := &encoding.OnionHop{
+		NextHop:    utest.HOP2,
+		Amount:     new(big.Int).Set(utest.UnitTransferAmount),
+		Expiration: int64(utest.Hop1Timeout) + 1000,
+		ErrorKey:   utils.NewRandomHash(),
+	}
+	onion := []byte("next onion")
+	makeOnionInit := func(routes []*route.State) *mediatedtransfer.ActionInitMediatorStateChange {
+		init := makeInitStateChange(fromTransfer, fromRoute, routes, utest.ADDR)
+		init.OnionHop = hop
+		init.Onion = onion
+		return init
+	}
+	r := utest.MakeRoute(utest.HOP2, utest.UnitTransferAmount, utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash())
+	sm := transfer.NewStateManager(StateTransition, nil, "mediator", utils.ShaSecret([]byte("3")), utils.NewRandomAddress())
+	events := sm.Dispatch(makeOnionInit([]*route.State{r}))
+	assert(t, len(events), 1)
+	mtr, ok := events[0].(*mediatedtransfer.EventSendMediatedTransfer)
+	if assert(t, ok, true) {
+		assert(t, mtr.Receiver, utest.HOP2)
+		assert(t, mtr.Onion, onion)
+		assert(t, mtr.Amount, hop.Amount)
+		//the lock can't expire later than the payer's lock allows
+		assert(t, mtr.Expiration, fromTransfer.Expiration-int64(fromRoute.RevealTimeout()))
+	}
+
+	r = utest.MakeRoute(utest.HOP2, big.NewInt(1), utest.UnitSettleTimeout, utest.UnitRevealTimeout, 0, utils.NewRandomHash())
+	sm = transfer.NewStateManager(StateTransition, nil, "mediator", utils.ShaSecret([]byte("3")), utils.NewRandomAddress())
+	events = sm.Dispatch(makeOnionInit([]*route.State{r}))
+	var disposed *mediatedtransfer.EventSendAnnounceDisposed
+	for _, e := range events {
+		if d, ok := e.(*mediatedtransfer.EventSendAnnounceDisposed); ok {
+			disposed = d
+		}
+	}
+	if assert(t, disposed != nil, true) {
+		assert(t, disposed.Receiver, fromRoute.HopNode())
+		assert(t, disposed.ErrorKey, hop.ErrorKey)
+	}
+}
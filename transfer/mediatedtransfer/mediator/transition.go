@@ -251,7 +251,7 @@ Finds the first route available that may be used.
             worst.
         timeoutBlocks : Base number of available blocks used to compute
             the lock timeout.
-        transferAmount : The amount of tokens that will be transferred
+        payeeAmount : The amount of tokens that will be transferred
             through the given route.
     Returns:
          The next route.
@@ -263,7 +263,7 @@ Finds the first route available that may be used.
 3.时间还足够安全
 */
 
-func nextRoute(fromRoute *route.State, rss *route.RoutesState, timeoutBlocks int, transferAmount, fee *big.Int) (routeCanUse *route.State, err error) {
+func nextRoute(fromRoute *route.State, rss *route.RoutesState, timeoutBlocks int, payeeAmount func(r *route.State) *big.Int, fee *big.Int) (routeCanUse *route.State, err error) {
 	for len(rss.AvailableRoutes) > 0 {
 		route := rss.AvailableRoutes[0]
 		ch := route.Channel()
@@ -278,8 +278,8 @@ func nextRoute(fromRoute *route.State, rss *route.RoutesState, timeoutBlocks int
 			rss.IgnoredRoutes = append(rss.IgnoredRoutes, route)
 			continue
 		}
-		// 通道余额校验
-		if route.AvailableBalance().Cmp(transferAmount) < 0 {
+		// 通道余额校验,手续费是负的时候转出的比收到的多
+		if route.AvailableBalance().Cmp(payeeAmount(route)) < 0 {
 			err = rerr.ErrNoAvailabeRoute.Errorf("channel with %s-%s can not transfer because balance not enough",
 				utils.APex(ch.OurState.Address),
 				utils.APex(ch.PartnerState.Address))
@@ -294,12 +294,16 @@ func nextRoute(fromRoute *route.State, rss *route.RoutesState, timeoutBlocks int
 			rss.IgnoredRoutes = append(rss.IgnoredRoutes, route)
 			continue
 		}
-		// 手续费校验
-		if fee.Cmp(route.Fee) < 0 {
+		// 手续费校验,trampoline还要保证后续节点的手续费足够
+		needFee := route.Fee
+		if route.DownstreamFee != nil {
+			needFee = new(big.Int).Add(route.Fee, route.DownstreamFee)
+		}
+		if fee.Cmp(needFee) < 0 {
 			err = rerr.ErrNoAvailabeRoute.Errorf("channel with %s-%s can not transfer because no enough fee: need %d ,left fee %d",
 				utils.APex(ch.OurState.Address),
 				utils.APex(ch.PartnerState.Address),
-				route.Fee.Int64(),
+				needFee.Int64(),
 				fee.Int64())
 			rss.IgnoredRoutes = append(rss.IgnoredRoutes, route)
 			continue
@@ -329,6 +333,26 @@ func nextRoute(fromRoute *route.State, rss *route.RoutesState, timeoutBlocks int
 	return
 }
 
+//fixedPayeeAmount 不管走哪个route,转出的金额都一样
+func fixedPayeeAmount(amount *big.Int) func(r *route.State) *big.Int {
+	return func(r *route.State) *big.Int {
+		return amount
+	}
+}
+
+/*
+mediatorPayeeAmount 通过r转出的金额,收到的金额扣掉我的手续费,下一跳是target时正好是target应收的金额.
+手续费可以是负的(补贴),这时转出的比收到的多.
+*/
+func mediatorPayeeAmount(payerTransfer *mediatedtransfer.LockedTransferState) func(r *route.State) *big.Int {
+	return func(r *route.State) *big.Int {
+		if r.HopNode() == payerTransfer.Target {
+			return payerTransfer.TargetAmount
+		}
+		return new(big.Int).Sub(payerTransfer.Amount, r.Fee)
+	}
+}
+
 /*
 Given a payer transfer tries a new route to proceed with the mediation.
 
@@ -352,7 +376,8 @@ func nextTransferPair(payerRoute *route.State, payerTransfer *mediatedtransfer.L
 	if int64(timeoutBlocks) > payerTransfer.Expiration-blockNumber {
 		panic("timeoutBlocks >payerTransfer.Expiration-blockNumber")
 	}
-	payeeRoute, err := nextRoute(payerRoute, routesState, timeoutBlocks, payerTransfer.Amount, payerTransfer.Fee)
+	payeeAmount := mediatorPayeeAmount(payerTransfer)
+	payeeRoute, err := nextRoute(payerRoute, routesState, timeoutBlocks, payeeAmount, payerTransfer.Fee)
 	if payeeRoute == nil {
 		return
 	}
@@ -370,7 +395,7 @@ func nextTransferPair(payerRoute *route.State, payerTransfer *mediatedtransfer.L
 	lockExpiration := int64(lockTimeout) + blockNumber
 	payeeTransfer := &mediatedtransfer.LockedTransferState{
 		TargetAmount:   payerTransfer.TargetAmount,
-		Amount:         big.NewInt(0).Sub(payerTransfer.Amount, payeeRoute.Fee),
+		Amount:         payeeAmount(payeeRoute),
 		Token:          payerTransfer.Token,
 		Initiator:      payerTransfer.Initiator,
 		Target:         payerTransfer.Target,
@@ -382,7 +407,6 @@ func nextTransferPair(payerRoute *route.State, payerTransfer *mediatedtransfer.L
 	if payeeRoute.HopNode() == payeeTransfer.Target {
 		//i'm the last hop,so take the rest of the fee
 		payeeTransfer.Fee = utils.BigInt0
-		payeeTransfer.Amount = payerTransfer.TargetAmount
 	}
 	//todo log how many tokens fee for this transfer .
 	transferPair = mediatedtransfer.NewMediationPairState(payerRoute, payeeRoute, payerTransfer, payeeTransfer)
@@ -392,6 +416,43 @@ func nextTransferPair(payerRoute *route.State, payerTransfer *mediatedtransfer.L
 	return
 }
 
+/*
+nextOnionTransferPair onion交易只有一条到OnionHop.NextHop的路由,
+转出的金额由发起方指定,差额就是我的手续费,
+过期时间也由发起方指定,但是不能晚于我需要的安全时间和下家通道的settle timeout.
+*/
+func nextOnionTransferPair(state *mediatedtransfer.MediatorState, payerRoute *route.State, payerTransfer *mediatedtransfer.LockedTransferState) (
+	transferPair *mediatedtransfer.MediationPairState, events []transfer.Event, err error) {
+	hop := state.OnionHop
+	lockExpiration := hop.Expiration
+	if maxExpiration := payerTransfer.Expiration - int64(payerRoute.RevealTimeout()); lockExpiration > maxExpiration {
+		lockExpiration = maxExpiration
+	}
+	fee := new(big.Int).Sub(payerTransfer.Amount, hop.Amount)
+	payeeRoute, err := nextRoute(payerRoute, state.Routes, int(lockExpiration-state.BlockNumber), fixedPayeeAmount(hop.Amount), fee)
+	if payeeRoute == nil {
+		return
+	}
+	if maxExpiration := state.BlockNumber + int64(payeeRoute.SettleTimeout()); lockExpiration > maxExpiration {
+		lockExpiration = maxExpiration
+	}
+	payeeTransfer := &mediatedtransfer.LockedTransferState{
+		TargetAmount:   new(big.Int).Set(hop.Amount),
+		Amount:         new(big.Int).Set(hop.Amount),
+		Token:          payerTransfer.Token,
+		Expiration:     lockExpiration,
+		LockSecretHash: payerTransfer.LockSecretHash,
+		Secret:         payerTransfer.Secret,
+		Fee:            big.NewInt(0),
+	}
+	transferPair = mediatedtransfer.NewMediationPairState(payerRoute, payeeRoute, payerTransfer, payeeTransfer)
+	eventSendMediatedTransfer := mediatedtransfer.NewEventSendMediatedTransfer(payeeTransfer, payeeRoute.HopNode(), nil)
+	eventSendMediatedTransfer.FromChannel = payerRoute.ChannelIdentifier
+	eventSendMediatedTransfer.Onion = state.Onion
+	events = []transfer.Event{eventSendMediatedTransfer}
+	return
+}
+
 /*
 Set the state of a transfer *sent* to a payee and check the secret is
     being revealed backwards.
@@ -537,6 +598,20 @@ func eventsForRefund(refundRoute *route.State, refundTransfer *mediatedtransfer.
 	return
 }
 
+//withOnionError onion交易的失败原因要加密给发起方,如果是下游失败的,把下游加密的原因包起来
+func withOnionError(state *mediatedtransfer.MediatorState, events []transfer.Event) []transfer.Event {
+	if state.OnionHop == nil {
+		return events
+	}
+	for _, e := range events {
+		if ev, ok := e.(*mediatedtransfer.EventSendAnnounceDisposed); ok {
+			ev.ErrorKey = state.OnionHop.ErrorKey
+			ev.DownstreamOnionError = state.DownstreamOnionError
+		}
+	}
+	return events
+}
+
 /*
 Reveal the secret backwards.
 
@@ -748,7 +823,9 @@ func mediateTransfer(state *mediatedtransfer.MediatorState, payerRoute *route.St
 	//	state.BlockNumber,
 	//))
 	var err error
-	if timeoutBlocks > 0 {
+	if state.OnionHop != nil {
+		transferPair, events, err = nextOnionTransferPair(state, payerRoute, payerTransfer)
+	} else if timeoutBlocks > 0 {
 		transferPair, events, err = nextTransferPair(payerRoute, payerTransfer, state.Routes, timeoutBlocks, state.BlockNumber)
 	}
 	if transferPair == nil {
@@ -767,7 +844,7 @@ func mediateTransfer(state *mediatedtransfer.MediatorState, payerRoute *route.St
 		 */
 		originalTransfer := payerTransfer
 		originalRoute := payerRoute
-		refundEvents := eventsForRefund(originalRoute, originalTransfer, err.(rerr.StandardError))
+		refundEvents := withOnionError(state, eventsForRefund(originalRoute, originalTransfer, err.(rerr.StandardError)))
 		return &transfer.TransitionResult{
 			NewState: state,
 			Events:   refundEvents,
@@ -792,7 +869,7 @@ func mediateTransfer(state *mediatedtransfer.MediatorState, payerRoute *route.St
 		log.Warn(fmt.Sprintf("holding too much lock of %s, reject new mediated transfer from him", utils.APex2(payerChannel.PartnerState.Address)))
 		return &transfer.TransitionResult{
 			NewState: state,
-			Events:   eventsForRefund(payerRoute, payerTransfer, rerr.ErrRejectTransferBecauseChannelHoldingTooMuchLock),
+			Events:   withOnionError(state, eventsForRefund(payerRoute, payerTransfer, rerr.ErrRejectTransferBecauseChannelHoldingTooMuchLock)),
 		}
 	}
 	/*
@@ -841,7 +918,7 @@ func cancelCurrentRoute(state *mediatedtransfer.MediatorState, refundChannelIden
 	*/
 	if transferPair.PayerRoute.ClosedBlock() != 0 {
 		log.Warn("channel already closed, stop trying new route")
-		it.Events = eventsForRefund(transferPair.PayerRoute, transferPair.PayerTransfer, rerr.ErrRejectTransferBecausePayerChannelClosed)
+		it.Events = withOnionError(state, eventsForRefund(transferPair.PayerRoute, transferPair.PayerTransfer, rerr.ErrRejectTransferBecausePayerChannelClosed))
 		return it
 	}
 	it = mediateTransfer(state, transferPair.PayerRoute, transferPair.PayerTransfer)
@@ -853,9 +930,21 @@ func cancelCurrentRoute(state *mediatedtransfer.MediatorState, refundChannelIden
 */
 // receive another mediatedTransfer
 func handleMediatedTransferAgain(state *mediatedtransfer.MediatorState, st *mediatedtransfer.MediatorReReceiveStateChange) *transfer.TransitionResult {
+	if st.RejectReason != nil {
+		return rejectTransfer(state, st.FromRoute, st.FromTransfer, *st.RejectReason)
+	}
 	return mediateTransfer(state, st.FromRoute, st.FromTransfer)
 }
 
+//rejectTransfer 操作员暂停了通道,不尝试任何路由,直接退回给上家
+func rejectTransfer(state *mediatedtransfer.MediatorState, payerRoute *route.State, payerTransfer *mediatedtransfer.LockedTransferState, reason rerr.StandardError) *transfer.TransitionResult {
+	log.Warn(fmt.Sprintf("reject mediated transfer %s,%s", utils.HPex(payerTransfer.LockSecretHash), reason.ErrorMsg))
+	return &transfer.TransitionResult{
+		NewState: state,
+		Events:   withOnionError(state, eventsForRefund(payerRoute, payerTransfer, reason)),
+	}
+}
+
 /*
 After Photon learns about a new block this function must be called to
     handle expiration of the hash time locks.
@@ -957,6 +1046,10 @@ func handleAnnouceDisposed(state *mediatedtransfer.MediatorState, st *mediatedtr
 			 *	which means we receive refund of F, then we should assume that payeeTransfer invalid,
 			 *  which acts like receiving transfer of E, then begin to find a route again.
 			 */
+			if state.OnionHop != nil {
+				//onion交易没有其他路由,下游的失败原因要转给上家
+				state.DownstreamOnionError = st.Message.ErrorOnion
+			}
 			it = cancelCurrentRoute(state, st.Message.ChannelIdentifier)
 			ev := &mediatedtransfer.EventSendAnnounceDisposedResponse{
 				Token:          state.Token,
@@ -1139,8 +1232,14 @@ func StateTransition(originalState transfer.State, stateChange transfer.StateCha
 				Db:             aim.Db,
 				Token:          aim.FromTranfer.Token,
 				LockSecretHash: aim.FromTranfer.LockSecretHash,
+				OnionHop:       aim.OnionHop,
+				Onion:          aim.Onion,
+			}
+			if aim.RejectReason != nil {
+				it = rejectTransfer(state, aim.FromRoute, aim.FromTranfer, *aim.RejectReason)
+			} else {
+				it = mediateTransfer(state, aim.FromRoute, aim.FromTranfer)
 			}
-			it = mediateTransfer(state, aim.FromRoute, aim.FromTranfer)
 		}
 	} else {
 		switch st2 := stateChange.(type) {
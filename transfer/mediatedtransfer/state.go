@@ -88,7 +88,9 @@ type InitiatorState struct {
 	RevealSecret                   *EventSendRevealSecret
 	CanceledTransfers              []*EventSendMediatedTransfer
 	Db                             channeltype.Db
-	CancelByExceptionSecretRequest bool // set true when receive exception SecretRequest
+	CancelByExceptionSecretRequest bool     // set true when receive exception SecretRequest
+	MaxFee                         *big.Int // 发起方最多愿意支付的手续费,nil表示不限制
+	MaxHops                        int      // 路由最多的跳数,0表示不限制
 }
 
 /*
@@ -108,6 +110,10 @@ type MediatorState struct {
 	LockSecretHash common.Hash
 	Token          common.Address
 	Db             channeltype.Db
+	OnionHop       *encoding.OnionHop //onion交易中给我的指令,nil表示不是onion交易
+	Onion          []byte             //转给下一跳的onion
+	//下一跳返回的加密的失败原因
+	DownstreamOnionError []byte
 }
 
 /*
@@ -8,6 +8,7 @@ import (
 	"github.com/SmartMeshFoundation/Photon/channel/channeltype"
 	"github.com/SmartMeshFoundation/Photon/encoding"
 	"github.com/SmartMeshFoundation/Photon/network/rpc/contracts"
+	"github.com/SmartMeshFoundation/Photon/rerr"
 	"github.com/SmartMeshFoundation/Photon/transfer"
 	"github.com/SmartMeshFoundation/Photon/transfer/mtree"
 	"github.com/SmartMeshFoundation/Photon/transfer/route"
@@ -38,17 +39,22 @@ type ActionInitInitiatorStateChange struct {
 	Db             channeltype.Db       //get the latest channel state
 	LockSecretHash common.Hash
 	Secret         common.Hash
+	MaxFee         *big.Int //nil no limit
+	MaxHops        int      //0 no limit
 }
 
 //ActionInitMediatorStateChange  Initial state for a new mediator.
 type ActionInitMediatorStateChange struct {
-	OurAddress  common.Address             //This node address.
-	FromTranfer *LockedTransferState       //The received MediatedTransfer.
-	Routes      *route.RoutesState         //The current available routes.
-	FromRoute   *route.State               //The route from which the MediatedTransfer was received.
-	BlockNumber int64                      //The current block number.
-	Message     *encoding.MediatedTransfer //the message trigger this statechange
-	Db          channeltype.Db             //get the latest channel state
+	OurAddress   common.Address             //This node address.
+	FromTranfer  *LockedTransferState       //The received MediatedTransfer.
+	Routes       *route.RoutesState         //The current available routes.
+	FromRoute    *route.State               //The route from which the MediatedTransfer was received.
+	BlockNumber  int64                      //The current block number.
+	Message      *encoding.MediatedTransfer //the message trigger this statechange
+	Db           channeltype.Db             //get the latest channel state
+	OnionHop     *encoding.OnionHop         //decoded instruction of an onion routed transfer, Routes has only the route to its NextHop
+	Onion        []byte                     //onion to forward
+	RejectReason *rerr.StandardError        //not nil if the operator paused the channels, refund with this reason
 }
 
 //MediatorReReceiveStateChange 中间节点再次收到 MediatedTransfer
@@ -57,6 +63,7 @@ type MediatorReReceiveStateChange struct {
 	FromRoute    *route.State
 	FromTransfer *LockedTransferState
 	BlockNumber  int64
+	RejectReason *rerr.StandardError //不为nil时直接拒绝
 }
 
 //ActionInitTargetStateChange Initial state for a new target.
@@ -67,6 +74,9 @@ type ActionInitTargetStateChange struct {
 	BlockNumber int64
 	Message     *encoding.MediatedTransfer //the message trigger this statechange
 	Db          channeltype.Db             //get the latest channel state
+	//不为nil时不接收这笔交易,通过AnnounceDisposed退回给上家
+	RejectReason *rerr.StandardError
+	ErrorKey     common.Hash //onion交易用它把RejectReason加密给发起方
 }
 
 /*
@@ -9,6 +9,7 @@ import (
 
 	"github.com/SmartMeshFoundation/Photon/encoding"
 	"github.com/SmartMeshFoundation/Photon/log"
+	"github.com/SmartMeshFoundation/Photon/rerr"
 	"github.com/SmartMeshFoundation/Photon/transfer"
 	"github.com/SmartMeshFoundation/Photon/transfer/mediatedtransfer"
 	"github.com/SmartMeshFoundation/Photon/utils"
@@ -125,6 +126,23 @@ func TestHandleInitTarget(t *testing.T) {
 	assert(t, ev.Receiver, initiator)
 }
 
+//the operator paused receiving on the channel, refund instead of requesting the secret
+func TestHandleInitTargetRejected(t *testing.T) {
+	var blockNumber int64 = 1
+	var expire = int64(utest.UnitRevealTimeout) + blockNumber + 1
+	st := makeInitStateChange(utest.ADDR, 1, blockNumber, utest.HOP1, expire)
+	reason := rerr.ErrReceivePaused
+	st.RejectReason = &reason
+	st.ErrorKey = utils.NewRandomHash()
+	it := handleInitTraget(st)
+	assert(t, len(it.Events), 1)
+	ev := it.Events[0].(*mediatedtransfer.EventSendAnnounceDisposed)
+	assert(t, ev.Reason, rerr.ErrReceivePaused)
+	assert(t, ev.Receiver, st.FromRoute.HopNode())
+	assert(t, ev.LockSecretHash, st.FromTranfer.LockSecretHash)
+	assert(t, ev.ErrorKey, st.ErrorKey)
+}
+
 // Init transfer must do nothing if the expiration is bad.
 func TestHandleInitTargetBadExpiration(t *testing.T) {
 	var blockNumber int64 = 1
@@ -2,6 +2,7 @@ package target
 
 import (
 	"fmt"
+	"math/big"
 
 	"github.com/SmartMeshFoundation/Photon/channel/channeltype"
 
@@ -53,6 +54,23 @@ func handleInitTraget(st *mediatedtransfer.ActionInitTargetStateChange) *transfe
 		BlockNumber:  blockNumber,
 		Db:           st.Db,
 	}
+	if st.RejectReason != nil {
+		//操作员暂停了收款,原封不动声明放弃此锁,锁过期以后移除
+		log.Warn(fmt.Sprintf("reject mediated transfer %s,%s", utils.HPex(tr.LockSecretHash), st.RejectReason.ErrorMsg))
+		disposed := &mediatedtransfer.EventSendAnnounceDisposed{
+			Token:          tr.Token,
+			Amount:         new(big.Int).Set(tr.Amount),
+			LockSecretHash: tr.LockSecretHash,
+			Expiration:     tr.Expiration,
+			Receiver:       route.HopNode(),
+			Reason:         *st.RejectReason,
+			ErrorKey:       st.ErrorKey,
+		}
+		return &transfer.TransitionResult{
+			NewState: state,
+			Events:   []transfer.Event{disposed},
+		}
+	}
 	safeToWait := mediator.IsSafeToWait(tr, route.RevealTimeout(), blockNumber)
 	/*
 			  if there is not enough time to safely withdraw the token on-chain
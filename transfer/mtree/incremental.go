@@ -0,0 +1,199 @@
+package mtree
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/*
+The tree is kept as linked nodes instead of layers, so a new tree shares all unchanged nodes with the old one.
+Its shape is the same as the layers: a tree of n leaves has the first splitSize(n) leaves on the left,
+the rest on the right, the last node of an odd layer is promoted unchanged.
+So the root and proofs are exactly what the layers produce, and what other nodes and the contract expect.
+
+Adding a lock only hashes nodes on the right edge, O(log n).
+Removing a lock shifts all locks after it, so nodes covering them have to be hashed again,
+removing the newest lock is O(log n), the oldest one about 2n.
+Leaves are kept in a leafStore shared by trees made by adding locks one after another,
+so neither adding a lock nor finding one has to go through all leaves.
+*/
+
+//node of the tree, never changed once created, so it can be shared by trees
+type node struct {
+	hash  common.Hash
+	left  *node //nil if it's a leaf
+	right *node
+	size  int //number of leaves
+}
+
+func newLeafNode(hash common.Hash) *node {
+	return &node{hash: hash, size: 1}
+}
+
+func newInnerNode(left, right *node) *node {
+	return &node{
+		hash:  HashPair(left.hash, right.hash),
+		left:  left,
+		right: right,
+		size:  left.size + right.size,
+	}
+}
+
+//splitSize returns number of leaves on the left of a tree with n>1 leaves, the largest power of 2 less than n
+func splitSize(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+//appendLeaf returns a new tree with `leaf` added after all leaves of `root`
+func appendLeaf(root, leaf *node) *node {
+	if root == nil {
+		return leaf
+	}
+	if root.size&(root.size-1) == 0 {
+		//a perfect tree becomes the left of the new one
+		return newInnerNode(root, leaf)
+	}
+	return newInnerNode(root.left, appendLeaf(root.right, leaf))
+}
+
+/*
+buildTree makes a tree of `leaves`.
+The first `same` leaves are at the same place in `old`, subtrees of `old` containing only them are reused.
+*/
+func buildTree(leaves []*node, old *node, same int) *node {
+	n := len(leaves)
+	if n == 0 {
+		return nil
+	}
+	//the old subtree of n leaves starting at the same leaf
+	start := old
+	for start != nil && start.size > n {
+		start = start.left
+	}
+	if start != nil && start.size == n && n <= same {
+		return start
+	}
+	if n == 1 {
+		return leaves[0]
+	}
+	k := splitSize(n)
+	left := buildTree(leaves[:k], old, same)
+	return newInnerNode(left, buildTree(leaves[k:], subtreeAt(old, k), same-k))
+}
+
+//subtreeAt returns the largest subtree of `root` starting at leaf `offset`, nil if there is none
+func subtreeAt(root *node, offset int) *node {
+	for nd := root; nd != nil && nd.left != nil; {
+		if offset == nd.left.size {
+			return nd.right
+		}
+		if offset < nd.left.size {
+			nd = nd.left
+		} else {
+			offset -= nd.left.size
+			nd = nd.right
+		}
+	}
+	return nil
+}
+
+//makeProof returns siblings from leaf `idx` up to the root
+func makeProof(root *node, idx int) (proof []common.Hash) {
+	var path []common.Hash
+	for nd := root; nd != nil && nd.left != nil; {
+		if idx < nd.left.size {
+			path = append(path, nd.right.hash)
+			nd = nd.left
+		} else {
+			path = append(path, nd.left.hash)
+			idx -= nd.left.size
+			nd = nd.right
+		}
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		proof = append(proof, path[i])
+	}
+	return
+}
+
+/*
+leafStore holds leaves of trees made by adding locks one after another,
+each of these trees uses the first n of them.
+*/
+type leafStore struct {
+	lock  sync.Mutex
+	locks []*Lock
+	nodes []*node
+	index map[common.Hash]int //position of each leaf
+}
+
+//newLeafStore takes `locks` and `nodes`, panics if there are duplicated leaves
+func newLeafStore(locks []*Lock, nodes []*node) *leafStore {
+	s := &leafStore{
+		locks: locks,
+		nodes: nodes,
+		index: make(map[common.Hash]int, len(nodes)),
+	}
+	for i, nd := range nodes {
+		if _, ok := s.index[nd.hash]; ok {
+			panic(fmt.Sprintf("elements %s duplicated", nd.hash.String()))
+		}
+		s.index[nd.hash] = i
+	}
+	return s
+}
+
+//find returns position of leaf `hash` among the first n leaves, -1 if not found
+func (s *leafStore) find(hash common.Hash, n int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	i, ok := s.index[hash]
+	if !ok || i >= n {
+		return -1
+	}
+	return i
+}
+
+//leafNodes returns the first n leaves
+func (s *leafStore) leafNodes(n int) []*node {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.nodes[:n:n]
+}
+
+/*
+appendLeaf adds a leaf after the first n leaves, returns the store holding them and the new locks.
+The leaf is added in place if no other tree uses leaves after n,
+or reused if the same one has been added after n before, such as a lock checked before registered.
+Otherwise the first n are copied to a new store.
+*/
+func (s *leafStore) appendLeaf(n int, l *Lock, nd *node) (store *leafStore, locks []*Lock) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if i, ok := s.index[nd.hash]; ok && i < n {
+		panic(fmt.Sprintf("elements %s duplicated", nd.hash.String()))
+	}
+	if len(s.nodes) > n && s.nodes[n].hash == nd.hash {
+		return s, s.locks[: n+1 : n+1]
+	}
+	if len(s.nodes) == n {
+		s.locks = append(s.locks, l)
+		s.nodes = append(s.nodes, nd)
+		s.index[nd.hash] = n
+		return s, s.locks[: n+1 : n+1]
+	}
+	newLocks := make([]*Lock, n+1)
+	copy(newLocks, s.locks[:n])
+	newLocks[n] = l
+	newNodes := make([]*node, n+1)
+	copy(newNodes, s.nodes[:n])
+	newNodes[n] = nd
+	store = newLeafStore(newLocks, newNodes)
+	return store, newLocks[: n+1 : n+1]
+}
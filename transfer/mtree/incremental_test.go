@@ -0,0 +1,216 @@
+package mtree
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/SmartMeshFoundation/Photon/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+//layersTree is how the tree was built before, layer by layer from scratch
+type layersTree struct {
+	layers [][]common.Hash
+}
+
+func newLayersTree(leaves []*Lock) *layersTree {
+	m := &layersTree{}
+	var prevLayer []common.Hash
+	for _, l := range leaves {
+		prevLayer = append(prevLayer, l.Hash())
+	}
+	if len(prevLayer) == 0 {
+		m.layers = append(m.layers, []common.Hash(nil))
+		return m
+	}
+	for {
+		m.layers = append(m.layers, prevLayer)
+		if len(prevLayer) == 1 {
+			break
+		}
+		curLayer := make([]common.Hash, lenDiv2(len(prevLayer)))
+		for j := 0; j < len(prevLayer); j += 2 {
+			if j == len(prevLayer)-1 {
+				curLayer[j/2] = prevLayer[j]
+			} else {
+				curLayer[j/2] = HashPair(prevLayer[j], prevLayer[j+1])
+			}
+		}
+		prevLayer = curLayer
+	}
+	return m
+}
+
+func (m *layersTree) root() common.Hash {
+	top := m.layers[len(m.layers)-1]
+	if len(top) == 0 {
+		return utils.EmptyHash
+	}
+	return top[0]
+}
+
+func (m *layersTree) makeProof(element common.Hash) []common.Hash {
+	idx := 0
+	for i := range m.layers[0] {
+		if m.layers[0][i] == element {
+			idx = i
+		}
+	}
+	var proof []common.Hash
+	for _, layer := range m.layers {
+		pairidx := idx - 1
+		if idx%2 == 0 {
+			pairidx = idx + 1
+		}
+		if pairidx < len(layer) {
+			proof = append(proof, layer[pairidx])
+		}
+		idx = idx / 2
+	}
+	return proof
+}
+
+func newRandomLock(r *rand.Rand) *Lock {
+	return &Lock{
+		Expiration:     r.Int63n(1000000),
+		Amount:         big.NewInt(r.Int63()),
+		LockSecretHash: utils.Sha3(big.NewInt(r.Int63()).Bytes()),
+	}
+}
+
+func assertSameAsLayers(t *testing.T, tree *Merkletree) {
+	ref := newLayersTree(tree.Leaves)
+	assert.Equal(t, ref.root(), tree.MerkleRoot())
+	assert.Equal(t, len(ref.layers), tree.layerCount())
+	for _, l := range tree.Leaves {
+		proof := tree.MakeProof(l.Hash())
+		assert.Equal(t, ref.makeProof(l.Hash()), proof)
+		assert.True(t, checkProof(proof, tree.MerkleRoot(), l.Hash()))
+	}
+}
+
+func TestIncrementalMerkleTreeSameAsLayers(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n <= 33; n++ {
+		var leaves []*Lock
+		for i := 0; i < n; i++ {
+			leaves = append(leaves, newRandomLock(r))
+		}
+		tree := NewMerkleTree(leaves)
+		assertSameAsLayers(t, tree)
+		//remove each lock from the full tree
+		for i := 0; i < n; i++ {
+			tree2, err := tree.ComputeMerkleRootWithout(leaves[i])
+			assert.Nil(t, err)
+			assertSameAsLayers(t, tree2)
+		}
+		//the old tree is not changed
+		assertSameAsLayers(t, tree)
+	}
+}
+
+func TestIncrementalMerkleTreeRandomOperations(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	tree := NewMerkleTree(nil)
+	var history []*Merkletree
+	for i := 0; i < 500; i++ {
+		if len(history) > 0 && r.Intn(5) == 0 {
+			//go on from an older tree, trees sharing leaves must not affect each other
+			tree = history[r.Intn(len(history))]
+		}
+		if len(tree.Leaves) > 0 && r.Intn(3) == 0 {
+			var err error
+			tree, err = tree.ComputeMerkleRootWithout(tree.Leaves[r.Intn(len(tree.Leaves))])
+			assert.Nil(t, err)
+		} else {
+			tree = tree.ComputeMerkleRootWith(newRandomLock(r))
+		}
+		assertSameAsLayers(t, tree)
+		history = append(history, tree)
+	}
+	for _, tree := range history {
+		assertSameAsLayers(t, tree)
+	}
+	_, err := tree.ComputeMerkleRootWithout(newRandomLock(r))
+	assert.NotNil(t, err)
+}
+
+func TestIncrementalMerkleTreeDuplicates(t *testing.T) {
+	lock0 := newTestLock(0)
+	tree := NewMerkleTree([]*Lock{lock0, newTestLock(1)})
+	defer func() {
+		if err := recover(); err == nil {
+			t.Error("should panic")
+		}
+	}()
+	tree.ComputeMerkleRootWith(newTestLock(0))
+}
+
+func makeBenchmarkTree(n int) (*Merkletree, *rand.Rand) {
+	r := rand.New(rand.NewSource(3))
+	leaves := make([]*Lock, n)
+	for i := range leaves {
+		leaves[i] = newRandomLock(r)
+	}
+	return NewMerkleTree(leaves), r
+}
+
+func BenchmarkMerkleTreeWith(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		b.Run(fmt.Sprintf("incremental-%d", n), func(b *testing.B) {
+			tree, r := makeBenchmarkTree(n)
+			lock := newRandomLock(r)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tree.ComputeMerkleRootWith(lock)
+			}
+		})
+		b.Run(fmt.Sprintf("rebuild-%d", n), func(b *testing.B) {
+			tree, r := makeBenchmarkTree(n)
+			lock := newRandomLock(r)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				leaves := make([]*Lock, len(tree.Leaves), len(tree.Leaves)+1)
+				copy(leaves, tree.Leaves)
+				newLayersTree(append(leaves, lock))
+			}
+		})
+	}
+}
+
+func BenchmarkMerkleTreeWithout(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		for _, pos := range []string{"oldest", "newest"} {
+			b.Run(fmt.Sprintf("incremental-%s-%d", pos, n), func(b *testing.B) {
+				tree, _ := makeBenchmarkTree(n)
+				lock := tree.Leaves[0]
+				if pos == "newest" {
+					lock = tree.Leaves[n-1]
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					tree.ComputeMerkleRootWithout(lock)
+				}
+			})
+		}
+		b.Run(fmt.Sprintf("rebuild-%d", n), func(b *testing.B) {
+			tree, _ := makeBenchmarkTree(n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				newLayersTree(tree.Leaves[1:])
+			}
+		})
+	}
+}
+
+func BenchmarkMerkleTreeMakeProof(b *testing.B) {
+	tree, _ := makeBenchmarkTree(10000)
+	element := tree.Leaves[5000].Hash()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.MakeProof(element)
+	}
+}
@@ -28,8 +28,9 @@ const LayerMerkleRoot = -1
 Merkletree is hash tree
 */
 type Merkletree struct {
-	Layers [][]common.Hash
 	Leaves []*Lock
+	store  *leafStore //leaves of the tree are the first len(Leaves) ones
+	root   *node
 }
 
 // EmptyTree contains no locks
@@ -121,9 +122,17 @@ func NewMerkleTree(leaves []*Lock) (m *Merkletree) {
 	if err != nil {
 		log.Crit(fmt.Sprintf("NewMerkleTree err %s", err))
 	}
-	m = new(Merkletree)
-	m.buildMerkleTreeLayers(elements)
-	m.Leaves = leaves
+	nodes := make([]*node, len(elements))
+	for i, e := range elements {
+		nodes[i] = newLeafNode(e)
+	}
+	locks := make([]*Lock, len(leaves))
+	copy(locks, leaves)
+	m = &Merkletree{
+		Leaves: locks[:len(locks):len(locks)],
+		store:  newLeafStore(locks, nodes),
+		root:   buildTree(nodes, nil, 0),
+	}
 	return m
 }
 
@@ -131,59 +140,23 @@ func lenDiv2(l int) int {
 	return l/2 + l%2
 }
 
-/*
-   computes the layers of the merkletree. First layer is the list
-   of elements and the last layer is a list with a single entry, the
-   merkleroot
-*/
-func (m *Merkletree) buildMerkleTreeLayers(elements []common.Hash) {
-	if len(elements) == 0 {
-		m.Layers = append(m.Layers, []common.Hash(nil)) //make sure has one empty layer
-		return
-	}
-	elementsMap := make(map[common.Hash]bool)
-	for _, e := range elements {
-		if elementsMap[e] {
-			panic(fmt.Sprintf("elements %s duplicated", e.String()))
-		}
-		elementsMap[e] = true
-	}
-	//sort.Slice(elements, func(i, j int) bool {
-	//	return bytes.Compare(elements[i][:], elements[j][:]) == -1
-	//})
-	//m.Layers = append(m.Layers, elements)
-	prevLayer := elements
-	for i := 0; ; i++ {
-		m.Layers = append(m.Layers, prevLayer)
-		if len(prevLayer) == 1 {
-			break
-		}
-		curLayer := make([]common.Hash, lenDiv2(len(prevLayer)))
-		for j := 0; j < len(prevLayer); j += 2 {
-			if j == len(prevLayer)-1 {
-				curLayer[j/2] = prevLayer[j]
-			} else {
-				curLayer[j/2] = HashPair(prevLayer[j], prevLayer[j+1])
-			}
-		}
-		prevLayer = curLayer
+//layerCount returns number of layers, the leaves are the first one
+func (m *Merkletree) layerCount() int {
+	l := 1
+	for n := len(m.Leaves); n > 1; n = lenDiv2(n) {
+		l++
 	}
-	return
+	return l
 }
 
 /*
 MerkleRoot Return the root element of the merkle tree.
 */
 func (m *Merkletree) MerkleRoot() common.Hash {
-	l := len(m.Layers)
-	if l > 1 {
-		return m.Layers[l-1][0]
-	} else if l == 1 && len(m.Layers[0]) > 0 {
-		//root layer may be emtpy
-		return m.Layers[l-1][0]
-	} else {
+	if m.root == nil {
 		return utils.EmptyHash
 	}
+	return m.root.hash
 }
 
 /*
@@ -192,24 +165,14 @@ If on all of [element] + proof is recursively hash_pair applied one
 gets the root.
 */
 func (m *Merkletree) MakeProof(element common.Hash) []common.Hash {
-	idx := 0
-	for i := range m.Layers[0] {
-		if bytes.Equal(element[:], m.Layers[0][i][:]) {
-			idx = i
-		}
+	if m.root == nil {
+		return nil
 	}
-	var proof []common.Hash
-	for _, layer := range m.Layers {
-		pairidx := idx - 1
-		if idx%2 == 0 {
-			pairidx = idx + 1
-		}
-		if pairidx < len(layer) {
-			proof = append(proof, layer[pairidx])
-		}
-		idx = idx / 2
+	idx := m.store.find(element, len(m.Leaves))
+	if idx < 0 {
+		idx = 0
 	}
-	return proof
+	return makeProof(m.root, idx)
 }
 
 //Leaves2Byets get bytes of locks
@@ -239,60 +202,56 @@ ComputeMerkleRootWith 创建包含新 lock 的 merkleTree
  */
 func (m *Merkletree) ComputeMerkleRootWith(include *Lock) (newm *Merkletree) {
 	//我们并不会更改锁的内容,只会进行不同的排列组合.
-	leaves := make([]*Lock, len(m.Leaves))
-	copy(leaves, m.Leaves)
-	leaves = append(leaves, include)
-	newm = NewMerkleTree(leaves)
-	return
-}
-
-/*
-返回移除without 的数组,如果不包含 without 直接返回本身
-*/
-/*
- *	removeHash : function to remove array of locks that have removed `without`.
- *
- *	Note that if `without` does not include in array, then return the array.
- */
-func removeHash(leaves []*Lock, without *Lock) ([]*Lock, bool) {
-	var r bool
-	i := -1
-	for j := 0; j < len(leaves); j++ {
-		if leaves[j].Expiration == without.Expiration &&
-			leaves[j].Amount.Cmp(without.Amount) == 0 &&
-			leaves[j].LockSecretHash == without.LockSecretHash {
-			i = j
-			r = true
-			break
-		}
+	leaf := newLeafNode(include.Hash())
+	newm = &Merkletree{
+		root: appendLeaf(m.root, leaf),
 	}
-	if i >= 0 {
-		leaves = append(leaves[:i], leaves[i+1:]...)
-	}
-	return leaves, r
+	newm.store, newm.Leaves = m.store.appendLeaf(len(m.Leaves), include, leaf)
+	return
 }
 
 /*
 ComputeMerkleRootWithout Compute the resulting merkle root if the lock `without` is exclude from the tree
 */
 func (m *Merkletree) ComputeMerkleRootWithout(without *Lock) (newm *Merkletree, err error) {
-	leaves := make([]*Lock, len(m.Leaves))
-	copy(leaves, m.Leaves)
-	leaves, hasLock := removeHash(leaves, without)
-	if !hasLock {
+	n := len(m.Leaves)
+	i := -1
+	if n > 0 {
+		i = m.store.find(without.Hash(), n)
+	}
+	if i < 0 {
 		err = fmt.Errorf("no such lock %s", utils.HPex(without.LockSecretHash))
 		return
 	}
-	if len(leaves) > 0 {
-		newm = NewMerkleTree(leaves)
+	if n == 1 {
+		newm = NewMerkleTree(nil)
 		return
 	}
-	newm = NewMerkleTree(nil)
+	if i == n-1 {
+		//移除最新的锁,其余的锁位置不变	// others stay where they are
+		newm = &Merkletree{
+			Leaves: m.Leaves[:i:i],
+			store:  m.store,
+			root:   buildTree(m.store.leafNodes(i), m.root, i),
+		}
+		return
+	}
+	//后面的锁都要前移,无法复用原来的leafStore
+	locks := make([]*Lock, 0, n-1)
+	locks = append(append(locks, m.Leaves[:i]...), m.Leaves[i+1:]...)
+	oldNodes := m.store.leafNodes(n)
+	nodes := make([]*node, 0, n-1)
+	nodes = append(append(nodes, oldNodes[:i]...), oldNodes[i+1:]...)
+	newm = &Merkletree{
+		Leaves: locks[: n-1 : n-1],
+		store:  newLeafStore(locks, nodes),
+		root:   buildTree(nodes, m.root, i),
+	}
 	return
 }
 
 func (m *Merkletree) String() string {
-	return fmt.Sprintf("MerkleTreeState{root:%s,layer level:%d}", m.MerkleRoot(), len(m.Layers))
+	return fmt.Sprintf("MerkleTreeState{root:%s,layer level:%d}", m.MerkleRoot(), m.layerCount())
 }
 
 /*
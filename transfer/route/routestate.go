@@ -25,6 +25,11 @@ type State struct {
 	Fee               *big.Int         // how much fee to this channel charge charge .
 	TotalFee          *big.Int         // how much fee for all path when initiator use this route
 	Path              []common.Address // 2019-03消息升级,路由中保存该条路径上所有节点,有序
+	Hops              int              // 到target的跳数,0表示不知道
+	Trampoline        common.Address   // 发起方通过trampoline交易时,由它计算剩余路由
+	DownstreamFee     *big.Int         // trampoline计算路由时,下一跳以后的节点需要的手续费,nil表示不知道
+	Onion             []byte           // 发起方为这条路由构造的onion,不为空时mediator看不到Path
+	OnionKeys         []common.Hash    // 解密各节点返回的失败原因,与Path一一对应
 }
 
 //NewState create route state
@@ -33,6 +38,7 @@ func NewState(ch *channel.Channel, path []common.Address) *State {
 		ChannelIdentifier: ch.ChannelIdentifier.ChannelIdentifier,
 		ch:                ch,
 		Path:              path,
+		Hops:              len(path),
 	}
 }
 
@@ -118,33 +118,23 @@ func MakePrivateKeyAddress() (*ecdsa.PrivateKey, common.Address) {
 	return key, addr
 }
 
-//StringInterface use spew to string any object with max `depth`,it's not thread safe.
+//StringInterface use spew to string any object with max `depth`,
+//it works on a copy of spew.Config, so channel workers can call it concurrently.
 func StringInterface(i interface{}, depth int) string {
 	stringer, ok := i.(fmt.Stringer)
 	if ok {
 		return stringer.String()
 	}
 	c := spew.Config
-	spew.Config.DisableMethods = false
-	//spew.Config.ContinueOnMethod = false
-	spew.Config.MaxDepth = depth
-	s := spew.Sdump(i)
-	spew.Config = c
-	return s
+	c.DisableMethods = false
+	//c.ContinueOnMethod = false
+	c.MaxDepth = depth
+	return c.Sdump(i)
 }
 
-//StringInterface1 use spew to string any object with depth 1,it's not thread safe.
+//StringInterface1 use spew to string any object with depth 1
 func StringInterface1(i interface{}) string {
-	stringer, ok := i.(fmt.Stringer)
-	if ok {
-		return stringer.String()
-	}
-	c := spew.Config
-	spew.Config.DisableMethods = false
-	spew.Config.MaxDepth = 1
-	s := spew.Sdump(i)
-	spew.Config = c
-	return s
+	return StringInterface(i, 1)
 }
 
 //DeepCopy use gob to copy